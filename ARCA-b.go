@@ -10,9 +10,11 @@ import (
     "math"
     "net/http"
     "os"
+    "sort"
     "strings"
     "sync"
     "time"
+    "unicode/utf8"
 
     "github.com/google/uuid"
     "github.com/sashabaranov/go-openai"
@@ -20,113 +22,73 @@ import (
 
 type Session struct {
     History []openai.ChatCompletionMessage
+    Turns   []ConversationTurn
 }
 
 type UserRequestTracker struct {
-    HourlyCount   int
-    LastResetHour time.Time
-    IsPremium     bool
+    Tier      string
+    IsPremium bool
 }
 
 type ChatRequest struct {
     Message           string `json:"message"`
     Response          string `json:"response"`
     Style             string `json:"style"`
+    Persona           string `json:"persona"`
     Language          string `json:"language"`
     SaveConversation  bool   `json:"saveConversation"`
     ConversationIndex int    `json:"conversationIndex"`
+    ExpiresInDays     int    `json:"expiresInDays"`
+    ChatID            string `json:"chatId"`
+    // FactCheck asks for the claim table, at the cost of more embeddings.
+    FactCheck bool `json:"factCheck"`
 }
 
 type ChatResponse struct {
     Response      string `json:"response"`
+    ResponseHTML  string `json:"responseHtml,omitempty"`
     RawResponses  string `json:"rawResponses"`
     Contributions string `json:"contributions"`
+    ServiceLevel  string `json:"serviceLevel,omitempty"`
+    Language      string `json:"language,omitempty"`
+    TurnIndex     *int   `json:"turnIndex,omitempty"`
+    ChatID        string `json:"chatId,omitempty"`
+    // Citations are the retrieved sources the answer cites as [n].
+    Citations []Citation `json:"citations,omitempty"`
+    // Claims is the fact-check table, when the request asked for it.
+    Claims []Claim `json:"claims,omitempty"`
+    // Sources are all the retrieved sources, numbered as in the claims'
+    // [n]; they are only sent with a fact check.
+    Sources []Article `json:"sources,omitempty"`
+    // Disagreements are the points on which the providers contradict
+    // each other.
+    Disagreements []Disagreement `json:"disagreements,omitempty"`
+    // DisagreementsNote says why the answers were not compared, when they
+    // were not.
+    DisagreementsNote string `json:"disagreementsNote,omitempty"`
+    // Flags are the refusals, hedging and evasions found in each
+    // provider's answer.
+    Flags map[string][]AnswerFlag `json:"flags,omitempty"`
 }
 
-var (
-    sessions        = make(map[string]*Session)
-    requestTrackers = make(map[string]*UserRequestTracker)
-    premiumUsers    = make(map[string]bool)
-    conversations   = make(map[string]ChatResponse)
-    mutex           = &sync.Mutex{}
-    hourlyLimit     = 15
-)
-
-func getNewsContext(newsAPIKey string, client *http.Client, query string, language string) (string, error) {
-    if newsAPIKey == "" {
-        return "", fmt.Errorf("NEWS_API_KEY is not set")
-    }
-
-    query = strings.ReplaceAll(query, " ", "+")
-    newsLanguage := "it"
-    if language != "Italiano" {
-        newsLanguage = "en"
-    }
-    url := fmt.Sprintf("https://newsapi.org/v2/everything?q=%s&sortBy=relevancy&language=%s&pageSize=3&apiKey=%s", query, newsLanguage, newsAPIKey)
+var store Store
 
-    req, err := http.NewRequest("GET", url, nil)
-    if err != nil {
-        return "", fmt.Errorf("error creating request to NewsAPI: %v", err)
-    }
-    req.Header.Set("Accept", "application/json")
-
-    var resp *http.Response
-    for attempt := 1; attempt <= 3; attempt++ {
-        resp, err = client.Do(req)
-        if err == nil {
-            break
-        }
-        time.Sleep(time.Second * time.Duration(attempt))
-    }
-    if err != nil {
-        if newsLanguage == "it" {
-            url = fmt.Sprintf("https://newsapi.org/v2/everything?q=%s&sortBy=relevancy&language=en&pageSize=3&apiKey=%s", query, newsAPIKey)
-            req, _ = http.NewRequest("GET", url, nil)
-            req.Header.Set("Accept", "application/json")
-            resp, err = client.Do(req)
-        }
-        if err != nil {
-            return "", fmt.Errorf("error with NewsAPI after 3 attempts: %v", err)
-        }
-    }
-    defer resp.Body.Close()
+// chatProviders are the models asked in every /chat turn.
+var chatProviders = []string{"OpenAI", "DeepSeek", "Gemini", "Mistral", "Cohere"}
 
-    body, err := io.ReadAll(resp.Body)
+// loadRequestTracker picks the rate limit tier of the request owner.
+func loadRequestTracker(owner string) (*UserRequestTracker, error) {
+    grant, err := loadPremium(owner)
     if err != nil {
-        return "", fmt.Errorf("error reading NewsAPI response: %v", err)
-    }
-
-    var newsResult struct {
-        Status       string `json:"status"`
-        TotalResults int    `json:"totalResults"`
-        Articles     []struct {
-            Title       string `json:"title"`
-            Description string `json:"description"`
-            Content     string `json:"content"`
-            PublishedAt string `json:"publishedAt"`
-        } `json:"articles"`
-        Message string `json:"message"`
-    }
-    if err := json.Unmarshal(body, &newsResult); err != nil {
-        return "", fmt.Errorf("error parsing NewsAPI response: %v", err)
+        return nil, err
     }
-    if newsResult.Status != "ok" {
-        return "", fmt.Errorf("error from NewsAPI: %s", newsResult.Message)
+    tracker := &UserRequestTracker{Tier: "anonymous", IsPremium: grant.Active(time.Now())}
+    if tracker.IsPremium {
+        tracker.Tier = "premium"
+    } else if strings.HasPrefix(owner, userPrefix) {
+        tracker.Tier = "account"
     }
-    if len(newsResult.Articles) == 0 {
-        return "No recent news found for the query.", nil
-    }
-
-    var response strings.Builder
-    response.WriteString("Recent News Context:\n")
-    for i, article := range newsResult.Articles {
-        response.WriteString(fmt.Sprintf("%d. %s\n", i+1, article.Title))
-        response.WriteString(fmt.Sprintf("Published %s\n", article.PublishedAt))
-        if article.Description != "" {
-            response.WriteString(fmt.Sprintf("%s\n", article.Description))
-        }
-    }
-    return response.String(), nil
+    return tracker, nil
 }
 
 func getDeepInfraResponse(deepInfraKey string, client *http.Client, prompt string) (string, error) {
@@ -272,16 +234,27 @@ func getHuggingFaceResponse(hfKey string, client *http.Client, prompt string) (s
     return strings.TrimSpace(generatedText), nil
 }
 
-func getMistralResponse(mistralKey string, client *http.Client, prompt string) (string, error) {
+func getMistralResponse(mistralKey string, client *http.Client, prompt string, options promptOptions) (string, TokenUsage, error) {
     if mistralKey == "" {
-        return "", fmt.Errorf("MISTRAL_API_KEY is not set")
+        return "", TokenUsage{}, fmt.Errorf("MISTRAL_API_KEY is not set")
+    }
+    messages := []map[string]string{}
+    if options.System != "" {
+        messages = append(messages, map[string]string{"role": "system", "content": options.System})
+    }
+    messages = append(messages, map[string]string{"role": "user", "content": prompt})
+    payload, err := json.Marshal(map[string]interface{}{
+        "model":       "mistral-small-latest",
+        "messages":    messages,
+        "max_tokens":  maxTokensOr(options.MaxTokens, 1000),
+        "temperature": 0.7,
+    })
+    if err != nil {
+        return "", TokenUsage{}, fmt.Errorf("error creating JSON body: %v", err)
     }
-    prompt = strings.ReplaceAll(prompt, "\n", " ")
-    prompt = strings.ReplaceAll(prompt, "\"", "\\\"")
-    payload := fmt.Sprintf(`{"model": "mistral-small-latest", "messages": [{"role": "user", "content": "%s"}], "max_tokens": 1000, "temperature": 0.7}`, prompt)
-    req, err := http.NewRequest("POST", "https://api.mistral.ai/v1/chat/completions", strings.NewReader(payload))
+    req, err := http.NewRequest("POST", "https://api.mistral.ai/v1/chat/completions", bytes.NewReader(payload))
     if err != nil {
-        return "", fmt.Errorf("error creating request to Mistral: %v", err)
+        return "", TokenUsage{}, fmt.Errorf("error creating request to Mistral: %v", err)
     }
     req.Header.Set("Authorization", "Bearer "+mistralKey)
     req.Header.Set("Content-Type", "application/json")
@@ -295,12 +268,12 @@ func getMistralResponse(mistralKey string, client *http.Client, prompt string) (
         time.Sleep(time.Second * time.Duration(attempt))
     }
     if err != nil {
-        return "", fmt.Errorf("error with Mistral after 3 attempts: %v", err)
+        return "", TokenUsage{}, fmt.Errorf("error with Mistral after 3 attempts: %v", err)
     }
     defer resp.Body.Close()
     body, err := io.ReadAll(resp.Body)
     if err != nil {
-        return "", fmt.Errorf("error reading Mistral response: %v", err)
+        return "", TokenUsage{}, fmt.Errorf("error reading Mistral response: %v", err)
     }
     var mistralResult struct {
         Choices []struct {
@@ -308,62 +281,63 @@ func getMistralResponse(mistralKey string, client *http.Client, prompt string) (
                 Content string `json:"content"`
             } `json:"message"`
         } `json:"choices"`
+        Usage struct {
+            PromptTokens     int `json:"prompt_tokens"`
+            CompletionTokens int `json:"completion_tokens"`
+        } `json:"usage"`
         Error string `json:"error"`
     }
     if err := json.Unmarshal(body, &mistralResult); err != nil {
-        return "", fmt.Errorf("error parsing Mistral response: %v", err)
+        return "", TokenUsage{}, fmt.Errorf("error parsing Mistral response: %v", err)
     }
     if mistralResult.Error != "" {
-        return "", fmt.Errorf("error from Mistral: %s", mistralResult.Error)
+        return "", TokenUsage{}, fmt.Errorf("error from Mistral: %s", mistralResult.Error)
     }
     if len(mistralResult.Choices) == 0 || mistralResult.Choices[0].Message.Content == "" {
-        return "", fmt.Errorf("no valid response from Mistral")
+        return "", TokenUsage{}, fmt.Errorf("no valid response from Mistral")
     }
-    return mistralResult.Choices[0].Message.Content, nil
+    return mistralResult.Choices[0].Message.Content, TokenUsage{InputTokens: mistralResult.Usage.PromptTokens, OutputTokens: mistralResult.Usage.CompletionTokens}, nil
 }
 
-func getDeepSeekResponse(client *http.Client, deepSeekKey string, messages []openai.ChatCompletionMessage, language string) (string, error) {
+func getDeepSeekResponse(client *http.Client, deepSeekKey string, messages []openai.ChatCompletionMessage, options promptOptions) (string, TokenUsage, error) {
     if deepSeekKey == "" {
-        return "", fmt.Errorf("DEEPSEEK_API_KEY is not set")
+        return "", TokenUsage{}, fmt.Errorf("DEEPSEEK_API_KEY is not set")
     }
     var deepSeekMessages []map[string]string
-    for i, msg := range messages {
-        if i == len(messages)-1 {
-            deepSeekMessages = append(deepSeekMessages, map[string]string{
-                "role":    msg.Role,
-                "content": fmt.Sprintf("Respond in %s: %s", language, msg.Content),
-            })
-        } else {
-            deepSeekMessages = append(deepSeekMessages, map[string]string{
-                "role":    msg.Role,
-                "content": msg.Content,
-            })
-        }
+    if options.System != "" {
+        deepSeekMessages = append(deepSeekMessages, map[string]string{"role": "system", "content": options.System})
+    }
+    for _, msg := range messages {
+        deepSeekMessages = append(deepSeekMessages, map[string]string{
+            "role":    msg.Role,
+            "content": msg.Content,
+        })
     }
     body, err := json.Marshal(map[string]interface{}{
-        "model":    "deepseek-chat",
-        "messages": deepSeekMessages,
+        "model":      "deepseek-chat",
+        "messages":   deepSeekMessages,
+        "max_tokens": maxTokensOr(options.MaxTokens, 1000),
     })
     if err != nil {
-        return "", fmt.Errorf("error creating JSON body: %v", err)
+        return "", TokenUsage{}, fmt.Errorf("error creating JSON body: %v", err)
     }
     req, err := http.NewRequest("POST", "https://api.deepseek.com/v1/chat/completions", strings.NewReader(string(body)))
     if err != nil {
-        return "", fmt.Errorf("error creating request: %v", err)
+        return "", TokenUsage{}, fmt.Errorf("error creating request: %v", err)
     }
     req.Header.Set("Authorization", "Bearer "+deepSeekKey)
     req.Header.Set("Content-Type", "application/json")
     resp, err := client.Do(req)
     if err != nil {
-        return "", fmt.Errorf("error requesting DeepSeek: %v", err)
+        return "", TokenUsage{}, fmt.Errorf("error requesting DeepSeek: %v", err)
     }
     defer resp.Body.Close()
     bodyResp, err := io.ReadAll(resp.Body)
     if err != nil {
-        return "", fmt.Errorf("error reading response: %v", err)
+        return "", TokenUsage{}, fmt.Errorf("error reading response: %v", err)
     }
     if resp.StatusCode != http.StatusOK {
-        return "", fmt.Errorf("invalid response from DeepSeek (status %d): %s", resp.StatusCode, string(bodyResp))
+        return "", TokenUsage{}, fmt.Errorf("invalid response from DeepSeek (status %d): %s", resp.StatusCode, string(bodyResp))
     }
     var result struct {
         Choices []struct {
@@ -371,27 +345,41 @@ func getDeepSeekResponse(client *http.Client, deepSeekKey string, messages []ope
                 Content string `json:"content"`
             } `json:"message"`
         } `json:"choices"`
+        Usage struct {
+            PromptTokens     int `json:"prompt_tokens"`
+            CompletionTokens int `json:"completion_tokens"`
+        } `json:"usage"`
     }
     if err := json.Unmarshal(bodyResp, &result); err != nil {
-        return "", fmt.Errorf("error parsing JSON: %v", err)
+        return "", TokenUsage{}, fmt.Errorf("error parsing JSON: %v", err)
     }
     if len(result.Choices) > 0 {
-        return result.Choices[0].Message.Content, nil
+        return result.Choices[0].Message.Content, TokenUsage{InputTokens: result.Usage.PromptTokens, OutputTokens: result.Usage.CompletionTokens}, nil
     }
-    return "", fmt.Errorf("no valid response from DeepSeek")
+    return "", TokenUsage{}, fmt.Errorf("no valid response from DeepSeek")
 }
 
-func getCohereResponse(cohereKey string, client *http.Client, prompt string) (string, error) {
+func getCohereResponse(cohereKey string, client *http.Client, prompt string, options promptOptions) (string, TokenUsage, error) {
     if cohereKey == "" {
-        return "", fmt.Errorf("COHERE_API_KEY is not set")
+        return "", TokenUsage{}, fmt.Errorf("COHERE_API_KEY is not set")
+    }
+    // L'endpoint generate non ha un ruolo di sistema: le istruzioni, lingua compresa, precedono il prompt
+    fullPrompt := prompt
+    if options.System != "" {
+        fullPrompt = options.System + "\n\n" + prompt
+    }
+    payload, err := json.Marshal(map[string]interface{}{
+        "model":       "command",
+        "prompt":      fullPrompt,
+        "max_tokens":  maxTokensOr(options.MaxTokens, 1000),
+        "temperature": 0.7,
+    })
+    if err != nil {
+        return "", TokenUsage{}, fmt.Errorf("error creating JSON body: %v", err)
     }
-    prompt = strings.ReplaceAll(prompt, "\n", " ")
-    prompt = strings.ReplaceAll(prompt, "\"", "\\\"")
-    fullPrompt := fmt.Sprintf("Rispondi esclusivamente in italiano. Non usare altre lingue, nemmeno per frasi brevi o parole singole. Domanda: %s", prompt)
-    payload := fmt.Sprintf(`{"model": "command", "prompt": "%s", "max_tokens": 1000, "temperature": 0.7}`, fullPrompt)
-    req, err := http.NewRequest("POST", "https://api.cohere.ai/v1/generate", strings.NewReader(payload))
+    req, err := http.NewRequest("POST", "https://api.cohere.ai/v1/generate", bytes.NewReader(payload))
     if err != nil {
-        return "", fmt.Errorf("error creating request to Cohere: %v", err)
+        return "", TokenUsage{}, fmt.Errorf("error creating request to Cohere: %v", err)
     }
     req.Header.Set("Authorization", "Bearer "+cohereKey)
     req.Header.Set("Content-Type", "application/json")
@@ -405,72 +393,106 @@ func getCohereResponse(cohereKey string, client *http.Client, prompt string) (st
         time.Sleep(time.Second * time.Duration(attempt))
     }
     if err != nil {
-        return "", fmt.Errorf("error with Cohere after 3 attempts: %v", err)
+        return "", TokenUsage{}, fmt.Errorf("error with Cohere after 3 attempts: %v", err)
     }
     defer resp.Body.Close()
     body, err := io.ReadAll(resp.Body)
     if err != nil {
-        return "", fmt.Errorf("error reading Cohere response: %v", err)
+        return "", TokenUsage{}, fmt.Errorf("error reading Cohere response: %v", err)
     }
     var cohereResult struct {
         Generations []struct {
             Text string `json:"text"`
         } `json:"generations"`
+        Meta struct {
+            BilledUnits struct {
+                InputTokens  int `json:"input_tokens"`
+                OutputTokens int `json:"output_tokens"`
+            } `json:"billed_units"`
+        } `json:"meta"`
         Error struct {
             Message string `json:"message"`
         } `json:"error"`
     }
     if err := json.Unmarshal(body, &cohereResult); err != nil {
-        return "", fmt.Errorf("error parsing Cohere response: %v", err)
+        return "", TokenUsage{}, fmt.Errorf("error parsing Cohere response: %v", err)
     }
     if cohereResult.Error.Message != "" {
-        return "", fmt.Errorf("error from Cohere API: %s", cohereResult.Error.Message)
+        return "", TokenUsage{}, fmt.Errorf("error from Cohere API: %s", cohereResult.Error.Message)
     }
     if len(cohereResult.Generations) == 0 || cohereResult.Generations[0].Text == "" {
-        return "", fmt.Errorf("no valid response from Cohere")
+        return "", TokenUsage{}, fmt.Errorf("no valid response from Cohere")
     }
-    return cohereResult.Generations[0].Text, nil
+    return cohereResult.Generations[0].Text, TokenUsage{InputTokens: cohereResult.Meta.BilledUnits.InputTokens, OutputTokens: cohereResult.Meta.BilledUnits.OutputTokens}, nil
 }
 
-func getCohereEmbedding(cohereKey string, client *http.Client, text string) ([]float64, error) {
+// Cohere embeds the passages to search and the queries searching them
+// differently; comparing answers with each other uses the passage form.
+const (
+    cohereSearchDocument = "search_document"
+    cohereSearchQuery    = "search_query"
+)
+
+func getCohereEmbedding(cohereKey string, client *http.Client, text, inputType string) ([]float64, TokenUsage, error) {
+    embeddings, usage, err := getCohereEmbeddings(cohereKey, client, []string{text}, inputType)
+    if err != nil {
+        return nil, usage, err
+    }
+    return embeddings[0], usage, nil
+}
+
+// getCohereEmbeddings embeds up to 96 texts in one call, the Cohere limit.
+func getCohereEmbeddings(cohereKey string, client *http.Client, texts []string, inputType string) ([][]float64, TokenUsage, error) {
     if cohereKey == "" {
-        return nil, fmt.Errorf("COHERE_API_KEY is not set")
+        return nil, TokenUsage{}, fmt.Errorf("COHERE_API_KEY is not set")
+    }
+    payload, err := json.Marshal(map[string]interface{}{
+        "texts":      texts,
+        "model":      "embed-multilingual-v3.0",
+        "input_type": inputType,
+    })
+    if err != nil {
+        return nil, TokenUsage{}, fmt.Errorf("error encoding Cohere Embed request: %v", err)
     }
-    text = strings.ReplaceAll(text, "\n", " ")
-    text = strings.ReplaceAll(text, "\"", "\\\"")
-    payload := fmt.Sprintf(`{"texts": ["%s"], "model": "embed-multilingual-v3.0", "input_type": "search_document"}`, text)
-    req, err := http.NewRequest("POST", "https://api.cohere.ai/v1/embed", strings.NewReader(payload))
+    req, err := http.NewRequest("POST", "https://api.cohere.ai/v1/embed", bytes.NewReader(payload))
     if err != nil {
-        return nil, fmt.Errorf("error creating request to Cohere Embed: %v", err)
+        return nil, TokenUsage{}, fmt.Errorf("error creating request to Cohere Embed: %v", err)
     }
     req.Header.Set("Authorization", "Bearer "+cohereKey)
     req.Header.Set("Content-Type", "application/json")
     req.Header.Set("Accept", "application/json")
     resp, err := client.Do(req)
     if err != nil {
-        return nil, fmt.Errorf("error with Cohere Embed request: %v", err)
+        return nil, TokenUsage{}, fmt.Errorf("error with Cohere Embed request: %v", err)
     }
     defer resp.Body.Close()
     body, err := io.ReadAll(resp.Body)
     if err != nil {
-        return nil, fmt.Errorf("error reading Cohere Embed response: %v", err)
+        return nil, TokenUsage{}, fmt.Errorf("error reading Cohere Embed response: %v", err)
     }
     var embedResult struct {
         Embeddings [][]float64 `json:"embeddings"`
-        Error      struct {
+        Meta       struct {
+            BilledUnits struct {
+                InputTokens int `json:"input_tokens"`
+            } `json:"billed_units"`
+        } `json:"meta"`
+        Error struct {
             Message string `json:"message"`
         } `json:"error"`
     }
     if err := json.Unmarshal(body, &embedResult); err != nil {
-        return nil, fmt.Errorf("error parsing Cohere Embed response: %v", err)
+        return nil, TokenUsage{}, fmt.Errorf("error parsing Cohere Embed response: %v", err)
     }
     if embedResult.Error.Message != "" {
-        return nil, fmt.Errorf("error from Cohere Embed API: %s", embedResult.Error.Message)
+        return nil, TokenUsage{}, fmt.Errorf("error from Cohere Embed API: %s", embedResult.Error.Message)
     }
-if len(embedResult.Embeddings) == 0 || len(embedResult.Embeddings[0]) == 0 {
+    if len(embedResult.Embeddings) != len(texts) || len(embedResult.Embeddings[0]) == 0 {
+        return nil, TokenUsage{}, fmt.Errorf("no embedding returned by Cohere Embed")
     }
-    return embedResult.Embeddings[0], nil
+    return embedResult.Embeddings, TokenUsage{InputTokens: embedResult.Meta.BilledUnits.InputTokens}, nil
 }
+
 func cosineSimilarity(vec1, vec2 []float64) float64 {
     if len(vec1) != len(vec2) {
         return 0.0
@@ -489,6 +511,11 @@ func cosineSimilarity(vec1, vec2 []float64) float64 {
     return dotProduct / (math.Sqrt(norm1) * math.Sqrt(norm2))
 }
 
+func writeJSON(w http.ResponseWriter, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(v)
+}
+
 func main() {
     openAIKey := os.Getenv("OPENAI_API_KEY")
     deepSeekKey := os.Getenv("DEEPSEEK_API_KEY")
@@ -547,6 +574,34 @@ func main() {
         fmt.Println("NEWS_API_KEY loaded successfully")
     }
 
+    var err error
+    store, err = newStore(os.Getenv("STORE_URL"))
+    if err != nil {
+        fmt.Printf("Error: could not initialize store: %v\n", err)
+        os.Exit(1)
+    }
+    if len(os.Args) > 1 {
+        if err := runCLI(os.Args[1:]); err != nil {
+            fmt.Println("Error:", err)
+            os.Exit(1)
+        }
+        return
+    }
+    fmt.Printf("Using %T for shared state\n", store)
+    loadRateLimitConfig()
+    loadCostConfig()
+    loadPromptConfig()
+    loadLanguageConfig()
+    if err := loadDocumentIndex(); err != nil {
+        fmt.Printf("Error: could not load the document index: %v\n", err)
+        os.Exit(1)
+    }
+
+    mailer = newMailer()
+    if u := os.Getenv("PUBLIC_URL"); u != "" {
+        publicURL = strings.TrimSuffix(u, "/")
+    }
+
     port := os.Getenv("PORT")
     if port == "" {
         fmt.Println("PORT not specified, using default :8080")
@@ -555,6 +610,32 @@ func main() {
 
     openAIClient := openai.NewClient(openAIKey)
     client := &http.Client{Timeout: 30 * time.Second}
+    news := newsSources(client, newsAPIKey)
+    translate := newTranslator(client, openAIClient, map[string]string{
+        "OpenAI":   openAIKey,
+        "DeepSeek": deepSeekKey,
+        "Mistral":  mistralKey,
+        "Cohere":   cohereKey,
+    })
+
+    if dir := os.Getenv("RAG_DIR"); dir != "" {
+        go func() {
+            embed, finish := meteredEmbedder("system", "", cohereKey, client)
+            added, err := documents.Scan(dir, embed)
+            finish()
+            if err != nil {
+                fmt.Printf("Error scanning %s: %v\n", dir, err)
+            }
+            fmt.Printf("Indexed %d new documents from %s\n", added, dir)
+        }()
+    }
+
+    watchers, err := newChainWatchers(client)
+    if err != nil {
+        fmt.Printf("Error: could not start donation watchers: %v\n", err)
+    } else {
+        go runDonationWatchers(watchers, 2*time.Minute)
+    }
 
     // Speech-to-Text Handler
     http.HandleFunc("/speech-to-text", func(w http.ResponseWriter, r *http.Request) {
@@ -562,9 +643,18 @@ func main() {
             http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
             return
         }
+        owner, err := requestOwner(r)
+        if err != nil {
+            http.Error(w, "Error: Session not found", http.StatusBadRequest)
+            return
+        }
+        tracker, ok := enforceRateLimit(w, r, owner)
+        if !ok || !checkBudget(w, owner, tracker.Tier) {
+            return
+        }
 
         // Parse the multipart form to get the audio file
-        err := r.ParseMultipartForm(10 << 20) // 10 MB limit
+        err = r.ParseMultipartForm(10 << 20) // 10 MB limit
         if err != nil {
             http.Error(w, "Error parsing multipart form: "+err.Error(), http.StatusBadRequest)
             return
@@ -591,12 +681,29 @@ func main() {
         ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second) // Increased timeout for mobile
         defer cancel()
 
+        // Whisper riconosce la lingua da solo, ma un suggerimento corretto migliora la trascrizione
+        var hint string
+        if lang, ok := parseLanguage(r.FormValue("language")); ok {
+            hint = lang.Code
+        }
+        started := time.Now()
         resp, err := openAIClient.CreateTranscription(ctx, openai.AudioRequest{
             Model:    "whisper-1",
             FilePath: "audio.mp4", // Changed to audio.mp4 for iOS compatibility
             Reader:   bytes.NewReader(audioData),
-            Format:   openai.AudioResponseFormatJSON,
+            Format:   openai.AudioResponseFormatVerboseJSON,
+            Language: hint,
         })
+        // Whisper si paga a secondi: la durata arriva con verbose_json, altrimenti
+        // si stima da un audio compresso a circa 16 kB al secondo
+        var usage TokenUsage
+        if err == nil {
+            usage.InputTokens = int(math.Ceil(resp.Duration))
+            if usage.InputTokens == 0 {
+                usage.InputTokens = len(audioData)/16000 + 1
+            }
+        }
+        chargeCall(owner, tracker.Tier, "speech-to-text", "OpenAI Whisper", usage, started, err != nil)
         if err != nil {
             fmt.Printf("Error transcribing audio: %v\n", err)
             http.Error(w, "Error transcribing audio: "+err.Error(), http.StatusInternalServerError)
@@ -616,6 +723,15 @@ http.HandleFunc("/text-to-speech", func(w http.ResponseWriter, r *http.Request)
         http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
     }
+    owner, err := requestOwner(r)
+    if err != nil {
+        http.Error(w, "Error: Session not found", http.StatusBadRequest)
+        return
+    }
+    tracker, ok := enforceRateLimit(w, r, owner)
+    if !ok || !checkBudget(w, owner, tracker.Tier) {
+        return
+    }
 
     var req struct {
         Text     string `json:"text"`
@@ -630,16 +746,23 @@ http.HandleFunc("/text-to-speech", func(w http.ResponseWriter, r *http.Request)
     ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second) // Timeout aumentato
     defer cancel()
 
-    voice := "alloy"
-    if req.Language == "Italiano" {
-        voice = "nova"
+    lang, err := resolveLanguage(req.Language, req.Text)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
     }
 
+    started := time.Now()
     audioResp, err := openAIClient.CreateSpeech(ctx, openai.CreateSpeechRequest{
         Model: "tts-1",
         Input: req.Text,
-        Voice: openai.SpeechVoice(voice),
+        Voice: openai.SpeechVoice(lang.voice()),
     })
+    var usage TokenUsage
+    if err == nil {
+        usage.InputTokens = utf8.RuneCountInString(req.Text)
+    }
+    chargeCall(owner, tracker.Tier, "text-to-speech", "OpenAI TTS", usage, started, err != nil)
     if err != nil {
         fmt.Println("Error generating speech:", err)
         http.Error(w, "Error generating speech: "+err.Error(), http.StatusInternalServerError)
@@ -668,8 +791,19 @@ http.HandleFunc("/text-to-speech", func(w http.ResponseWriter, r *http.Request)
 
         fmt.Println("Received file upload request")
 
+        owner, err := requestOwner(r)
+        if err != nil {
+            w.Header().Set("Content-Type", "application/json")
+            json.NewEncoder(w).Encode(map[string]string{"error": "Session not found"})
+            return
+        }
+        tracker, ok := enforceRateLimit(w, r, owner)
+        if !ok {
+            return
+        }
+
         // Parse the multipart form to get the file
-        err := r.ParseMultipartForm(10 << 20) // 10 MB limit
+        err = r.ParseMultipartForm(10 << 20) // 10 MB limit
         if err != nil {
             fmt.Println("Error parsing multipart form:", err)
             w.Header().Set("Content-Type", "application/json")
@@ -703,6 +837,9 @@ http.HandleFunc("/text-to-speech", func(w http.ResponseWriter, r *http.Request)
             text = string(fileContent)
             fmt.Println("Extracted text from .txt:", text)
         } else if strings.HasSuffix(strings.ToLower(header.Filename), ".png") || strings.HasSuffix(strings.ToLower(header.Filename), ".jpg") || strings.HasSuffix(strings.ToLower(header.Filename), ".jpeg") {
+            if !checkBudget(w, owner, tracker.Tier) {
+                return
+            }
             // Se è un'immagine, usa OpenAI Vision per estrarre il testo
             base64Image := base64.StdEncoding.EncodeToString(fileContent)
             imageURL := "data:image/jpeg;base64," + base64Image
@@ -712,6 +849,7 @@ http.HandleFunc("/text-to-speech", func(w http.ResponseWriter, r *http.Request)
 
             // Prompt più esplicito per estrarre il testo
             prompt := "Extract all visible text from the provided image. If no text is present, return 'No text found in the image.'"
+            started := time.Now()
             resp, err := openAIClient.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
                 Model: "gpt-4o",
                 Messages: []openai.ChatCompletionMessage{
@@ -733,6 +871,7 @@ http.HandleFunc("/text-to-speech", func(w http.ResponseWriter, r *http.Request)
                 },
                 MaxTokens: 500,
             })
+            chargeCall(owner, tracker.Tier, "ocr", "OpenAI Vision", TokenUsage{InputTokens: resp.Usage.PromptTokens, OutputTokens: resp.Usage.CompletionTokens}, started, err != nil)
             if err != nil {
                 fmt.Println("Error extracting text with OpenAI Vision:", err)
                 w.Header().Set("Content-Type", "application/json")
@@ -755,6 +894,25 @@ http.HandleFunc("/text-to-speech", func(w http.ResponseWriter, r *http.Request)
             return
         }
 
+        // Con index=true il testo viene aggiunto ai documenti dell'utente invece di tornare nella chat
+        if r.FormValue("index") == "true" {
+            if !checkBudget(w, owner, tracker.Tier) {
+                return
+            }
+            embed, finish := meteredEmbedder(owner, tracker.Tier, cohereKey, client)
+            doc, err := documents.Add(owner, header.Filename, "", text, header.Size, time.Now().UTC(), embed)
+            chargeSpend(owner, finish())
+            if err != nil {
+                fmt.Println("Error indexing document:", err)
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(map[string]string{"error": "Error indexing document: " + err.Error()})
+                return
+            }
+            fmt.Printf("Indexed %s for %s: %d passages\n", doc.Name, owner, doc.Chunks)
+            writeJSON(w, map[string]interface{}{"text": text, "document": doc})
+            return
+        }
+
         // Invia il testo estratto al client
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(map[string]string{
@@ -771,709 +929,15 @@ http.HandleFunc("/text-to-speech", func(w http.ResponseWriter, r *http.Request)
     http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
         fmt.Println("Received request on /")
         sessionID, err := r.Cookie("session_id")
-        if err != nil || sessionID == nil {
-            sessionID = &http.Cookie{
-                Name:  "session_id",
-                Value: uuid.New().String(),
-                Path:  "/",
-            }
+        if err != nil || !validSessionID(sessionID.Value) {
+            sessionID = newSecureCookie("session_id", uuid.New().String(), 0)
             http.SetCookie(w, sessionID)
         }
-        w.Header().Set("Content-Type", "text/html; charset=utf-8")
-        fmt.Fprint(w, `<!DOCTYPE html>
-<html>
-<head>
-    <title>ARCA-b Chat AI</title>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <style>
-        body {
-            font-family: 'Courier New', monospace;
-            margin: 0;
-            padding: 20px;
-            background-color: #0d0d0d;
-            color: #00ff00;
-            display: flex;
-            flex-direction: column;
-            min-height: 100vh;
-            overflow-x: hidden;
-        }
-        h1 {
-            font-size: 1.8em;
-            margin-bottom: 15px;
-            text-align: center;
-            text-shadow: 0 0 10px #00ff00;
-            animation: glitch 2s linear infinite;
-        }
-        @keyframes glitch {
-            2%, 64% { transform: translate(2px, 0) skew(0deg); }
-            4%, 60% { transform: translate(-2px, 0) skew(0deg); }
-            62% { transform: translate(0, 0) skew(5deg); }
-        }
-        .button-container {
-            display: flex;
-            justify-content: center;
-            gap: 15px;
-            margin-bottom: 20px;
-        }
-        #chat-container {
-            flex: 1;
-            display: flex;
-            flex-direction: column;
-            overflow-y: hidden;
-            margin-bottom: 10px;
-            border: 1px solid #00ff00;
-            border-radius: 10px;
-            background-color: #1a1a1a;
-            box-shadow: 0 0 15px rgba(0, 255, 0, 0.3);
-        }
-        #chat {
-            flex-grow: 1;
-            padding: 10px;
-            background-color: transparent;
-            border-radius: 10px;
-            overflow-y: auto;
-        }
-        .message {
-            margin: 10px 0;
-            padding: 10px;
-            border-radius: 5px;
-            max-width: 80%;
-            word-wrap: break-word;
-            opacity: 0;
-            animation: fadeIn 0.5s forwards;
-            position: relative;
-            text-shadow: 0 0 5px #00ff00;
-        }
-        @keyframes fadeIn {
-            from { opacity: 0; transform: translateY(10px); }
-            to { opacity: 1; transform: translateY(0); }
-        }
-        .user {
-            background-color: #1e90ff;
-            color: #ffffff;
-            margin-left: auto;
-            text-align: right;
-            box-shadow: 0 0 10px #1e90ff;
-        }
-        .bot {
-            background-color: #333;
-            color: #00ff00;
-            margin-right: auto;
-            box-shadow: 0 0 10px #00ff00;
-        }
-        .input-and-style-container {
-            position: sticky;
-            bottom: 0;
-            background-color: #1a1a1a;
-            padding: 10px;
-            border-top: 1px solid #F7931A;
-            box-shadow: 0 -5px 15px rgba(247, 147, 26, 0.2);
-        }
-        .style-container {
-            display: flex;
-            justify-content: center;
-            gap: 10px;
-            margin-bottom: 10px;
-        }
-        select {
-            padding: 8px;
-            border: 1px solid #00ff00;
-            border-radius: 5px;
-            font-size: 1em;
-            background-color: #333;
-            color: #00ff00;
-            box-shadow: 0 0 5px #00ff00;
-        }
-        .input-container {
-            display: flex;
-            align-items: center;
-            gap: 10px;
-            flex-wrap: wrap;
-            justify-content: center;
-        }
-        #input {
-            flex: 1;
-            padding: 10px;
-            border: 1px solid #F7931A;
-            border-radius: 5px;
-            font-size: 1em;
-            background-color: #333;
-            color: #F7931A;
-            box-shadow: 0 0 5px #F7931A;
-            min-width: 200px;
-        }
-        #input::placeholder {
-            color: #F7931A;
-            opacity: 0.7;
-        }
-        button {
-            padding: 10px 15px;
-            background-color: #1e90ff;
-            color: #ffffff;
-            border: none;
-            border-radius: 5px;
-            cursor: pointer;
-            font-size: 1em;
-            box-shadow: 0 0 10px #1e90ff;
-            transition: all 0.3s;
-        }
-        button:hover {
-            background-color: #00ff00;
-            color: #000000;
-            box-shadow: 0 0 15px #00ff00;
-        }
-        .speak-button, .listen-button, .upload-button, .save-button, .copy-button, .link-button {
-            padding: 5px 10px;
-            font-size: 0.8em;
-            margin-left: 10px;
-            background-color: #ff00ff;
-            box-shadow: 0 0 10px #ff00ff;
-        }
-        .speak-button:hover, .listen-button:hover, .upload-button:hover, .save-button:hover, .copy-button:hover, .link-button:hover {
-            background-color: #00ff00;
-            box-shadow: 0 0 15px #00ff00;
-        }
-        .recording {
-            background-color: #ff0000;
-            box-shadow: 0 0 10px #ff0000;
-        }
-        .processing {
-            width: 100%;
-            text-align: center;
-            margin: 5px 0;
-            color: #00ff00;
-            font-size: 1.2em;
-            text-shadow: 0 0 10px #00ff00;
-        }
-        .details {
-            display: none;
-            margin-top: 10px;
-            padding: 10px;
-            background-color: #222;
-            border: 1px solid #00ff00;
-            border-radius: 5px;
-            color: #00ff00;
-        }
-        .toggle-details {
-            cursor: pointer;
-            color: #1e90ff;
-            text-decoration: underline;
-            margin-top: 5px;
-            display: inline-block;
-            text-shadow: 0 0 5px #1e90ff;
-        }
-        .vision-text {
-            text-align: center;
-            font-size: 0.9em;
-            color: #1e90ff;
-            margin-bottom: 20px;
-            line-height: 1.4;
-            text-shadow: 0 0 5px #1e90ff;
-        }
-        .contributions {
-            font-size: 0.9em;
-            color: #ff00ff;
-            margin-top: 10px;
-            text-align: left;
-            text-shadow: 0 0 5px #ff00ff;
-        }
-        .footer {
-            text-align: center;
-            font-size: 1em;
-            color: #F7931A;
-            margin-top: 20px;
-            text-shadow: 0 0 10px #F7931A;
-        }
-        .footer a {
-            color: #1e90ff;
-            text-decoration: none;
-            text-shadow: 0 0 5px #1e90ff;
-        }
-        .footer a:hover {
-            color: #00ff00;
-            text-shadow: 0 0 10px #00ff00;
-        }
-        @media (max-width: 600px) {
-            h1 { font-size: 1.2em; }
-            #chat-container { margin-bottom: 10px; }
-            #chat { margin-top: 10px; }
-            .style-container { flex-direction: column; gap: 5px; }
-            select { width: 100%; }
-            .input-container { flex-direction: column; gap: 5px; }
-            #input { width: 100%; font-size: 0.9em; }
-            button { width: 100%; padding: 12px; font-size: 0.9em; }
-            .button-container { flex-direction: column; gap: 10px; align-items: center; }
-            .button-container button { width: 100%; max-width: 200px; }
-            .speak-button, .listen-button, .upload-button, .save-button, .copy-button, .link-button { margin-left: 0; margin-top: 5px; }
-        }
-    </style>
-</head>
-<body>
-    <h1>ARCA-b Chat AI</h1>
-    <p style="text-align: center; font-size: 0.9em; color: #1e90ff; margin-bottom: 10px; text-shadow: 0 0 5px #1e90ff;">
-        Note: Conversations are stored temporarily in memory during your session and are not saved to disk. Messages are sent securely over HTTPS.
-    </p>
-    <p class="vision-text">
-        <strong>Vision:</strong> ARCA-b Chat AI aims to unleash the full power of global digital knowledge for everyone, tapping into multiple AI sources to gather diverse data - something no single AI can do alone. It delivers transparent, objective, and propaganda-free answers by blending the best insights from every source into one ultimate response. As an open-source project, ARCA-b is built for scalability, empowering communities to access and share knowledge freely.
-    </p>
-    <div class="button-container">
-        <a href="/donate"><button>Donate</button></a>
-        <a href="mailto:arcab.founder@gmail.com"><button>Contact</button></a>
-    </div>
-    <div id="chat-container">
-        <div id="chat"></div>
-        <div class="input-and-style-container">
-            <div class="style-container">
-                <select id="language-select">
-                    <option value="Italiano">Italiano</option>
-                    <option value="English">English</option>
-                    <option value="Deutsch">Deutsch</option>
-                </select>
-            </div>
-            <div class="input-container">
-                <input id="input" type="text" placeholder="Write your question...">
-                <button onclick="sendMessage()">Send</button>
-                <button onclick="startRecording()" id="speak-button" class="speak-button">Speak</button>
-                <input type="file" id="file-input" accept=".txt,image/*" style="display: none;" onchange="uploadFile()">
-                <button onclick="document.getElementById('file-input').click()" class="upload-button">Upload File</button>
-                <button onclick="clearChat()">Clear Chat</button>
-            </div>
-        </div>
-    </div>
-    <p class="footer">
-        Powered by arcab-global-ai.org | Check out the code on <a href="https://github.com/thomasinama/ARCA-b" target="_blank">GitHub</a>
-    </p>
-    <script>
-        let conversationHistory = [];
-        let mediaRecorder = null;
-        let audioChunks = [];
-        let audioStream = null;
-
-        const chat = document.getElementById("chat");
-        const input = document.getElementById("input");
-        const languageSelect = document.getElementById("language-select");
-        const speakButton = document.getElementById("speak-button");
-
-        if (localStorage.getItem("language")) {
-            languageSelect.value = localStorage.getItem("language");
-        } else {
-            languageSelect.value = "Italiano";
-        }
-
-        function addMessage(text, isUser, rawResponses, contributions, index) {
-            const div = document.createElement("div");
-            div.innerHTML = (isUser ? "You: " : "ARCA-b: ") + text.replace(/\n/g, "<br>");
-            div.className = "message " + (isUser ? "user" : "bot");
-            chat.appendChild(div);
-
-            if (!isUser) {
-                const saveButton = document.createElement("button");
-                saveButton.textContent = "Save";
-                saveButton.className = "save-button";
-                saveButton.onclick = function() { saveConversation(index); };
-                div.appendChild(saveButton);
-
-                const copyButton = document.createElement("button");
-                copyButton.textContent = "Copy Text";
-                copyButton.className = "copy-button";
-                copyButton.onclick = function() { copyConversation(index); };
-                div.appendChild(copyButton);
-
-                const linkButton = document.createElement("button");
-                linkButton.textContent = "Share Link";
-                linkButton.className = "link-button";
-                linkButton.onclick = function() { shareConversationLink(index); };
-                div.appendChild(linkButton);
-
-                const listenButton = document.createElement("button");
-                listenButton.textContent = "Listen";
-                listenButton.className = "listen-button";
-                listenButton.onclick = function() { textToSpeech(text, languageSelect.value, this); };
-                div.appendChild(listenButton);
-            }
-
-            if (!isUser && contributions && contributions.trim() !== "") {
-                const contributionsDiv = document.createElement("div");
-                contributionsDiv.className = "contributions";
-                contributionsDiv.innerHTML = "<strong>Contributions:</strong><br>" + contributions.replace(/\n/g, "<br>");
-                chat.appendChild(contributionsDiv);
-            }
-
-            if (!isUser && rawResponses && rawResponses.trim() !== "") {
-                console.log("Raw responses received:", rawResponses);
-                const toggle = document.createElement("span");
-                toggle.className = "toggle-details";
-                toggle.textContent = "Show original responses";
-                toggle.onclick = function() {
-                    const details = this.nextSibling;
-                    if (details.style.display === "none" || details.style.display === "") {
-                        details.style.display = "block";
-                        this.textContent = "Hide original responses";
-                    } else {
-                        details.style.display = "none";
-                        this.textContent = "Show original responses";
-                    }
-                };
-                chat.appendChild(toggle);
-
-                const details = document.createElement("div");
-                details.className = "details";
-                details.innerHTML = rawResponses.replace(/\n/g, "<br>");
-                chat.appendChild(details);
-            }
-
-            chat.scrollTop = chat.scrollHeight;
-        }
-
-        function saveConversation(index) {
-            const conv = conversationHistory[index];
-            const text = "User: " + conv.user + "\nARCA-b: " + conv.response;
-            const blob = new Blob([text], { type: "text/plain" });
-            const url = URL.createObjectURL(blob);
-            const a = document.createElement("a");
-            a.href = url;
-            a.download = "conversation-" + (index + 1) + ".txt";
-            a.click();
-            URL.revokeObjectURL(url);
-        }
-
-        function copyConversation(index) {
-            const conv = conversationHistory[index];
-            const shareText = "User: " + conv.user + "\nARCA-b: " + conv.response + "\n\nTry ARCA-b Chat AI at: https://arcab-global-ai.org";
-            if (navigator.clipboard && navigator.clipboard.writeText) {
-                navigator.clipboard.writeText(shareText).then(function() {
-                    alert("Conversation text copied to clipboard!");
-                }).catch(function(err) {
-                    alert("Error copying text: " + err.message);
-                });
-            } else {
-                prompt("Copy this text manually:", shareText);
-            }
-        }
-
-        function shareConversationLink(index) {
-            const conv = conversationHistory[index];
-            fetch("/chat", {
-                method: "POST",
-                headers: { "Content-Type": "application/json" },
-                body: JSON.stringify({
-                    message: conv.user,
-                    response: conv.response,
-                    language: languageSelect.value,
-                    saveConversation: true,
-                    conversationIndex: index
-                }),
-                credentials: "include"
-            }).then(response => {
-                if (!response.ok) {
-                    throw new Error("Network response was not ok: " + response.statusText);
-                }
-                return response.json();
-            }).then(data => {
-                const conversationId = data.conversationId;
-                if (!conversationId) throw new Error("conversationId not found");
-                const shareLink = "https://arcab-global-ai.org/conversation/" + conversationId;
-                if (navigator.clipboard && navigator.clipboard.writeText) {
-                    navigator.clipboard.writeText(shareLink).then(function() {
-                        alert("Conversation link copied to clipboard: " + shareLink);
-                    }).catch(function(err) {
-                        alert("Error copying link: " + err.message);
-                        prompt("Copy this link manually:", shareLink);
-                    });
-                } else {
-                    prompt("Copy this link manually:", shareLink);
-                }
-            }).catch(err => {
-                console.error("Error generating share link:", err);
-                alert("Error generating share link: " + err.message);
-            });
-        }
-
-        function showProcessingMessage() {
-            const div = document.createElement("div");
-            div.id = "processing-message";
-            div.className = "processing";
-            div.textContent = "Processing...";
-            chat.appendChild(div);
-            chat.scrollTop = chat.scrollHeight;
-        }
-
-        function removeProcessingMessage() {
-            const processingMessage = document.getElementById("processing-message");
-            if (processingMessage) processingMessage.remove();
-        }
-
-        async function sendMessage(messageText) {
-            const question = messageText || input.value.trim();
-            if (!question) {
-                console.log("No question to send");
-                return;
-            }
-
-            console.log("Sending message:", question);
-
-            addMessage(question, true);
-            input.value = "";
-
-            const language = languageSelect.value;
-            localStorage.setItem("language", language);
-
-            showProcessingMessage();
-            try {
-                const minDisplayTime = new Promise(resolve => setTimeout(resolve, 1000));
-                const response = await fetch("/chat", {
-                    method: "POST",
-                    headers: { "Content-Type": "application/json" },
-                    body: JSON.stringify({
-                        message: question,
-                        language: language
-                    }),
-                    credentials: "include"
-                });
-                const answer = await Promise.all([response.json(), minDisplayTime]);
-                removeProcessingMessage();
-
-                conversationHistory.push({ user: question, response: answer[0].response });
-                const rawResponses = answer[0].rawResponses || "";
-                const contributions = answer[0].contributions || "";
-                addMessage(answer[0].response, false, rawResponses, contributions, conversationHistory.length - 1);
-            } catch (error) {
-                removeProcessingMessage();
-                addMessage("Error: I couldn't get a response. " + error.message, false);
-                console.error("Error sending message:", error);
-            }
-        }
-
-        function clearChat() {
-            fetch("/clear", {
-                method: "POST",
-                credentials: "include"
-            }).then(() => {
-                chat.innerHTML = "";
-                conversationHistory = [];
-            });
-        }
-
-        async function startRecording() {
-            if (!navigator.mediaDevices || !navigator.mediaDevices.getUserMedia) {
-                alert("Your browser does not support audio recording.");
-                return;
-            }
-
-            if (audioStream) {
-                audioStream.getTracks().forEach(track => track.stop());
-                audioStream = null;
-            }
-            if (mediaRecorder) {
-                mediaRecorder = null;
-            }
-            audioChunks = [];
-
-            speakButton.classList.add("recording");
-            speakButton.textContent = "Recording... (Click to Stop)";
-
-            try {
-                audioStream = await navigator.mediaDevices.getUserMedia({ audio: true });
-                mediaRecorder = new MediaRecorder(audioStream, { mimeType: "audio/mp4" });
-
-                mediaRecorder.ondataavailable = function(e) {
-                    if (e.data.size > 0) {
-                        audioChunks.push(e.data);
-                    }
-                };
-
-                mediaRecorder.onstop = async function() {
-                    speakButton.classList.remove("recording");
-                    speakButton.textContent = "Speak";
-                    speakButton.onclick = startRecording;
-
-                    console.log("Recording stopped, audio chunks:", audioChunks.length);
-
-                    if (audioChunks.length === 0) {
-                        alert("Error: No audio data recorded.");
-                        return;
-                    }
-
-                    const audioBlob = new Blob(audioChunks, { type: "audio/mp4" });
-                    const formData = new FormData();
-                    formData.append("audio", audioBlob, "recording.mp4");
-
-                    try {
-                        const response = await fetch("/speech-to-text", {
-                            method: "POST",
-                            body: formData,
-                        });
-                        const result = await response.json();
-                        if (result.text) {
-                            input.value = result.text;
-                            sendMessage(result.text);
-                        } else {
-                            alert("Error: Could not transcribe audio.");
-                        }
-                    } catch (error) {
-                        console.error("Error transcribing audio:", error);
-                        alert("Error transcribing audio: " + error.message);
-                    } finally {
-                        if (audioStream) {
-                            audioStream.getTracks().forEach(track => track.stop());
-                            audioStream = null;
-                        }
-                        audioChunks = [];
-                        mediaRecorder = null;
-                    }
-                };
-
-                mediaRecorder.onerror = function(event) {
-                    console.error("MediaRecorder error:", event);
-                    alert("Error recording audio: " + event);
-                };
-
-                mediaRecorder.start();
-                speakButton.onclick = stopRecording;
-            } catch (error) {
-                speakButton.classList.remove("recording");
-                speakButton.textContent = "Speak";
-                speakButton.onclick = startRecording;
-                console.error("Error accessing microphone:", error);
-                alert("Error accessing microphone: " + error.message);
-            }
-        }
-
-        function stopRecording() {
-            if (mediaRecorder && mediaRecorder.state === "recording") {
-                mediaRecorder.stop();
-            }
-        }
-
-        async function textToSpeech(text, language, button) {
-            try {
-                button.disabled = true;
-                button.textContent = "Playing...";
-
-                const response = await fetch("/text-to-speech", {
-                    method: "POST",
-                    headers: { "Content-Type": "application/json" },
-                    body: JSON.stringify({ text: text, language: language }),
-                });
-                if (!response.ok) {
-                    throw new Error("HTTP error, status: " + response.status);
-                }
-                const audioBlob = await response.blob();
-                const audioUrl = URL.createObjectURL(audioBlob);
-                const audio = new Audio(audioUrl);
-
-                const isIOS = /iPad|iPhone|iPod/.test(navigator.userAgent) && !window.MSStream;
-                if (isIOS) {
-                    const playButton = document.createElement("button");
-                    playButton.textContent = "Play Audio";
-                    playButton.className = "listen-button";
-                    playButton.onclick = function() {
-                        audio.play().catch(err => {
-                            console.error("Error playing audio on iOS:", err);
-                            alert("Error playing audio: " + err.message);
-                        });
-                        playButton.remove();
-                        button.disabled = false;
-                        button.textContent = "Listen";
-                    };
-                    button.parentNode.insertBefore(playButton, button.nextSibling);
-                } else {
-                    audio.play().catch(err => {
-                        console.error("Error playing audio:", err);
-                        alert("Error playing audio: " + err.message);
-                    });
-                    audio.onended = () => {
-                        button.disabled = false;
-                        button.textContent = "Listen";
-                        URL.revokeObjectURL(audioUrl);
-                    };
-                }
-            } catch (error) {
-                console.error("Error fetching audio:", error);
-                alert("Error playing audio: " + error.message);
-                button.disabled = false;
-                button.textContent = "Listen";
-            }
-        }
-
-        async function uploadFile() {
-            const fileInput = document.getElementById("file-input");
-            const file = fileInput.files[0];
-            if (!file) {
-                console.log("No file selected");
-                alert("Please select a file to upload.");
-                return;
-            }
-
-            console.log("Uploading file:", file.name, "size:", file.size);
-
-            const formData = new FormData();
-            formData.append("file", file);
-
-            try {
-                const response = await fetch("/upload-file", {
-                    method: "POST",
-                    body: formData,
-                });
-                console.log("Response status:", response.status);
-                if (!response.ok) {
-                    const errorData = await response.json();
-                    throw new Error(errorData.error || "Server error");
-                }
-                const result = await response.json();
-                console.log("Response from server:", result);
-                if (result.text) {
-                    console.log("Text extracted:", result.text);
-                    input.value = result.text;
-                    sendMessage(result.text);
-                } else if (result.error) {
-                    console.log("Server error:", result.error);
-                    alert("Error: " + result.error);
-                } else {
-                    console.log("No text extracted from file");
-                    alert("Error: Could not extract text from file.");
-                }
-            } catch (error) {
-                console.error("Error uploading file:", error);
-                alert("Error uploading file: " + error.message);
-            } finally {
-                fileInput.value = "";
-            }
-        }
-
-        input.addEventListener("keypress", function(e) {
-            if (e.key === "Enter") sendMessage();
-        });
-    </script>
-</body>
-</html>`)
+        renderPage(w, "index.html", map[string]interface{}{"PublicURL": publicURL})
     }) // Fine handler /
 
     http.HandleFunc("/donate", func(w http.ResponseWriter, r *http.Request) {
-        fmt.Fprint(w, `<!DOCTYPE html>
-<html>
-<head>
-    <title>Donations - ARCA-b Chat AI</title>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <style>
-        body { font-family: Arial, sans-serif; margin: 20px; text-align: center; }
-        button { padding: 10px 20px; background-color: #007bff; color: white; border: none; border-radius: 5px; cursor: pointer; font-size: 1em; margin: 10px; }
-        button:hover { background-color: #0056b3; }
-        code { background-color: #f4f4f4; padding: 2px 5px; border-radius: 3px; }
-    </style>
-</head>
-<body>
-    <h1>Support ARCA-b Chat AI</h1>
-    <p>Your donations help us improve the project and keep it free from censorship and propaganda. Thank you!</p>
-    <p>Please send your donation to one of the following cryptocurrency addresses:</p>
-    <div><strong>Bitcoin (BTC):</strong> <code>38JkmWhTFYosecu45ewoheYMjJw68sHSj3</code></div>
-    <div><strong>USDT (Ethereum):</strong> <code>0x71ECB5C451ED648583722F5834fF6490D4570f7d</code></div>
-    <p><small>After donating, contact us at <a href="mailto:arcab.founder@gmail.com">arcab.founder@gmail.com</a> with your session ID to unlock premium features.</small></p>
-    <a href="/"><button>Back to Chat</button></a>
-</body>
-</html>`)
+        renderPage(w, "donate.html", nil)
     }) // Fine handler /donate
 
     http.HandleFunc("/clear", func(w http.ResponseWriter, r *http.Request) {
@@ -1481,67 +945,30 @@ http.HandleFunc("/text-to-speech", func(w http.ResponseWriter, r *http.Request)
             http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
             return
         }
-        sessionID, err := r.Cookie("session_id")
+        owner, err := requestOwner(r)
         if err != nil {
             http.Error(w, "Error: Session not found", http.StatusBadRequest)
             return
         }
-        mutex.Lock()
-        delete(sessions, sessionID.Value)
-        mutex.Unlock()
-        w.WriteHeader(http.StatusOK)
-    }) // Fine handler /clear
-
-    http.HandleFunc("/conversation/", func(w http.ResponseWriter, r *http.Request) {
-        id := strings.TrimPrefix(r.URL.Path, "/conversation/")
-        if id == "" {
-            http.Error(w, "Conversation ID not provided", http.StatusBadRequest)
-            return
+        // Le chat precedenti restano nella cronologia: si riparte da una nuova,
+        // a meno che quella corrente sia ancora vuota
+        chat, err := currentChat(owner)
+        if err == nil && chat.Turns > 0 {
+            chat, err = createChat(owner, "")
         }
-        mutex.Lock()
-        conversation, exists := conversations[id]
-        mutex.Unlock()
-        if !exists {
-            http.Error(w, "Conversation not found", http.StatusNotFound)
+        if err != nil {
+            http.Error(w, "Error clearing session: "+err.Error(), http.StatusInternalServerError)
             return
         }
-        w.Header().Set("Content-Type", "text/html; charset=utf-8")
-        fmt.Fprintf(w, `
-<!DOCTYPE html>
-<html>
-<head>
-    <title>ARCA-b Chat AI - Conversation</title>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <style>
-        body { font-family: 'Courier New', monospace; margin: 0; padding: 20px; background-color: #0d0d0d; color: #00ff00; }
-        h1 { font-size: 1.8em; text-align: center; text-shadow: 0 0 10px #00ff00; }
-        .conversation { margin: auto; padding: 20px; border: 1px solid #00ff00; border-radius: 10px; background-color: #1a1a1a; max-width: 800px; }
-        .conversation p { margin: 10px 0; line-height: 1.5; }
-        a { color: #1e90ff; text-decoration: none; }
-        a:hover { color: #00ff00; }
-    </style>
-</head>
-<body>
-    <h1>ARCA-b Chat AI - Conversation</h1>
-    <div class="conversation">
-        <p><strong>Response:</strong></p>
-        <p>%s</p>
-        <p><strong>Contributions:</strong></p>
-        <p>%s</p>
-        <p><a href="/">Back to Chat</a></p>
-    </div>
-</body>
-</html>
-`, strings.ReplaceAll(conversation.Response, "\n", "<br>"), strings.ReplaceAll(conversation.Contributions, "\n", "<br>"))
-    }) // Fine handler /conversation/
+        writeJSON(w, map[string]string{"chatId": chat.ID})
+    }) // Fine handler /clear
 
     http.HandleFunc("/chat", func(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPost {
             http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
             return
         }
-        sessionID, err := r.Cookie("session_id")
+        owner, err := requestOwner(r)
         if err != nil {
             http.Error(w, "Error: Session not found", http.StatusBadRequest)
             return
@@ -1559,60 +986,90 @@ http.HandleFunc("/text-to-speech", func(w http.ResponseWriter, r *http.Request)
         }
         fmt.Printf("Parsed request: %+v\n", req)
 
-        mutex.Lock()
-        tracker, exists := requestTrackers[sessionID.Value]
-        if !exists {
-            tracker = &UserRequestTracker{
-                HourlyCount:   0,
-                LastResetHour: time.Now(),
-                IsPremium:     premiumUsers[sessionID.Value],
-            }
-            requestTrackers[sessionID.Value] = tracker
+        tracker, ok := enforceRateLimit(w, r, owner)
+        if !ok {
+            return
         }
-        if !tracker.IsPremium {
-            if time.Since(tracker.LastResetHour) > time.Hour {
-                tracker.HourlyCount = 0
-                tracker.LastResetHour = time.Now()
-            }
-            tracker.HourlyCount++
-            if tracker.HourlyCount > hourlyLimit {
-                mutex.Unlock()
-                response := ChatResponse{
-                    Response: "You have reached the hourly limit of 15 requests. Please consider supporting us with a donation to keep the project alive! Visit the <a href=\"/donate\">Donate</a> page.",
-                }
-                w.Header().Set("Content-Type", "application/json")
-                json.NewEncoder(w).Encode(response)
-                return
-            }
+        remaining, err := budgetRemaining(owner, tracker.Tier)
+        if err != nil {
+            http.Error(w, "Error checking budget: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        level := serviceLevel(remaining)
+        if level == serviceNone && !req.SaveConversation {
+            w.Header().Set("Content-Type", "application/json")
+            w.WriteHeader(http.StatusTooManyRequests)
+            json.NewEncoder(w).Encode(map[string]interface{}{"error": "budget_exhausted", "tier": tracker.Tier})
+            return
+        }
+        providers := selectProviders(level, chatProviders)
+        style, err := resolveStyle(owner, req.Style)
+        if err != nil {
+            http.Error(w, "Invalid style: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        prompts, err := currentPromptConfig()
+        if err != nil {
+            http.Error(w, "Error loading prompts: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        persona, err := resolvePersona(prompts, owner, req.Persona)
+        if err != nil {
+            http.Error(w, "Invalid persona: "+err.Error(), http.StatusBadRequest)
+            return
         }
-        mutex.Unlock()
 
-        language := req.Language
-        if language == "" {
-            language = "Italiano"
+        lang, err := resolveLanguage(req.Language, req.Message)
+        if err != nil {
+            http.Error(w, "Invalid language: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        language := lang.Name
+        personaName := ""
+        if persona != nil {
+            personaName = persona.Name
         }
 
-        mutex.Lock()
-        session, exists := sessions[sessionID.Value]
-        if !exists {
-            session = &Session{History: []openai.ChatCompletionMessage{}}
-            sessions[sessionID.Value] = session
+        chat, err := resolveChat(owner, req.ChatID)
+        if err == errChatNotFound {
+            http.Error(w, "Chat not found", http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            http.Error(w, "Error loading chat: "+err.Error(), http.StatusInternalServerError)
+            return
         }
-        session.History = append(session.History, openai.ChatCompletionMessage{
-            Role:    openai.ChatMessageRoleUser,
-            Content: req.Message,
-        })
-        mutex.Unlock()
 
+        // La condivisione pubblica la trascrizione registrata sul server,
+        // non il testo inviato dal client
         if req.SaveConversation {
-            conversationID := uuid.New().String()
-            mutex.Lock()
-            conversations[conversationID] = ChatResponse{
-                Response: req.Response,
+            turns, err := sessionTranscript(owner, chat.ID, req.ConversationIndex)
+            if err != nil {
+                http.Error(w, "Error saving conversation: "+err.Error(), http.StatusNotFound)
+                return
             }
-            mutex.Unlock()
-            w.Header().Set("Content-Type", "application/json")
-            json.NewEncoder(w).Encode(map[string]string{"conversationId": conversationID})
+            conversation, err := shareConversation(owner, turns, req.ExpiresInDays)
+            if err != nil {
+                http.Error(w, "Error saving conversation: "+err.Error(), http.StatusInternalServerError)
+                return
+            }
+            writeJSON(w, map[string]interface{}{
+                "conversationId": conversation.ID,
+                "url":            publicURL + "/conversation/" + conversation.ID,
+                "expiresAt":      conversation.ExpiresAt,
+            })
+            return
+        }
+
+        history, err := updateSession(chatSessionID(owner, chat.ID), func(session *Session) error {
+            session.History = append(session.History, openai.ChatCompletionMessage{
+                Role:    openai.ChatMessageRoleUser,
+                Content: req.Message,
+            })
+            return nil
+        })
+        if err != nil {
+            http.Error(w, "Error saving session: "+err.Error(), http.StatusInternalServerError)
             return
         }
 
@@ -1620,130 +1077,216 @@ http.HandleFunc("/text-to-speech", func(w http.ResponseWriter, r *http.Request)
             name    string
             content string
             err     error
+            usage   TokenUsage
         }
-        responses := make(chan aiResponse, 6)
+        responses := make(chan aiResponse, len(chatProviders))
         var wg sync.WaitGroup
-
-        wg.Add(1)
-        go func() {
-            defer wg.Done()
-            var answer string
-            if openAIKey == "" {
-                answer = fmt.Sprintf("Error: OPENAI_API_KEY is not set. (in %s)", language)
-            } else {
-                ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-                defer cancel()
-                messagesWithLang := append([]openai.ChatCompletionMessage{}, session.History...)
-                messagesWithLang[len(messagesWithLang)-1].Content = fmt.Sprintf("Respond in %s: %s", language, req.Message)
-                resp, err := openAIClient.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
-                    Model:    openai.GPT3Dot5Turbo,
-                    Messages: messagesWithLang,
-                })
+        started := time.Now()
+
+        // Le fonti si cercano prima di interrogare i modelli: tutti ricevono
+        // gli stessi articoli, numerati, e possono citarli nella risposta
+        var spent int64
+        entry := &LedgerEntry{Owner: owner, Tier: tracker.Tier, Time: started, ServiceLevel: level}
+        embedUsage := ProviderUsage{Name: "Cohere Embed"}
+        embedAs := func(inputType string, texts []string) ([][]float64, error) {
+            var vectors [][]float64
+            for start := 0; start < len(texts); start += 96 {
+                batch := texts[start:min(len(texts), start+96)]
+                embedStarted := time.Now()
+                embeddings, usage, err := getCohereEmbeddings(cohereKey, client, batch, inputType)
+                if err == nil && usage.InputTokens == 0 {
+                    for _, text := range batch {
+                        usage.InputTokens += estimateTokens(text)
+                    }
+                }
+                spent += costOf("Cohere Embed", usage)
+                embedUsage.InputTokens += usage.InputTokens
+                embedUsage.CostMicros += costOf("Cohere Embed", usage)
+                embedUsage.LatencyMs += time.Since(embedStarted).Milliseconds()
+                embedUsage.Failed = embedUsage.Failed || err != nil
                 if err != nil {
-                    answer = fmt.Sprintf("Error: OpenAI did not respond: %v. (in %s)", err, language)
-                } else {
-                    answer = resp.Choices[0].Message.Content
+                    return nil, err
                 }
+                vectors = append(vectors, embeddings...)
             }
-            responses <- aiResponse{name: "OpenAI", content: answer}
-        }()
+            return vectors, nil
+        }
+        embedAll := func(texts []string) ([][]float64, error) {
+            return embedAs(cohereSearchDocument, texts)
+        }
+        embed := func(text string) ([]float64, error) {
+            vectors, err := embedAll([]string{text})
+            if err != nil {
+                return nil, err
+            }
+            return vectors[0], nil
+        }
+        embedQuery := func(text string) ([]float64, error) {
+            vectors, err := embedAs(cohereSearchQuery, []string{text})
+            if err != nil {
+                return nil, err
+            }
+            return vectors[0], nil
+        }
 
-        wg.Add(1)
-        go func() {
-            defer wg.Done()
-            answer, err := getDeepSeekResponse(client, deepSeekKey, session.History, language)
+        query := extractNewsQuery(req.Message, started)
+        fmt.Printf("News query: %s\n", query)
+        sources, err := searchNews(r.Context(), news, query, lang, maxNewsArticles)
+        if err != nil {
+            fmt.Printf("Error retrieving news: %v\n", err)
+        }
+        if !query.Skip {
+            entry.Providers = append(entry.Providers, ProviderUsage{Name: "News", LatencyMs: time.Since(started).Milliseconds(), Failed: err != nil})
+        }
+        // I passaggi dei documenti indicizzati vengono prima delle notizie
+        if documentTopK > 0 {
+            matches, err := documents.Search(owner, req.Message, documentTopK, embedQuery)
             if err != nil {
-                answer = fmt.Sprintf("Error: DeepSeek did not respond: %v. (in %s)", err, language)
+                fmt.Printf("Error searching documents: %v\n", err)
             }
-            responses <- aiResponse{name: "DeepSeek", content: answer}
-        }()
+            sources = append(chunkArticles(matches), sources...)
+        }
+        grounding := groundingPrompt(sources, lang)
+        promptFor := func(provider string) promptOptions {
+            options := prompts.systemPrompt(provider, persona, style, lang)
+            if grounding != "" {
+                options.System += "\n\n" + grounding
+            }
+            return options
+        }
 
-        wg.Add(1)
-        go func() {
-            defer wg.Done()
-            var answer string
-            if geminiKey == "" {
-                answer = fmt.Sprintf("Error: GEMINI_API_KEY is not set. (in %s)", language)
-            } else {
-                historyForGemini := ""
-                for _, msg := range session.History {
-                    historyForGemini += fmt.Sprintf("%s: %s\n", msg.Role, msg.Content)
+        if providers["OpenAI"] {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                var answer string
+                var usage TokenUsage
+                if openAIKey == "" {
+                    answer = fmt.Sprintf("Error: OPENAI_API_KEY is not set. (in %s)", language)
+                } else {
+                    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+                    defer cancel()
+                    options := promptFor("OpenAI")
+                    messages := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleSystem, Content: options.System}}
+                    messages = append(messages, history...)
+                    resp, err := openAIClient.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+                        Model:     openai.GPT3Dot5Turbo,
+                        Messages:  messages,
+                        MaxTokens: options.MaxTokens,
+                    })
+                    if err != nil {
+                        answer = fmt.Sprintf("Error: OpenAI did not respond: %v. (in %s)", err, language)
+                    } else {
+                        answer = resp.Choices[0].Message.Content
+                        usage = TokenUsage{InputTokens: resp.Usage.PromptTokens, OutputTokens: resp.Usage.CompletionTokens}
+                    }
                 }
-                historyForGemini += fmt.Sprintf("user: Respond in %s: %s\n", language, req.Message)
-                req, err := http.NewRequest("POST", "https://generativelanguage.googleapis.com/v1/models/gemini-1.5-flash:generateContent?key="+geminiKey,
-                    strings.NewReader(fmt.Sprintf(`{"contents":[{"parts":[{"text":"%s"}]}]}`, historyForGemini)))
-                if err == nil {
-                    req.Header.Set("Content-Type", "application/json")
-                    resp, err := client.Do(req)
+                responses <- aiResponse{name: "OpenAI", content: answer, usage: usage}
+            }()
+        }
+
+        if providers["DeepSeek"] {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                answer, usage, err := getDeepSeekResponse(client, deepSeekKey, history, promptFor("DeepSeek"))
+                if err != nil {
+                    answer = fmt.Sprintf("Error: DeepSeek did not respond: %v. (in %s)", err, language)
+                }
+                responses <- aiResponse{name: "DeepSeek", content: answer, usage: usage}
+            }()
+        }
+
+        if providers["Gemini"] {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                var answer string
+                var usage TokenUsage
+                if geminiKey == "" {
+                    answer = fmt.Sprintf("Error: GEMINI_API_KEY is not set. (in %s)", language)
+                } else {
+                    historyForGemini := ""
+                    for _, msg := range history {
+                        historyForGemini += fmt.Sprintf("%s: %s\n", msg.Role, msg.Content)
+                    }
+                    options := promptFor("Gemini")
+                    geminiRequest := map[string]interface{}{
+                        "contents":         []map[string]interface{}{{"parts": []map[string]string{{"text": historyForGemini}}}},
+                        "generationConfig": map[string]int{"maxOutputTokens": maxTokensOr(options.MaxTokens, 1000)},
+                    }
+                    if options.System != "" {
+                        geminiRequest["systemInstruction"] = map[string]interface{}{"parts": []map[string]string{{"text": options.System}}}
+                    }
+                    payload, _ := json.Marshal(geminiRequest)
+                    req, err := http.NewRequest("POST", "https://generativelanguage.googleapis.com/v1beta/models/gemini-1.5-flash:generateContent?key="+geminiKey,
+                        bytes.NewReader(payload))
                     if err == nil {
-                        defer resp.Body.Close()
-                        var geminiResult struct {
-                            Candidates []struct {
-                                Content struct {
-                                    Parts []struct {
-                                        Text string `json:"text"`
-                                    } `json:"parts"`
-                                } `json:"content"`
-                            } `json:"candidates"`
-                        }
-                        if err := json.NewDecoder(resp.Body).Decode(&geminiResult); err == nil && len(geminiResult.Candidates) > 0 && len(geminiResult.Candidates[0].Content.Parts) > 0 {
-                            answer = geminiResult.Candidates[0].Content.Parts[0].Text
+                        req.Header.Set("Content-Type", "application/json")
+                        resp, err := client.Do(req)
+                        if err == nil {
+                            defer resp.Body.Close()
+                            var geminiResult struct {
+                                Candidates []struct {
+                                    Content struct {
+                                        Parts []struct {
+                                            Text string `json:"text"`
+                                        } `json:"parts"`
+                                    } `json:"content"`
+                                } `json:"candidates"`
+                                UsageMetadata struct {
+                                    PromptTokenCount     int `json:"promptTokenCount"`
+                                    CandidatesTokenCount int `json:"candidatesTokenCount"`
+                                } `json:"usageMetadata"`
+                            }
+                            if err := json.NewDecoder(resp.Body).Decode(&geminiResult); err == nil && len(geminiResult.Candidates) > 0 && len(geminiResult.Candidates[0].Content.Parts) > 0 {
+                                answer = geminiResult.Candidates[0].Content.Parts[0].Text
+                                usage = TokenUsage{InputTokens: geminiResult.UsageMetadata.PromptTokenCount, OutputTokens: geminiResult.UsageMetadata.CandidatesTokenCount}
+                            } else {
+                                answer = fmt.Sprintf("Error: Gemini did not provide a valid response. (in %s)", language)
+                            }
                         } else {
-                            answer = fmt.Sprintf("Error: Gemini did not provide a valid response. (in %s)", language)
+                            answer = fmt.Sprintf("Error: Gemini did not respond: %v. (in %s)", err, language)
                         }
                     } else {
                         answer = fmt.Sprintf("Error: Gemini did not respond: %v. (in %s)", err, language)
                     }
-                } else {
-                    answer = fmt.Sprintf("Error: Gemini did not respond: %v. (in %s)", err, language)
                 }
-            }
-            responses <- aiResponse{name: "Gemini", content: answer}
-        }()
-
-        wg.Add(1)
-        go func() {
-            defer wg.Done()
-            prompt := ""
-            for _, msg := range session.History {
-                prompt += fmt.Sprintf("%s: %s\n", msg.Role, msg.Content)
-            }
-            answer, err := getMistralResponse(mistralKey, client, prompt)
-            if err != nil {
-                answer = fmt.Sprintf("Error: Mistral did not respond: %v. (in %s)", err, language)
-            }
-            responses <- aiResponse{name: "Mistral", content: answer}
-        }()
+                responses <- aiResponse{name: "Gemini", content: answer, usage: usage}
+            }()
+        }
 
-        wg.Add(1)
-        go func() {
-            defer wg.Done()
-            prompt := ""
-            for _, msg := range session.History {
-                prompt += fmt.Sprintf("%s: %s\n", msg.Role, msg.Content)
-            }
-            answer, err := getCohereResponse(cohereKey, client, prompt)
-            if err != nil {
-                answer = fmt.Sprintf("Error: Cohere did not respond: %v. (in %s)", err, language)
-            }
-            responses <- aiResponse{name: "Cohere", content: answer}
-        }()
+        if providers["Mistral"] {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                prompt := ""
+                for _, msg := range history {
+                    prompt += fmt.Sprintf("%s: %s\n", msg.Role, msg.Content)
+                }
+                answer, usage, err := getMistralResponse(mistralKey, client, prompt, promptFor("Mistral"))
+                if err != nil {
+                    answer = fmt.Sprintf("Error: Mistral did not respond: %v. (in %s)", err, language)
+                }
+                responses <- aiResponse{name: "Mistral", content: answer, usage: usage}
+            }()
+        }
 
-        wg.Add(1)
-        go func() {
-            defer wg.Done()
-            var answer string
-            if newsAPIKey == "" {
-                answer = fmt.Sprintf("Error: NEWS_API_KEY is not set. (in %s)", language)
-            } else {
-                var err error
-                answer, err = getNewsContext(newsAPIKey, client, req.Message, language)
+        if providers["Cohere"] {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                prompt := ""
+                for _, msg := range history {
+                    prompt += fmt.Sprintf("%s: %s\n", msg.Role, msg.Content)
+                }
+                answer, usage, err := getCohereResponse(cohereKey, client, prompt, promptFor("Cohere"))
                 if err != nil {
-                    answer = fmt.Sprintf("Error: NewsAPI did not respond: %v. (in %s)", err, language)
+                    answer = fmt.Sprintf("Error: Cohere did not respond: %v. (in %s)", err, language)
                 }
-            }
-            responses <- aiResponse{name: "NewsAPI", content: answer}
-        }()
+                responses <- aiResponse{name: "Cohere", content: answer, usage: usage}
+            }()
+        }
 
         go func() {
             wg.Wait()
@@ -1752,61 +1295,199 @@ http.HandleFunc("/text-to-speech", func(w http.ResponseWriter, r *http.Request)
 
         wholeResponse := ""
         validResponses := make([]string, 0)
+        responseContents := make(map[string]string)
         responseEmbeddings := make(map[string][]float64)
         contributionScores := make(map[string]float64)
         rawResponses := ""
+        var answers []ProviderAnswer
+        var wrongLanguage []ProviderAnswer
+        var refused []ProviderAnswer
+        weights := make(map[string]float64)
+        topic := questionTopic(req.Message)
+        accept := func(name, content string) {
+            validResponses = append(validResponses, content)
+            responseContents[name] = content
+            // Al livello minimo c'è un solo provider: niente embedding da confrontare
+            if level != serviceMinimal {
+                embedding, err := embed(content)
+                if err == nil {
+                    responseEmbeddings[name] = embedding
+                }
+            }
+        }
 
         for resp := range responses {
-            if !strings.HasPrefix(resp.content, "Error:") {
-                validResponses = append(validResponses, resp.content)
-                if resp.name != "NewsAPI" {
-                    embedding, err := getCohereEmbedding(cohereKey, client, resp.content)
-                    if err == nil {
-                        responseEmbeddings[resp.name] = embedding
-                    }
+            if resp.usage == (TokenUsage{}) && !strings.HasPrefix(resp.content, "Error:") {
+                resp.usage = TokenUsage{InputTokens: estimateTokens(req.Message), OutputTokens: estimateTokens(resp.content)}
+            }
+            spent += costOf(resp.name, resp.usage)
+            // Le risposte arrivano appena il provider termina, quindi il tempo trascorso è la sua latenza
+            entry.Providers = append(entry.Providers, ProviderUsage{
+                Name:       resp.name,
+                TokenUsage: resp.usage,
+                CostMicros: costOf(resp.name, resp.usage),
+                LatencyMs:  time.Since(started).Milliseconds(),
+                Failed:     strings.HasPrefix(resp.content, "Error:"),
+            })
+            answer := ProviderAnswer{
+                Name:    resp.name,
+                Content: resp.content,
+                Failed:  strings.HasPrefix(resp.content, "Error:"),
+                Usage:   resp.usage,
+            }
+            if !answer.Failed {
+                answer.Language, answer.WrongLanguage = checkAnswerLanguage(resp.content, lang)
+            }
+            if answer.WrongLanguage {
+                fmt.Printf("%s answered in %s instead of %s\n", resp.name, answer.Language, lang.Code)
+                translationStarted := time.Now()
+                usage, err := translate.fixLanguage(&answer, lang)
+                if usage != (TokenUsage{}) {
+                    spent += costOf(translate.provider, usage)
+                    entry.Providers = append(entry.Providers, ProviderUsage{
+                        Name:       translate.provider + " translation",
+                        TokenUsage: usage,
+                        CostMicros: costOf(translate.provider, usage),
+                        LatencyMs:  time.Since(translationStarted).Milliseconds(),
+                        Failed:     err != nil,
+                    })
                 }
+                if err != nil {
+                    fmt.Printf("Error translating the %s answer: %v\n", resp.name, err)
+                }
+            }
+            if !answer.Failed {
+                answer.Flags = flagAnswer(req.Message, answer.Content)
+                weights[answer.Name] = flagWeight(answer.Flags)
+                recordAnswerFlags(answer.Name, topic, answer.Flags, started)
+            }
+            answers = append(answers, answer)
+            if !answer.Failed {
+                // Le risposte nella lingua sbagliata non tradotte falserebbero i punteggi:
+                // si usano solo se non ce ne sono altre
+                if answer.WrongLanguage && answer.TranslatedBy == "" {
+                    wrongLanguage = append(wrongLanguage, answer)
+                } else if hasFlag(answer.Flags, flagRefusal) {
+                    refused = append(refused, answer)
+                } else {
+                    accept(answer.Name, answer.Content)
+                }
+            }
+            rawResponses += fmt.Sprintf("%s: %s\n", answerHeading(answer), answer.Content)
+        }
+        if len(validResponses) == 0 {
+            for _, answer := range wrongLanguage {
+                accept(answer.Name, answer.Content)
+            }
+        }
+        var flags map[string][]AnswerFlag
+        for _, answer := range answers {
+            if len(answer.Flags) > 0 {
+                if flags == nil {
+                    flags = make(map[string][]AnswerFlag)
+                }
+                flags[answer.Name] = answer.Flags
+            }
+        }
+        // Un rifiuto è la risposta solo se tutti i modelli hanno rifiutato
+        if len(validResponses) == 0 {
+            for _, answer := range refused {
+                accept(answer.Name, answer.Content)
             }
-            rawResponses += fmt.Sprintf("%s: %s\n", resp.name, resp.content)
         }
+        // saveTurn registra il turno nella sessione, così può essere condiviso
+        saveTurn := func(response *ChatResponse) {
+            for i := range answers {
+                answers[i].Contribution = contributionScores[answers[i].Name]
+            }
+            index, err := recordTurn(owner, chat.ID, ConversationTurn{
+                Time:          started,
+                Question:      req.Message,
+                Language:      lang.Code,
+                Response:      response.Response,
+                RawResponses:  response.RawResponses,
+                Contributions: response.Contributions,
+                ServiceLevel:  level,
+                Style:         style.Name,
+                Persona:       personaName,
+                Providers:     answers,
+                Sources:       sources,
+                Citations:     response.Citations,
+                Claims:        response.Claims,
+                Disagreements: response.Disagreements,
+            })
+            if err != nil {
+                fmt.Printf("Error recording turn for %s: %v\n", owner, err)
+                return
+            }
+            response.TurnIndex = &index
+            response.ChatID = chat.ID
+        }
+        defer func() {
+            chargeSpend(owner, spent)
+            if embedUsage.InputTokens > 0 || embedUsage.Failed {
+                entry.Providers = append(entry.Providers, embedUsage)
+            }
+            entry.LatencyMs = time.Since(started).Milliseconds()
+            recordLedgerEntry(entry)
+        }()
 
         if len(validResponses) == 0 {
             response := ChatResponse{
                 Response:     fmt.Sprintf("I'm sorry, I couldn't get any valid responses from the AI services. (in %s)", language),
                 RawResponses: rawResponses,
+                ServiceLevel: level,
+                Language:     lang.Code,
+                Flags:        flags,
             }
+            response.ResponseHTML = string(renderMarkdown(response.Response))
+            saveTurn(&response)
             w.Header().Set("Content-Type", "application/json")
             json.NewEncoder(w).Encode(response)
             return
         }
 
-        referenceEmbedding, err := getCohereEmbedding(cohereKey, client, validResponses[0])
+        // Il riferimento è la prima risposta valida che non elude la domanda
+        reference := validResponses[0]
+        for _, answer := range answers {
+            if content, ok := responseContents[answer.Name]; ok && weights[answer.Name] == 1 {
+                reference = content
+                break
+            }
+        }
+        var referenceEmbedding []float64
+        err = fmt.Errorf("no embeddings available")
+        if level != serviceMinimal {
+            // Riusa l'embedding già calcolato se il riferimento viene da un modello
+            for name, content := range responseContents {
+                if content == reference && responseEmbeddings[name] != nil {
+                    referenceEmbedding, err = responseEmbeddings[name], nil
+                }
+            }
+            if referenceEmbedding == nil {
+                referenceEmbedding, err = embed(reference)
+            }
+        }
         if err != nil {
-            wholeResponse = validResponses[0]
+            wholeResponse = reference
             // Assegna un peso uniforme se gli embedding non sono disponibili
             for name := range responseEmbeddings {
                 contributionScores[name] = 1.0 / float64(len(responseEmbeddings))
             }
         } else {
-            bestResponse := validResponses[0]
+            bestResponse := reference
             bestScore := 0.0
             totalScore := 0.0
             scores := make(map[string]float64)
 
             for name, embedding := range responseEmbeddings {
-                score := cosineSimilarity(referenceEmbedding, embedding)
+                // Le risposte evasive o piene di cautele pesano meno nella sintesi
+                score := cosineSimilarity(referenceEmbedding, embedding) * weights[name]
                 scores[name] = score
                 totalScore += score
                 if score > bestScore {
                     bestScore = score
-                    bestResponse = validResponses[0] // Default alla prima risposta valida
-                    // Trova la risposta corrispondente all'embedding
-                    for _, content := range validResponses {
-                        embeddingCheck, err := getCohereEmbedding(cohereKey, client, content)
-                        if err == nil && cosineSimilarity(referenceEmbedding, embeddingCheck) == score {
-                            bestResponse = content
-                            break
-                        }
-                    }
+                    bestResponse = responseContents[name]
                 }
             }
 
@@ -1822,6 +1503,46 @@ http.HandleFunc("/text-to-speech", func(w http.ResponseWriter, r *http.Request)
             wholeResponse = bestResponse
         }
 
+        // Le affermazioni servono al fact-check e a mostrare dove i modelli non concordano
+        var claims []Claim
+        var divergences []Disagreement
+        var disagreementsNote string
+        compare := compareAnswers(req.FactCheck, len(responseContents), level)
+        if compare && !req.FactCheck {
+            // Il livello è stato scelto prima delle chiamate: si ricontrolla il budget
+            if remaining, err := budgetRemaining(owner, tracker.Tier); err != nil || serviceLevel(remaining) != serviceFull {
+                compare = false
+            }
+        }
+        if !compare && len(responseContents) > 1 {
+            disagreementsNote = disagreementsSkipped
+        }
+        if compare {
+            checked := make([]ProviderAnswer, 0, len(responseContents))
+            for _, answer := range answers {
+                if content, ok := responseContents[answer.Name]; ok {
+                    answer.Content = content
+                    checked = append(checked, answer)
+                }
+            }
+            sort.SliceStable(checked, func(i, j int) bool {
+                return contributionScores[checked[i].Name] > contributionScores[checked[j].Name]
+            })
+            // Senza fact-check le fonti non servono: si confrontano solo le risposte
+            checkSources := sources
+            if !req.FactCheck {
+                checkSources = nil
+            }
+            found, err := checkClaims(checked, checkSources, embedAll)
+            if err != nil {
+                fmt.Printf("Error checking claims: %v\n", err)
+            }
+            divergences = disagreements(found)
+            if req.FactCheck {
+                claims = found
+            }
+        }
+
         // Costruisci la stringa delle contribuzioni con le percentuali
         var contribStrings []string
         for name, percentage := range contributionScores {
@@ -1833,11 +1554,53 @@ http.HandleFunc("/text-to-speech", func(w http.ResponseWriter, r *http.Request)
             Response:      wholeResponse,
             RawResponses:  rawResponses,
             Contributions: contributionsStr,
+            ServiceLevel:  level,
+            Language:      lang.Code,
+            Citations:     citations(wholeResponse, sources),
+            Claims:        claims,
+            Disagreements: divergences,
+            Flags:         flags,
+
+            DisagreementsNote: disagreementsNote,
         }
+        if len(claims) > 0 {
+            response.Sources = sources
+        }
+        response.ResponseHTML = string(renderMarkdown(response.Response))
+        saveTurn(&response)
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(response)
     }) // Fine handler /chat
 
+    http.HandleFunc("/login", handleLoginPage)
+    http.HandleFunc("/auth/register", handleRegister)
+    http.HandleFunc("/auth/login", handleLogin)
+    http.HandleFunc("/auth/magic-link", handleMagicLink)
+    http.HandleFunc("/auth/magic", handleMagicLinkCallback)
+    http.HandleFunc("/auth/logout", handleLogout)
+    http.HandleFunc("/auth/me", handleMe)
+    http.HandleFunc("/premium", handlePremiumStatus)
+    http.HandleFunc("/premium/redeem", handleRedeemVoucher)
+    http.HandleFunc("/donate/reference", handleDonationReference)
+    http.HandleFunc("/admin/premium", handleAdminPremium)
+    http.HandleFunc("/admin/vouchers", handleAdminVouchers)
+    http.HandleFunc("/admin/audit", handleAdminAudit)
+    http.HandleFunc("/conversation/", handleConversation)
+    http.HandleFunc("/conversations/shared", handleSharedConversations)
+    http.HandleFunc("/chats", handleChats)
+    http.HandleFunc("/chats/", handleChats)
+    http.HandleFunc("/styles", handleStyles)
+    http.HandleFunc("/styles/", handleStyles)
+    http.HandleFunc("/languages", handleLanguages)
+    http.HandleFunc("/documents", handleDocuments)
+    http.HandleFunc("/documents/", handleDocuments)
+    http.HandleFunc("/transparency", handleTransparency)
+    http.HandleFunc("/personas", handlePersonas)
+    http.HandleFunc("/personas/", handlePersonas)
+    http.HandleFunc("/admin/prompts", handleAdminPrompts)
+    http.HandleFunc("/usage", handleUsage)
+    http.HandleFunc("/admin/usage", handleAdminUsage)
+
     fmt.Printf("Starting ARCA-b server on port %s...\n", port)
     if err := http.ListenAndServe(":"+port, nil); err != nil {
         fmt.Printf("Server failed to start: %v\n", err)
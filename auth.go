@@ -0,0 +1,448 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/mail"
+    "net/smtp"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+    "golang.org/x/crypto/bcrypt"
+)
+
+type User struct {
+    ID           string    `json:"id"`
+    Email        string    `json:"email"`
+    PasswordHash string    `json:"passwordHash,omitempty"`
+    CreatedAt    time.Time `json:"createdAt"`
+}
+
+// AuthToken is the server-side record behind an auth_token cookie. Only the
+// SHA-256 of the token is used as a key, so a leaked store dump cannot be
+// replayed as cookies.
+type AuthToken struct {
+    UserID    string    `json:"userId"`
+    CreatedAt time.Time `json:"createdAt"`
+}
+
+const (
+    userPrefix      = "user:"
+    anonymousPrefix = "anon:"
+    userEmailPrefix = "user-email:"
+    authTokenPrefix = "auth-token:"
+    magicLinkPrefix = "magic-link:"
+
+    authTokenTTL      = 30 * 24 * time.Hour
+    magicLinkTTL      = 15 * time.Minute
+    minPasswordLength = 8
+)
+
+// Mailer sends the messages needed by the login flow.
+type Mailer interface {
+    Send(to, subject, body string) error
+}
+
+type smtpMailer struct {
+    addr string
+    auth smtp.Auth
+    from string
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+    msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n", m.from, to, subject, body)
+    return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
+
+// logMailer is the local fake used when no SMTP server is configured: it
+// prints every message and keeps it in memory.
+type logMailer struct {
+    mu   sync.Mutex
+    sent []mailMessage
+}
+
+type mailMessage struct {
+    To      string
+    Subject string
+    Body    string
+}
+
+func (m *logMailer) Send(to, subject, body string) error {
+    m.mu.Lock()
+    m.sent = append(m.sent, mailMessage{To: to, Subject: subject, Body: body})
+    m.mu.Unlock()
+    fmt.Printf("Mail to %s: %s\n%s\n", to, subject, body)
+    return nil
+}
+
+func newMailer() Mailer {
+    host := os.Getenv("SMTP_HOST")
+    if host == "" {
+        return &logMailer{}
+    }
+    port := os.Getenv("SMTP_PORT")
+    if port == "" {
+        port = "587"
+    }
+    from := os.Getenv("SMTP_FROM")
+    if from == "" {
+        from = "arcab.founder@gmail.com"
+    }
+    var auth smtp.Auth
+    if username := os.Getenv("SMTP_USERNAME"); username != "" {
+        auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+    }
+    return &smtpMailer{addr: host + ":" + port, auth: auth, from: from}
+}
+
+var (
+    mailer    Mailer
+    publicURL = "https://arcab-global-ai.org"
+)
+
+func newSecureCookie(name, value string, maxAge time.Duration) *http.Cookie {
+    return &http.Cookie{
+        Name:     name,
+        Value:    value,
+        Path:     "/",
+        MaxAge:   int(maxAge.Seconds()),
+        Secure:   true,
+        HttpOnly: true,
+        SameSite: http.SameSiteLaxMode,
+    }
+}
+
+func randomToken() (string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+func normalizeEmail(email string) (string, error) {
+    addr, err := mail.ParseAddress(strings.TrimSpace(email))
+    if err != nil {
+        return "", fmt.Errorf("invalid email address")
+    }
+    return strings.ToLower(addr.Address), nil
+}
+
+func findUserByEmail(email string) (*User, error) {
+    var userID string
+    found, err := store.Get(userEmailPrefix+email, &userID)
+    if err != nil || !found {
+        return nil, err
+    }
+    return loadUser(userID)
+}
+
+func loadUser(userID string) (*User, error) {
+    user := &User{}
+    found, err := store.Get(userPrefix+userID, user)
+    if err != nil || !found {
+        return nil, err
+    }
+    return user, nil
+}
+
+var errEmailTaken = fmt.Errorf("an account with this email already exists")
+
+// createUser saves the account and then claims its email with SetNX, so
+// two concurrent registrations cannot both succeed and the email never
+// points to a missing account.
+func createUser(email, password string) (*User, error) {
+    user := &User{ID: uuid.New().String(), Email: email, CreatedAt: time.Now()}
+    if password != "" {
+        hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+        if err != nil {
+            return nil, fmt.Errorf("error hashing password: %v", err)
+        }
+        user.PasswordHash = string(hash)
+    }
+    if err := store.Set(userPrefix+user.ID, user, 0); err != nil {
+        return nil, err
+    }
+    claimed, err := store.SetNX(userEmailPrefix+email, user.ID, 0)
+    if err == nil && !claimed {
+        err = errEmailTaken
+    }
+    if err != nil {
+        store.Delete(userPrefix + user.ID)
+        return nil, err
+    }
+    return user, nil
+}
+
+// startAuthSession issues a new auth token for the user and sets its cookie.
+// The chats of the anonymous session that signed in move to the account.
+func startAuthSession(w http.ResponseWriter, r *http.Request, user *User) error {
+    token, err := randomToken()
+    if err != nil {
+        return err
+    }
+    record := AuthToken{UserID: user.ID, CreatedAt: time.Now()}
+    if err := store.Set(authTokenPrefix+hashToken(token), record, authTokenTTL); err != nil {
+        return err
+    }
+    http.SetCookie(w, newSecureCookie("auth_token", token, authTokenTTL))
+    if sessionID, err := r.Cookie("session_id"); err == nil && validSessionID(sessionID.Value) {
+        if err := moveChats(anonymousPrefix+sessionID.Value, userPrefix+user.ID); err != nil {
+            fmt.Printf("Error moving anonymous chats to %s: %v\n", user.ID, err)
+        }
+    }
+    return nil
+}
+
+// currentUser returns the account bound to the request's auth_token cookie,
+// or nil for anonymous visitors.
+func currentUser(r *http.Request) (*User, error) {
+    cookie, err := r.Cookie("auth_token")
+    if err != nil || cookie.Value == "" {
+        return nil, nil
+    }
+    var record AuthToken
+    found, err := store.Get(authTokenPrefix+hashToken(cookie.Value), &record)
+    if err != nil || !found {
+        return nil, err
+    }
+    return loadUser(record.UserID)
+}
+
+// validSessionID reports whether id looks like a session_id issued by the
+// server: a UUID in canonical form.
+func validSessionID(id string) bool {
+    parsed, err := uuid.Parse(id)
+    return err == nil && parsed.String() == id
+}
+
+// requestOwner returns the key under which the caller's history, request
+// counters and premium status are kept: the account when logged in, so they
+// follow the person across devices, otherwise the anonymous session cookie.
+// Anonymous owners live under their own prefix, so a forged cookie can never
+// reach an account's keys.
+func requestOwner(r *http.Request) (string, error) {
+    user, err := currentUser(r)
+    if err != nil {
+        return "", err
+    }
+    if user != nil {
+        return userPrefix + user.ID, nil
+    }
+    sessionID, err := r.Cookie("session_id")
+    if err != nil || !validSessionID(sessionID.Value) {
+        return "", fmt.Errorf("session not found")
+    }
+    return anonymousPrefix + sessionID.Value, nil
+}
+
+func decodeCredentials(r *http.Request) (string, string, error) {
+    var req struct {
+        Email    string `json:"email"`
+        Password string `json:"password"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        return "", "", fmt.Errorf("invalid request body")
+    }
+    email, err := normalizeEmail(req.Email)
+    if err != nil {
+        return "", "", err
+    }
+    return email, req.Password, nil
+}
+
+// Register Handler
+func handleRegister(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if !enforceIPRateLimit(w, r, "auth") {
+        return
+    }
+    email, password, err := decodeCredentials(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if len(password) < minPasswordLength {
+        http.Error(w, fmt.Sprintf("Password must be at least %d characters long", minPasswordLength), http.StatusBadRequest)
+        return
+    }
+    user, err := createUser(email, password)
+    if err != nil {
+        http.Error(w, "Error creating account: "+err.Error(), http.StatusConflict)
+        return
+    }
+    if err := startAuthSession(w, r, user); err != nil {
+        http.Error(w, "Error starting session: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    writeJSON(w, map[string]string{"id": user.ID, "email": user.Email})
+}
+
+// Login Handler
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if !enforceIPRateLimit(w, r, "auth") {
+        return
+    }
+    email, password, err := decodeCredentials(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    user, err := findUserByEmail(email)
+    if err != nil {
+        http.Error(w, "Error loading account: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if user == nil || user.PasswordHash == "" || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+        http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+        return
+    }
+    if err := startAuthSession(w, r, user); err != nil {
+        http.Error(w, "Error starting session: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    writeJSON(w, map[string]string{"id": user.ID, "email": user.Email})
+}
+
+// Magic Link Handler: emails a one-time login link. Unknown addresses get an
+// account on first use, so the link doubles as passwordless sign-up.
+func handleMagicLink(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if !enforceIPRateLimit(w, r, "auth") {
+        return
+    }
+    email, _, err := decodeCredentials(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    token, err := randomToken()
+    if err != nil {
+        http.Error(w, "Error creating login link", http.StatusInternalServerError)
+        return
+    }
+    if err := store.Set(magicLinkPrefix+hashToken(token), email, magicLinkTTL); err != nil {
+        http.Error(w, "Error creating login link: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    link := publicURL + "/auth/magic?token=" + url.QueryEscape(token)
+    body := fmt.Sprintf("Open this link to sign in to ARCA-b Chat AI:\n\n%s\n\nThe link expires in %d minutes. If you did not request it, ignore this email.", link, int(magicLinkTTL.Minutes()))
+    if err := mailer.Send(email, "Your ARCA-b login link", body); err != nil {
+        fmt.Println("Error sending login link:", err)
+        http.Error(w, "Error sending login link", http.StatusInternalServerError)
+        return
+    }
+    writeJSON(w, map[string]string{"status": "sent"})
+}
+
+// Magic Link Callback Handler: GET only shows a confirmation form, because
+// mail scanners open links; the token is consumed by the form's POST.
+func handleMagicLinkCallback(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        token := r.URL.Query().Get("token")
+        var email string
+        found, err := store.Get(magicLinkPrefix+hashToken(token), &email)
+        if err != nil {
+            http.Error(w, "Error checking login link: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        if !found {
+            http.Error(w, "This login link is invalid or has expired", http.StatusUnauthorized)
+            return
+        }
+        renderPage(w, "magic.html", map[string]string{"Token": token, "Email": email})
+        return
+    case http.MethodPost:
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if !enforceIPRateLimit(w, r, "auth") {
+        return
+    }
+    key := magicLinkPrefix + hashToken(r.FormValue("token"))
+    var email string
+    // GetDelete consuma il link: due richieste concorrenti non possono usarlo entrambe
+    found, err := store.GetDelete(key, &email)
+    if err != nil {
+        http.Error(w, "Error checking login link: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if !found {
+        http.Error(w, "This login link is invalid or has expired", http.StatusUnauthorized)
+        return
+    }
+    user, err := findUserByEmail(email)
+    if err == nil && user == nil {
+        user, err = createUser(email, "")
+        if err == errEmailTaken {
+            // Un altro link per la stessa email ha appena creato l'account
+            user, err = findUserByEmail(email)
+        }
+    }
+    if err != nil {
+        http.Error(w, "Error loading account: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if err := startAuthSession(w, r, user); err != nil {
+        http.Error(w, "Error starting session: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Logout Handler
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if cookie, err := r.Cookie("auth_token"); err == nil {
+        store.Delete(authTokenPrefix + hashToken(cookie.Value))
+    }
+    http.SetCookie(w, newSecureCookie("auth_token", "", -time.Second))
+    w.WriteHeader(http.StatusOK)
+}
+
+// Current Account Handler
+func handleMe(w http.ResponseWriter, r *http.Request) {
+    user, err := currentUser(r)
+    if err != nil {
+        http.Error(w, "Error loading account: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if user == nil {
+        http.Error(w, "Not logged in", http.StatusUnauthorized)
+        return
+    }
+    writeJSON(w, map[string]string{"id": user.ID, "email": user.Email})
+}
+
+// Login Page Handler
+func handleLoginPage(w http.ResponseWriter, r *http.Request) {
+    renderPage(w, "login.html", nil)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+
+    "github.com/google/uuid"
+)
+
+func TestRequestOwnerSessionID(t *testing.T) {
+    store = newMemoryStore()
+    id := uuid.New().String()
+    cases := []struct {
+        cookie string
+        owner  string
+    }{
+        {id, anonymousPrefix + id},
+        {"user:" + id, ""},
+        {strings.ToUpper(id), ""},
+        {"{" + id + "}", ""},
+        {"abc:def", ""},
+        {"", ""},
+    }
+    for _, c := range cases {
+        r := httptest.NewRequest("GET", "/", nil)
+        r.AddCookie(&http.Cookie{Name: "session_id", Value: c.cookie})
+        owner, err := requestOwner(r)
+        if owner != c.owner || (c.owner == "") != (err != nil) {
+            t.Errorf("session_id %q: owner %q, %v; want %q", c.cookie, owner, err, c.owner)
+        }
+    }
+}
+
+func TestCreateUserConcurrent(t *testing.T) {
+    for name, s := range storeBackends(t) {
+        t.Run(name, func(t *testing.T) {
+            store = s
+            var wg sync.WaitGroup
+            var mu sync.Mutex
+            created := 0
+            for i := 0; i < 10; i++ {
+                wg.Add(1)
+                go func() {
+                    defer wg.Done()
+                    if _, err := createUser("same@example.com", ""); err == nil {
+                        mu.Lock()
+                        created++
+                        mu.Unlock()
+                    } else if err != errEmailTaken {
+                        t.Error(err)
+                    }
+                }()
+            }
+            wg.Wait()
+            if created != 1 {
+                t.Fatalf("%d accounts created for one email; want 1", created)
+            }
+            keys, _ := store.Keys(userPrefix)
+            if len(keys) != 1 {
+                t.Fatalf("%d account records left; want 1", len(keys))
+            }
+        })
+    }
+}
+
+func TestMagicLinkUsedOnce(t *testing.T) {
+    store = newMemoryStore()
+    token := "token"
+    store.Set(magicLinkPrefix+hashToken(token), "link@example.com", magicLinkTTL)
+
+    // Aprire il link, come fanno gli scanner della posta, non lo consuma
+    for i := 0; i < 2; i++ {
+        w := httptest.NewRecorder()
+        handleMagicLinkCallback(w, httptest.NewRequest("GET", "/auth/magic?token="+token, nil))
+        if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `name="token" value="token"`) {
+            t.Fatalf("GET %d = %d, want the confirmation form:\n%s", i, w.Code, w.Body.String())
+        }
+    }
+
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    logins := 0
+    for i := 0; i < 10; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            w := httptest.NewRecorder()
+            r := httptest.NewRequest("POST", "/auth/magic", strings.NewReader("token="+token))
+            r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+            handleMagicLinkCallback(w, r)
+            if w.Code == http.StatusSeeOther {
+                mu.Lock()
+                logins++
+                mu.Unlock()
+            }
+        }()
+    }
+    wg.Wait()
+    if logins != 1 {
+        t.Fatalf("magic link used %d times; want 1", logins)
+    }
+}
+
+func TestLoginMovesAnonymousChats(t *testing.T) {
+    store = newMemoryStore()
+    sessionID := uuid.New().String()
+    anonymous := anonymousPrefix + sessionID
+    chat, err := createChat(anonymous, "Before login")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := updateSession(chatSessionID(anonymous, chat.ID), func(session *Session) error {
+        session.Turns = append(session.Turns, ConversationTurn{Question: "What is ARCA-b?"})
+        return nil
+    }); err != nil {
+        t.Fatal(err)
+    }
+    user, err := createUser("mover@example.com", "")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    r := httptest.NewRequest("POST", "/auth/login", nil)
+    r.AddCookie(&http.Cookie{Name: "session_id", Value: sessionID})
+    if err := startAuthSession(httptest.NewRecorder(), r, user); err != nil {
+        t.Fatal(err)
+    }
+    owner := userPrefix + user.ID
+    chats, _ := listChats(owner)
+    if len(chats) != 1 || chats[0].Title != "Before login" {
+        t.Fatalf("account chats = %+v", chats)
+    }
+    session, _ := loadChatSession(owner, chat.ID)
+    if len(session.Turns) != 1 {
+        t.Fatalf("moved chat has %d turns; want 1", len(session.Turns))
+    }
+    if current, _ := currentChat(owner); current.ID != chat.ID {
+        t.Fatalf("current chat = %s; want the moved one", current.ID)
+    }
+    if left, _ := listChats(anonymous); len(left) != 0 {
+        t.Fatalf("anonymous chats left behind: %+v", left)
+    }
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// ChatSummary describes one of an owner's named chats. The transcript
+// itself lives in the chat's Session, under sessionPrefix+chatSessionID.
+type ChatSummary struct {
+    ID        string    `json:"id"`
+    Title     string    `json:"title"`
+    CreatedAt time.Time `json:"createdAt"`
+    UpdatedAt time.Time `json:"updatedAt"`
+    Turns     int       `json:"turns"`
+    Preview   string    `json:"preview"`
+}
+
+type ChatMatch struct {
+    TurnIndex int    `json:"turnIndex"`
+    Field     string `json:"field"`
+    Snippet   string `json:"snippet"`
+}
+
+type ChatSearchResult struct {
+    Chat    ChatSummary `json:"chat"`
+    Matches []ChatMatch `json:"matches"`
+}
+
+const (
+    chatPrefix        = "chat:"
+    currentChatPrefix = "chat-current:"
+    defaultChatTitle  = "New chat"
+)
+
+func chatSessionID(owner, chatID string) string {
+    return owner + ":" + chatID
+}
+
+// chatTTL keeps account chats until they are deleted; anonymous chats
+// expire with the cookie session.
+func chatTTL(owner string) time.Duration {
+    if strings.HasPrefix(owner, userPrefix) {
+        return 0
+    }
+    return sessionTTL
+}
+
+func loadChat(owner, id string) (*ChatSummary, bool, error) {
+    var chat ChatSummary
+    found, err := store.Get(chatPrefix+owner+":"+id, &chat)
+    if err != nil || !found {
+        return nil, found, err
+    }
+    return &chat, true, nil
+}
+
+func saveChat(owner string, chat *ChatSummary) error {
+    return store.Set(chatPrefix+owner+":"+chat.ID, chat, chatTTL(owner))
+}
+
+func setCurrentChat(owner, id string) error {
+    return store.Set(currentChatPrefix+owner, id, chatTTL(owner))
+}
+
+func createChat(owner, title string) (*ChatSummary, error) {
+    title = strings.TrimSpace(title)
+    if title == "" {
+        title = defaultChatTitle
+    }
+    now := time.Now().UTC()
+    chat := &ChatSummary{ID: uuid.New().String(), Title: title, CreatedAt: now, UpdatedAt: now}
+    if err := saveChat(owner, chat); err != nil {
+        return nil, err
+    }
+    if err := setCurrentChat(owner, chat.ID); err != nil {
+        return nil, err
+    }
+    return chat, nil
+}
+
+// currentChat returns the chat the owner last used, creating one if needed.
+// A session saved before chats existed becomes the owner's first chat.
+func currentChat(owner string) (*ChatSummary, error) {
+    if chat, err := loadCurrentChat(owner); err != nil || chat != nil {
+        return chat, err
+    }
+    unlock, err := sessionLocks.Lock(owner)
+    if err != nil {
+        return nil, err
+    }
+    defer unlock()
+    // Una richiesta concorrente può averla creata mentre si aspettava il lock
+    if chat, err := loadCurrentChat(owner); err != nil || chat != nil {
+        return chat, err
+    }
+    chat, err := createChat(owner, "")
+    if err != nil {
+        return nil, err
+    }
+    var legacy Session
+    if found, err := store.Get(sessionPrefix+owner, &legacy); err != nil || !found {
+        return chat, err
+    }
+    if err := store.Set(sessionPrefix+chatSessionID(owner, chat.ID), &legacy, chatTTL(owner)); err != nil {
+        return nil, err
+    }
+    chat.Turns = len(legacy.Turns)
+    if len(legacy.Turns) > 0 {
+        chat.Title = chatTitle(legacy.Turns[0].Question)
+        chat.Preview = chatTitle(legacy.Turns[len(legacy.Turns)-1].Response)
+    }
+    if err := saveChat(owner, chat); err != nil {
+        return nil, err
+    }
+    return chat, store.Delete(sessionPrefix+owner)
+}
+
+// moveChats hands an anonymous visitor's chats to the account they have
+// just signed in to, so that the history follows the person.
+func moveChats(from, to string) error {
+    keys, err := store.Keys(chatPrefix + from + ":")
+    if err != nil {
+        return err
+    }
+    for _, key := range keys {
+        var chat ChatSummary
+        found, err := store.Get(key, &chat)
+        if err != nil {
+            return err
+        }
+        if found {
+            if err := moveChat(from, to, &chat); err != nil {
+                return err
+            }
+        }
+    }
+    var current string
+    if found, err := store.Get(currentChatPrefix+from, &current); err != nil || !found {
+        return err
+    }
+    if err := setCurrentChat(to, current); err != nil {
+        return err
+    }
+    return store.Delete(currentChatPrefix + from)
+}
+
+func moveChat(from, to string, chat *ChatSummary) error {
+    unlock, err := sessionLocks.Lock(chatSessionID(from, chat.ID))
+    if err != nil {
+        return err
+    }
+    defer unlock()
+    var session Session
+    found, err := store.Get(sessionPrefix+chatSessionID(from, chat.ID), &session)
+    if err != nil {
+        return err
+    }
+    if found {
+        if err := store.Set(sessionPrefix+chatSessionID(to, chat.ID), &session, chatTTL(to)); err != nil {
+            return err
+        }
+    }
+    if err := saveChat(to, chat); err != nil {
+        return err
+    }
+    if err := store.Delete(sessionPrefix + chatSessionID(from, chat.ID)); err != nil {
+        return err
+    }
+    return store.Delete(chatPrefix + from + ":" + chat.ID)
+}
+
+// loadCurrentChat returns the owner's current chat, or nil when there is
+// none or it was deleted.
+func loadCurrentChat(owner string) (*ChatSummary, error) {
+    var id string
+    found, err := store.Get(currentChatPrefix+owner, &id)
+    if err != nil || !found {
+        return nil, err
+    }
+    chat, _, err := loadChat(owner, id)
+    return chat, err
+}
+
+// resolveChat picks the chat named in a request, or the current one.
+func resolveChat(owner, id string) (*ChatSummary, error) {
+    if id == "" {
+        return currentChat(owner)
+    }
+    chat, found, err := loadChat(owner, id)
+    if err != nil {
+        return nil, err
+    }
+    if !found {
+        return nil, errChatNotFound
+    }
+    return chat, setCurrentChat(owner, id)
+}
+
+var errChatNotFound = fmt.Errorf("chat not found")
+
+func listChats(owner string) ([]ChatSummary, error) {
+    keys, err := store.Keys(chatPrefix + owner + ":")
+    if err != nil {
+        return nil, err
+    }
+    chats := make([]ChatSummary, 0, len(keys))
+    for _, key := range keys {
+        var chat ChatSummary
+        if found, err := store.Get(key, &chat); err == nil && found {
+            chats = append(chats, chat)
+        }
+    }
+    sort.Slice(chats, func(i, j int) bool { return chats[i].UpdatedAt.After(chats[j].UpdatedAt) })
+    return chats, nil
+}
+
+func loadChatSession(owner, id string) (*Session, error) {
+    session := &Session{}
+    if _, err := store.Get(sessionPrefix+chatSessionID(owner, id), session); err != nil {
+        return nil, err
+    }
+    return session, nil
+}
+
+func deleteChat(owner, id string) error {
+    unlock, err := sessionLocks.Lock(chatSessionID(owner, id))
+    if err != nil {
+        return err
+    }
+    defer unlock()
+    if err := store.Delete(sessionPrefix + chatSessionID(owner, id)); err != nil {
+        return err
+    }
+    if err := store.Delete(chatPrefix + owner + ":" + id); err != nil {
+        return err
+    }
+    var current string
+    if found, err := store.Get(currentChatPrefix+owner, &current); err == nil && found && current == id {
+        return store.Delete(currentChatPrefix + owner)
+    }
+    return nil
+}
+
+// chatTitle turns the first question into a one-line title.
+func chatTitle(text string) string {
+    title := strings.Join(strings.Fields(text), " ")
+    if len([]rune(title)) > 60 {
+        title = string([]rune(title)[:57]) + "..."
+    }
+    if title == "" {
+        return defaultChatTitle
+    }
+    return title
+}
+
+// searchChats looks for every word of query, case-insensitively, in the
+// questions and answers of the owner's chats.
+func searchChats(owner, query string) ([]ChatSearchResult, error) {
+    words := strings.Fields(strings.ToLower(query))
+    if len(words) == 0 {
+        return []ChatSearchResult{}, nil
+    }
+    chats, err := listChats(owner)
+    if err != nil {
+        return nil, err
+    }
+    results := make([]ChatSearchResult, 0)
+    for _, chat := range chats {
+        session, err := loadChatSession(owner, chat.ID)
+        if err != nil {
+            return nil, err
+        }
+        result := ChatSearchResult{Chat: chat}
+        if containsAll(strings.ToLower(chat.Title), words) {
+            result.Matches = append(result.Matches, ChatMatch{TurnIndex: -1, Field: "title", Snippet: chat.Title})
+        }
+        for _, turn := range session.Turns {
+            for _, field := range []struct{ name, text string }{{"question", turn.Question}, {"response", turn.Response}} {
+                if containsAll(strings.ToLower(field.text), words) {
+                    result.Matches = append(result.Matches, ChatMatch{TurnIndex: turn.Index, Field: field.name, Snippet: snippet(field.text, words[0])})
+                }
+            }
+        }
+        if len(result.Matches) > 0 {
+            results = append(results, result)
+        }
+    }
+    return results, nil
+}
+
+func containsAll(text string, words []string) bool {
+    for _, word := range words {
+        if !strings.Contains(text, word) {
+            return false
+        }
+    }
+    return true
+}
+
+// snippet returns about 120 characters of text around the first match.
+func snippet(text, word string) string {
+    // ToLower cambia i byte ma non il numero di rune
+    runes := []rune(text)
+    lower := strings.ToLower(text)
+    at := len([]rune(lower[:max(0, strings.Index(lower, word))]))
+    start, end := max(0, at-50), min(len(runes), at+70)
+    out := strings.Join(strings.Fields(string(runes[start:end])), " ")
+    if start > 0 {
+        out = "..." + out
+    }
+    if end < len(runes) {
+        out += "..."
+    }
+    return out
+}
+
+// Chats Handler:
+//   GET    /chats               list the caller's chats
+//   POST   /chats               start a new chat, optionally {"title": ...}
+//   GET    /chats/search?q=...  full-text search
+//   POST   /chats/import        import from another assistant, see handleChatImport
+//   GET    /chats/{id}          open a chat and make it current
+//   PATCH  /chats/{id}          rename, {"title": ...}
+//   DELETE /chats/{id}          delete
+func handleChats(w http.ResponseWriter, r *http.Request) {
+    owner, err := requestOwner(r)
+    if err != nil {
+        http.Error(w, "Error: Session not found", http.StatusBadRequest)
+        return
+    }
+    id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/chats"), "/")
+    switch {
+    case id == "" && r.Method == http.MethodGet:
+        chats, err := listChats(owner)
+        if err != nil {
+            http.Error(w, "Error listing chats: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        var current string
+        store.Get(currentChatPrefix+owner, &current)
+        writeJSON(w, map[string]interface{}{"chats": chats, "current": current})
+    case id == "" && r.Method == http.MethodPost:
+        var req struct {
+            Title string `json:"title"`
+        }
+        json.NewDecoder(r.Body).Decode(&req)
+        chat, err := createChat(owner, req.Title)
+        if err != nil {
+            http.Error(w, "Error creating chat: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(chat)
+    case id == "import":
+        handleChatImport(w, r)
+    case id == "search" && r.Method == http.MethodGet:
+        results, err := searchChats(owner, r.URL.Query().Get("q"))
+        if err != nil {
+            http.Error(w, "Error searching chats: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        writeJSON(w, results)
+    case id != "" && !strings.Contains(id, "/"):
+        handleChat(w, r, owner, id)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func handleChat(w http.ResponseWriter, r *http.Request, owner, id string) {
+    chat, found, err := loadChat(owner, id)
+    if err != nil {
+        http.Error(w, "Error loading chat: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if !found {
+        http.Error(w, "Chat not found", http.StatusNotFound)
+        return
+    }
+    switch r.Method {
+    case http.MethodGet:
+        session, err := loadChatSession(owner, id)
+        if err != nil {
+            http.Error(w, "Error loading chat: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        if err := setCurrentChat(owner, id); err != nil {
+            http.Error(w, "Error opening chat: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        type turnView struct {
+            ConversationTurn
+            ResponseHTML string `json:"responseHtml"`
+        }
+        turns := make([]turnView, len(session.Turns))
+        for i, turn := range session.Turns {
+            turns[i] = turnView{turn, string(renderMarkdown(turn.Response))}
+        }
+        writeJSON(w, map[string]interface{}{"chat": chat, "turns": turns})
+    case http.MethodPatch:
+        var req struct {
+            Title string `json:"title"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Title) == "" {
+            http.Error(w, "Invalid request: title required", http.StatusBadRequest)
+            return
+        }
+        unlock, err := sessionLocks.Lock(chatSessionID(owner, id))
+        if err == nil {
+            chat, found, err = loadChat(owner, id)
+            if err == nil && !found {
+                err = errChatNotFound
+            }
+            if err == nil {
+                chat.Title = chatTitle(req.Title)
+                err = saveChat(owner, chat)
+            }
+            unlock()
+        }
+        if err != nil {
+            http.Error(w, "Error renaming chat: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        writeJSON(w, chat)
+    case http.MethodDelete:
+        if err := deleteChat(owner, id); err != nil {
+            http.Error(w, "Error deleting chat: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        writeJSON(w, map[string]interface{}{"deleted": true})
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+
+    "github.com/google/uuid"
+)
+
+func TestCurrentChatConcurrent(t *testing.T) {
+    for name, s := range storeBackends(t) {
+        t.Run(name, func(t *testing.T) {
+            store = s
+            owner := anonymousPrefix + uuid.New().String()
+            var wg sync.WaitGroup
+            ids := make([]string, 10)
+            for i := range ids {
+                wg.Add(1)
+                go func(i int) {
+                    defer wg.Done()
+                    chat, err := currentChat(owner)
+                    if err != nil {
+                        t.Error(err)
+                        return
+                    }
+                    ids[i] = chat.ID
+                }(i)
+            }
+            wg.Wait()
+            for _, id := range ids {
+                if id != ids[0] {
+                    t.Fatalf("concurrent first requests got different chats: %v", ids)
+                }
+            }
+            if chats, _ := listChats(owner); len(chats) != 1 {
+                t.Fatalf("%d chats created; want 1", len(chats))
+            }
+        })
+    }
+}
+
+func addTurns(t *testing.T, owner, chatID string, turns ...ConversationTurn) {
+    if _, err := updateSession(chatSessionID(owner, chatID), func(session *Session) error {
+        for _, turn := range turns {
+            turn.Index = len(session.Turns)
+            session.Turns = append(session.Turns, turn)
+        }
+        return nil
+    }); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestSearchChats(t *testing.T) {
+    store = newMemoryStore()
+    owner := "user:searcher"
+    ecb, _ := createChat(owner, "Central banks")
+    addTurns(t, owner, ecb.ID,
+        ConversationTurn{Question: "What did the ECB decide?", Response: "The European Central Bank kept rates steady."},
+        ConversationTurn{Question: "And the Fed?", Response: "The Federal Reserve cut rates."})
+    garden, _ := createChat(owner, "Garden")
+    addTurns(t, owner, garden.ID, ConversationTurn{Question: "When to plant tomatoes?", Response: "In spring, after the last frost."})
+    other, _ := createChat("user:other", "Not mine")
+    addTurns(t, "user:other", other.ID, ConversationTurn{Question: "ECB rates?", Response: "Steady."})
+
+    tests := []struct {
+        query string
+        want  []string // chat:field:turn
+    }{
+        {"ecb", []string{"Central banks:question:0"}},
+        {"RATES", []string{"Central banks:response:0", "Central banks:response:1"}},
+        {"rates steady", []string{"Central banks:response:0"}},
+        {"central", []string{"Central banks:title:-1", "Central banks:response:0"}},
+        {"tomatoes frost", nil},
+        {"frost", []string{"Garden:response:0"}},
+        {"   ", nil},
+    }
+    for _, tt := range tests {
+        results, err := searchChats(owner, tt.query)
+        if err != nil {
+            t.Fatal(err)
+        }
+        var got []string
+        for _, result := range results {
+            for _, match := range result.Matches {
+                got = append(got, strings.Join([]string{result.Chat.Title, match.Field, strconv.Itoa(match.TurnIndex)}, ":"))
+            }
+        }
+        if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+            t.Errorf("searchChats(%q) = %v; want %v", tt.query, got, tt.want)
+        }
+    }
+}
+
+func TestSnippet(t *testing.T) {
+    long := strings.Repeat("alpha ", 30) + "Città centrale " + strings.Repeat("omega ", 30)
+    tests := []struct {
+        text, word, want string
+    }{
+        {"Short text about the ECB.", "ecb", "Short text about the ECB."},
+        {long, "città", "...a alpha alpha alpha alpha alpha alpha alpha alpha Città centrale omega omega omega omega omega omega omega omega omega o..."},
+        {"Start with the match and then\n\nsome   spaced   words", "start", "Start with the match and then some spaced words"},
+        {"No match here", "missing", "No match here"},
+    }
+    for _, tt := range tests {
+        if got := snippet(tt.text, tt.word); got != tt.want {
+            t.Errorf("snippet(%q) =\n %q\nwant\n %q", tt.word, got, tt.want)
+        }
+    }
+}
+
+func TestRenameAndDeleteChat(t *testing.T) {
+    store = newMemoryStore()
+    sessionID := uuid.New().String()
+    owner := anonymousPrefix + sessionID
+    chat, _ := createChat(owner, "Old title")
+    addTurns(t, owner, chat.ID, ConversationTurn{Question: "Hello"})
+    request := func(method, path, body string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest(method, path, strings.NewReader(body))
+        r.AddCookie(&http.Cookie{Name: "session_id", Value: sessionID})
+        w := httptest.NewRecorder()
+        handleChats(w, r)
+        return w
+    }
+
+    if w := request("PATCH", "/chats/"+chat.ID, `{"title": "  "}`); w.Code != http.StatusBadRequest {
+        t.Fatalf("empty rename = %d; want 400", w.Code)
+    }
+    if w := request("PATCH", "/chats/"+chat.ID, `{"title": "New   title"}`); w.Code != http.StatusOK {
+        t.Fatalf("rename = %d: %s", w.Code, w.Body.String())
+    }
+    if renamed, _, _ := loadChat(owner, chat.ID); renamed.Title != "New title" {
+        t.Fatalf("title after rename = %q", renamed.Title)
+    }
+    if w := request("PATCH", "/chats/missing", `{"title": "x"}`); w.Code != http.StatusNotFound {
+        t.Fatalf("rename of a missing chat = %d; want 404", w.Code)
+    }
+
+    if w := request("DELETE", "/chats/"+chat.ID, ""); w.Code != http.StatusOK {
+        t.Fatalf("delete = %d: %s", w.Code, w.Body.String())
+    }
+    if _, found, _ := loadChat(owner, chat.ID); found {
+        t.Fatal("chat still there after delete")
+    }
+    if session, _ := loadChatSession(owner, chat.ID); len(session.Turns) != 0 {
+        t.Fatal("transcript still there after delete")
+    }
+    if w := request("GET", "/chats/"+chat.ID, ""); w.Code != http.StatusNotFound {
+        t.Fatalf("open after delete = %d; want 404", w.Code)
+    }
+    // La chat corrente cancellata viene sostituita da una nuova
+    if current, _ := currentChat(owner); current.ID == chat.ID {
+        t.Fatal("deleted chat is still the current one")
+    }
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "net/http"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// TokenUsage is the token count reported by a provider for one call.
+type TokenUsage struct {
+    InputTokens  int `json:"inputTokens"`
+    OutputTokens int `json:"outputTokens"`
+}
+
+// estimateTokens approximates the token count of text for providers that do
+// not report usage, using the common four-characters-per-token rule.
+func estimateTokens(text string) int {
+    return (len(text) + 3) / 4
+}
+
+// providerPrice is the list price in USD per million tokens.
+type providerPrice struct {
+    InputPerMillion  float64 `json:"inputPerMillion"`
+    OutputPerMillion float64 `json:"outputPerMillion"`
+}
+
+// providerPrices can be overridden with a JSON object in PROVIDER_PRICES,
+// for example {"OpenAI": {"inputPerMillion": 0.5, "outputPerMillion": 1.5}}.
+var providerPrices = map[string]providerPrice{
+    "OpenAI":       {InputPerMillion: 0.50, OutputPerMillion: 1.50},
+    "DeepSeek":     {InputPerMillion: 0.27, OutputPerMillion: 1.10},
+    "Gemini":       {InputPerMillion: 0.075, OutputPerMillion: 0.30},
+    "Mistral":      {InputPerMillion: 0.20, OutputPerMillion: 0.60},
+    "Cohere":       {InputPerMillion: 1.00, OutputPerMillion: 2.00},
+    "Cohere Embed": {InputPerMillion: 0.10},
+    "NewsAPI":      {},
+    // Gli endpoint audio non contano token: Whisper in secondi di audio
+    // ($0.006 al minuto), TTS in caratteri
+    "OpenAI Whisper": {InputPerMillion: 100},
+    "OpenAI TTS":     {InputPerMillion: 15.00},
+    "OpenAI Vision":  {InputPerMillion: 2.50, OutputPerMillion: 10.00},
+}
+
+// costOf returns the cost of a call in micro-dollars, so that spend can be
+// kept in the store's integer counters.
+func costOf(provider string, usage TokenUsage) int64 {
+    price := providerPrices[provider]
+    usd := (float64(usage.InputTokens)*price.InputPerMillion + float64(usage.OutputTokens)*price.OutputPerMillion) / 1e6
+    return int64(math.Ceil(usd * 1e6))
+}
+
+func formatUSD(micros int64) string {
+    return fmt.Sprintf("$%.4f", float64(micros)/1e6)
+}
+
+// spendBudget limits spend in micro-dollars over a day and a month.
+type spendBudget struct {
+    Daily   int64
+    Monthly int64
+}
+
+// Budgets are configured in USD with BUDGET_<SCOPE>_DAILY and
+// BUDGET_<SCOPE>_MONTHLY, where SCOPE is ANONYMOUS, ACCOUNT, PREMIUM or
+// GLOBAL. A zero limit disables that budget.
+var spendBudgets = map[string]*spendBudget{
+    "anonymous": {Daily: 50000, Monthly: 500000},
+    "account":   {Daily: 100000, Monthly: 1000000},
+    "premium":   {Daily: 1000000, Monthly: 10000000},
+    "global":    {Daily: 20000000, Monthly: 300000000},
+}
+
+const spendPrefix = "spend:"
+
+// Service levels, from the full fan-out down to a single cheap provider.
+const (
+    serviceFull    = "full"
+    serviceEconomy = "economy"
+    serviceMinimal = "minimal"
+    serviceNone    = "exhausted"
+)
+
+func loadCostConfig() {
+    if prices := os.Getenv("PROVIDER_PRICES"); prices != "" {
+        overrides := make(map[string]providerPrice)
+        if err := json.Unmarshal([]byte(prices), &overrides); err != nil {
+            fmt.Printf("Error: invalid PROVIDER_PRICES: %v\n", err)
+        }
+        for name, price := range overrides {
+            providerPrices[name] = price
+        }
+    }
+    for scope, budget := range spendBudgets {
+        for period, limit := range map[string]*int64{"DAILY": &budget.Daily, "MONTHLY": &budget.Monthly} {
+            name := fmt.Sprintf("BUDGET_%s_%s", strings.ToUpper(scope), period)
+            value := os.Getenv(name)
+            if value == "" {
+                continue
+            }
+            usd, err := strconv.ParseFloat(value, 64)
+            if err != nil || usd < 0 {
+                fmt.Printf("Error: invalid %s %q\n", name, value)
+                continue
+            }
+            *limit = int64(usd * 1e6)
+        }
+    }
+}
+
+// checkBudget reports whether owner has budget left for a paid call outside
+// /chat, and writes the same budget_exhausted reply as /chat when not.
+func checkBudget(w http.ResponseWriter, owner, tier string) bool {
+    remaining, err := budgetRemaining(owner, tier)
+    if err != nil {
+        http.Error(w, "Error checking budget: "+err.Error(), http.StatusInternalServerError)
+        return false
+    }
+    if remaining <= 0 {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusTooManyRequests)
+        json.NewEncoder(w).Encode(map[string]interface{}{"error": "budget_exhausted", "tier": tier})
+        return false
+    }
+    return true
+}
+
+// chargeCall prices a paid call made outside /chat, records it in the
+// owner's ledger under the given kind and charges it to the owner.
+func chargeCall(owner, tier, kind, provider string, usage TokenUsage, started time.Time, failed bool) {
+    call := ProviderUsage{Name: provider, TokenUsage: usage, CostMicros: costOf(provider, usage), LatencyMs: time.Since(started).Milliseconds(), Failed: failed}
+    recordLedgerEntry(&LedgerEntry{Owner: owner, Tier: tier, Time: started, ServiceLevel: kind, Providers: []ProviderUsage{call}, LatencyMs: call.LatencyMs})
+    chargeSpend(owner, call.CostMicros)
+}
+
+func spendKeys(scope string, now time.Time) (string, string) {
+    now = now.UTC()
+    return fmt.Sprintf("%s%s:day:%s", spendPrefix, scope, now.Format("2006-01-02")),
+        fmt.Sprintf("%s%s:month:%s", spendPrefix, scope, now.Format("2006-01"))
+}
+
+// budgetRemaining returns the smallest fraction left across the owner's
+// budgets and the global one.
+func budgetRemaining(owner, tier string) (float64, error) {
+    now := time.Now()
+    remaining := 1.0
+    scopes := []struct {
+        key    string
+        budget *spendBudget
+    }{
+        {"owner:" + owner, spendBudgets[tier]},
+        {"global", spendBudgets["global"]},
+    }
+    for _, scope := range scopes {
+        dayKey, monthKey := spendKeys(scope.key, now)
+        for _, check := range []struct {
+            key   string
+            limit int64
+            ttl   time.Duration
+        }{
+            {dayKey, scope.budget.Daily, 48 * time.Hour},
+            {monthKey, scope.budget.Monthly, 62 * 24 * time.Hour},
+        } {
+            if check.limit <= 0 {
+                continue
+            }
+            spent, err := store.IncrBy(check.key, 0, check.ttl)
+            if err != nil {
+                return 0, err
+            }
+            remaining = math.Min(remaining, 1-float64(spent)/float64(check.limit))
+        }
+    }
+    return remaining, nil
+}
+
+// serviceLevel degrades to cheaper providers as the budget runs low.
+func serviceLevel(remaining float64) string {
+    switch {
+    case remaining <= 0:
+        return serviceNone
+    case remaining <= 0.05:
+        return serviceMinimal
+    case remaining <= 0.25:
+        return serviceEconomy
+    }
+    return serviceFull
+}
+
+// selectProviders returns the providers to call at the given service level,
+// cheapest first by the cost of a typical 500-in/500-out call.
+func selectProviders(level string, candidates []string) map[string]bool {
+    sorted := append([]string(nil), candidates...)
+    typical := TokenUsage{InputTokens: 500, OutputTokens: 500}
+    sort.SliceStable(sorted, func(i, j int) bool {
+        return costOf(sorted[i], typical) < costOf(sorted[j], typical)
+    })
+    n := len(sorted)
+    switch level {
+    case serviceEconomy:
+        n = (len(sorted) + 1) / 2
+    case serviceMinimal:
+        n = 1
+    case serviceNone:
+        n = 0
+    }
+    selected := make(map[string]bool)
+    for _, name := range sorted[:n] {
+        selected[name] = true
+    }
+    return selected
+}
+
+// chargeSpend adds the cost of a chat turn to the owner's and the global
+// counters.
+func chargeSpend(owner string, micros int64) {
+    if micros <= 0 {
+        return
+    }
+    now := time.Now()
+    for _, scope := range []string{"owner:" + owner, "global"} {
+        dayKey, monthKey := spendKeys(scope, now)
+        if _, err := store.IncrBy(dayKey, micros, 48*time.Hour); err != nil {
+            fmt.Printf("Error recording spend for %s: %v\n", scope, err)
+        }
+        if _, err := store.IncrBy(monthKey, micros, 62*24*time.Hour); err != nil {
+            fmt.Printf("Error recording spend for %s: %v\n", scope, err)
+        }
+    }
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func TestChargeCallAndBudget(t *testing.T) {
+    store = newMemoryStore()
+    owner := "anon:caller"
+    // Un minuto di Whisper costa $0.006
+    chargeCall(owner, "anonymous", "speech-to-text", "OpenAI Whisper", TokenUsage{InputTokens: 60}, time.Now(), false)
+    entries, err := loadLedger(ledgerPrefix+owner+":", time.Now().Add(-time.Hour))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(entries) != 1 || entries[0].CostMicros != 6000 || entries[0].ServiceLevel != "speech-to-text" {
+        t.Fatalf("ledger = %+v", entries)
+    }
+    if !checkBudget(httptest.NewRecorder(), owner, "anonymous") {
+        t.Fatal("budget refused after a small call")
+    }
+
+    // Una chiamata fallita non si paga
+    chargeCall(owner, "anonymous", "text-to-speech", "OpenAI TTS", TokenUsage{}, time.Now(), true)
+    // 20000 token di Vision esauriscono il budget giornaliero anonimo di $0.05
+    chargeCall(owner, "anonymous", "ocr", "OpenAI Vision", TokenUsage{InputTokens: 20000}, time.Now(), false)
+    w := httptest.NewRecorder()
+    if checkBudget(w, owner, "anonymous") {
+        t.Fatal("budget allowed a call after it was used up")
+    }
+    if w.Code != http.StatusTooManyRequests {
+        t.Fatalf("budget reply = %d; want 429", w.Code)
+    }
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+    "strings"
+    "unicode"
+)
+
+// Disagreement is a point on which the providers contradict each other,
+// with what each of them said about it.
+type Disagreement struct {
+    Topic     string          `json:"topic"`
+    Positions []ClaimPosition `json:"positions"`
+}
+
+const maxTopicWords = 6
+
+// disagreements turns the contested claims of a fact-check table into
+// points of divergence, one per claim.
+func disagreements(claims []Claim) []Disagreement {
+    var points []Disagreement
+    for _, claim := range claims {
+        if len(claim.ContestedBy) == 0 {
+            continue
+        }
+        point := Disagreement{Topic: disagreementTopic(claim)}
+        for _, provider := range claim.StatedBy {
+            point.Positions = append(point.Positions, ClaimPosition{Provider: provider, Text: claim.Text})
+        }
+        point.Positions = append(point.Positions, claim.ContestedBy...)
+        points = append(points, point)
+    }
+    return points
+}
+
+// disagreementTopic names what the statements are about: the words of the
+// claim that every opposing statement also uses, in the claim's order.
+func disagreementTopic(claim Claim) string {
+    shared := make(map[string]bool)
+    for _, term := range queryTerms(claim.Text) {
+        shared[term] = true
+    }
+    for _, position := range claim.ContestedBy {
+        other := make(map[string]bool)
+        for _, term := range queryTerms(position.Text) {
+            other[term] = true
+        }
+        for term := range shared {
+            if !other[term] {
+                delete(shared, term)
+            }
+        }
+    }
+    var words []string
+    for _, word := range strings.FieldsFunc(claim.Text, func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+    }) {
+        lower := strings.ToLower(word)
+        if shared[lower] {
+            words = append(words, word)
+            delete(shared, lower)
+        }
+        if len(words) == maxTopicWords {
+            break
+        }
+    }
+    if len(words) == 0 {
+        return chatTitle(claim.Text)
+    }
+    return strings.Join(words, " ")
+}
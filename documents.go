@@ -0,0 +1,519 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// IndexedDocument is a file added to the local document index. Documents
+// uploaded by a user are searched only in that user's chats; documents
+// found by a directory scan have no owner and are searched for everyone.
+type IndexedDocument struct {
+    ID      string    `json:"id"`
+    Owner   string    `json:"owner,omitempty"`
+    Name    string    `json:"name"`
+    Path    string    `json:"path,omitempty"`
+    Size    int64     `json:"size"`
+    ModTime time.Time `json:"modTime,omitempty"`
+    AddedAt time.Time `json:"addedAt"`
+    Chunks  int       `json:"chunks"`
+}
+
+// DocumentChunk is a passage of a document with its embedding.
+type DocumentChunk struct {
+    DocID  string    `json:"docId"`
+    Owner  string    `json:"owner,omitempty"`
+    Index  int       `json:"index"`
+    Text   string    `json:"text"`
+    Vector []float64 `json:"vector"`
+}
+
+// ChunkMatch is a chunk returned by a search, with its similarity.
+type ChunkMatch struct {
+    DocumentChunk
+    Name  string  `json:"name"`
+    Score float64 `json:"score"`
+}
+
+// documentIndex is the vector index, kept in memory and saved as JSON to
+// RAG_INDEX (default arca-index.json). Every change reloads the file under
+// a lock file before saving it, and reads pick up a file saved by someone
+// else, so the server and the CLI's index scan can share it.
+type documentIndex struct {
+    mu        sync.RWMutex
+    path      string
+    modTime   time.Time
+    size      int64
+    Documents map[string]*IndexedDocument `json:"documents"`
+    Chunks    []DocumentChunk             `json:"chunks"`
+}
+
+type embedFunc func(text string) ([]float64, error)
+
+const (
+    chunkSize         = 1200
+    chunkOverlap      = 200
+    maxOwnerChunks    = 2000
+    defaultTopK       = 4
+    minChunkScore     = 0.3
+    maxDocumentsBytes = 10 << 20
+    // Il file di lock più vecchio di così è di un processo terminato
+    indexLockTimeout = 10 * time.Second
+    indexLockStale   = 30 * time.Second
+)
+
+var documents *documentIndex
+
+// documentTopK is the number of passages attached to each chat prompt.
+// RAG_TOP_K overrides it; 0 turns document retrieval off.
+var documentTopK = defaultTopK
+
+func loadDocumentIndex() error {
+    if k := os.Getenv("RAG_TOP_K"); k != "" {
+        n, err := strconv.Atoi(k)
+        if err != nil || n < 0 {
+            return fmt.Errorf("invalid RAG_TOP_K %q", k)
+        }
+        documentTopK = n
+    }
+    path := os.Getenv("RAG_INDEX")
+    if path == "" {
+        path = "arca-index.json"
+    }
+    index := &documentIndex{path: path, Documents: make(map[string]*IndexedDocument)}
+    if err := index.reloadLocked(true); err != nil {
+        return err
+    }
+    documents = index
+    return nil
+}
+
+// reloadLocked reads the index file again, unless force is false and the
+// file is the one last read or written. The caller holds x.mu.
+func (x *documentIndex) reloadLocked(force bool) error {
+    info, err := os.Stat(x.path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("error reading %s: %v", x.path, err)
+    }
+    if !force && info.ModTime().Equal(x.modTime) && info.Size() == x.size {
+        return nil
+    }
+    data, err := os.ReadFile(x.path)
+    if err != nil {
+        return fmt.Errorf("error reading %s: %v", x.path, err)
+    }
+    var disk documentIndex
+    if err := json.Unmarshal(data, &disk); err != nil {
+        return fmt.Errorf("error parsing %s: %v", x.path, err)
+    }
+    if disk.Documents == nil {
+        disk.Documents = make(map[string]*IndexedDocument)
+    }
+    x.Documents, x.Chunks = disk.Documents, disk.Chunks
+    x.modTime, x.size = info.ModTime(), info.Size()
+    return nil
+}
+
+// refresh reloads the index when another process, such as the CLI's index
+// scan, has saved it since it was last read.
+func (x *documentIndex) refresh() {
+    info, err := os.Stat(x.path)
+    if err != nil {
+        return
+    }
+    x.mu.RLock()
+    current := info.ModTime().Equal(x.modTime) && info.Size() == x.size
+    x.mu.RUnlock()
+    if current {
+        return
+    }
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    if err := x.reloadLocked(false); err != nil {
+        fmt.Printf("Error reloading the document index: %v\n", err)
+    }
+}
+
+// lockFile takes an exclusive lock by creating path, waiting for another
+// process to remove it. A lock older than indexLockStale was left by a
+// process that died and is taken over.
+func lockFile(path string) (func(), error) {
+    deadline := time.Now().Add(indexLockTimeout)
+    for {
+        f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+        if err == nil {
+            f.Close()
+            return func() { os.Remove(path) }, nil
+        }
+        if !os.IsExist(err) {
+            return nil, fmt.Errorf("error locking %s: %v", path, err)
+        }
+        if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > indexLockStale {
+            os.Remove(path)
+            continue
+        }
+        if time.Now().After(deadline) {
+            return nil, fmt.Errorf("%s is locked by another process", path)
+        }
+        time.Sleep(20 * time.Millisecond)
+    }
+}
+
+// update applies change to the index as it is on disk and saves it, under
+// the lock file, so that concurrent writers never drop each other's
+// documents. change reports whether there is anything to save.
+func (x *documentIndex) update(change func() bool) error {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    if dir := filepath.Dir(x.path); dir != "." {
+        if err := os.MkdirAll(dir, 0o755); err != nil {
+            return err
+        }
+    }
+    unlock, err := lockFile(x.path + ".lock")
+    if err != nil {
+        return err
+    }
+    defer unlock()
+    if err := x.reloadLocked(true); err != nil {
+        return err
+    }
+    if !change() {
+        return nil
+    }
+    return x.save()
+}
+
+// save writes the index to a temporary file and renames it, so a crash
+// never leaves a truncated index. The caller holds x.mu and the lock file.
+func (x *documentIndex) save() error {
+    data, err := json.Marshal(x)
+    if err != nil {
+        return err
+    }
+    tmp := x.path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0o600); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, x.path); err != nil {
+        return err
+    }
+    if info, err := os.Stat(x.path); err == nil {
+        x.modTime, x.size = info.ModTime(), info.Size()
+    }
+    return nil
+}
+
+// chunkText splits text into passages of about chunkSize characters,
+// breaking at paragraph or sentence ends where possible, with chunkOverlap
+// characters repeated between consecutive passages.
+func chunkText(text string) []string {
+    runes := []rune(strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n")))
+    var chunks []string
+    for start := 0; start < len(runes); {
+        end := min(len(runes), start+chunkSize)
+        if end < len(runes) {
+            // Cerca la fine di un paragrafo o di una frase nell'ultimo terzo del blocco
+            for cut := end; cut > start+chunkSize*2/3; cut-- {
+                if runes[cut-1] == '\n' || (runes[cut-1] == ' ' && strings.ContainsRune(".!?", runes[cut-2])) {
+                    end = cut
+                    break
+                }
+            }
+        }
+        if chunk := strings.Join(strings.Fields(string(runes[start:end])), " "); chunk != "" {
+            chunks = append(chunks, chunk)
+        }
+        if end == len(runes) {
+            break
+        }
+        start = max(end-chunkOverlap, start+1)
+    }
+    return chunks
+}
+
+// Add embeds and stores a document, replacing an earlier one with the same
+// owner and name.
+func (x *documentIndex) Add(owner, name, path, text string, size int64, modTime time.Time, embed embedFunc) (*IndexedDocument, error) {
+    chunks := chunkText(text)
+    if len(chunks) == 0 {
+        return nil, fmt.Errorf("%s has no text", name)
+    }
+    // Un primo controllo evita di pagare gli embedding di un documento che
+    // non entrerebbe; quello che conta si ripete sotto il lock
+    if owner != "" {
+        x.refresh()
+        x.mu.RLock()
+        used := x.ownerChunksLocked(owner, name)
+        x.mu.RUnlock()
+        if used+len(chunks) > maxOwnerChunks {
+            return nil, errDocumentLimit
+        }
+    }
+    doc := &IndexedDocument{ID: uuid.New().String(), Owner: owner, Name: name, Path: path, Size: size, ModTime: modTime, AddedAt: time.Now().UTC(), Chunks: len(chunks)}
+    embedded := make([]DocumentChunk, 0, len(chunks))
+    for i, chunk := range chunks {
+        vector, err := embed(chunk)
+        if err != nil {
+            return nil, fmt.Errorf("error embedding %s: %v", name, err)
+        }
+        embedded = append(embedded, DocumentChunk{DocID: doc.ID, Owner: owner, Index: i, Text: chunk, Vector: vector})
+    }
+
+    var limitErr error
+    err := x.update(func() bool {
+        if owner != "" && x.ownerChunksLocked(owner, name)+len(chunks) > maxOwnerChunks {
+            limitErr = errDocumentLimit
+            return false
+        }
+        for id, existing := range x.Documents {
+            if existing.Owner == owner && existing.Name == name {
+                x.removeLocked(id)
+            }
+        }
+        x.Documents[doc.ID] = doc
+        x.Chunks = append(x.Chunks, embedded...)
+        return true
+    })
+    if err == nil {
+        err = limitErr
+    }
+    if err != nil {
+        return nil, err
+    }
+    return doc, nil
+}
+
+var errDocumentLimit = fmt.Errorf("document limit reached: at most %d passages per user", maxOwnerChunks)
+
+// ownerChunksLocked counts the owner's passages, leaving out those of the
+// document called name, which a new upload would replace.
+func (x *documentIndex) ownerChunksLocked(owner, name string) int {
+    used := 0
+    for _, chunk := range x.Chunks {
+        if doc := x.Documents[chunk.DocID]; chunk.Owner == owner && doc != nil && doc.Name != name {
+            used++
+        }
+    }
+    return used
+}
+
+func (x *documentIndex) removeLocked(id string) {
+    delete(x.Documents, id)
+    kept := x.Chunks[:0]
+    for _, chunk := range x.Chunks {
+        if chunk.DocID != id {
+            kept = append(kept, chunk)
+        }
+    }
+    x.Chunks = kept
+}
+
+func (x *documentIndex) Remove(owner, id string) (bool, error) {
+    removed := false
+    err := x.update(func() bool {
+        doc, ok := x.Documents[id]
+        if !ok || doc.Owner != owner {
+            return false
+        }
+        x.removeLocked(id)
+        removed = true
+        return true
+    })
+    return removed, err
+}
+
+// List returns the documents visible to owner: the owner's own and the
+// shared ones.
+func (x *documentIndex) List(owner string) []IndexedDocument {
+    x.refresh()
+    x.mu.RLock()
+    defer x.mu.RUnlock()
+    list := make([]IndexedDocument, 0)
+    for _, doc := range x.Documents {
+        if doc.Owner == "" || doc.Owner == owner {
+            list = append(list, *doc)
+        }
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+    return list
+}
+
+// Search returns the k chunks visible to owner that are most similar to the
+// query, skipping those below minChunkScore. embed must embed the query as
+// a search query, not as a passage.
+func (x *documentIndex) Search(owner, query string, k int, embed embedFunc) ([]ChunkMatch, error) {
+    x.refresh()
+    x.mu.RLock()
+    empty := true
+    for _, chunk := range x.Chunks {
+        if chunk.Owner == "" || chunk.Owner == owner {
+            empty = false
+            break
+        }
+    }
+    x.mu.RUnlock()
+    if empty {
+        return nil, nil
+    }
+    vector, err := embed(query)
+    if err != nil {
+        return nil, err
+    }
+    x.mu.RLock()
+    defer x.mu.RUnlock()
+    var matches []ChunkMatch
+    for _, chunk := range x.Chunks {
+        if chunk.Owner != "" && chunk.Owner != owner {
+            continue
+        }
+        if score := cosineSimilarity(vector, chunk.Vector); score >= minChunkScore {
+            matches = append(matches, ChunkMatch{DocumentChunk: chunk, Name: x.Documents[chunk.DocID].Name, Score: score})
+        }
+    }
+    sort.Slice(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+    if len(matches) > k {
+        matches = matches[:k]
+    }
+    return matches, nil
+}
+
+// Scan adds the text files under dir as shared documents, skipping those
+// already indexed with the same size and modification time.
+func (x *documentIndex) Scan(dir string, embed embedFunc) (int, error) {
+    x.refresh()
+    added := 0
+    err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+        if err != nil || entry.IsDir() {
+            return err
+        }
+        switch strings.ToLower(filepath.Ext(path)) {
+        case ".txt", ".md", ".html", ".htm":
+        default:
+            return nil
+        }
+        info, err := entry.Info()
+        if err != nil || info.Size() > maxDocumentsBytes {
+            return nil
+        }
+        rel, _ := filepath.Rel(dir, path)
+        rel = filepath.ToSlash(rel)
+        x.mu.RLock()
+        unchanged := false
+        for _, doc := range x.Documents {
+            if doc.Owner == "" && doc.Path == rel && doc.ModTime.Equal(info.ModTime().UTC()) && doc.Size == info.Size() {
+                unchanged = true
+            }
+        }
+        x.mu.RUnlock()
+        if unchanged {
+            return nil
+        }
+        data, err := os.ReadFile(path)
+        if err != nil {
+            fmt.Printf("Error reading %s: %v\n", path, err)
+            return nil
+        }
+        text := string(data)
+        if ext := strings.ToLower(filepath.Ext(path)); ext == ".html" || ext == ".htm" {
+            text = plainText(text)
+        }
+        if _, err := x.Add("", rel, rel, text, info.Size(), info.ModTime().UTC(), embed); err != nil {
+            fmt.Printf("Error indexing %s: %v\n", path, err)
+            return nil
+        }
+        added++
+        return nil
+    })
+    return added, err
+}
+
+// chunkArticles turns matches into sources for the providers' prompts, so
+// they are numbered and cited like the news.
+func chunkArticles(matches []ChunkMatch) []Article {
+    articles := make([]Article, 0, len(matches))
+    for _, match := range matches {
+        articles = append(articles, Article{
+            ID:          fmt.Sprintf("%s-%d", match.DocID[:8], match.Index),
+            Title:       fmt.Sprintf("%s (passage %d)", match.Name, match.Index+1),
+            Description: match.Text,
+            Source:      "document:" + match.Name,
+            Retriever:   "Documents",
+            Score:       match.Score,
+        })
+    }
+    return articles
+}
+
+// meteredEmbedder embeds with Cohere for ingestion outside /chat. finish
+// records the calls in owner's ledger and returns their cost, which the
+// caller charges when the owner is a user.
+func meteredEmbedder(owner, tier, cohereKey string, client *http.Client) (embedFunc, func() int64) {
+    entry := &LedgerEntry{Owner: owner, Tier: tier, Time: time.Now(), ServiceLevel: "ingest"}
+    usage := ProviderUsage{Name: "Cohere Embed"}
+    embed := func(text string) ([]float64, error) {
+        started := time.Now()
+        vector, u, err := getCohereEmbedding(cohereKey, client, text, cohereSearchDocument)
+        if err == nil && u.InputTokens == 0 {
+            u.InputTokens = estimateTokens(text)
+        }
+        usage.InputTokens += u.InputTokens
+        usage.CostMicros += costOf("Cohere Embed", u)
+        usage.LatencyMs += time.Since(started).Milliseconds()
+        usage.Failed = usage.Failed || err != nil
+        return vector, err
+    }
+    finish := func() int64 {
+        if usage.InputTokens == 0 && !usage.Failed {
+            return 0
+        }
+        entry.Providers = []ProviderUsage{usage}
+        entry.LatencyMs = time.Since(entry.Time).Milliseconds()
+        recordLedgerEntry(entry)
+        return usage.CostMicros
+    }
+    return embed, finish
+}
+
+// Documents Handler:
+//   GET    /documents       the caller's documents and the shared ones
+//   DELETE /documents/{id}  remove one of the caller's documents
+// Documents are added with POST /upload-file and index=true.
+func handleDocuments(w http.ResponseWriter, r *http.Request) {
+    owner, err := requestOwner(r)
+    if err != nil {
+        http.Error(w, "Error: Session not found", http.StatusBadRequest)
+        return
+    }
+    id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/documents"), "/")
+    switch {
+    case r.Method == http.MethodGet && id == "":
+        writeJSON(w, map[string]interface{}{"documents": documents.List(owner)})
+    case r.Method == http.MethodDelete && id != "":
+        found, err := documents.Remove(owner, id)
+        if err != nil {
+            http.Error(w, "Error deleting document: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        if !found {
+            http.Error(w, "Document not found", http.StatusNotFound)
+            return
+        }
+        writeJSON(w, map[string]interface{}{"deleted": true})
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// roundTripFunc lets a test answer HTTP requests in place of a remote API.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+    return f(r)
+}
+
+func TestCohereEmbeddingInputType(t *testing.T) {
+    var inputTypes []string
+    client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+        var payload struct {
+            InputType string `json:"input_type"`
+        }
+        json.NewDecoder(r.Body).Decode(&payload)
+        inputTypes = append(inputTypes, payload.InputType)
+        body := `{"embeddings":[[0.1,0.2]],"meta":{"billed_units":{"input_tokens":3}}}`
+        return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+    })}
+    for _, inputType := range []string{cohereSearchDocument, cohereSearchQuery} {
+        if _, _, err := getCohereEmbedding("key", client, "ECB rates", inputType); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if got := strings.Join(inputTypes, ","); got != "search_document,search_query" {
+        t.Fatalf("input types sent = %s", got)
+    }
+}
+
+func fakeEmbed(text string) ([]float64, error) {
+    return []float64{float64(len(text)), 1}, nil
+}
+
+func documentNames(x *documentIndex, owner string) string {
+    var names []string
+    for _, doc := range x.List(owner) {
+        names = append(names, doc.Name)
+    }
+    sort.Strings(names)
+    return strings.Join(names, ",")
+}
+
+// Il server e la scansione da CLI tengono ognuno la propria copia dell'indice
+func TestDocumentIndexSharedFile(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "index", "arca-index.json")
+    server := &documentIndex{path: path, Documents: make(map[string]*IndexedDocument)}
+    cli := &documentIndex{path: path, Documents: make(map[string]*IndexedDocument)}
+
+    if _, err := server.Add("user", "notes.txt", "", "Notes about the ECB.", 20, time.Now(), fakeEmbed); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := cli.Add("", "report.md", "report.md", "The ECB annual report.", 22, time.Now(), fakeEmbed); err != nil {
+        t.Fatal(err)
+    }
+    if got := documentNames(server, "user"); got != "notes.txt,report.md" {
+        t.Fatalf("server sees %s after the CLI scan", got)
+    }
+    // Il salvataggio successivo del server non deve perdere il documento della CLI
+    if _, err := server.Add("user", "more.txt", "", "More notes.", 11, time.Now(), fakeEmbed); err != nil {
+        t.Fatal(err)
+    }
+    disk := &documentIndex{path: path, Documents: make(map[string]*IndexedDocument)}
+    if err := disk.reloadLocked(true); err != nil {
+        t.Fatal(err)
+    }
+    if got := documentNames(disk, "user"); got != "more.txt,notes.txt,report.md" {
+        t.Fatalf("index file holds %s", got)
+    }
+
+    // Una rimozione dalla copia non aggiornata non resuscita documenti
+    var notes string
+    for _, doc := range cli.List("user") {
+        if doc.Name == "notes.txt" {
+            notes = doc.ID
+        }
+    }
+    if removed, err := cli.Remove("user", notes); err != nil || !removed {
+        t.Fatalf("Remove = %v, %v", removed, err)
+    }
+    if got := documentNames(server, "user"); got != "more.txt,report.md" {
+        t.Fatalf("server sees %s after the removal", got)
+    }
+}
+
+func TestDocumentIndexConcurrentWriters(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "arca-index.json")
+    indexes := []*documentIndex{
+        {path: path, Documents: make(map[string]*IndexedDocument)},
+        {path: path, Documents: make(map[string]*IndexedDocument)},
+    }
+    var wg sync.WaitGroup
+    for i, x := range indexes {
+        for j := 0; j < 10; j++ {
+            wg.Add(1)
+            go func(x *documentIndex, name string) {
+                defer wg.Done()
+                if _, err := x.Add("", name, name, "Text of "+name, 10, time.Now(), fakeEmbed); err != nil {
+                    t.Error(err)
+                }
+            }(x, fmt.Sprintf("doc-%d-%d.txt", i, j))
+        }
+    }
+    wg.Wait()
+    for _, x := range indexes {
+        if n := len(x.List("")); n != 20 {
+            t.Errorf("index lists %d documents; want 20", n)
+        }
+    }
+}
+
+func TestDocumentOwnerLimit(t *testing.T) {
+    x := &documentIndex{path: filepath.Join(t.TempDir(), "arca-index.json"), Documents: make(map[string]*IndexedDocument)}
+    // Un testo di circa un passaggio ogni 1000 caratteri
+    text := func(passages int) string {
+        return strings.Repeat(strings.Repeat("word ", 199)+"end.\n\n", passages)
+    }
+    // Il documento più grande che sta ancora nel limite
+    full := maxOwnerChunks * 100 / len(chunkText(text(100)))
+    for len(chunkText(text(full))) > maxOwnerChunks {
+        full--
+    }
+    if _, err := x.Add("user", "big.txt", "", text(full), 0, time.Now(), fakeEmbed); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := x.Add("user", "more.txt", "", text(full/2), 0, time.Now(), fakeEmbed); err != errDocumentLimit {
+        t.Fatalf("upload over the limit = %v; want errDocumentLimit", err)
+    }
+    // Ricaricare lo stesso file al limite lo sostituisce
+    if _, err := x.Add("user", "big.txt", "", text(full), 0, time.Now(), fakeEmbed); err != nil {
+        t.Fatalf("re-upload of the same document = %v", err)
+    }
+
+    // Caricamenti concorrenti non superano il limite
+    x = &documentIndex{path: filepath.Join(t.TempDir(), "arca-index.json"), Documents: make(map[string]*IndexedDocument)}
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            x.Add("user", fmt.Sprintf("part-%d.txt", i), "", text(full/3), 0, time.Now(), fakeEmbed)
+        }(i)
+    }
+    wg.Wait()
+    x.mu.RLock()
+    used := x.ownerChunksLocked("user", "")
+    x.mu.RUnlock()
+    if used > maxOwnerChunks {
+        t.Fatalf("owner has %d passages; the limit is %d", used, maxOwnerChunks)
+    }
+}
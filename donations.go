@@ -0,0 +1,553 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "math/big"
+    "math/rand"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// The donation flow links an anonymous on-chain payment to a user by asking
+// them to send an exact, unique amount: a small random tag is added to the
+// amount they choose, and the chain watcher matches incoming transfers on
+// that amount.
+
+const (
+    chainBTC  = "btc"
+    chainUSDT = "usdt"
+
+    donationPrefix        = "donation:"
+    donationPendingPrefix = "donation-pending:"
+    donationAmountPrefix  = "donation-amount:"
+    donationTxPrefix      = "donation-tx:"
+
+    donationReferenceTTL = 48 * time.Hour
+    // Le donazioni scadute restano visibili per una settimana, poi spariscono
+    expiredDonationTTL = 7 * 24 * time.Hour
+    usdtContract         = "0xdAC17F958D2ee523a2206206994597C13D831ec7"
+)
+
+type chainConfig struct {
+    Address       string
+    Decimals      int
+    MinAmount     int64
+    MaxTag        int64
+    Confirmations int
+    PremiumDays   int
+    DisplaySymbol string
+}
+
+var donationChains = map[string]*chainConfig{
+    chainBTC: {
+        Address:       "38JkmWhTFYosecu45ewoheYMjJw68sHSj3",
+        Decimals:      8,
+        MinAmount:     10000,
+        MaxTag:        999,
+        Confirmations: 2,
+        PremiumDays:   30,
+        DisplaySymbol: "BTC",
+    },
+    chainUSDT: {
+        Address:       "0x71ECB5C451ED648583722F5834fF6490D4570f7d",
+        Decimals:      6,
+        MinAmount:     5000000,
+        MaxTag:        9999,
+        Confirmations: 12,
+        PremiumDays:   30,
+        DisplaySymbol: "USDT",
+    },
+}
+
+type DonationReference struct {
+    ID          string    `json:"id"`
+    Chain       string    `json:"chain"`
+    Address     string    `json:"address"`
+    Amount      int64     `json:"amount"`
+    AmountText  string    `json:"amountText"`
+    Status      string    `json:"status"`
+    TxHash      string    `json:"txHash,omitempty"`
+    CreatedAt   time.Time `json:"createdAt"`
+    ExpiresAt   time.Time `json:"expiresAt"`
+    ConfirmedAt time.Time `json:"confirmedAt,omitempty"`
+}
+
+// storedDonationReference keeps the owner, which is hidden from API replies.
+type storedDonationReference struct {
+    DonationReference
+    Owner string `json:"owner"`
+}
+
+// ChainTransfer is an incoming transfer to one of the donation addresses,
+// with Amount in the chain's smallest unit.
+type ChainTransfer struct {
+    TxHash        string
+    Amount        int64
+    Confirmations int
+    Time          time.Time
+}
+
+// ChainWatcher lists incoming transfers to an address on one chain.
+type ChainWatcher interface {
+    Chain() string
+    IncomingTransfers(address string) ([]ChainTransfer, error)
+}
+
+// parseUnits converts a decimal amount such as "0.0015" into the smallest
+// unit of a currency with the given number of decimals.
+func parseUnits(amount string, decimals int) (int64, error) {
+    r, ok := new(big.Rat).SetString(strings.TrimSpace(amount))
+    if !ok || r.Sign() <= 0 {
+        return 0, fmt.Errorf("invalid amount %q", amount)
+    }
+    r.Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)))
+    if !r.IsInt() {
+        return 0, fmt.Errorf("amount %q has more than %d decimals", amount, decimals)
+    }
+    return r.Num().Int64(), nil
+}
+
+func formatUnits(units int64, decimals int) string {
+    r := new(big.Rat).SetFrac(big.NewInt(units), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil))
+    return strings.TrimRight(strings.TrimRight(r.FloatString(decimals), "0"), ".")
+}
+
+// createDonationReference reserves a unique amount on the chain for owner.
+func createDonationReference(owner, chain, amount string) (*DonationReference, error) {
+    cfg, ok := donationChains[chain]
+    if !ok {
+        return nil, fmt.Errorf("unsupported chain %q", chain)
+    }
+    base, err := parseUnits(amount, cfg.Decimals)
+    if err != nil {
+        return nil, err
+    }
+    if base < cfg.MinAmount {
+        return nil, fmt.Errorf("minimum donation is %s %s", formatUnits(cfg.MinAmount, cfg.Decimals), cfg.DisplaySymbol)
+    }
+    for attempt := 0; attempt < 20; attempt++ {
+        tagged := base + 1 + rand.Int63n(cfg.MaxTag)
+        claimed, err := store.Incr(fmt.Sprintf("%s%s:%d", donationAmountPrefix, chain, tagged), donationReferenceTTL)
+        if err != nil {
+            return nil, err
+        }
+        if claimed != 1 {
+            continue
+        }
+        now := time.Now()
+        ref := storedDonationReference{
+            DonationReference: DonationReference{
+                ID:         uuid.New().String(),
+                Chain:      chain,
+                Address:    cfg.Address,
+                Amount:     tagged,
+                AmountText: formatUnits(tagged, cfg.Decimals),
+                Status:     "pending",
+                CreatedAt:  now,
+                ExpiresAt:  now.Add(donationReferenceTTL),
+            },
+            Owner: owner,
+        }
+        if err := store.Set(donationPrefix+ref.ID, ref, donationReferenceTTL+expiredDonationTTL); err != nil {
+            return nil, err
+        }
+        if err := store.Set(donationPendingPrefix+ref.ID, chain, donationReferenceTTL+expiredDonationTTL); err != nil {
+            return nil, err
+        }
+        return &ref.DonationReference, nil
+    }
+    return nil, fmt.Errorf("too many pending donations for this amount, please try a different one")
+}
+
+func loadDonationReference(id string) (*storedDonationReference, error) {
+    ref := &storedDonationReference{}
+    found, err := store.Get(donationPrefix+id, ref)
+    if err != nil || !found {
+        return nil, err
+    }
+    return ref, nil
+}
+
+// checkDonations matches the pending references of one chain against the
+// transfers reported by its watcher and grants premium for each match. The
+// transaction hash is claimed with SetNX, so every transfer unlocks premium
+// once even when several instances run the watcher; the claim is released
+// if the grant fails, so the next check tries again. Only the references
+// listed under donationPendingPrefix are scanned: confirmed ones are kept
+// as a record, expired ones are dropped after expiredDonationTTL.
+func checkDonations(watcher ChainWatcher) error {
+    cfg := donationChains[watcher.Chain()]
+    keys, err := store.Keys(donationPendingPrefix)
+    if err != nil {
+        return err
+    }
+    pending := make(map[int64]*storedDonationReference)
+    now := time.Now()
+    for _, key := range keys {
+        id := strings.TrimPrefix(key, donationPendingPrefix)
+        ref, err := loadDonationReference(id)
+        if err != nil {
+            return err
+        }
+        if ref == nil || ref.Status != "pending" {
+            store.Delete(key)
+            continue
+        }
+        if ref.Chain != watcher.Chain() {
+            continue
+        }
+        if now.After(ref.ExpiresAt) {
+            ref.Status = "expired"
+            store.Set(donationPrefix+id, ref, expiredDonationTTL)
+            store.Delete(key)
+            continue
+        }
+        pending[ref.Amount] = ref
+    }
+    if len(pending) == 0 {
+        return nil
+    }
+    transfers, err := watcher.IncomingTransfers(cfg.Address)
+    if err != nil {
+        return err
+    }
+    for _, tx := range transfers {
+        ref, ok := pending[tx.Amount]
+        if !ok || tx.Confirmations < cfg.Confirmations || tx.Time.Before(ref.CreatedAt.Add(-time.Hour)) {
+            continue
+        }
+        claimed, err := store.SetNX(donationTxPrefix+tx.TxHash, ref.ID, 0)
+        if err != nil {
+            return err
+        }
+        if !claimed {
+            continue
+        }
+        if _, err := grantPremium(ref.Owner, cfg.PremiumDays, fmt.Sprintf("donation:%s:%s", ref.Chain, tx.TxHash), "chain-watcher"); err != nil {
+            store.Delete(donationTxPrefix + tx.TxHash)
+            return err
+        }
+        ref.Status = "confirmed"
+        ref.TxHash = tx.TxHash
+        ref.ConfirmedAt = now
+        if err := store.Set(donationPrefix+ref.ID, ref, 0); err != nil {
+            return err
+        }
+        store.Delete(donationPendingPrefix + ref.ID)
+        fmt.Printf("Donation %s confirmed on %s: %s %s\n", ref.ID, ref.Chain, ref.AmountText, cfg.DisplaySymbol)
+        delete(pending, tx.Amount)
+    }
+    return nil
+}
+
+func runDonationWatchers(watchers []ChainWatcher, interval time.Duration) {
+    for {
+        for _, watcher := range watchers {
+            if err := checkDonations(watcher); err != nil {
+                fmt.Printf("Error checking %s donations: %v\n", watcher.Chain(), err)
+            }
+        }
+        time.Sleep(interval)
+    }
+}
+
+// esploraWatcher reads Bitcoin transfers from an Esplora-compatible API
+// such as blockstream.info or mempool.space.
+type esploraWatcher struct {
+    baseURL string
+    client  *http.Client
+}
+
+func (e *esploraWatcher) Chain() string { return chainBTC }
+
+func (e *esploraWatcher) IncomingTransfers(address string) ([]ChainTransfer, error) {
+    var tipHeight int
+    if err := getJSON(e.client, e.baseURL+"/blocks/tip/height", &tipHeight); err != nil {
+        return nil, fmt.Errorf("error reading Bitcoin tip height: %v", err)
+    }
+    var txs []struct {
+        TxID string `json:"txid"`
+        Vout []struct {
+            Address string `json:"scriptpubkey_address"`
+            Value   int64  `json:"value"`
+        } `json:"vout"`
+        Status struct {
+            Confirmed   bool  `json:"confirmed"`
+            BlockHeight int   `json:"block_height"`
+            BlockTime   int64 `json:"block_time"`
+        } `json:"status"`
+    }
+    if err := getJSON(e.client, e.baseURL+"/address/"+address+"/txs", &txs); err != nil {
+        return nil, fmt.Errorf("error reading Bitcoin transactions: %v", err)
+    }
+    var transfers []ChainTransfer
+    for _, tx := range txs {
+        transfer := ChainTransfer{TxHash: tx.TxID, Time: time.Now()}
+        if tx.Status.Confirmed {
+            transfer.Confirmations = tipHeight - tx.Status.BlockHeight + 1
+            transfer.Time = time.Unix(tx.Status.BlockTime, 0)
+        }
+        for _, out := range tx.Vout {
+            if out.Address == address {
+                transfer.Amount += out.Value
+            }
+        }
+        if transfer.Amount > 0 {
+            transfers = append(transfers, transfer)
+        }
+    }
+    return transfers, nil
+}
+
+// etherscanWatcher reads USDT (ERC-20) transfers from an Etherscan-compatible
+// API.
+type etherscanWatcher struct {
+    baseURL string
+    apiKey  string
+    client  *http.Client
+}
+
+func (e *etherscanWatcher) Chain() string { return chainUSDT }
+
+func (e *etherscanWatcher) IncomingTransfers(address string) ([]ChainTransfer, error) {
+    var result struct {
+        Status  string `json:"status"`
+        Message string `json:"message"`
+        Result  []struct {
+            Hash          string `json:"hash"`
+            To            string `json:"to"`
+            Value         string `json:"value"`
+            Confirmations string `json:"confirmations"`
+            TimeStamp     string `json:"timeStamp"`
+        } `json:"result"`
+    }
+    url := fmt.Sprintf("%s?module=account&action=tokentx&contractaddress=%s&address=%s&sort=desc&apikey=%s", e.baseURL, usdtContract, address, e.apiKey)
+    if err := getJSON(e.client, url, &result); err != nil {
+        return nil, fmt.Errorf("error reading USDT transfers: %v", err)
+    }
+    if result.Status != "1" && result.Message != "No transactions found" {
+        return nil, fmt.Errorf("error from Etherscan: %s", result.Message)
+    }
+    var transfers []ChainTransfer
+    for _, tx := range result.Result {
+        if !strings.EqualFold(tx.To, address) {
+            continue
+        }
+        amount, err := strconv.ParseInt(tx.Value, 10, 64)
+        if err != nil {
+            continue
+        }
+        confirmations, _ := strconv.Atoi(tx.Confirmations)
+        ts, _ := strconv.ParseInt(tx.TimeStamp, 10, 64)
+        transfers = append(transfers, ChainTransfer{TxHash: tx.Hash, Amount: amount, Confirmations: confirmations, Time: time.Unix(ts, 0)})
+    }
+    return transfers, nil
+}
+
+func getJSON(client *http.Client, url string, v interface{}) error {
+    resp, err := client.Get(url)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    body, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return err
+    }
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+    }
+    return json.Unmarshal(body, v)
+}
+
+// mockExplorer serves the Esplora and Etherscan endpoints used by the
+// watchers from an in-memory list of transfers, so the whole donation flow
+// can be exercised locally. Transfers are added with
+//
+//    POST /mock/transfer {"chain": "btc", "txHash": "...", "amount": "0.0010042", "confirmations": 6}
+type mockExplorer struct {
+    mu        sync.Mutex
+    tipHeight int
+    transfers map[string][]mockTransfer
+}
+
+type mockTransfer struct {
+    TxHash        string
+    Amount        int64
+    Confirmations int
+    Time          time.Time
+}
+
+func startMockExplorer(addr string) (string, error) {
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return "", err
+    }
+    m := &mockExplorer{tipHeight: 800000, transfers: make(map[string][]mockTransfer)}
+    mux := http.NewServeMux()
+    mux.HandleFunc("/mock/transfer", m.handleAddTransfer)
+    mux.HandleFunc("/esplora/blocks/tip/height", func(w http.ResponseWriter, r *http.Request) {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        fmt.Fprint(w, m.tipHeight)
+    })
+    mux.HandleFunc("/esplora/address/", m.handleEsploraTxs)
+    mux.HandleFunc("/etherscan", m.handleEtherscan)
+    go http.Serve(listener, mux)
+    return "http://" + listener.Addr().String(), nil
+}
+
+func (m *mockExplorer) handleAddTransfer(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        Chain         string `json:"chain"`
+        TxHash        string `json:"txHash"`
+        Amount        string `json:"amount"`
+        Confirmations int    `json:"confirmations"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    cfg, ok := donationChains[req.Chain]
+    if !ok {
+        http.Error(w, "Unknown chain", http.StatusBadRequest)
+        return
+    }
+    amount, err := parseUnits(req.Amount, cfg.Decimals)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if req.TxHash == "" {
+        req.TxHash = strings.ReplaceAll(uuid.New().String(), "-", "")
+    }
+    m.mu.Lock()
+    m.transfers[req.Chain] = append(m.transfers[req.Chain], mockTransfer{TxHash: req.TxHash, Amount: amount, Confirmations: req.Confirmations, Time: time.Now()})
+    m.mu.Unlock()
+    writeJSON(w, map[string]string{"txHash": req.TxHash})
+}
+
+func (m *mockExplorer) handleEsploraTxs(w http.ResponseWriter, r *http.Request) {
+    address := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/esplora/address/"), "/txs")
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    txs := []map[string]interface{}{}
+    for _, t := range m.transfers[chainBTC] {
+        status := map[string]interface{}{"confirmed": t.Confirmations > 0}
+        if t.Confirmations > 0 {
+            status["block_height"] = m.tipHeight - t.Confirmations + 1
+            status["block_time"] = t.Time.Unix()
+        }
+        txs = append(txs, map[string]interface{}{
+            "txid":   t.TxHash,
+            "vout":   []map[string]interface{}{{"scriptpubkey_address": address, "value": t.Amount}},
+            "status": status,
+        })
+    }
+    writeJSON(w, txs)
+}
+
+func (m *mockExplorer) handleEtherscan(w http.ResponseWriter, r *http.Request) {
+    address := r.URL.Query().Get("address")
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    result := []map[string]string{}
+    for _, t := range m.transfers[chainUSDT] {
+        result = append(result, map[string]string{
+            "hash":          t.TxHash,
+            "to":            strings.ToLower(address),
+            "value":         strconv.FormatInt(t.Amount, 10),
+            "confirmations": strconv.Itoa(t.Confirmations),
+            "timeStamp":     strconv.FormatInt(t.Time.Unix(), 10),
+        })
+    }
+    if len(result) == 0 {
+        writeJSON(w, map[string]interface{}{"status": "0", "message": "No transactions found", "result": result})
+        return
+    }
+    writeJSON(w, map[string]interface{}{"status": "1", "message": "OK", "result": result})
+}
+
+// newChainWatchers configures the watchers from the environment. With
+// CHAIN_EXPLORER=mock both watchers point at an in-process mock explorer.
+func newChainWatchers(client *http.Client) ([]ChainWatcher, error) {
+    if addr := os.Getenv("BTC_DONATION_ADDRESS"); addr != "" {
+        donationChains[chainBTC].Address = addr
+    }
+    if addr := os.Getenv("USDT_DONATION_ADDRESS"); addr != "" {
+        donationChains[chainUSDT].Address = addr
+    }
+    esploraURL := os.Getenv("ESPLORA_URL")
+    if esploraURL == "" {
+        esploraURL = "https://blockstream.info/api"
+    }
+    etherscanURL := os.Getenv("ETHERSCAN_URL")
+    if etherscanURL == "" {
+        etherscanURL = "https://api.etherscan.io/api"
+    }
+    if os.Getenv("CHAIN_EXPLORER") == "mock" {
+        base, err := startMockExplorer("127.0.0.1:0")
+        if err != nil {
+            return nil, err
+        }
+        fmt.Printf("Mock block explorer running at %s (POST /mock/transfer to simulate a donation)\n", base)
+        esploraURL = base + "/esplora"
+        etherscanURL = base + "/etherscan"
+    }
+    watchers := []ChainWatcher{&esploraWatcher{baseURL: esploraURL, client: client}}
+    if apiKey := os.Getenv("ETHERSCAN_API_KEY"); apiKey != "" || os.Getenv("CHAIN_EXPLORER") == "mock" {
+        watchers = append(watchers, &etherscanWatcher{baseURL: etherscanURL, apiKey: apiKey, client: client})
+    } else {
+        fmt.Println("ETHERSCAN_API_KEY is not set, USDT donations will not be verified automatically")
+    }
+    return watchers, nil
+}
+
+// Donation Reference Handler: POST creates a reference for the caller, GET
+// returns the status of one of their references.
+func handleDonationReference(w http.ResponseWriter, r *http.Request) {
+    owner, err := requestOwner(r)
+    if err != nil {
+        http.Error(w, "Error: Session not found", http.StatusBadRequest)
+        return
+    }
+    switch r.Method {
+    case http.MethodPost:
+        var req struct {
+            Chain  string `json:"chain"`
+            Amount string `json:"amount"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            http.Error(w, "Invalid request body", http.StatusBadRequest)
+            return
+        }
+        ref, err := createDonationReference(owner, req.Chain, req.Amount)
+        if err != nil {
+            http.Error(w, "Error creating donation reference: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        writeJSON(w, ref)
+    case http.MethodGet:
+        ref, err := loadDonationReference(r.URL.Query().Get("id"))
+        if err != nil {
+            http.Error(w, "Error loading donation reference: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        if ref == nil || ref.Owner != owner {
+            http.Error(w, "Donation reference not found", http.StatusNotFound)
+            return
+        }
+        writeJSON(w, ref.DonationReference)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "net/http"
+    "testing"
+    "time"
+)
+
+// newMockWatcher starts a mock block explorer and returns the Bitcoin
+// watcher reading from it, with a function that reports a transfer.
+func newMockWatcher(t *testing.T) (ChainWatcher, func(txHash, amount string, confirmations int)) {
+    base, err := startMockExplorer("127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    client := &http.Client{Timeout: 5 * time.Second}
+    addTransfer := func(txHash, amount string, confirmations int) {
+        body, _ := json.Marshal(map[string]interface{}{"chain": chainBTC, "txHash": txHash, "amount": amount, "confirmations": confirmations})
+        resp, err := client.Post(base+"/mock/transfer", "application/json", bytes.NewReader(body))
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp.Body.Close()
+    }
+    return &esploraWatcher{baseURL: base + "/esplora", client: client}, addTransfer
+}
+
+func donationStatus(t *testing.T, id string) string {
+    ref, err := loadDonationReference(id)
+    if err != nil || ref == nil {
+        t.Fatalf("loading reference %s: %v", id, err)
+    }
+    return ref.Status
+}
+
+func TestCheckDonations(t *testing.T) {
+    tests := []struct {
+        name          string
+        confirmations int
+        exactAmount   bool
+        wantStatus    string
+    }{
+        {"matching transfer", 6, true, "confirmed"},
+        {"insufficient confirmations", 1, true, "pending"},
+        {"different amount", 6, false, "pending"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            store = newMemoryStore()
+            watcher, addTransfer := newMockWatcher(t)
+            ref, err := createDonationReference("anon:donor", chainBTC, "0.001")
+            if err != nil {
+                t.Fatal(err)
+            }
+            amount := ref.AmountText
+            if !tt.exactAmount {
+                amount = "0.001"
+            }
+            addTransfer("tx-"+tt.name, amount, tt.confirmations)
+            if err := checkDonations(watcher); err != nil {
+                t.Fatal(err)
+            }
+            if status := donationStatus(t, ref.ID); status != tt.wantStatus {
+                t.Fatalf("status = %s; want %s", status, tt.wantStatus)
+            }
+            grant, _ := loadPremium("anon:donor")
+            if grant.Active(time.Now()) != (tt.wantStatus == "confirmed") {
+                t.Fatalf("premium active = %v with status %s", grant.Active(time.Now()), tt.wantStatus)
+            }
+        })
+    }
+}
+
+func TestCheckDonationsDuplicateTx(t *testing.T) {
+    store = newMemoryStore()
+    watcher, addTransfer := newMockWatcher(t)
+    ref, err := createDonationReference("anon:donor", chainBTC, "0.001")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addTransfer("tx-dup", ref.AmountText, 6)
+    addTransfer("tx-dup", ref.AmountText, 6)
+    for i := 0; i < 3; i++ {
+        if err := checkDonations(watcher); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // Un secondo riferimento con lo stesso importo non può riusare la transazione
+    other := storedDonationReference{DonationReference: DonationReference{ID: "other", Chain: chainBTC, Amount: ref.Amount, Status: "pending", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}, Owner: "anon:other"}
+    store.Set(donationPrefix+"other", other, 0)
+    store.Set(donationPendingPrefix+"other", chainBTC, 0)
+    if err := checkDonations(watcher); err != nil {
+        t.Fatal(err)
+    }
+    grant, _ := loadPremium("anon:donor")
+    days := grant.ExpiresAt.Sub(time.Now()).Hours() / 24
+    if days < 29 || days > 30 {
+        t.Fatalf("premium lasts %.1f days; want one grant of 30", days)
+    }
+    if other, _ := loadPremium("anon:other"); other.Active(time.Now()) {
+        t.Fatal("the same transaction unlocked premium twice")
+    }
+}
+
+func TestCheckDonationsGrantFailure(t *testing.T) {
+    store = newMemoryStore()
+    watcher, addTransfer := newMockWatcher(t)
+    ref, err := createDonationReference("anon:donor", chainBTC, "0.001")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addTransfer("tx-retry", ref.AmountText, 6)
+    cfg := donationChains[chainBTC]
+    days := cfg.PremiumDays
+    t.Cleanup(func() { cfg.PremiumDays = days })
+    cfg.PremiumDays = 0
+    if err := checkDonations(watcher); err == nil {
+        t.Fatal("checkDonations ignored the failed grant")
+    }
+    cfg.PremiumDays = days
+    if status := donationStatus(t, ref.ID); status != "pending" {
+        t.Fatalf("status after a failed grant = %s; want pending", status)
+    }
+    if err := checkDonations(watcher); err != nil {
+        t.Fatal(err)
+    }
+    if status := donationStatus(t, ref.ID); status != "confirmed" {
+        t.Fatalf("status after retry = %s; want confirmed", status)
+    }
+}
+
+func TestCheckDonationsExpiry(t *testing.T) {
+    store = newMemoryStore()
+    watcher, _ := newMockWatcher(t)
+    expired := storedDonationReference{DonationReference: DonationReference{ID: "old", Chain: chainBTC, Amount: 1, Status: "pending", ExpiresAt: time.Now().Add(-time.Minute)}}
+    store.Set(donationPrefix+"old", expired, 0)
+    store.Set(donationPendingPrefix+"old", chainBTC, 0)
+    if err := checkDonations(watcher); err != nil {
+        t.Fatal(err)
+    }
+    if status := donationStatus(t, "old"); status != "expired" {
+        t.Fatalf("status = %s; want expired", status)
+    }
+    if keys, _ := store.Keys(donationPendingPrefix); len(keys) != 0 {
+        t.Fatalf("expired reference still scanned: %v", keys)
+    }
+}
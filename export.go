@@ -0,0 +1,241 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+    "time"
+)
+
+// exportTurn is what an exported report shows of a turn: the model answers,
+// sorted by contribution, and every source they were given.
+type exportTurn struct {
+    ConversationTurn
+    Answers    []ProviderAnswer
+    SourceList []SourceEntry
+}
+
+func exportTurns(conversation *SharedConversation) []exportTurn {
+    turns := make([]exportTurn, 0, len(conversation.Turns))
+    for _, turn := range conversation.Turns {
+        t := exportTurn{ConversationTurn: turn, SourceList: sourceEntries(turn, true)}
+        t.Answers = append(t.Answers, turn.Providers...)
+        sort.SliceStable(t.Answers, func(i, j int) bool { return t.Answers[i].Contribution > t.Answers[j].Contribution })
+        turns = append(turns, t)
+    }
+    return turns
+}
+
+// sourceLine formats a listed source for the exports, noting the cited ones.
+func sourceLine(entry SourceEntry) string {
+    line := citationLine(entry.Citation)
+    if entry.Cited {
+        line += " (cited)"
+    }
+    return line
+}
+
+// answerHeading names the provider and notes answers in the wrong language
+// and the flags raised on them.
+func answerHeading(answer ProviderAnswer) string {
+    heading := answer.Name
+    switch {
+    case answer.TranslatedBy != "":
+        heading = fmt.Sprintf("%s (translated from %s by %s)", answer.Name, answer.Language, answer.TranslatedBy)
+    case answer.WrongLanguage:
+        heading = fmt.Sprintf("%s (answered in %s)", answer.Name, answer.Language)
+    }
+    if len(answer.Flags) > 0 {
+        kinds := make([]string, len(answer.Flags))
+        for i, flag := range answer.Flags {
+            kinds[i] = flag.Kind
+        }
+        heading += " [" + strings.Join(kinds, ", ") + "]"
+    }
+    return heading
+}
+
+// claimEvidence lists the objections to a claim and the sources that back it.
+func claimEvidence(claim Claim, separator string) string {
+    var evidence []string
+    for _, position := range claim.ContestedBy {
+        evidence = append(evidence, position.Provider+": "+position.Text)
+    }
+    if len(claim.Sources) > 0 {
+        sources := "Sources"
+        for _, n := range claim.Sources {
+            sources += fmt.Sprintf(" [%d]", n)
+        }
+        evidence = append(evidence, sources)
+    }
+    return strings.Join(evidence, separator)
+}
+
+// tableCell keeps text on one line and escapes the Markdown column separator.
+func tableCell(text string) string {
+    return strings.ReplaceAll(strings.Join(strings.Fields(text), " "), "|", "\\|")
+}
+
+func exportTitle(conversation *SharedConversation) string {
+    for _, turn := range conversation.Turns {
+        if turn.Question != "" {
+            title := strings.Join(strings.Fields(turn.Question), " ")
+            if len([]rune(title)) > 80 {
+                title = string([]rune(title)[:77]) + "..."
+            }
+            return title
+        }
+    }
+    return "ARCA-b conversation"
+}
+
+func exportMarkdown(conversation *SharedConversation) string {
+    var out strings.Builder
+    fmt.Fprintf(&out, "# %s\n\n", exportTitle(conversation))
+    fmt.Fprintf(&out, "_Shared from ARCA-b Chat AI on %s — %s/conversation/%s_\n\n", conversation.CreatedAt.Format("2006-01-02"), publicURL, conversation.ID)
+    for i, turn := range exportTurns(conversation) {
+        fmt.Fprintf(&out, "## Question %d\n\n", i+1)
+        if turn.Question != "" {
+            fmt.Fprintf(&out, "> %s\n\n", strings.ReplaceAll(turn.Question, "\n", "\n> "))
+        }
+        fmt.Fprintf(&out, "### Answer\n\n%s\n\n", strings.TrimSpace(turn.Response))
+        if len(turn.SourceList) > 0 {
+            out.WriteString("### Sources\n\n")
+            for _, entry := range turn.SourceList {
+                fmt.Fprintf(&out, "- %s\n", sourceLine(entry))
+            }
+            out.WriteString("\n")
+        }
+        if len(turn.Disagreements) > 0 {
+            out.WriteString("### Where the AIs disagree\n\n")
+            for _, point := range turn.Disagreements {
+                fmt.Fprintf(&out, "**%s**\n\n", point.Topic)
+                for _, position := range point.Positions {
+                    fmt.Fprintf(&out, "- %s: %s\n", position.Provider, position.Text)
+                }
+                out.WriteString("\n")
+            }
+        }
+        if len(turn.Claims) > 0 {
+            out.WriteString("### Fact check\n\n| Claim | Stated by | Status | Evidence |\n|---|---|---|---|\n")
+            for _, claim := range turn.Claims {
+                fmt.Fprintf(&out, "| %s | %s | %s | %s |\n", tableCell(claim.Text), strings.Join(claim.StatedBy, ", "), claim.Status, tableCell(claimEvidence(claim, "; ")))
+            }
+            out.WriteString("\n")
+        }
+        if len(turn.Answers) > 0 {
+            out.WriteString("### Contributions\n\n| Provider | Contribution |\n|---|---|\n")
+            for _, answer := range turn.Answers {
+                status := fmt.Sprintf("%.2f%%", answer.Contribution)
+                if answer.Failed {
+                    status = "failed"
+                }
+                fmt.Fprintf(&out, "| %s | %s |\n", answer.Name, status)
+            }
+            out.WriteString("\n### Provider answers\n\n")
+            for _, answer := range turn.Answers {
+                fmt.Fprintf(&out, "#### %s\n\n%s\n\n", answerHeading(answer), strings.TrimSpace(answer.Content))
+            }
+        } else if turn.Contributions != "" {
+            fmt.Fprintf(&out, "### Contributions\n\n%s\n\n", turn.Contributions)
+        }
+    }
+    return out.String()
+}
+
+func exportPDF(conversation *SharedConversation) []byte {
+    title := exportTitle(conversation)
+    pdf := newPDFWriter(title)
+    pdf.Heading(title, 18)
+    pdf.Text(fmt.Sprintf("Shared from ARCA-b Chat AI on %s - %s/conversation/%s", conversation.CreatedAt.Format("2006-01-02"), publicURL, conversation.ID), "F1", 9)
+    for i, turn := range exportTurns(conversation) {
+        pdf.Space(12)
+        pdf.Heading(fmt.Sprintf("Question %d", i+1), 14)
+        if turn.Question != "" {
+            pdf.Text(turn.Question, "F1", 11)
+        }
+        pdf.Heading("Answer", 12)
+        pdf.Text(strings.TrimSpace(turn.Response), "F1", 11)
+        if len(turn.SourceList) > 0 {
+            pdf.Heading("Sources", 12)
+            for _, entry := range turn.SourceList {
+                line := fmt.Sprintf("[%d] %s", entry.Number, entry.Title)
+                if entry.Source != "" {
+                    line += " - " + entry.Source
+                }
+                if entry.Cited {
+                    line += " (cited)"
+                }
+                if entry.URL != "" {
+                    line += "\n" + entry.URL
+                }
+                pdf.Text(line, "F1", 10)
+            }
+        }
+        if len(turn.Disagreements) > 0 {
+            pdf.Heading("Where the AIs disagree", 12)
+            for _, point := range turn.Disagreements {
+                pdf.Text(point.Topic, "F2", 10)
+                for _, position := range point.Positions {
+                    pdf.Text(position.Provider+": "+position.Text, "F1", 10)
+                }
+            }
+        }
+        if len(turn.Claims) > 0 {
+            pdf.Heading("Fact check", 12)
+            for _, claim := range turn.Claims {
+                pdf.Text(fmt.Sprintf("[%s] %s (%s)", claim.Status, claim.Text, strings.Join(claim.StatedBy, ", ")), "F1", 10)
+                if evidence := claimEvidence(claim, "\n"); evidence != "" {
+                    pdf.Text(evidence, "F1", 9)
+                }
+            }
+        }
+        if len(turn.Answers) > 0 {
+            pdf.Heading("Contributions", 12)
+            for _, answer := range turn.Answers {
+                status := fmt.Sprintf("%.2f%%", answer.Contribution)
+                if answer.Failed {
+                    status = "failed"
+                }
+                pdf.Text(fmt.Sprintf("%s: %s", answer.Name, status), "F1", 10)
+            }
+            pdf.Heading("Provider answers", 12)
+            for _, answer := range turn.Answers {
+                pdf.Text(answerHeading(answer), "F2", 10)
+                pdf.Text(strings.TrimSpace(answer.Content), "F1", 10)
+                pdf.Space(4)
+            }
+        } else if turn.Contributions != "" {
+            pdf.Heading("Contributions", 12)
+            pdf.Text(turn.Contributions, "F1", 10)
+        }
+    }
+    return pdf.Bytes()
+}
+
+// Conversation Export Handler: GET /conversation/{id}/export?format=md|json|pdf
+func handleConversationExport(w http.ResponseWriter, r *http.Request, conversation *SharedConversation) {
+    filename := "arca-b-conversation-" + conversation.ID
+    switch format := r.URL.Query().Get("format"); format {
+    case "", "md", "markdown":
+        w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+        w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.md"`)
+        fmt.Fprint(w, exportMarkdown(conversation))
+    case "json":
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+        view := conversation.publicView()
+        view["exportedAt"] = time.Now().UTC()
+        encoder := json.NewEncoder(w)
+        encoder.SetIndent("", "  ")
+        encoder.Encode(view)
+    case "pdf":
+        w.Header().Set("Content-Type", "application/pdf")
+        w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.pdf"`)
+        w.Write(exportPDF(conversation))
+    default:
+        http.Error(w, "Unsupported format "+format+", expected md, json or pdf", http.StatusBadRequest)
+    }
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestExportListsEverySource(t *testing.T) {
+    conversation := &SharedConversation{Turns: []ConversationTurn{{
+        Question:  "What did the ECB decide?",
+        Response:  "Rates were kept steady [1].",
+        Providers: []ProviderAnswer{{Name: "OpenAI", Content: "Rates were kept steady."}},
+        Sources: []Article{
+            {Title: "ECB holds rates", URL: "https://example.org/ecb", Source: "Reuters"},
+            {Title: "Inflation slows", URL: "https://example.org/inflation", Source: "Eurostat"},
+        },
+        Citations: []Citation{{Number: 1, Article: Article{Title: "ECB holds rates", URL: "https://example.org/ecb", Source: "Reuters"}}},
+        Claims:    []Claim{{Text: "Inflation slowed.", StatedBy: []string{"OpenAI"}, Sources: []int{2}, Status: "supported"}},
+    }}}
+    markdown := exportMarkdown(conversation)
+    for _, want := range []string{"[1] [ECB holds rates](https://example.org/ecb)", "(cited)", "[2] [Inflation slows](https://example.org/inflation)"} {
+        if !strings.Contains(markdown, want) {
+            t.Errorf("markdown export lacks %q:\n%s", want, markdown)
+        }
+    }
+    if strings.Contains(markdown, "News sources") {
+        t.Error("markdown export still has a News sources section")
+    }
+    if strings.Count(markdown, "(cited)") != 1 {
+        t.Errorf("want only source 1 marked as cited:\n%s", markdown)
+    }
+
+    // Le conversazioni salvate prima delle fonti hanno solo le citazioni
+    conversation.Turns[0].Sources = nil
+    if entries := sourceEntries(conversation.Turns[0], true); len(entries) != 1 || !entries[0].Cited {
+        t.Fatalf("sourceEntries without sources = %+v", entries)
+    }
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+    "regexp"
+    "sort"
+    "strings"
+    "unicode"
+)
+
+// Claim is a row of the fact-check table: a factual statement found in the
+// providers' answers and how well the other providers and the retrieved
+// sources back it.
+type Claim struct {
+    Text string `json:"text"`
+    // StatedBy lists the providers that make the claim, the one whose
+    // wording is shown first.
+    StatedBy    []string        `json:"statedBy"`
+    ContestedBy []ClaimPosition `json:"contestedBy,omitempty"`
+    // Sources are the numbers of the retrieved sources that back the claim.
+    Sources []int  `json:"sources,omitempty"`
+    Status  string `json:"status"`
+}
+
+func (c *Claim) contestedBy(provider string) bool {
+    for _, position := range c.ContestedBy {
+        if position.Provider == provider {
+            return true
+        }
+    }
+    return false
+}
+
+// ClaimPosition is what a provider said instead of a claim.
+type ClaimPosition struct {
+    Provider string `json:"provider"`
+    Text     string `json:"text"`
+}
+
+const (
+    claimSupported   = "supported"
+    claimContested   = "contested"
+    claimUnsupported = "unsupported"
+)
+
+const (
+    maxClaimsPerAnswer    = 6
+    maxSentencesPerAnswer = 25
+    maxClaims             = 20
+    // Soglie di similarità del coseno tra embedding di frasi
+    sameClaimSimilarity = 0.88
+    agreeSimilarity     = 0.80
+    relatedSimilarity   = 0.70
+    sourceSimilarity    = 0.72
+)
+
+// disagreementsSkipped is the note sent when the answers were not compared.
+const disagreementsSkipped = "Disagreements between the AIs were not checked, to save budget. Turn on Fact-check to compare the answers."
+
+// compareAnswers reports whether the answers are compared claim by claim.
+// A fact check always does; otherwise the comparison embeds every sentence
+// of every answer, so it only runs at the full service level.
+func compareAnswers(factCheck bool, answers int, level string) bool {
+    if factCheck {
+        return true
+    }
+    return answers > 1 && level == serviceFull
+}
+
+// batchEmbedFunc embeds several texts, returning one vector per text.
+type batchEmbedFunc func(texts []string) ([][]float64, error)
+
+var (
+    sentenceEnd     = regexp.MustCompile(`([.!?])\s+`)
+    listMarker      = regexp.MustCompile(`^\s*(#{1,6}\s+|[-*+•]\s+|\d+[.)]\s+|>\s*)`)
+    numberPattern   = regexp.MustCompile(`\d+(?:[.,]\d+)?`)
+    citationMarkers = regexp.MustCompile(`\s*\[\d{1,2}\]`)
+    claimMetaPrefix = regexp.MustCompile(`(?i)^(i |i'm |as an ai|sure|certainly|of course|here |in summary|in conclusion|overall|note that|please|let me|however, i|it is important to|it's important to|ecco|certo|in sintesi|in conclusione|tuttavia, non)`)
+)
+
+// negations are the words that flip the meaning of a statement.
+var negations = wordSet("not", "no", "never", "none", "neither", "nor", "isn't", "aren't", "wasn't", "weren't", "doesn't", "don't", "didn't", "won't", "cannot", "can't",
+    "non", "nessun", "nessuno", "nessuna", "mai", "né",
+    "nicht", "kein", "keine", "keinen", "niemals", "nie",
+    "pas", "jamais", "aucun", "aucune",
+    "nunca", "ningún", "ninguna", "ni")
+
+// answerSentences splits an answer into plain sentences, without code,
+// Markdown markup or questions.
+func answerSentences(text string) []string {
+    text = codeBlockPattern.ReplaceAllString(text, " ")
+    var sentences []string
+    for _, line := range strings.Split(text, "\n") {
+        line = listMarker.ReplaceAllString(line, "")
+        line = strings.NewReplacer("**", "", "__", "", "*", "").Replace(line)
+        for _, sentence := range strings.SplitAfter(sentenceEnd.ReplaceAllString(line, "$1\n"), "\n") {
+            sentence = strings.TrimSpace(sentence)
+            if sentence == "" || strings.HasSuffix(sentence, "?") || strings.HasSuffix(sentence, ":") {
+                continue
+            }
+            sentences = append(sentences, sentence)
+            if len(sentences) == maxSentencesPerAnswer {
+                return sentences
+            }
+        }
+    }
+    return sentences
+}
+
+// isClaim reports whether a sentence states a checkable fact rather than
+// a courtesy, a caveat or a heading.
+func isClaim(sentence string) bool {
+    n := len([]rune(sentence))
+    return n >= 25 && n <= 300 && len(strings.Fields(sentence)) >= 5 && !claimMetaPrefix.MatchString(sentence)
+}
+
+// pickClaims chooses the sentences to check, preferring those with figures
+// or names, which are the ones worth verifying, and keeps their order.
+func pickClaims(sentences []string) []int {
+    var specific, general []int
+    for i, sentence := range sentences {
+        if !isClaim(sentence) {
+            continue
+        }
+        if numberPattern.MatchString(sentence) || len(properNames(sentence)) > 0 {
+            specific = append(specific, i)
+        } else {
+            general = append(general, i)
+        }
+    }
+    picked := append(specific, general...)
+    if len(picked) > maxClaimsPerAnswer {
+        picked = picked[:maxClaimsPerAnswer]
+    }
+    sort.Ints(picked)
+    return picked
+}
+
+func numbersIn(text string) map[string]bool {
+    numbers := make(map[string]bool)
+    for _, n := range numberPattern.FindAllString(citationPattern.ReplaceAllString(text, ""), -1) {
+        numbers[strings.ReplaceAll(n, ",", ".")] = true
+    }
+    return numbers
+}
+
+func negated(text string) bool {
+    count := 0
+    for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+        return !unicode.IsLetter(r) && r != '\''
+    }) {
+        if negations[word] {
+            count++
+        }
+    }
+    return count%2 == 1
+}
+
+// conflicting reports whether two statements about the same thing
+// disagree: they give different figures, or one denies what the other says.
+func conflicting(a, b string) bool {
+    na, nb := numbersIn(a), numbersIn(b)
+    if len(na) > 0 && len(nb) > 0 {
+        shared := false
+        for n := range na {
+            if nb[n] {
+                shared = true
+            }
+        }
+        if !shared {
+            return true
+        }
+    }
+    return negated(a) != negated(b)
+}
+
+// checkClaims builds the fact-check table. answers are the accepted
+// provider answers, most relevant first; claims are taken from each of them
+// and compared by embedding similarity with every other provider's
+// sentences and with the sources the answers were grounded on.
+func checkClaims(answers []ProviderAnswer, sources []Article, embed batchEmbedFunc) ([]Claim, error) {
+    type providerSentences struct {
+        name      string
+        sentences []string
+        vectors   [][]float64
+        claims    []int
+    }
+    var providers []*providerSentences
+    var texts []string
+    for _, answer := range answers {
+        p := &providerSentences{name: answer.Name, sentences: answerSentences(answer.Content)}
+        p.claims = pickClaims(p.sentences)
+        providers = append(providers, p)
+        for _, sentence := range p.sentences {
+            texts = append(texts, citationMarkers.ReplaceAllString(sentence, ""))
+        }
+    }
+    for _, source := range sources {
+        texts = append(texts, strings.TrimSpace(source.Title+". "+source.Description))
+    }
+    if len(texts) == 0 {
+        return nil, nil
+    }
+    vectors, err := embed(texts)
+    if err != nil {
+        return nil, err
+    }
+    next := 0
+    for _, p := range providers {
+        p.vectors = vectors[next : next+len(p.sentences)]
+        next += len(p.sentences)
+    }
+    sourceVectors := vectors[next:]
+
+    type row struct {
+        Claim
+        raw    string
+        vector []float64
+    }
+    var rows []*row
+    for _, p := range providers {
+        for _, i := range p.claims {
+            text := strings.TrimSpace(citationMarkers.ReplaceAllString(p.sentences[i], ""))
+            merged := false
+            for _, r := range rows {
+                if containsString(r.StatedBy, p.name) {
+                    continue
+                }
+                score := cosineSimilarity(r.vector, p.vectors[i])
+                // Una frase che contraddice una riga esistente ne diventa l'obiezione, non una nuova riga
+                if score >= relatedSimilarity && conflicting(r.Text, text) {
+                    r.ContestedBy = append(r.ContestedBy, ClaimPosition{Provider: p.name, Text: text})
+                    merged = true
+                    break
+                }
+                if score >= sameClaimSimilarity {
+                    r.StatedBy = append(r.StatedBy, p.name)
+                    r.raw += " " + p.sentences[i]
+                    merged = true
+                    break
+                }
+            }
+            if !merged && len(rows) < maxClaims {
+                rows = append(rows, &row{Claim: Claim{Text: text, StatedBy: []string{p.name}}, raw: p.sentences[i], vector: p.vectors[i]})
+            }
+        }
+    }
+
+    claims := make([]Claim, 0, len(rows))
+    for _, r := range rows {
+        for _, p := range providers {
+            if containsString(r.StatedBy, p.name) || r.contestedBy(p.name) {
+                continue
+            }
+            best, bestScore := -1, 0.0
+            for j, vector := range p.vectors {
+                if score := cosineSimilarity(r.vector, vector); score > bestScore {
+                    best, bestScore = j, score
+                }
+            }
+            if best < 0 {
+                continue
+            }
+            other := strings.TrimSpace(citationMarkers.ReplaceAllString(p.sentences[best], ""))
+            switch {
+            case bestScore >= relatedSimilarity && conflicting(r.Text, other):
+                r.ContestedBy = append(r.ContestedBy, ClaimPosition{Provider: p.name, Text: other})
+            case bestScore >= agreeSimilarity:
+                r.StatedBy = append(r.StatedBy, p.name)
+            }
+        }
+        // Una fonte conta se la risposta la cita o se dice la stessa cosa
+        backing := make(map[int]bool)
+        for _, n := range citedSources(r.raw, sources) {
+            backing[n] = true
+        }
+        for i, vector := range sourceVectors {
+            if cosineSimilarity(r.vector, vector) >= sourceSimilarity {
+                backing[i+1] = true
+            }
+        }
+        for n := range backing {
+            r.Sources = append(r.Sources, n)
+        }
+        sort.Ints(r.Sources)
+        switch {
+        case len(r.ContestedBy) > 0:
+            r.Status = claimContested
+        case len(r.StatedBy) > 1 || len(r.Sources) > 0:
+            r.Status = claimSupported
+        default:
+            r.Status = claimUnsupported
+        }
+        claims = append(claims, r.Claim)
+    }
+    return claims, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+    "fmt"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestCompareAnswers(t *testing.T) {
+    tests := []struct {
+        factCheck bool
+        answers   int
+        level     string
+        want      bool
+    }{
+        {true, 1, serviceMinimal, true},
+        {true, 3, serviceEconomy, true},
+        {false, 1, serviceFull, false},
+        {false, 3, serviceFull, true},
+        {false, 3, serviceEconomy, false},
+        {false, 2, serviceMinimal, false},
+    }
+    for _, tt := range tests {
+        if got := compareAnswers(tt.factCheck, tt.answers, tt.level); got != tt.want {
+            t.Errorf("compareAnswers(%v, %d, %s) = %v; want %v", tt.factCheck, tt.answers, tt.level, got, tt.want)
+        }
+    }
+}
+
+// topicEmbed embeds a text on the axis of the first topic it mentions, so
+// that sentences on the same topic have similarity 1, and every other text
+// on an axis of its own.
+func topicEmbed(topics ...string) batchEmbedFunc {
+    return func(texts []string) ([][]float64, error) {
+        vectors := make([][]float64, len(texts))
+        for i, text := range texts {
+            vectors[i] = make([]float64, len(topics)+len(texts))
+            axis := len(topics) + i
+            for j, topic := range topics {
+                if strings.Contains(strings.ToLower(text), topic) {
+                    axis = j
+                    break
+                }
+            }
+            vectors[i][axis] = 1
+        }
+        return vectors, nil
+    }
+}
+
+func TestCheckClaims(t *testing.T) {
+    const (
+        tower   = "The Eiffel Tower in Paris is 330 metres tall."
+        wall    = "The Great Wall of China is visible from space with the naked eye."
+        danube  = "The Danube flows through ten countries of central Europe."
+        everest = "Mount Everest is the highest mountain above sea level."
+    )
+    answer := func(name string, sentences ...string) ProviderAnswer {
+        return ProviderAnswer{Name: name, Content: strings.Join(sentences, " ")}
+    }
+    var many []ProviderAnswer
+    for _, name := range []string{"A", "B", "C", "D"} {
+        var sentences []string
+        for i := 0; i < maxClaimsPerAnswer; i++ {
+            sentences = append(sentences, fmt.Sprintf("Provider %s states a distinct fact numbered %d here.", name, i))
+        }
+        many = append(many, answer(name, sentences...))
+    }
+    tests := []struct {
+        name    string
+        answers []ProviderAnswer
+        sources []Article
+        want    []Claim
+        count   int
+    }{
+        {
+            name:    "supported by a second provider",
+            answers: []ProviderAnswer{answer("A", tower), answer("B", "The 330 metres tall Eiffel Tower stands in Paris.")},
+            want:    []Claim{{Text: tower, StatedBy: []string{"A", "B"}, Status: claimSupported}},
+        },
+        {
+            name:    "supported by a source",
+            answers: []ProviderAnswer{answer("A", danube)},
+            sources: []Article{{Title: "Weather", Description: "Rain tomorrow"}, {Title: "The Danube", Description: "Europe's second longest river"}},
+            want:    []Claim{{Text: danube, StatedBy: []string{"A"}, Sources: []int{2}, Status: claimSupported}},
+        },
+        {
+            name:    "contested by a different figure",
+            answers: []ProviderAnswer{answer("A", tower), answer("B", "The Eiffel Tower in Paris is 300 metres tall.")},
+            want: []Claim{{Text: tower, StatedBy: []string{"A"}, Status: claimContested,
+                ContestedBy: []ClaimPosition{{Provider: "B", Text: "The Eiffel Tower in Paris is 300 metres tall."}}}},
+        },
+        {
+            name:    "contested by a negation",
+            answers: []ProviderAnswer{answer("A", wall), answer("B", "The Great Wall of China is not visible from space with the naked eye.")},
+            want: []Claim{{Text: wall, StatedBy: []string{"A"}, Status: claimContested,
+                ContestedBy: []ClaimPosition{{Provider: "B", Text: "The Great Wall of China is not visible from space with the naked eye."}}}},
+        },
+        {
+            name:    "unsupported",
+            answers: []ProviderAnswer{answer("A", danube), answer("B", everest)},
+            sources: []Article{{Title: "Weather", Description: "Rain tomorrow"}},
+            want: []Claim{
+                {Text: danube, StatedBy: []string{"A"}, Status: claimUnsupported},
+                {Text: everest, StatedBy: []string{"B"}, Status: claimUnsupported},
+            },
+        },
+        {
+            name:    "at most maxClaims rows",
+            answers: many,
+            count:   maxClaims,
+        },
+    }
+    embed := topicEmbed("eiffel", "great wall", "danube", "everest")
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            claims, err := checkClaims(tt.answers, tt.sources, embed)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if tt.want == nil {
+                if len(claims) != tt.count {
+                    t.Fatalf("%d claims; want %d", len(claims), tt.count)
+                }
+                return
+            }
+            if !reflect.DeepEqual(claims, tt.want) {
+                t.Fatalf("claims = %+v\nwant %+v", claims, tt.want)
+            }
+        })
+    }
+}
@@ -6,3 +6,5 @@ require (
 	github.com/google/uuid v1.6.0
 	github.com/sashabaranov/go-openai v1.38.2
 )
+
+require golang.org/x/crypto v0.31.0
@@ -0,0 +1,323 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "strings"
+    "time"
+    "unicode/utf8"
+
+    "github.com/sashabaranov/go-openai"
+)
+
+// importedThread is one conversation read from another tool.
+type importedThread struct {
+    Title     string
+    CreatedAt time.Time
+    Messages  []openai.ChatCompletionMessage
+}
+
+const (
+    maxImportBytes    = 20 << 20
+    maxImportThreads  = 200
+    maxImportMessages = 200
+    // maxImportHistoryChars bounds the imported messages re-sent to the
+    // providers with every later question, about 6000 tokens; the turns
+    // shown in the chat keep everything.
+    maxImportHistoryChars = 24000
+)
+
+// importMessage is a message in the OpenAI chat format. Content is either a
+// string or a list of parts, of which only the text ones are kept.
+type importMessage struct {
+    Role    string          `json:"role"`
+    Content json.RawMessage `json:"content"`
+}
+
+// chatGPTConversation is one entry of conversations.json in a ChatGPT
+// data export. Messages form a tree in Mapping; the thread shown to the
+// user is the path from CurrentNode back to the root.
+type chatGPTConversation struct {
+    Title       string  `json:"title"`
+    CreateTime  float64 `json:"create_time"`
+    CurrentNode string  `json:"current_node"`
+    Mapping     map[string]struct {
+        Parent  string `json:"parent"`
+        Message *struct {
+            Author struct {
+                Role string `json:"role"`
+            } `json:"author"`
+            Content struct {
+                ContentType string            `json:"content_type"`
+                Parts       []json.RawMessage `json:"parts"`
+            } `json:"content"`
+        } `json:"message"`
+    } `json:"mapping"`
+}
+
+// parseImport recognises, in this order: a ChatGPT export (a list of
+// conversations or a single one), an object with a "messages" array and an
+// optional "title", and a bare array of OpenAI-style messages.
+func parseImport(data []byte) ([]importedThread, error) {
+    data = bytes.TrimSpace(data)
+    var probe []map[string]json.RawMessage
+    if len(data) > 0 && data[0] == '[' {
+        if err := json.Unmarshal(data, &probe); err != nil {
+            return nil, fmt.Errorf("invalid JSON: %v", err)
+        }
+        if len(probe) > 0 && probe[0]["mapping"] != nil {
+            var conversations []chatGPTConversation
+            if err := json.Unmarshal(data, &conversations); err != nil {
+                return nil, fmt.Errorf("invalid ChatGPT export: %v", err)
+            }
+            if len(conversations) > maxImportThreads {
+                conversations = conversations[:maxImportThreads]
+            }
+            threads := make([]importedThread, 0, len(conversations))
+            for _, conversation := range conversations {
+                if thread := conversation.thread(); len(thread.Messages) > 0 {
+                    threads = append(threads, thread)
+                }
+            }
+            return threads, nil
+        }
+        var messages []importMessage
+        if err := json.Unmarshal(data, &messages); err != nil {
+            return nil, fmt.Errorf("invalid message array: %v", err)
+        }
+        return []importedThread{{Messages: convertMessages(messages)}}, nil
+    }
+
+    var object struct {
+        Title    string          `json:"title"`
+        Messages []importMessage `json:"messages"`
+        Mapping  json.RawMessage `json:"mapping"`
+    }
+    if err := json.Unmarshal(data, &object); err != nil {
+        return nil, fmt.Errorf("invalid JSON: %v", err)
+    }
+    if object.Mapping != nil {
+        var conversation chatGPTConversation
+        if err := json.Unmarshal(data, &conversation); err != nil {
+            return nil, fmt.Errorf("invalid ChatGPT conversation: %v", err)
+        }
+        return []importedThread{conversation.thread()}, nil
+    }
+    if object.Messages == nil {
+        return nil, fmt.Errorf("expected a messages array or a ChatGPT export")
+    }
+    return []importedThread{{Title: object.Title, Messages: convertMessages(object.Messages)}}, nil
+}
+
+func convertMessages(messages []importMessage) []openai.ChatCompletionMessage {
+    converted := make([]openai.ChatCompletionMessage, 0, len(messages))
+    for _, message := range messages {
+        var text string
+        if err := json.Unmarshal(message.Content, &text); err != nil {
+            var parts []struct {
+                Type string `json:"type"`
+                Text string `json:"text"`
+            }
+            json.Unmarshal(message.Content, &parts)
+            var texts []string
+            for _, part := range parts {
+                if part.Type == "text" || part.Type == "input_text" || part.Type == "output_text" {
+                    texts = append(texts, part.Text)
+                }
+            }
+            text = strings.Join(texts, "\n")
+        }
+        if msg, ok := importedMessage(message.Role, text); ok {
+            converted = append(converted, msg)
+        }
+    }
+    return converted
+}
+
+func (c *chatGPTConversation) thread() importedThread {
+    thread := importedThread{Title: c.Title}
+    if c.CreateTime > 0 {
+        thread.CreatedAt = time.Unix(int64(c.CreateTime), 0).UTC()
+    }
+    var path []openai.ChatCompletionMessage
+    seen := make(map[string]bool)
+    for id := c.CurrentNode; id != "" && !seen[id]; id = c.Mapping[id].Parent {
+        seen[id] = true
+        node, ok := c.Mapping[id]
+        if !ok {
+            break
+        }
+        if node.Message == nil || node.Message.Content.ContentType != "text" {
+            continue
+        }
+        var texts []string
+        for _, part := range node.Message.Content.Parts {
+            var text string
+            if json.Unmarshal(part, &text) == nil && text != "" {
+                texts = append(texts, text)
+            }
+        }
+        if msg, ok := importedMessage(node.Message.Author.Role, strings.Join(texts, "\n")); ok {
+            path = append(path, msg)
+        }
+    }
+    for i := len(path) - 1; i >= 0; i-- {
+        thread.Messages = append(thread.Messages, path[i])
+    }
+    return thread
+}
+
+// importedMessage keeps user and assistant messages and drops tool calls
+// and empty messages. System messages are dropped too: replayed from the
+// history they would override the operator's system prompts.
+func importedMessage(role, text string) (openai.ChatCompletionMessage, bool) {
+    text = strings.TrimSpace(text)
+    switch role {
+    case openai.ChatMessageRoleUser, openai.ChatMessageRoleAssistant:
+    default:
+        return openai.ChatCompletionMessage{}, false
+    }
+    if text == "" {
+        return openai.ChatCompletionMessage{}, false
+    }
+    return openai.ChatCompletionMessage{Role: role, Content: text}, true
+}
+
+// importTurns pairs each user message with the assistant replies that
+// follow it, so the imported chat can be browsed and shared like any other.
+func importTurns(thread importedThread) []ConversationTurn {
+    var turns []ConversationTurn
+    for _, msg := range thread.Messages {
+        switch msg.Role {
+        case openai.ChatMessageRoleUser:
+            turns = append(turns, ConversationTurn{Index: len(turns), Time: thread.CreatedAt, Question: msg.Content, Source: "imported"})
+        case openai.ChatMessageRoleAssistant:
+            if len(turns) == 0 {
+                turns = append(turns, ConversationTurn{Time: thread.CreatedAt, Source: "imported"})
+            }
+            last := &turns[len(turns)-1]
+            if last.Response != "" {
+                last.Response += "\n\n"
+            }
+            last.Response += msg.Content
+        }
+    }
+    return turns
+}
+
+// importHistory keeps the most recent messages that fit in
+// maxImportHistoryChars, as the context of the next questions.
+func importHistory(messages []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+    total := 0
+    start := len(messages)
+    for start > 0 {
+        size := utf8.RuneCountInString(messages[start-1].Content)
+        if total+size > maxImportHistoryChars {
+            break
+        }
+        total += size
+        start--
+    }
+    return append([]openai.ChatCompletionMessage{}, messages[start:]...)
+}
+
+func importChat(owner string, thread importedThread) (*ChatSummary, error) {
+    if len(thread.Messages) > maxImportMessages {
+        thread.Messages = thread.Messages[len(thread.Messages)-maxImportMessages:]
+    }
+    turns := importTurns(thread)
+    title := thread.Title
+    if title == "" && len(turns) > 0 {
+        title = chatTitle(turns[0].Question)
+    }
+    chat, err := createChat(owner, title)
+    if err != nil {
+        return nil, err
+    }
+    _, err = updateSession(chatSessionID(owner, chat.ID), func(session *Session) error {
+        session.History = importHistory(thread.Messages)
+        session.Turns = turns
+        if len(session.Turns) > maxSessionTurns {
+            session.Turns = session.Turns[len(session.Turns)-maxSessionTurns:]
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    chat.Turns = len(turns)
+    for i := len(turns) - 1; i >= 0; i-- {
+        if turns[i].Response != "" {
+            chat.Preview = chatTitle(turns[i].Response)
+            break
+        }
+    }
+    if !thread.CreatedAt.IsZero() {
+        chat.CreatedAt = thread.CreatedAt
+    }
+    return chat, saveChat(owner, chat)
+}
+
+// Chat Import Handler: POST /chats/import with the JSON as the body or as
+// the "file" field of a multipart form. Every conversation found becomes a
+// new chat; the first one is made current.
+func handleChatImport(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    owner, err := requestOwner(r)
+    if err != nil {
+        http.Error(w, "Error: Session not found", http.StatusBadRequest)
+        return
+    }
+    if _, ok := enforceRateLimit(w, r, owner); !ok {
+        return
+    }
+    r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+    var data []byte
+    if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+        file, _, err := r.FormFile("file")
+        if err != nil {
+            http.Error(w, "Error reading file: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        defer file.Close()
+        data, err = io.ReadAll(file)
+    } else {
+        data, err = io.ReadAll(r.Body)
+    }
+    if err != nil {
+        http.Error(w, "Error reading import: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    threads, err := parseImport(data)
+    if err != nil {
+        http.Error(w, "Error importing: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    chats := make([]*ChatSummary, 0, len(threads))
+    for _, thread := range threads {
+        if len(thread.Messages) == 0 {
+            continue
+        }
+        chat, err := importChat(owner, thread)
+        if err != nil {
+            http.Error(w, "Error importing: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        chats = append(chats, chat)
+    }
+    if len(chats) == 0 {
+        http.Error(w, "Error importing: no messages found", http.StatusBadRequest)
+        return
+    }
+    if err := setCurrentChat(owner, chats[0].ID); err != nil {
+        http.Error(w, "Error importing: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    writeJSON(w, map[string]interface{}{"chats": chats})
+}
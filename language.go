@@ -0,0 +1,253 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "os"
+    "regexp"
+    "sort"
+    "strings"
+    "unicode"
+)
+
+// Language is one of the languages ARCA-b can answer in, identified by its
+// ISO 639-1 code. Name is what the models are told, Native what users see.
+type Language struct {
+    Code   string `json:"code"`
+    Name   string `json:"name"`
+    Native string `json:"native"`
+    // News is true when NewsAPI has articles in this language.
+    News bool `json:"-"`
+    // Voice is the OpenAI text-to-speech voice; empty means the default.
+    Voice string `json:"-"`
+}
+
+var languages = map[string]Language{
+    "it": {Code: "it", Name: "Italian", Native: "Italiano", News: true, Voice: "nova"},
+    "en": {Code: "en", Name: "English", Native: "English", News: true},
+    "de": {Code: "de", Name: "German", Native: "Deutsch", News: true},
+    "fr": {Code: "fr", Name: "French", Native: "Français", News: true},
+    "es": {Code: "es", Name: "Spanish", Native: "Español", News: true},
+    "pt": {Code: "pt", Name: "Portuguese", Native: "Português", News: true},
+    "nl": {Code: "nl", Name: "Dutch", Native: "Nederlands", News: true},
+    "pl": {Code: "pl", Name: "Polish", Native: "Polski"},
+    "ru": {Code: "ru", Name: "Russian", Native: "Русский", News: true},
+    "uk": {Code: "uk", Name: "Ukrainian", Native: "Українська"},
+    "el": {Code: "el", Name: "Greek", Native: "Ελληνικά"},
+    "ar": {Code: "ar", Name: "Arabic", Native: "العربية", News: true},
+    "he": {Code: "he", Name: "Hebrew", Native: "עברית", News: true},
+    "hi": {Code: "hi", Name: "Hindi", Native: "हिन्दी"},
+    "zh": {Code: "zh", Name: "Chinese", Native: "中文", News: true},
+    "ja": {Code: "ja", Name: "Japanese", Native: "日本語"},
+    "ko": {Code: "ko", Name: "Korean", Native: "한국어"},
+}
+
+// defaultLanguage is used when the language is neither given nor
+// recognisable in the message. DEFAULT_LANGUAGE overrides it.
+var defaultLanguage = "it"
+
+func loadLanguageConfig() {
+    if code := os.Getenv("DEFAULT_LANGUAGE"); code != "" {
+        if lang, ok := parseLanguage(code); ok {
+            defaultLanguage = lang.Code
+        } else {
+            fmt.Printf("Error: unsupported DEFAULT_LANGUAGE %q, using %s\n", code, defaultLanguage)
+        }
+    }
+}
+
+// parseLanguage accepts an ISO code ("de", "de-CH"), an English name
+// ("German") or a native one ("Deutsch"), the form older clients send.
+func parseLanguage(value string) (Language, bool) {
+    value = strings.ToLower(strings.TrimSpace(value))
+    if i := strings.IndexAny(value, "-_"); i > 0 {
+        value = value[:i]
+    }
+    if lang, ok := languages[value]; ok {
+        return lang, true
+    }
+    for _, lang := range languages {
+        if strings.ToLower(lang.Name) == value || strings.ToLower(lang.Native) == value {
+            return lang, true
+        }
+    }
+    return Language{}, false
+}
+
+// resolveLanguage picks the answer language: the requested one, or the one
+// the message is written in when the request says "auto" or nothing.
+func resolveLanguage(requested, message string) (Language, error) {
+    if requested != "" && !strings.EqualFold(requested, "auto") {
+        lang, ok := parseLanguage(requested)
+        if !ok {
+            return Language{}, fmt.Errorf("unsupported language %q", requested)
+        }
+        return lang, nil
+    }
+    if code, _ := detectLanguage(message); code != "" {
+        return languages[code], nil
+    }
+    return languages[defaultLanguage], nil
+}
+
+// instruction is the sentence appended to every provider's system prompt.
+func (l Language) instruction() string {
+    return fmt.Sprintf("Respond only in %s (%s), whatever the language of the question, the conversation or the sources.", l.Name, l.Code)
+}
+
+func (l Language) voice() string {
+    if l.Voice != "" {
+        return l.Voice
+    }
+    return "alloy"
+}
+
+// stopwords are frequent short words that tell Latin-script languages
+// apart. Words frequent in more than one of them, such as "que", "en" or
+// "il", are left out, so that every word points to a single language.
+var stopwords = map[string][]string{
+    "en": {"the", "and", "are", "of", "that", "it", "for", "with", "this", "you", "what", "how", "why", "not", "have", "be", "which", "there", "from", "they", "would", "been", "their", "these"},
+    "it": {"lo", "gli", "di", "che", "è", "per", "non", "sono", "cosa", "perché", "della", "nel", "anche", "più", "ho", "questo", "quale", "alla", "degli", "questa", "nella", "sul"},
+    "de": {"der", "die", "das", "und", "ist", "nicht", "ein", "eine", "ich", "zu", "den", "mit", "von", "sie", "wie", "warum", "auch", "sind", "auf", "dem", "für", "welche", "wer", "wird", "oder", "nur"},
+    "fr": {"le", "les", "et", "est", "des", "du", "qui", "pas", "pour", "dans", "ce", "vous", "avec", "sur", "au", "comment", "pourquoi", "quoi", "une", "quel", "quelle", "sont", "elle", "nous", "cette"},
+    "es": {"el", "los", "las", "y", "qué", "cómo", "pero", "cuál", "muy", "también", "cuando", "hay", "sus", "eso", "ello", "mucho", "ellos"},
+    "pt": {"os", "é", "um", "uma", "em", "com", "não", "são", "mais", "você", "qual", "isso", "porque", "ao", "dos", "nas", "também", "muito", "pelo"},
+    "nl": {"het", "een", "van", "dat", "niet", "ik", "wat", "hoe", "waarom", "zijn", "met", "voor", "op", "ook", "maar", "welke", "er", "dit", "naar", "heeft", "worden"},
+    "pl": {"w", "na", "jest", "nie", "się", "że", "z", "co", "jak", "dlaczego", "czy", "są", "ale", "od", "który", "jaki", "oraz", "tak", "już", "przez", "tego", "być"},
+}
+
+var stopwordLanguages = func() map[string][]string {
+    index := make(map[string][]string)
+    for code, words := range stopwords {
+        for _, word := range words {
+            index[word] = append(index[word], code)
+        }
+    }
+    return index
+}()
+
+var codeBlockPattern = regexp.MustCompile("(?s)```.*?```|`[^`\n]*`|https?://\\S+")
+
+// detectLanguage guesses the language of text from its script and, for
+// Latin script, from its most frequent words. It returns "" when the text
+// is too short or too mixed to tell; confidence is between 0 and 1.
+func detectLanguage(text string) (string, float64) {
+    text = codeBlockPattern.ReplaceAllString(text, " ")
+    scripts := make(map[string]int)
+    letters := 0
+    for _, r := range text {
+        if !unicode.IsLetter(r) {
+            continue
+        }
+        letters++
+        switch {
+        case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+            scripts["ja"]++
+        case unicode.Is(unicode.Han, r):
+            scripts["han"]++
+        case unicode.Is(unicode.Hangul, r):
+            scripts["ko"]++
+        case unicode.Is(unicode.Cyrillic, r):
+            scripts["cyrillic"]++
+            if strings.ContainsRune("іїєґІЇЄҐ", r) {
+                scripts["uk"]++
+            }
+        case unicode.Is(unicode.Greek, r):
+            scripts["el"]++
+        case unicode.Is(unicode.Arabic, r):
+            scripts["ar"]++
+        case unicode.Is(unicode.Hebrew, r):
+            scripts["he"]++
+        case unicode.Is(unicode.Devanagari, r):
+            scripts["hi"]++
+        case unicode.Is(unicode.Latin, r):
+            scripts["latin"]++
+        }
+    }
+    if letters < 3 {
+        return "", 0
+    }
+    // Il giapponese mescola kana e kanji: bastano pochi kana per riconoscerlo
+    if scripts["ja"] > 0 && scripts["ja"]+scripts["han"] > letters/2 {
+        return "ja", float64(scripts["ja"]+scripts["han"]) / float64(letters)
+    }
+    best, bestCount := "", 0
+    for script, count := range scripts {
+        if script != "uk" && count > bestCount {
+            best, bestCount = script, count
+        }
+    }
+    share := float64(bestCount) / float64(letters)
+    switch best {
+    case "han":
+        return "zh", share
+    case "cyrillic":
+        if scripts["uk"] > 0 {
+            return "uk", share
+        }
+        return "ru", share
+    case "latin":
+        return detectLatin(text, share)
+    }
+    return best, share
+}
+
+func detectLatin(text string, share float64) (string, float64) {
+    words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+        return !unicode.IsLetter(r) && r != '\''
+    })
+    hits := make(map[string]float64)
+    total := 0.0
+    for _, word := range words {
+        for _, code := range stopwordLanguages[word] {
+            hits[code]++
+            total++
+        }
+    }
+    // Lettere che compaiono in una sola lingua
+    for _, hint := range []struct{ letters, code string }{{"ß", "de"}, {"ñ¿¡", "es"}, {"ãõ", "pt"}, {"ąęłńśźż", "pl"}} {
+        if strings.ContainsAny(text, hint.letters) {
+            hits[hint.code] += 2
+            total += 2
+        }
+    }
+    if total < 2 {
+        return "", 0
+    }
+    codes := make([]string, 0, len(hits))
+    for code := range hits {
+        codes = append(codes, code)
+    }
+    sort.Slice(codes, func(i, j int) bool {
+        if hits[codes[i]] != hits[codes[j]] {
+            return hits[codes[i]] > hits[codes[j]]
+        }
+        return codes[i] < codes[j]
+    })
+    confidence := hits[codes[0]] / total * share
+    if len(codes) > 1 && hits[codes[0]] == hits[codes[1]] {
+        return "", confidence
+    }
+    return codes[0], confidence
+}
+
+// checkAnswerLanguage reports the language an answer is written in and
+// whether it differs from the requested one. Answers too short or mixed to
+// classify are given the benefit of the doubt.
+func checkAnswerLanguage(answer string, want Language) (string, bool) {
+    code, confidence := detectLanguage(answer)
+    if code == "" || confidence < 0.5 {
+        return code, false
+    }
+    return code, code != want.Code
+}
+
+// Languages Handler: GET /languages lists the supported languages.
+func handleLanguages(w http.ResponseWriter, r *http.Request) {
+    list := make([]Language, 0, len(languages))
+    for _, lang := range languages {
+        list = append(list, lang)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+    writeJSON(w, map[string]interface{}{"default": defaultLanguage, "languages": list})
+}
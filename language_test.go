@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestStopwordsPointToOneLanguage(t *testing.T) {
+    for word, codes := range stopwordLanguages {
+        if len(codes) > 1 {
+            t.Errorf("stopword %q is listed for %v", word, codes)
+        }
+    }
+}
+
+func TestDetectLanguage(t *testing.T) {
+    tests := []struct {
+        text string
+        want string
+    }{
+        {"What is the capital of France and why is it there?", "en"},
+        {"Qual è la capitale della Francia e perché si trova lì?", "it"},
+        {"Warum ist der Himmel blau und wie entsteht die Farbe?", "de"},
+        {"Pourquoi le ciel est bleu et comment cette couleur apparaît?", "fr"},
+        {"¿Por qué el cielo es azul y cómo se explica eso?", "es"},
+        {"Porque o céu é azul e você sabe qual é a razão?", "pt"},
+        {"Waarom is de hemel blauw en hoe werkt dat precies?", "nl"},
+        {"Dlaczego niebo jest niebieskie i jak to działa?", "pl"},
+        {"Почему небо голубое?", "ru"},
+        {"Чому небо блакитне і що це означає?", "uk"},
+        {"为什么天空是蓝色的？", "zh"},
+        {"空はなぜ青いのですか？", "ja"},
+        {"하늘은 왜 파란색인가요?", "ko"},
+        {"Γιατί ο ουρανός είναι μπλε;", "el"},
+        {"لماذا السماء زرقاء؟", "ar"},
+        {"ok", ""},
+        {"`fmt.Println(x)` https://example.org/the/and/of", ""},
+    }
+    for _, tt := range tests {
+        if got, _ := detectLanguage(tt.text); got != tt.want {
+            t.Errorf("detectLanguage(%q) = %q; want %q", tt.text, got, tt.want)
+        }
+    }
+}
+
+func TestCheckAnswerLanguage(t *testing.T) {
+    italian := languages["it"]
+    tests := []struct {
+        answer string
+        code   string
+        wrong  bool
+    }{
+        {"La capitale della Francia è Parigi, che è anche la città più grande.", "it", false},
+        {"The capital of France is Paris, which is also the largest city.", "en", true},
+        // Risposte brevi o miste non vengono penalizzate
+        {"Paris.", "", false},
+        {"```go\nfunc main() {}\n```", "", false},
+    }
+    for _, tt := range tests {
+        code, wrong := checkAnswerLanguage(tt.answer, italian)
+        if code != tt.code || wrong != tt.wrong {
+            t.Errorf("checkAnswerLanguage(%q) = %q, %v; want %q, %v", tt.answer, code, wrong, tt.code, tt.wrong)
+        }
+    }
+}
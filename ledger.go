@@ -0,0 +1,212 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// ProviderUsage is one provider call within a chat turn.
+type ProviderUsage struct {
+    Name      string `json:"name"`
+    TokenUsage
+    CostMicros int64 `json:"costMicros"`
+    LatencyMs  int64 `json:"latencyMs"`
+    Failed     bool  `json:"failed,omitempty"`
+    // Calls is only set in summaries, where LatencyMs is the total over them.
+    Calls int `json:"calls,omitempty"`
+}
+
+// LedgerEntry records one chat turn. Entries are kept under
+// ledgerPrefix+owner+":"+timestamp so that a user's history is a prefix scan.
+type LedgerEntry struct {
+    Owner        string          `json:"owner"`
+    Tier         string          `json:"tier"`
+    Time         time.Time       `json:"time"`
+    ServiceLevel string          `json:"serviceLevel"`
+    Providers    []ProviderUsage `json:"providers"`
+    TokenUsage
+    CostMicros int64 `json:"costMicros"`
+    LatencyMs  int64 `json:"latencyMs"`
+}
+
+type UsageSummary struct {
+    Requests   int                       `json:"requests"`
+    TokenUsage
+    CostMicros int64                     `json:"costMicros"`
+    Cost       string                    `json:"cost"`
+    Providers  map[string]*ProviderUsage `json:"providers"`
+}
+
+const (
+    ledgerPrefix = "ledger:"
+    ledgerTTL    = 400 * 24 * time.Hour
+)
+
+func recordLedgerEntry(entry *LedgerEntry) {
+    for _, p := range entry.Providers {
+        entry.InputTokens += p.InputTokens
+        entry.OutputTokens += p.OutputTokens
+        entry.CostMicros += p.CostMicros
+    }
+    key := fmt.Sprintf("%s%s:%020d:%s", ledgerPrefix, entry.Owner, entry.Time.UnixNano(), uuid.New().String())
+    if err := store.Set(key, entry, ledgerTTL); err != nil {
+        fmt.Printf("Error recording usage for %s: %v\n", entry.Owner, err)
+    }
+}
+
+// loadLedger returns the entries under prefix newer than since, oldest first.
+func loadLedger(prefix string, since time.Time) ([]LedgerEntry, error) {
+    keys, err := store.Keys(prefix)
+    if err != nil {
+        return nil, err
+    }
+    entries := make([]LedgerEntry, 0, len(keys))
+    for _, key := range keys {
+        var entry LedgerEntry
+        if found, err := store.Get(key, &entry); err != nil || !found || entry.Time.Before(since) {
+            continue
+        }
+        entries = append(entries, entry)
+    }
+    sort.Slice(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+    return entries, nil
+}
+
+func summarizeUsage(entries []LedgerEntry) *UsageSummary {
+    summary := &UsageSummary{Providers: make(map[string]*ProviderUsage)}
+    for _, entry := range entries {
+        summary.Requests++
+        summary.InputTokens += entry.InputTokens
+        summary.OutputTokens += entry.OutputTokens
+        summary.CostMicros += entry.CostMicros
+        for _, p := range entry.Providers {
+            total, ok := summary.Providers[p.Name]
+            if !ok {
+                total = &ProviderUsage{Name: p.Name}
+                summary.Providers[p.Name] = total
+            }
+            total.InputTokens += p.InputTokens
+            total.OutputTokens += p.OutputTokens
+            total.CostMicros += p.CostMicros
+            total.LatencyMs += p.LatencyMs
+            total.Calls++
+            if p.Failed {
+                total.Failed = true
+            }
+        }
+    }
+    summary.Cost = formatUSD(summary.CostMicros)
+    return summary
+}
+
+func usageWindow(r *http.Request) time.Time {
+    days, _ := strconv.Atoi(r.URL.Query().Get("days"))
+    if days <= 0 || days > 366 {
+        days = 30
+    }
+    return time.Now().AddDate(0, 0, -days)
+}
+
+// Usage Handler: the caller's own consumption, limits and recent turns.
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+    owner, err := requestOwner(r)
+    if err != nil {
+        http.Error(w, "Error: Session not found", http.StatusBadRequest)
+        return
+    }
+    tracker, err := loadRequestTracker(owner)
+    if err != nil {
+        http.Error(w, "Error loading usage: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    entries, err := loadLedger(ledgerPrefix+owner+":", usageWindow(r))
+    if err != nil {
+        http.Error(w, "Error loading usage: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    remaining, err := budgetRemaining(owner, tracker.Tier)
+    if err != nil {
+        http.Error(w, "Error loading usage: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    recent := entries
+    if len(recent) > 50 {
+        recent = recent[len(recent)-50:]
+    }
+    tier := rateLimitTiers[tracker.Tier]
+    budget := spendBudgets[tracker.Tier]
+    writeJSON(w, map[string]interface{}{
+        "tier":      tracker.Tier,
+        "isPremium": tracker.IsPremium,
+        "limits": map[string]interface{}{
+            "requests":      tier.Capacity,
+            "windowSeconds": int(tier.Period.Seconds()),
+            "dailyBudget":   formatUSD(budget.Daily),
+            "monthlyBudget": formatUSD(budget.Monthly),
+        },
+        "budgetRemaining": remaining,
+        "summary":         summarizeUsage(entries),
+        "recent":          recent,
+    })
+}
+
+// Admin Usage Handler: aggregates over every owner, by day, tier and owner.
+func handleAdminUsage(w http.ResponseWriter, r *http.Request) {
+    if !adminAuthorized(w, r) {
+        return
+    }
+    entries, err := loadLedger(ledgerPrefix, usageWindow(r))
+    if err != nil {
+        http.Error(w, "Error loading usage: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    byDay := make(map[string][]LedgerEntry)
+    byTier := make(map[string][]LedgerEntry)
+    byOwner := make(map[string][]LedgerEntry)
+    levels := make(map[string]int)
+    for _, entry := range entries {
+        day := entry.Time.UTC().Format("2006-01-02")
+        byDay[day] = append(byDay[day], entry)
+        byTier[entry.Tier] = append(byTier[entry.Tier], entry)
+        byOwner[entry.Owner] = append(byOwner[entry.Owner], entry)
+        levels[entry.ServiceLevel]++
+    }
+    summarize := func(groups map[string][]LedgerEntry) map[string]*UsageSummary {
+        out := make(map[string]*UsageSummary, len(groups))
+        for name, group := range groups {
+            out[name] = summarizeUsage(group)
+        }
+        return out
+    }
+    type ownerCost struct {
+        Owner      string `json:"owner"`
+        Requests   int    `json:"requests"`
+        CostMicros int64  `json:"costMicros"`
+    }
+    var top []ownerCost
+    for owner, group := range byOwner {
+        s := summarizeUsage(group)
+        // Le sessioni anonime sono identificate solo da un prefisso
+        if strings.HasPrefix(owner, anonymousPrefix) && len(owner) > len(anonymousPrefix)+8 {
+            owner = owner[:len(anonymousPrefix)+8] + "…"
+        }
+        top = append(top, ownerCost{Owner: owner, Requests: s.Requests, CostMicros: s.CostMicros})
+    }
+    sort.Slice(top, func(i, j int) bool { return top[i].CostMicros > top[j].CostMicros })
+    if len(top) > 20 {
+        top = top[:20]
+    }
+    writeJSON(w, map[string]interface{}{
+        "total":         summarizeUsage(entries),
+        "byDay":         summarize(byDay),
+        "byTier":        summarize(byTier),
+        "serviceLevels": levels,
+        "topOwners":     top,
+    })
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+    "fmt"
+    "html"
+    "html/template"
+    "net/url"
+    "regexp"
+    "strings"
+)
+
+// renderMarkdown turns model output into HTML. It supports the subset the
+// providers actually produce (headings, lists, quotes, fenced and inline
+// code, bold, italic and links) and escapes everything else, so the result
+// is safe to embed in a page even when the text contains markup.
+func renderMarkdown(text string) template.HTML {
+    var out strings.Builder
+    var paragraph []string
+    list := ""
+    inCode := false
+
+    flushParagraph := func() {
+        if len(paragraph) > 0 {
+            out.WriteString("<p>" + strings.Join(paragraph, "<br>") + "</p>\n")
+            paragraph = nil
+        }
+    }
+    closeList := func() {
+        if list != "" {
+            out.WriteString("</" + list + ">\n")
+            list = ""
+        }
+    }
+    openList := func(tag string) {
+        if list != tag {
+            closeList()
+            out.WriteString("<" + tag + ">\n")
+            list = tag
+        }
+    }
+
+    for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+        trimmed := strings.TrimSpace(line)
+        if strings.HasPrefix(trimmed, "```") {
+            if inCode {
+                out.WriteString("</code></pre>\n")
+            } else {
+                flushParagraph()
+                closeList()
+                out.WriteString("<pre><code>")
+            }
+            inCode = !inCode
+            continue
+        }
+        if inCode {
+            out.WriteString(html.EscapeString(line) + "\n")
+            continue
+        }
+        if trimmed == "" {
+            flushParagraph()
+            closeList()
+            continue
+        }
+        if m := markdownHeading.FindStringSubmatch(trimmed); m != nil {
+            flushParagraph()
+            closeList()
+            level := len(m[1]) + 2
+            if level > 6 {
+                level = 6
+            }
+            fmt.Fprintf(&out, "<h%d>%s</h%d>\n", level, renderInline(m[2]), level)
+            continue
+        }
+        if m := markdownBullet.FindStringSubmatch(trimmed); m != nil {
+            flushParagraph()
+            openList("ul")
+            out.WriteString("<li>" + renderInline(m[1]) + "</li>\n")
+            continue
+        }
+        if m := markdownNumbered.FindStringSubmatch(trimmed); m != nil {
+            flushParagraph()
+            openList("ol")
+            out.WriteString("<li>" + renderInline(m[1]) + "</li>\n")
+            continue
+        }
+        if strings.HasPrefix(trimmed, ">") {
+            flushParagraph()
+            closeList()
+            out.WriteString("<blockquote>" + renderInline(strings.TrimSpace(strings.TrimPrefix(trimmed, ">"))) + "</blockquote>\n")
+            continue
+        }
+        closeList()
+        paragraph = append(paragraph, renderInline(trimmed))
+    }
+    if inCode {
+        out.WriteString("</code></pre>\n")
+    }
+    flushParagraph()
+    closeList()
+    return template.HTML(out.String())
+}
+
+var (
+    markdownHeading  = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+    markdownBullet   = regexp.MustCompile(`^[-*+]\s+(.*)$`)
+    markdownNumbered = regexp.MustCompile(`^\d+[.)]\s+(.*)$`)
+    markdownBold     = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+    markdownItalic   = regexp.MustCompile(`\*([^*\s][^*]*)\*`)
+    markdownLink     = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+)
+
+// renderInline formats one line. Code spans are escaped verbatim; the rest
+// is escaped first and only then decorated, so no input reaches the output
+// unescaped.
+func renderInline(text string) string {
+    parts := strings.Split(text, "`")
+    if len(parts)%2 == 0 {
+        // Backtick senza chiusura: resta testo normale
+        last := len(parts) - 1
+        parts[last-1] += "`" + parts[last]
+        parts = parts[:last]
+    }
+    var out strings.Builder
+    for i, part := range parts {
+        if i%2 == 1 {
+            out.WriteString("<code>" + html.EscapeString(part) + "</code>")
+            continue
+        }
+        // L'enfasi si applica solo al testo, mai dentro i tag dei link generati
+        escaped := html.EscapeString(part)
+        start := 0
+        for _, m := range markdownLink.FindAllStringSubmatchIndex(escaped, -1) {
+            out.WriteString(emphasize(escaped[start:m[0]]))
+            label := emphasize(escaped[m[2]:m[3]])
+            if href, ok := safeLink(html.UnescapeString(escaped[m[4]:m[5]])); ok {
+                out.WriteString(`<a href="` + html.EscapeString(href) + `" target="_blank" rel="noopener noreferrer nofollow">` + label + `</a>`)
+            } else {
+                out.WriteString(label)
+            }
+            start = m[1]
+        }
+        out.WriteString(emphasize(escaped[start:]))
+    }
+    return out.String()
+}
+
+// emphasize applies bold and italic to already escaped text.
+func emphasize(escaped string) string {
+    escaped = markdownBold.ReplaceAllString(escaped, "<strong>$1</strong>")
+    return markdownItalic.ReplaceAllString(escaped, "<em>$1</em>")
+}
+
+// safeLink only lets through web and mail links, so a link cannot run
+// script through a javascript: or data: URL.
+func safeLink(raw string) (string, bool) {
+    u, err := url.Parse(raw)
+    if err != nil {
+        return "", false
+    }
+    switch strings.ToLower(u.Scheme) {
+    case "http", "https", "mailto":
+        return u.String(), true
+    case "":
+        if strings.HasPrefix(raw, "/") && !strings.HasPrefix(raw, "//") {
+            return u.String(), true
+        }
+    }
+    return "", false
+}
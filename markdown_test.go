@@ -0,0 +1,82 @@
+package main
+
+import (
+    "regexp"
+    "strings"
+    "testing"
+)
+
+// hrefPattern finds the href values of the rendered links.
+var hrefPattern = regexp.MustCompile(`href="([^"]*)"`)
+
+func TestRenderMarkdownSanitizes(t *testing.T) {
+    tests := []struct {
+        name    string
+        text    string
+        want    []string
+        notWant []string
+    }{
+        {"script tag", "Hello <script>alert(1)</script>", []string{"&lt;script&gt;alert(1)&lt;/script&gt;"}, []string{"<script"}},
+        {"img onerror", `<img src=x onerror="alert(1)">`, []string{"&lt;img"}, []string{"<img"}},
+        {"script in heading and list", "# <script>x</script>\n- <b onclick=x>y</b>", nil, []string{"<script", "<b "}},
+        {"javascript link", "[x](javascript:alert(1))", []string{"x"}, []string{"href", "javascript:alert"}},
+        {"mixed case javascript link", "[x](JaVaScRiPt:alert`1`)", nil, []string{"href"}},
+        {"data link", "[x](data:text/html;base64,PHNjcmlwdD4=)", nil, []string{"href"}},
+        {"entity encoded javascript link", "[x](javascript&#58;alert(1))", nil, []string{"href"}},
+        {"protocol relative link", "[x](//evil.example)", nil, []string{"href"}},
+        {"quote breakout", `[x](https://example.org/"onmouseover="alert(1))`, []string{`href="https://example.org/%22onmouseover=%22alert%281"`}, []string{`"onmouseover`}},
+        {"single quote breakout", `[x](https://example.org/'onmouseover='alert(1))`, nil, []string{`'onmouseover`}},
+        {"safe links", "[site](https://example.org/a?b=1&c=2) and [mail](mailto:a@example.org) and [page](/about)", []string{`href="https://example.org/a?b=1&amp;c=2"`, `href="mailto:a@example.org"`, `href="/about"`}, nil},
+        {"unclosed backtick", "a `b <i>x</i>", []string{"a `b &lt;i&gt;x&lt;/i&gt;"}, []string{"<code>", "<i>"}},
+        {"code span", "run `<script>` now", []string{"<code>&lt;script&gt;</code>"}, []string{"<script"}},
+        {"unclosed fence", "text\n```\n<script>alert(1)</script>\n**not bold**", []string{"<pre><code>&lt;script&gt;", "**not bold**\n</code></pre>"}, []string{"<script", "<strong>"}},
+        {"emphasis", "**bold** and *italic*", []string{"<strong>bold</strong>", "<em>italic</em>"}, nil},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := string(renderMarkdown(tt.text))
+            for _, want := range tt.want {
+                if !strings.Contains(got, want) {
+                    t.Errorf("output lacks %q:\n%s", want, got)
+                }
+            }
+            for _, notWant := range tt.notWant {
+                if strings.Contains(got, notWant) {
+                    t.Errorf("output contains %q:\n%s", notWant, got)
+                }
+            }
+        })
+    }
+}
+
+func TestRenderMarkdownEmphasisOutsideLinks(t *testing.T) {
+    got := string(renderMarkdown("See [the *list*](https://example.org/a*b*c) and *more*"))
+    hrefs := hrefPattern.FindAllStringSubmatch(got, -1)
+    if len(hrefs) != 1 || hrefs[0][1] != "https://example.org/a*b*c" {
+        t.Fatalf("href = %v in:\n%s", hrefs, got)
+    }
+    for _, want := range []string{"<em>list</em></a>", "and <em>more</em>"} {
+        if !strings.Contains(got, want) {
+            t.Errorf("output lacks %q:\n%s", want, got)
+        }
+    }
+}
+
+func TestSafeLink(t *testing.T) {
+    for raw, ok := range map[string]bool{
+        "https://example.org":    true,
+        "http://example.org/x":   true,
+        "mailto:a@example.org":   true,
+        "/relative":              true,
+        "javascript:alert(1)":    false,
+        " javascript:alert(1)":   false,
+        "vbscript:msgbox":        false,
+        "data:text/html,x":       false,
+        "//evil.example":         false,
+        "relative/without/slash": false,
+    } {
+        if _, got := safeLink(raw); got != ok {
+            t.Errorf("safeLink(%q) = %v; want %v", raw, got, ok)
+        }
+    }
+}
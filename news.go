@@ -0,0 +1,951 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha1"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/xml"
+    "fmt"
+    "html"
+    "io"
+    "math"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "unicode"
+)
+
+// Article is a document found by a NewsSource: a news item, an
+// encyclopedia entry or a local file.
+type Article struct {
+    ID          string    `json:"id"`
+    Title       string    `json:"title"`
+    Description string    `json:"description,omitempty"`
+    URL         string    `json:"url,omitempty"`
+    Source      string    `json:"source"`
+    Author      string    `json:"author,omitempty"`
+    PublishedAt time.Time `json:"publishedAt,omitempty"`
+    // Retriever is the connector that found the article; AlsoIn lists the
+    // other connectors that returned the same one.
+    Retriever string   `json:"retriever"`
+    AlsoIn    []string `json:"alsoIn,omitempty"`
+    Score     float64  `json:"score"`
+}
+
+// NewsSource is a connector that finds documents relevant to a question.
+type NewsSource interface {
+    Name() string
+    Search(ctx context.Context, query NewsQuery, lang Language, limit int) ([]Article, error)
+}
+
+// referenceSource is implemented by sources of background material rather
+// than news, which are still searched for questions that are not about
+// current events.
+type referenceSource interface {
+    reference()
+}
+
+const (
+    newsTimeout     = 5 * time.Second
+    maxNewsArticles = 5
+    maxFeedBytes    = 5 << 20
+    maxFolderFiles  = 2000
+    maxPerPublisher = 2
+)
+
+// newsSources builds the connectors configured in the environment:
+//   NEWS_SOURCES  which ones to use, default "newsapi,gdelt,wikipedia,rss,folder"
+//   NEWS_API_KEY  for newsapi.org
+//   NEWS_FEEDS    comma-separated RSS or Atom feed URLs, optionally "name=url"
+//   NEWS_FOLDER   a directory of .txt, .md or .html documents, e.g. an
+//                 extracted Wikipedia dump
+//   NEWS_FIXTURES serve every HTTP request from this directory instead of
+//                 the network, see fixtureTransport
+func newsSources(client *http.Client, newsAPIKey string) []NewsSource {
+    if dir := os.Getenv("NEWS_FIXTURES"); dir != "" {
+        client = &http.Client{Transport: fixtureTransport{dir: dir}}
+        fmt.Printf("News sources read from fixtures in %s\n", dir)
+    }
+    enabled := os.Getenv("NEWS_SOURCES")
+    if enabled == "" {
+        enabled = "newsapi,gdelt,wikipedia,rss,folder"
+    }
+    var sources []NewsSource
+    for _, name := range strings.Split(enabled, ",") {
+        switch strings.TrimSpace(strings.ToLower(name)) {
+        case "newsapi":
+            if newsAPIKey != "" {
+                sources = append(sources, &newsAPISource{key: newsAPIKey, client: client, endpoint: "https://newsapi.org/v2/everything"})
+            }
+        case "gdelt":
+            sources = append(sources, &gdeltSource{client: client, endpoint: "https://api.gdeltproject.org/api/v2/doc/doc"})
+        case "wikipedia":
+            sources = append(sources, &wikipediaSource{client: client, endpoint: "https://%s.wikipedia.org/w/api.php"})
+        case "rss":
+            for _, feed := range strings.Split(os.Getenv("NEWS_FEEDS"), ",") {
+                if feed = strings.TrimSpace(feed); feed == "" {
+                    continue
+                }
+                name, feedURL := "", feed
+                if i := strings.Index(feed, "="); i > 0 && !strings.Contains(feed[:i], "/") {
+                    name, feedURL = feed[:i], feed[i+1:]
+                }
+                if name == "" {
+                    if u, err := url.Parse(feedURL); err == nil {
+                        name = u.Host
+                    }
+                }
+                sources = append(sources, &feedSource{name: name, url: feedURL, client: client})
+            }
+        case "folder":
+            if dir := os.Getenv("NEWS_FOLDER"); dir != "" {
+                sources = append(sources, &folderSource{dir: dir})
+            }
+        case "":
+        default:
+            fmt.Printf("Error: unknown news source %q in NEWS_SOURCES\n", name)
+        }
+    }
+    names := make([]string, len(sources))
+    for i, source := range sources {
+        names[i] = source.Name()
+    }
+    fmt.Printf("News sources: %s\n", strings.Join(names, ", "))
+    return sources
+}
+
+// searchNews queries every source in parallel, then merges, deduplicates
+// and ranks the results. It fails only when every source fails. Queries
+// marked Skip search nothing, and those that are not time-sensitive only
+// search reference sources.
+func searchNews(ctx context.Context, sources []NewsSource, query NewsQuery, lang Language, limit int) ([]Article, error) {
+    if len(sources) == 0 {
+        return nil, fmt.Errorf("no news sources configured")
+    }
+    if query.Skip {
+        return nil, nil
+    }
+    if !query.TimeSensitive {
+        var reference []NewsSource
+        for _, source := range sources {
+            if _, ok := source.(referenceSource); ok {
+                reference = append(reference, source)
+            }
+        }
+        if len(reference) == 0 {
+            return nil, nil
+        }
+        sources = reference
+    }
+    ctx, cancel := context.WithTimeout(ctx, newsTimeout)
+    defer cancel()
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    var found []Article
+    var errs []string
+    for _, source := range sources {
+        wg.Add(1)
+        go func(source NewsSource) {
+            defer wg.Done()
+            articles, err := source.Search(ctx, query, lang, limit)
+            mu.Lock()
+            defer mu.Unlock()
+            if err != nil {
+                errs = append(errs, fmt.Sprintf("%s: %v", source.Name(), err))
+                return
+            }
+            for _, article := range articles {
+                if !query.within(article.PublishedAt) {
+                    continue
+                }
+                article.Retriever = source.Name()
+                found = append(found, article)
+            }
+        }(source)
+    }
+    wg.Wait()
+    if len(errs) > 0 {
+        fmt.Printf("News sources failed: %s\n", strings.Join(errs, "; "))
+    }
+    if len(errs) == len(sources) {
+        return nil, fmt.Errorf("all news sources failed: %s", strings.Join(errs, "; "))
+    }
+    return rankArticles(found, query.words(), limit, time.Now()), nil
+}
+
+// rankArticles merges duplicates (same URL or same title), scores each
+// article by how many query terms it contains, how recent it is and how
+// many sources returned it, and keeps at most maxPerPublisher articles
+// from the same publisher so no single outlet dominates the context.
+func rankArticles(articles []Article, terms []string, limit int, now time.Time) []Article {
+    var merged []*Article
+    byKey := make(map[string]*Article)
+    for i := range articles {
+        article := articles[i]
+        var keys []string
+        if title := normalizeTitle(article.Title); title != "" {
+            keys = append(keys, "title:"+title)
+        }
+        if article.URL != "" {
+            keys = append(keys, "url:"+normalizeURL(article.URL))
+        }
+        var existing *Article
+        for _, key := range keys {
+            if existing = byKey[key]; existing != nil {
+                break
+            }
+        }
+        if existing != nil {
+            if existing.Retriever != article.Retriever && !containsString(existing.AlsoIn, article.Retriever) {
+                existing.AlsoIn = append(existing.AlsoIn, article.Retriever)
+            }
+            if len(article.Description) > len(existing.Description) {
+                existing.Description = article.Description
+            }
+            // Anche le chiavi del duplicato puntano all'originale, così una
+            // terza copia con lo stesso URL e un altro titolo viene unita
+            for _, key := range keys {
+                if byKey[key] == nil {
+                    byKey[key] = existing
+                }
+            }
+            continue
+        }
+        merged = append(merged, &article)
+        for _, key := range keys {
+            byKey[key] = &article
+        }
+    }
+
+    for _, article := range merged {
+        article.Score = relevance(article, terms) * recency(article.PublishedAt, now) * (1 + 0.5*float64(len(article.AlsoIn)))
+        if article.ID == "" {
+            article.ID = articleID(article)
+        }
+    }
+    sort.SliceStable(merged, func(i, j int) bool { return merged[i].Score > merged[j].Score })
+
+    ranked := make([]Article, 0, limit)
+    perPublisher := make(map[string]int)
+    for _, article := range merged {
+        if len(ranked) == limit {
+            break
+        }
+        if article.Score == 0 || perPublisher[article.Source] >= maxPerPublisher {
+            continue
+        }
+        perPublisher[article.Source]++
+        ranked = append(ranked, *article)
+    }
+    return ranked
+}
+
+func relevance(article *Article, terms []string) float64 {
+    if len(terms) == 0 {
+        return 1
+    }
+    title := strings.ToLower(article.Title)
+    body := strings.ToLower(article.Description)
+    score := 0.0
+    for _, term := range terms {
+        if strings.Contains(title, term) {
+            score += 2
+        } else if strings.Contains(body, term) {
+            score++
+        }
+    }
+    return score / float64(2*len(terms))
+}
+
+// recency halves the weight of an article every 30 days. Undated documents,
+// such as encyclopedia entries, count as a month old.
+func recency(published, now time.Time) float64 {
+    age := 30.0
+    if !published.IsZero() {
+        age = math.Max(0, now.Sub(published).Hours()/24)
+    }
+    return math.Pow(0.5, age/30)
+}
+
+// queryTerms lowercases the query and drops short and common words.
+func queryTerms(query string) []string {
+    var terms []string
+    seen := make(map[string]bool)
+    for _, word := range strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+    }) {
+        if len([]rune(word)) < 3 || stopwordLanguages[word] != nil || queryFillers[word] || seen[word] {
+            continue
+        }
+        seen[word] = true
+        terms = append(terms, word)
+    }
+    return terms
+}
+
+func normalizeTitle(title string) string {
+    return strings.Join(strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+    }), " ")
+}
+
+func normalizeURL(raw string) string {
+    u, err := url.Parse(raw)
+    if err != nil {
+        return raw
+    }
+    return strings.TrimPrefix(strings.ToLower(u.Host), "www.") + strings.TrimSuffix(u.Path, "/")
+}
+
+func articleID(article *Article) string {
+    key := article.URL
+    if key == "" {
+        key = article.Source + "\n" + article.Title
+    }
+    sum := sha1.Sum([]byte(key))
+    return hex.EncodeToString(sum[:4])
+}
+
+func containsString(list []string, value string) bool {
+    for _, item := range list {
+        if item == value {
+            return true
+        }
+    }
+    return false
+}
+
+// groundingPrompt lists the articles, numbered, for the providers' system
+// prompt, and asks them to cite the numbers.
+func groundingPrompt(articles []Article, lang Language) string {
+    if len(articles) == 0 {
+        return ""
+    }
+    var out strings.Builder
+    fmt.Fprintf(&out, "Sources retrieved for this question follow. Use them when they are relevant and cite them with their number in brackets, e.g. [1] or [1][3], right after the statement they support. "+
+        "Cite only the numbers listed here. If the sources do not cover the question, answer from your own knowledge without citations. "+
+        "The sources may be in other languages: your answer must still be in %s.\n", lang.Name)
+    for i, article := range articles {
+        fmt.Fprintf(&out, "\n[%d] %s", i+1, article.Title)
+        var meta []string
+        if article.Source != "" {
+            meta = append(meta, article.Source)
+        }
+        if !article.PublishedAt.IsZero() {
+            meta = append(meta, article.PublishedAt.Format("2006-01-02"))
+        }
+        if len(meta) > 0 {
+            fmt.Fprintf(&out, " (%s)", strings.Join(meta, ", "))
+        }
+        if article.URL != "" {
+            fmt.Fprintf(&out, "\n%s", article.URL)
+        }
+        if article.Description != "" {
+            fmt.Fprintf(&out, "\n%s", article.Description)
+        }
+        out.WriteString("\n")
+    }
+    return out.String()
+}
+
+var citationPattern = regexp.MustCompile(`\[(\d{1,2})\]`)
+
+// citedSources returns the 1-based numbers of the articles cited in text,
+// in order of first citation.
+func citedSources(text string, articles []Article) []int {
+    var cited []int
+    seen := make(map[int]bool)
+    for _, match := range citationPattern.FindAllStringSubmatch(text, -1) {
+        var n int
+        fmt.Sscan(match[1], &n)
+        if n >= 1 && n <= len(articles) && !seen[n] {
+            seen[n] = true
+            cited = append(cited, n)
+        }
+    }
+    return cited
+}
+
+// Citation is a source cited in an answer, with the number the answer
+// uses for it.
+type Citation struct {
+    Number int `json:"number"`
+    Article
+}
+
+// citations returns the articles cited in answer, by number, so that
+// clients can show them as references next to the [n] markers.
+func citations(answer string, articles []Article) []Citation {
+    cited := citedSources(answer, articles)
+    sort.Ints(cited)
+    list := make([]Citation, 0, len(cited))
+    for _, n := range cited {
+        list = append(list, Citation{Number: n, Article: articles[n-1]})
+    }
+    return list
+}
+
+// SourceEntry is a retrieved source as listed in a transcript, numbered as
+// the providers saw it.
+type SourceEntry struct {
+    Citation
+    Cited bool
+}
+
+// sourceEntries lists the sources of a turn: all of those retrieved when
+// all is set, otherwise only the cited ones. Turns saved before sources
+// were stored only have their citations.
+func sourceEntries(turn ConversationTurn, all bool) []SourceEntry {
+    cited := make(map[int]bool)
+    for _, c := range turn.Citations {
+        cited[c.Number] = true
+    }
+    var entries []SourceEntry
+    if !all || len(turn.Sources) == 0 {
+        for _, c := range turn.Citations {
+            entries = append(entries, SourceEntry{Citation: c, Cited: true})
+        }
+        return entries
+    }
+    for i, article := range turn.Sources {
+        entries = append(entries, SourceEntry{Citation: Citation{Number: i + 1, Article: article}, Cited: cited[i+1]})
+    }
+    return entries
+}
+
+// citationLine formats a citation for plain text and Markdown exports.
+func citationLine(c Citation) string {
+    title := c.Title
+    if link, ok := safeLink(c.URL); ok && c.URL != "" {
+        title = fmt.Sprintf("[%s](%s)", strings.NewReplacer("[", "(", "]", ")").Replace(c.Title), link)
+    }
+    line := fmt.Sprintf("[%d] %s", c.Number, title)
+    var meta []string
+    for _, value := range []string{c.Source, c.Author} {
+        if value != "" {
+            meta = append(meta, value)
+        }
+    }
+    if !c.PublishedAt.IsZero() {
+        meta = append(meta, c.PublishedAt.Format("2006-01-02"))
+    }
+    if len(meta) > 0 {
+        line += " — " + strings.Join(meta, ", ")
+    }
+    return line
+}
+
+var htmlTagPattern = regexp.MustCompile(`(?s)<[^>]*>`)
+
+// plainText strips markup and collapses whitespace.
+func plainText(text string) string {
+    text = html.UnescapeString(htmlTagPattern.ReplaceAllString(text, " "))
+    return strings.Join(strings.Fields(text), " ")
+}
+
+func parseFeedTime(value string) time.Time {
+    value = strings.TrimSpace(value)
+    for _, layout := range []string{time.RFC1123Z, time.RFC1123, time.RFC3339, "Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST", "20060102T150405Z", "2006-01-02"} {
+        if t, err := time.Parse(layout, value); err == nil {
+            return t.UTC()
+        }
+    }
+    return time.Time{}
+}
+
+func fetchJSON(ctx context.Context, client *http.Client, endpoint string, v interface{}) error {
+    req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+    if err != nil {
+        return fmt.Errorf("error creating request: %v", err)
+    }
+    req.Header.Set("Accept", "application/json")
+    req.Header.Set("User-Agent", "ARCA-b/1.0 (+https://arcab-global-ai.org)")
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    body, err := io.ReadAll(io.LimitReader(resp.Body, maxFeedBytes))
+    if err != nil {
+        return fmt.Errorf("error reading response: %v", err)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+    }
+    if err := json.Unmarshal(body, v); err != nil {
+        return fmt.Errorf("error parsing response: %v", err)
+    }
+    return nil
+}
+
+// newsAPISource queries newsapi.org.
+type newsAPISource struct {
+    key      string
+    client   *http.Client
+    endpoint string
+}
+
+func (s *newsAPISource) Name() string { return "NewsAPI" }
+
+func (s *newsAPISource) Search(ctx context.Context, query NewsQuery, lang Language, limit int) ([]Article, error) {
+    // NewsAPI copre solo alcune lingue: per le altre si cercano notizie in inglese
+    newsLanguage := "en"
+    if lang.News {
+        newsLanguage = lang.Code
+    }
+    params := url.Values{"q": {query.boolean(" AND ")}, "sortBy": {"relevancy"}, "language": {newsLanguage}, "pageSize": {fmt.Sprint(limit)}, "apiKey": {s.key}}
+    if !query.From.IsZero() {
+        params.Set("from", query.From.Format("2006-01-02"))
+        params.Set("to", query.To.Format("2006-01-02"))
+        params.Set("sortBy", "publishedAt")
+    }
+    var result struct {
+        Status   string `json:"status"`
+        Message  string `json:"message"`
+        Articles []struct {
+            Source struct {
+                Name string `json:"name"`
+            } `json:"source"`
+            Author      string `json:"author"`
+            Title       string `json:"title"`
+            Description string `json:"description"`
+            URL         string `json:"url"`
+            PublishedAt string `json:"publishedAt"`
+        } `json:"articles"`
+    }
+    if err := fetchJSON(ctx, s.client, s.endpoint+"?"+params.Encode(), &result); err != nil {
+        return nil, err
+    }
+    if result.Status != "ok" {
+        return nil, fmt.Errorf("error from NewsAPI: %s", result.Message)
+    }
+    articles := make([]Article, 0, len(result.Articles))
+    for _, a := range result.Articles {
+        articles = append(articles, Article{
+            Title:       a.Title,
+            Description: plainText(a.Description),
+            URL:         a.URL,
+            Source:      a.Source.Name,
+            Author:      a.Author,
+            PublishedAt: parseFeedTime(a.PublishedAt),
+        })
+    }
+    return articles, nil
+}
+
+// gdeltSource queries the GDELT DOC 2.0 API, which indexes news from
+// outlets in most countries and languages.
+type gdeltSource struct {
+    client   *http.Client
+    endpoint string
+}
+
+func (s *gdeltSource) Name() string { return "GDELT" }
+
+func (s *gdeltSource) Search(ctx context.Context, query NewsQuery, lang Language, limit int) ([]Article, error) {
+    q := query.boolean(" ")
+    if q == "" {
+        return nil, nil
+    }
+    q += " sourcelang:" + strings.ToLower(lang.Name)
+    params := url.Values{"query": {q}, "mode": {"artlist"}, "format": {"json"}, "maxrecords": {fmt.Sprint(2 * limit)}, "sort": {"hybridrel"}}
+    // GDELT copre solo gli ultimi tre mesi: per periodi più vecchi non si filtra
+    if !query.From.IsZero() && time.Since(query.From) < 90*24*time.Hour {
+        params.Set("startdatetime", query.From.UTC().Format("20060102150405"))
+        params.Set("enddatetime", query.To.UTC().Format("20060102150405"))
+    }
+    var result struct {
+        Articles []struct {
+            URL      string `json:"url"`
+            Title    string `json:"title"`
+            SeenDate string `json:"seendate"`
+            Domain   string `json:"domain"`
+            Language string `json:"language"`
+        } `json:"articles"`
+    }
+    if err := fetchJSON(ctx, s.client, s.endpoint+"?"+params.Encode(), &result); err != nil {
+        return nil, err
+    }
+    articles := make([]Article, 0, len(result.Articles))
+    for _, a := range result.Articles {
+        articles = append(articles, Article{
+            Title:       plainText(a.Title),
+            URL:         a.URL,
+            Source:      a.Domain,
+            PublishedAt: parseFeedTime(a.SeenDate),
+        })
+    }
+    return articles, nil
+}
+
+// wikipediaSource searches Wikipedia in the answer language.
+type wikipediaSource struct {
+    client *http.Client
+    // endpoint has a %s for the language code.
+    endpoint string
+}
+
+func (s *wikipediaSource) Name() string { return "Wikipedia" }
+
+func (s *wikipediaSource) reference() {}
+
+func (s *wikipediaSource) Search(ctx context.Context, query NewsQuery, lang Language, limit int) ([]Article, error) {
+    search := strings.TrimSpace(strings.Join(query.Phrases, " ") + " " + strings.Join(query.Terms, " "))
+    if search == "" {
+        return nil, nil
+    }
+    endpoint := fmt.Sprintf(s.endpoint, lang.Code)
+    params := url.Values{"action": {"query"}, "list": {"search"}, "srsearch": {search}, "srlimit": {fmt.Sprint(limit)}, "format": {"json"}, "utf8": {"1"}}
+    var result struct {
+        Query struct {
+            Search []struct {
+                Title     string `json:"title"`
+                Snippet   string `json:"snippet"`
+                Timestamp string `json:"timestamp"`
+            } `json:"search"`
+        } `json:"query"`
+    }
+    if err := fetchJSON(ctx, s.client, endpoint+"?"+params.Encode(), &result); err != nil {
+        return nil, err
+    }
+    base, _ := url.Parse(endpoint)
+    articles := make([]Article, 0, len(result.Query.Search))
+    for _, page := range result.Query.Search {
+        pageURL := url.URL{Scheme: base.Scheme, Host: base.Host, Path: "/wiki/" + strings.ReplaceAll(page.Title, " ", "_")}
+        articles = append(articles, Article{
+            Title:       page.Title,
+            Description: plainText(page.Snippet),
+            URL:         pageURL.String(),
+            Source:      "Wikipedia (" + lang.Code + ")",
+            // L'ultima modifica non è la data dei fatti: le voci restano "non datate"
+        })
+    }
+    return articles, nil
+}
+
+// feedSource reads an RSS 2.0, RSS 1.0 or Atom feed and keeps the items
+// that mention the query.
+type feedSource struct {
+    name   string
+    url    string
+    client *http.Client
+}
+
+func (s *feedSource) Name() string { return "RSS " + s.name }
+
+type feedDocument struct {
+    Title   string `xml:"title"`
+    Channel struct {
+        Title string     `xml:"title"`
+        Items []feedItem `xml:"item"`
+    } `xml:"channel"`
+    Items   []feedItem `xml:"item"`
+    Entries []struct {
+        Title string `xml:"title"`
+        Links []struct {
+            Href string `xml:"href,attr"`
+            Rel  string `xml:"rel,attr"`
+        } `xml:"link"`
+        Summary   string `xml:"summary"`
+        Content   string `xml:"content"`
+        Published string `xml:"published"`
+        Updated   string `xml:"updated"`
+        Author    struct {
+            Name string `xml:"name"`
+        } `xml:"author"`
+    } `xml:"entry"`
+}
+
+type feedItem struct {
+    Title       string `xml:"title"`
+    Link        string `xml:"link"`
+    Description string `xml:"description"`
+    PubDate     string `xml:"pubDate"`
+    Date        string `xml:"http://purl.org/dc/elements/1.1/ date"`
+    Creator     string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+    Author      string `xml:"author"`
+}
+
+func (s *feedSource) Search(ctx context.Context, query NewsQuery, lang Language, limit int) ([]Article, error) {
+    req, err := http.NewRequestWithContext(ctx, "GET", s.url, nil)
+    if err != nil {
+        return nil, fmt.Errorf("error creating request: %v", err)
+    }
+    req.Header.Set("User-Agent", "ARCA-b/1.0 (+https://arcab-global-ai.org)")
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("status %d", resp.StatusCode)
+    }
+    data, err := io.ReadAll(io.LimitReader(resp.Body, maxFeedBytes))
+    if err != nil {
+        return nil, fmt.Errorf("error reading feed: %v", err)
+    }
+    articles, err := parseFeed(data)
+    if err != nil {
+        return nil, err
+    }
+    for i := range articles {
+        if articles[i].Source == "" {
+            articles[i].Source = s.name
+        }
+    }
+    return matchingArticles(articles, query.words(), limit), nil
+}
+
+func parseFeed(data []byte) ([]Article, error) {
+    var doc feedDocument
+    decoder := xml.NewDecoder(bytes.NewReader(data))
+    decoder.Strict = false
+    decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+        switch strings.ToLower(charset) {
+        case "iso-8859-1", "latin1", "windows-1252":
+            return latin1Reader(input)
+        }
+        return input, nil
+    }
+    if err := decoder.Decode(&doc); err != nil {
+        return nil, fmt.Errorf("error parsing feed: %v", err)
+    }
+    var articles []Article
+    for _, item := range append(doc.Channel.Items, doc.Items...) {
+        author := item.Creator
+        if author == "" {
+            author = item.Author
+        }
+        published := parseFeedTime(item.PubDate)
+        if published.IsZero() {
+            published = parseFeedTime(item.Date)
+        }
+        articles = append(articles, Article{
+            Title:       plainText(item.Title),
+            Description: plainText(item.Description),
+            URL:         strings.TrimSpace(item.Link),
+            Source:      plainText(doc.Channel.Title),
+            Author:      author,
+            PublishedAt: published,
+        })
+    }
+    for _, entry := range doc.Entries {
+        var link string
+        for _, l := range entry.Links {
+            if l.Rel == "" || l.Rel == "alternate" {
+                link = l.Href
+                break
+            }
+        }
+        description := entry.Summary
+        if description == "" {
+            description = entry.Content
+        }
+        published := parseFeedTime(entry.Published)
+        if published.IsZero() {
+            published = parseFeedTime(entry.Updated)
+        }
+        articles = append(articles, Article{
+            Title:       plainText(entry.Title),
+            Description: plainText(description),
+            URL:         link,
+            Source:      plainText(doc.Title),
+            Author:      entry.Author.Name,
+            PublishedAt: published,
+        })
+    }
+    return articles, nil
+}
+
+func latin1Reader(input io.Reader) (io.Reader, error) {
+    data, err := io.ReadAll(input)
+    if err != nil {
+        return nil, err
+    }
+    runes := make([]rune, len(data))
+    for i, b := range data {
+        runes[i] = rune(b)
+    }
+    return strings.NewReader(string(runes)), nil
+}
+
+// matchingArticles keeps the articles that contain at least one query term,
+// most relevant first.
+func matchingArticles(articles []Article, terms []string, limit int) []Article {
+    var matches []Article
+    for _, article := range articles {
+        if relevance(&article, terms) > 0 {
+            matches = append(matches, article)
+        }
+    }
+    sort.SliceStable(matches, func(i, j int) bool { return relevance(&matches[i], terms) > relevance(&matches[j], terms) })
+    if len(matches) > limit {
+        matches = matches[:limit]
+    }
+    return matches
+}
+
+// folderSource searches text documents in a local directory, such as an
+// archive of reports or an extracted Wikipedia dump. The documents are read
+// once and kept in memory: the folder is walked again at most every
+// folderRefreshInterval, and only the files whose size or modification time
+// changed are read again, as documentIndex.Scan does.
+type folderSource struct {
+    dir string
+
+    mu        sync.Mutex
+    files     map[string]folderFile
+    refreshed time.Time
+}
+
+type folderFile struct {
+    size    int64
+    modTime time.Time
+    article Article
+}
+
+const folderRefreshInterval = time.Minute
+
+func (s *folderSource) Name() string { return "Folder" }
+
+func (s *folderSource) reference() {}
+
+func (s *folderSource) Search(ctx context.Context, query NewsQuery, lang Language, limit int) ([]Article, error) {
+    terms := query.words()
+    if len(terms) == 0 {
+        return nil, nil
+    }
+    s.mu.Lock()
+    if s.files == nil || time.Since(s.refreshed) > folderRefreshInterval {
+        if err := s.refresh(); err != nil {
+            s.mu.Unlock()
+            return nil, err
+        }
+    }
+    // In ordine di percorso, così a pari rilevanza l'ordine è stabile
+    paths := make([]string, 0, len(s.files))
+    for path := range s.files {
+        paths = append(paths, path)
+    }
+    sort.Strings(paths)
+    articles := make([]Article, 0, len(paths))
+    for _, path := range paths {
+        articles = append(articles, s.files[path].article)
+    }
+    s.mu.Unlock()
+    return matchingArticles(articles, terms, limit), nil
+}
+
+// refresh brings the in-memory copy of the folder up to date; the caller
+// holds s.mu. It does not use the request context: an index read in part
+// would be worse than a slow first search.
+func (s *folderSource) refresh() error {
+    files := make(map[string]folderFile)
+    err := filepath.WalkDir(s.dir, func(path string, entry os.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if entry.IsDir() {
+            return nil
+        }
+        switch strings.ToLower(filepath.Ext(path)) {
+        case ".txt", ".md", ".html", ".htm":
+        default:
+            return nil
+        }
+        if len(files) >= maxFolderFiles {
+            return filepath.SkipAll
+        }
+        info, err := entry.Info()
+        if err != nil {
+            return nil
+        }
+        if old, ok := s.files[path]; ok && old.size == info.Size() && old.modTime.Equal(info.ModTime()) {
+            files[path] = old
+            return nil
+        }
+        article, err := readFolderDocument(s.dir, path)
+        if err != nil {
+            fmt.Printf("Error reading %s: %v\n", path, err)
+            return nil
+        }
+        files[path] = folderFile{size: info.Size(), modTime: info.ModTime(), article: article}
+        return nil
+    })
+    if err != nil {
+        return fmt.Errorf("error reading %s: %v", s.dir, err)
+    }
+    s.files = files
+    s.refreshed = time.Now()
+    return nil
+}
+
+func readFolderDocument(dir, path string) (Article, error) {
+    info, err := os.Stat(path)
+    if err != nil {
+        return Article{}, err
+    }
+    file, err := os.Open(path)
+    if err != nil {
+        return Article{}, err
+    }
+    defer file.Close()
+    data, err := io.ReadAll(io.LimitReader(file, 256<<10))
+    if err != nil {
+        return Article{}, err
+    }
+    text := string(data)
+    if ext := strings.ToLower(filepath.Ext(path)); ext == ".html" || ext == ".htm" {
+        text = plainText(text)
+    }
+    rel, _ := filepath.Rel(dir, path)
+    title := filepath.Base(path)
+    for _, line := range strings.Split(text, "\n") {
+        if line = strings.TrimSpace(strings.TrimLeft(line, "# ")); line != "" {
+            title = line
+            break
+        }
+    }
+    description := strings.Join(strings.Fields(text), " ")
+    if len([]rune(description)) > 1000 {
+        description = string([]rune(description)[:1000]) + "..."
+    }
+    return Article{
+        Title:       chatTitle(title),
+        Description: description,
+        Source:      "local:" + filepath.ToSlash(rel),
+        PublishedAt: info.ModTime().UTC(),
+    }, nil
+}
+
+// fixtureTransport answers HTTP requests from files, so the connectors can
+// run without network: a request for https://host/path?query is served from
+// dir/host/path, ignoring the query string. testdata/news has a fixture for
+// every connector.
+type fixtureTransport struct {
+    dir string
+}
+
+func (t fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    path := filepath.Join(t.dir, req.URL.Host, filepath.FromSlash(req.URL.Path))
+    data, err := os.ReadFile(path)
+    status := http.StatusOK
+    if err != nil {
+        data, status = []byte(err.Error()), http.StatusNotFound
+    }
+    return &http.Response{
+        StatusCode: status,
+        Status:     http.StatusText(status),
+        Header:     http.Header{},
+        Body:       io.NopCloser(bytes.NewReader(data)),
+        Request:    req,
+    }, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "os"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+)
+
+// fixtureClient serves the connectors from testdata/news, so no test needs
+// the network.
+var fixtureClient = &http.Client{Transport: fixtureTransport{dir: "testdata/news"}}
+
+func TestNewsSourcesFromFixtures(t *testing.T) {
+    ecb := NewsQuery{Terms: []string{"ecb"}}
+    tests := []struct {
+        name   string
+        source NewsSource
+        query  NewsQuery
+        lang   string
+        want   []Article
+    }{
+        {"newsapi", &newsAPISource{key: "key", client: fixtureClient, endpoint: "https://newsapi.org/v2/everything"}, ecb, "en", []Article{
+            {Title: "European Central Bank holds interest rates steady", Description: "The ECB kept its deposit rate unchanged on Thursday.", URL: "https://www.reuters.com/markets/ecb-holds-rates", Source: "Reuters", Author: "Jane Smith", PublishedAt: time.Date(2026, 10, 16, 12, 15, 0, 0, time.UTC)},
+            {Title: "Bce, tassi fermi", Description: "La Banca centrale europea lascia i tassi invariati.", URL: "https://www.ilsole24ore.com/art/bce-tassi", Source: "Il Sole 24 Ore", PublishedAt: time.Date(2026, 10, 16, 13, 2, 11, 0, time.UTC)},
+        }},
+        {"gdelt", &gdeltSource{client: fixtureClient, endpoint: "https://api.gdeltproject.org/api/v2/doc/doc"}, ecb, "en", []Article{
+            {Title: "La BCE maintient ses taux & attend", URL: "https://www.lemonde.fr/economie/article/2026/10/16/bce-taux", Source: "lemonde.fr", PublishedAt: time.Date(2026, 10, 16, 13, 45, 0, 0, time.UTC)},
+            {Title: "ECB keeps rates on hold", URL: "https://www.dw.com/en/ecb-rates/a-7000", Source: "dw.com", PublishedAt: time.Date(2026, 10, 16, 12, 15, 0, 0, time.UTC)},
+        }},
+        {"wikipedia", &wikipediaSource{client: fixtureClient, endpoint: "https://%s.wikipedia.org/w/api.php"}, ecb, "en", []Article{
+            {Title: "European Central Bank", Description: "The European Central Bank (ECB) is the prime component of the Eurosystem", URL: "https://en.wikipedia.org/wiki/European_Central_Bank", Source: "Wikipedia (en)"},
+            {Title: "Monetary policy", Description: "Monetary policy is the policy adopted by the monetary authority", URL: "https://en.wikipedia.org/wiki/Monetary_policy", Source: "Wikipedia (en)"},
+        }},
+        {"rss", &feedSource{name: "world", url: "https://feeds.example.org/world.rss", client: fixtureClient}, ecb, "en", []Article{
+            {Title: "ECB decision keeps markets calm", Description: "Markets reacted calmly to the ECB decision.", URL: "https://news.example.org/ecb-decision", Source: "Example World News", Author: "Mario Rossi", PublishedAt: time.Date(2026, 10, 16, 14, 0, 0, 0, time.UTC)},
+        }},
+        {"atom", &feedSource{name: "atom", url: "https://feeds.example.org/atom.xml", client: fixtureClient}, NewsQuery{Terms: []string{"inflation"}}, "en", []Article{
+            {Title: "Inflation slows in the euro area", Description: "Eurostat says inflation fell to 2.1%, easing pressure on the ECB.", URL: "https://atom.example.org/inflation", Source: "Example Atom Feed", Author: "Anna Weber", PublishedAt: time.Date(2026, 10, 17, 8, 30, 0, 0, time.UTC)},
+        }},
+        {"latin1 rss", &feedSource{name: "latin1", url: "https://feeds.example.org/latin1.rss", client: fixtureClient}, NewsQuery{Terms: []string{"bce"}}, "it", []Article{
+            {Title: "La BCE lascia i tassi invariati: città e mercati", Description: "Decisione attesa per la BCE.", URL: "https://latin1.example.org/bce", Source: "Notizie Economia", PublishedAt: time.Date(2026, 10, 16, 13, 0, 0, 0, time.UTC)},
+        }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := tt.source.Search(context.Background(), tt.query, languages[tt.lang], maxNewsArticles)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(got) != len(tt.want) {
+                t.Fatalf("got %d articles, want %d: %+v", len(got), len(tt.want), got)
+            }
+            for i := range got {
+                if !got[i].PublishedAt.Equal(tt.want[i].PublishedAt) {
+                    t.Errorf("article %d published %v, want %v", i, got[i].PublishedAt, tt.want[i].PublishedAt)
+                }
+                got[i].PublishedAt = tt.want[i].PublishedAt
+                if !reflect.DeepEqual(got[i], tt.want[i]) {
+                    t.Errorf("article %d:\n got %+v\nwant %+v", i, got[i], tt.want[i])
+                }
+            }
+        })
+    }
+}
+
+func TestNewsSourceErrors(t *testing.T) {
+    missing := &newsAPISource{key: "key", client: fixtureClient, endpoint: "https://newsapi.org/v2/missing"}
+    if _, err := missing.Search(context.Background(), NewsQuery{Terms: []string{"ecb"}}, languages["en"], 5); err == nil {
+        t.Fatal("missing fixture did not fail")
+    }
+    if _, err := parseFeed([]byte("not a feed")); err == nil {
+        t.Fatal("parseFeed accepted garbage")
+    }
+}
+
+func TestNewsSourcesConfiguredWithFixtures(t *testing.T) {
+    t.Setenv("NEWS_FIXTURES", "testdata/news")
+    t.Setenv("NEWS_SOURCES", "newsapi,rss,folder")
+    t.Setenv("NEWS_FEEDS", "world=https://feeds.example.org/world.rss")
+    t.Setenv("NEWS_FOLDER", "testdata/folder")
+    sources := newsSources(&http.Client{}, "key")
+    var names []string
+    for _, source := range sources {
+        names = append(names, source.Name())
+    }
+    if got := strings.Join(names, ","); got != "NewsAPI,RSS world,Folder" {
+        t.Fatalf("sources = %s", got)
+    }
+    articles, err := searchNews(context.Background(), sources, NewsQuery{Terms: []string{"ecb"}, TimeSensitive: true}, languages["en"], maxNewsArticles)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(articles) == 0 {
+        t.Fatal("no articles found through the fixtures")
+    }
+}
+
+func folderSources(articles []Article) []string {
+    var sources []string
+    for _, article := range articles {
+        sources = append(sources, article.Source)
+    }
+    sort.Strings(sources)
+    return sources
+}
+
+func TestFolderSource(t *testing.T) {
+    dir := t.TempDir()
+    for _, name := range []string{"ecb.md", "garden.txt", "ignored.pdf", "reports/budget.html"} {
+        data, err := os.ReadFile(filepath.Join("testdata/folder", name))
+        if err != nil {
+            t.Fatal(err)
+        }
+        os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+        os.WriteFile(filepath.Join(dir, name), data, 0644)
+    }
+    source := &folderSource{dir: dir}
+    search := func() []string {
+        articles, err := source.Search(context.Background(), NewsQuery{Terms: []string{"ecb"}}, languages["en"], maxNewsArticles)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return folderSources(articles)
+    }
+    if got := strings.Join(search(), ","); got != "local:ecb.md,local:reports/budget.html" {
+        t.Fatalf("first search = %s", got)
+    }
+
+    // Entro l'intervallo di aggiornamento la cartella non viene riletta
+    os.WriteFile(filepath.Join(dir, "new.txt"), []byte("ECB news"), 0644)
+    if got := search(); len(got) != 2 {
+        t.Fatalf("folder walked again before the refresh interval: %v", got)
+    }
+    os.Remove(filepath.Join(dir, "ecb.md"))
+    os.WriteFile(filepath.Join(dir, "garden.txt"), []byte("The ECB does not grow tomatoes."), 0644)
+    source.refreshed = time.Now().Add(-2 * folderRefreshInterval)
+    if got := strings.Join(search(), ","); got != "local:garden.txt,local:new.txt,local:reports/budget.html" {
+        t.Fatalf("search after refresh = %s", got)
+    }
+}
+
+func TestRankArticles(t *testing.T) {
+    now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+    day := 24 * time.Hour
+    articles := []Article{
+        {Title: "ECB holds rates", URL: "https://www.reuters.com/ecb/", Source: "Reuters", Retriever: "NewsAPI", Description: "Short.", PublishedAt: now.Add(-day)},
+        // Stesso titolo, altro URL: si unisce e porta la descrizione più lunga
+        {Title: "ECB Holds Rates!", URL: "https://mirror.example.org/ecb", Source: "Mirror", Retriever: "GDELT", Description: "A longer description of the ECB decision.", PublishedAt: now.Add(-day)},
+        // Altro titolo, URL del duplicato: deve unirsi anche questo
+        {Title: "Rates on hold in Frankfurt", URL: "https://mirror.example.org/ecb/", Source: "Mirror", Retriever: "RSS", PublishedAt: now.Add(-day)},
+        {Title: "ECB minutes published", URL: "https://reuters.com/minutes", Source: "Reuters", Retriever: "NewsAPI", PublishedAt: now.Add(-2 * day)},
+        {Title: "ECB speech in Rome", URL: "https://reuters.com/speech", Source: "Reuters", Retriever: "NewsAPI", PublishedAt: now.Add(-3 * day)},
+        {Title: "Old ECB history", URL: "https://example.org/history", Source: "Example", Retriever: "Wikipedia", PublishedAt: now.Add(-300 * day)},
+        {Title: "Tomatoes in the garden", URL: "https://example.org/garden", Source: "Garden", Retriever: "RSS", PublishedAt: now},
+        {Title: "", URL: "https://example.org/untitled-ecb", Source: "Example", Retriever: "Folder", Description: "ECB notes", PublishedAt: now.Add(-day)},
+        {Title: "", URL: "https://example.org/other-ecb", Source: "Other", Retriever: "Folder", Description: "More ECB notes", PublishedAt: now.Add(-day)},
+    }
+    ranked := rankArticles(articles, []string{"ecb"}, 10, now)
+    var titles []string
+    for _, article := range ranked {
+        titles = append(titles, article.Title+"|"+article.URL)
+    }
+    want := []string{
+        "ECB holds rates|https://www.reuters.com/ecb/",
+        "ECB minutes published|https://reuters.com/minutes",
+        "|https://example.org/untitled-ecb",
+        "|https://example.org/other-ecb",
+        "Old ECB history|https://example.org/history",
+    }
+    if strings.Join(titles, "\n") != strings.Join(want, "\n") {
+        t.Fatalf("ranked:\n%s\nwant:\n%s", strings.Join(titles, "\n"), strings.Join(want, "\n"))
+    }
+    top := ranked[0]
+    if strings.Join(top.AlsoIn, ",") != "GDELT,RSS" {
+        t.Errorf("AlsoIn = %v; want the two duplicates' retrievers", top.AlsoIn)
+    }
+    if top.Description != "A longer description of the ECB decision." {
+        t.Errorf("description = %q; want the longest one", top.Description)
+    }
+    for _, article := range ranked {
+        if article.ID == "" || article.Score <= 0 {
+            t.Errorf("article %q has ID %q and score %v", article.Title, article.ID, article.Score)
+        }
+    }
+    if got := rankArticles(articles, []string{"ecb"}, 2, now); len(got) != 2 {
+        t.Errorf("limit 2 returned %d articles", len(got))
+    }
+}
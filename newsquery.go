@@ -0,0 +1,342 @@
+package main
+
+import (
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+    "unicode"
+    "unicode/utf8"
+)
+
+// NewsQuery is what the news sources are asked for: the keywords, names
+// and dates of the user's message rather than the message itself, which
+// search APIs handle badly when it is a long conversational question.
+type NewsQuery struct {
+    // Phrases are names and quoted expressions, searched as a whole.
+    Phrases []string `json:"phrases,omitempty"`
+    // Terms are the remaining keywords, lowercased.
+    Terms []string `json:"terms,omitempty"`
+    // From and To bound the publication date when the message mentions
+    // one ("yesterday", "in March 2024"); they are zero otherwise.
+    From time.Time `json:"from,omitempty"`
+    To   time.Time `json:"to,omitempty"`
+    // TimeSensitive is false for questions about timeless topics, which
+    // are looked up only in reference sources such as Wikipedia.
+    TimeSensitive bool `json:"timeSensitive"`
+    // Skip is true when nothing is worth looking up: code, arithmetic,
+    // translations, creative writing.
+    Skip bool `json:"skip,omitempty"`
+}
+
+const (
+    maxQueryPhrases = 3
+    maxQueryTerms   = 6
+)
+
+// queryFillers are words of conversational questions that never help a
+// search, in the languages of the stopwords table.
+var queryFillers = wordSet(
+    // en
+    "hi", "hello", "hey", "may", "mai", "please", "tell", "were", "said", "says", "works", "know", "can", "could", "would", "should", "about", "think", "explain", "give", "some", "any", "there", "their", "they", "been", "has", "had", "does", "did", "will", "want", "like", "more", "most", "also", "just", "really", "thing", "things", "who", "when", "where", "whats", "anything", "something", "happened", "happening", "going", "news", "latest", "recent", "recently", "current", "currently", "today", "yesterday", "tonight", "week", "month", "year", "now", "new", "update", "updates",
+    // it
+    "ciao", "salve", "buongiorno", "buonasera", "detto", "dice", "dimmi", "sapere", "vorrei", "puoi", "potresti", "sai", "parlami", "cosa", "cos", "chi", "quando", "dove", "sul", "sulla", "sui", "sulle", "dei", "delle", "degli", "alla", "alle", "agli", "nella", "nelle", "negli", "dal", "dalla", "dai", "dalle", "con", "tra", "fra", "successo", "succede", "succedendo", "notizie", "notizia", "ultime", "ultimo", "ultima", "recente", "recenti", "attuale", "adesso", "oggi", "ieri", "stasera", "settimana", "mese", "anno", "quest", "questa", "quello", "quella", "novità", "aggiornamenti",
+    // de
+    "hallo", "bitte", "los", "sag", "sagen", "wissen", "kannst", "könntest", "über", "gibt", "nachrichten", "neueste", "aktuell", "aktuelle", "heute", "gestern", "woche", "monat", "jahr", "jetzt", "passiert",
+    // fr
+    "bonjour", "salut", "dis", "dites", "savoir", "peux", "pouvez", "sur", "quoi", "nouvelles", "actualité", "actualités", "dernières", "récent", "récents", "aujourd", "hui", "hier", "semaine", "mois", "année", "maintenant", "passé",
+    // es
+    "hola", "dime", "saber", "puedes", "sobre", "noticias", "últimas", "reciente", "actual", "hoy", "ayer", "semana", "mes", "año", "ahora", "pasado", "pasó",
+    // comuni a più lingue, quindi assenti dalle stopwords
+    "is", "to", "was", "on", "il", "un", "una", "del", "da", "ma", "come", "es", "en", "su", "son", "que", "no", "para", "por", "está", "como", "je", "do", "i",
+)
+
+// timeSensitiveWords mark questions about current events.
+var timeSensitiveWords = wordSet(
+    "latest", "news", "recent", "recently", "current", "currently", "today", "yesterday", "tonight", "breaking", "now", "update", "updates", "happening", "election", "elections", "price", "prices", "score", "won", "wins",
+    "ultime", "ultimo", "ultima", "notizie", "notizia", "recente", "recenti", "attuale", "adesso", "oggi", "ieri", "stasera", "novità", "aggiornamenti", "elezioni", "prezzo", "prezzi", "guerra", "vinto",
+    "neueste", "nachrichten", "aktuell", "aktuelle", "heute", "gestern", "jetzt", "wahl", "wahlen", "krieg",
+    "actualité", "actualités", "dernières", "récent", "aujourd", "hier", "élection", "élections", "guerre",
+    "noticias", "últimas", "reciente", "actual", "hoy", "ayer", "elecciones",
+)
+
+// skipPatterns open requests that need no sources at all; referencePatterns
+// open questions that an encyclopedia answers as well as the news.
+var (
+    skipPatterns = regexp.MustCompile(`(?i)^\s*(translate|traduci|traduire|traduce|übersetze|write (me )?(a|an) (poem|story|song|essay|email|letter)|scrivi (una|un) (poesia|storia|canzone|email|lettera)|compose|correct|correggi|fix (this|my)|debug|refactor|calculate|calcola|solve|risolvi)\b`)
+    // \b conosce solo le lettere ASCII: dopo "cos'è" il confine va scritto a mano
+    referencePatterns = regexp.MustCompile(`(?i)^\s*((what is (a|an|the meaning of)|what does .* mean|define|definition of|explain( to me)? (how|what|why)|how (do|does|can|to)|why (do|does|is|are)|cosa significa|spiega(mi)?|come (si|funziona)|perché (il|la|lo|i|gli|le)|was ist (ein|eine|der|die|das)|wie funktioniert|qu'est-ce que|comment (faire|fonctionne)|qué es (un|una|el|la)|cómo (funciona|se))\b|(che )?cos['’]è(\s|$))`)
+    arithmeticPattern = regexp.MustCompile(`^[\d\s.,+\-*/^%()=x×÷?]+$`)
+    quotedPattern     = regexp.MustCompile(`"([^"]{3,60})"|“([^”]{3,60})”|«\s*([^»]{3,60}?)\s*»`)
+    yearPattern       = regexp.MustCompile(`\b(19\d{2}|20\d{2})\b`)
+)
+
+// monthNames maps month names to their number. "may" and "mai" are left
+// out: they are more often a verb or "never" than a month.
+var monthNames = map[string]time.Month{
+    "january": 1, "february": 2, "march": 3, "april": 4, "june": 6, "july": 7, "august": 8, "september": 9, "october": 10, "november": 11, "december": 12,
+    "gennaio": 1, "febbraio": 2, "marzo": 3, "aprile": 4, "maggio": 5, "giugno": 6, "luglio": 7, "agosto": 8, "settembre": 9, "ottobre": 10, "novembre": 11, "dicembre": 12,
+    "januar": 1, "februar": 2, "märz": 3, "juni": 6, "juli": 7, "oktober": 10, "dezember": 12,
+    "janvier": 1, "février": 2, "mars": 3, "avril": 4, "juin": 6, "juillet": 7, "août": 8, "septembre": 9, "octobre": 10, "décembre": 12,
+    "enero": 1, "febrero": 2, "abril": 4, "mayo": 5, "junio": 6, "julio": 7, "septiembre": 9, "octubre": 10, "noviembre": 11, "diciembre": 12,
+}
+
+// relativeDates are expressions of recent time and how far back they reach.
+var relativeDates = []struct {
+    words []string
+    days  int
+}{
+    {[]string{"today", "tonight", "oggi", "stasera", "heute", "aujourd'hui", "hoy"}, 1},
+    {[]string{"yesterday", "ieri", "gestern", "hier", "ayer"}, 2},
+    {[]string{"this week", "last few days", "past few days", "questa settimana", "ultimi giorni", "diese woche", "cette semaine", "esta semana"}, 7},
+    {[]string{"last week", "past week", "settimana scorsa", "scorsa settimana", "letzte woche", "semaine dernière", "semana pasada"}, 14},
+    {[]string{"this month", "last month", "past month", "questo mese", "ultimo mese", "mese scorso", "diesen monat", "ce mois", "este mes"}, 31},
+    {[]string{"this year", "quest'anno", "dieses jahr", "cette année", "este año"}, 366},
+}
+
+func wordSet(words ...string) map[string]bool {
+    set := make(map[string]bool, len(words))
+    for _, word := range words {
+        set[word] = true
+    }
+    return set
+}
+
+func splitWords(text string) []string {
+    return strings.FieldsFunc(text, func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-'
+    })
+}
+
+// extractNewsQuery builds the search for a message with local heuristics,
+// so it costs nothing and adds no latency.
+func extractNewsQuery(message string, now time.Time) NewsQuery {
+    query := NewsQuery{TimeSensitive: true}
+    text := strings.TrimSpace(message)
+    if strings.Contains(text, "```") || arithmeticPattern.MatchString(text) || skipPatterns.MatchString(text) {
+        query.Skip = true
+        return query
+    }
+    lower := strings.ToLower(text)
+
+    seen := make(map[string]bool)
+    for _, match := range quotedPattern.FindAllStringSubmatch(text, -1) {
+        phrase := strings.TrimSpace(match[1] + match[2] + match[3])
+        if len(query.Phrases) < maxQueryPhrases && !seen[strings.ToLower(phrase)] {
+            seen[strings.ToLower(phrase)] = true
+            query.Phrases = append(query.Phrases, phrase)
+        }
+    }
+    for _, name := range properNames(quotedPattern.ReplaceAllString(text, " . ")) {
+        key := strings.ToLower(name)
+        if len(query.Phrases) < maxQueryPhrases && !seen[key] {
+            seen[key] = true
+            query.Phrases = append(query.Phrases, name)
+        }
+    }
+    inPhrase := make(map[string]bool)
+    for _, phrase := range query.Phrases {
+        for _, word := range splitWords(strings.ToLower(phrase)) {
+            inPhrase[word] = true
+        }
+    }
+    for _, term := range queryTerms(text) {
+        if len(query.Terms) == maxQueryTerms {
+            break
+        }
+        if !inPhrase[term] && !yearPattern.MatchString(term) && monthNames[term] == 0 {
+            query.Terms = append(query.Terms, term)
+        }
+    }
+
+    query.From, query.To = dateRange(lower, now)
+    sensitive := !query.From.IsZero() && now.Sub(query.From) < 400*24*time.Hour
+    for _, word := range splitWords(lower) {
+        if timeSensitiveWords[word] {
+            sensitive = true
+        }
+    }
+    // Senza indizi temporali, le domande su definizioni o sul passato non cercano notizie
+    if !sensitive && (referencePatterns.MatchString(text) || !query.To.IsZero() && now.Sub(query.To) > 400*24*time.Hour) {
+        query.TimeSensitive = false
+    }
+    if len(query.Phrases) == 0 && len(query.Terms) == 0 {
+        query.Skip = true
+    }
+    return query
+}
+
+// properNames finds runs of capitalised words, such as "Giorgia Meloni" or
+// "Bank of Italy", and acronyms. A capitalised word that starts a sentence
+// is skipped when it is a common or question word.
+func properNames(text string) []string {
+    var names []string
+    var run []string
+    flush := func() {
+        // Le preposizioni valgono solo tra due parole maiuscole
+        for len(run) > 0 && nameConnectors[run[len(run)-1]] {
+            run = run[:len(run)-1]
+        }
+        if len(run) > 0 {
+            names = append(names, strings.Join(run, " "))
+        }
+        run = nil
+    }
+    sentenceStart := true
+    for _, token := range strings.Fields(text) {
+        word := strings.TrimFunc(token, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+        runes := []rune(word)
+        lower := strings.ToLower(word)
+        capitalised := len(runes) > 1 && unicode.IsUpper(runes[0])
+        common := stopwordLanguages[lower] != nil || queryFillers[lower] || isQuestionWord(lower)
+        // I mesi sono date, non nomi, anche in mezzo alla frase
+        month := monthNames[lower] != 0 || lower == "may" || lower == "mai"
+        switch {
+        case capitalised && !month && !(sentenceStart && common):
+            run = append(run, word)
+        case len(run) > 0 && nameConnectors[word]:
+            run = append(run, word)
+        default:
+            flush()
+        }
+        last, _ := utf8.DecodeLastRuneInString(token)
+        sentenceStart = strings.ContainsRune(".!?", last)
+        if strings.ContainsRune(".!?,;:)\"'»”", last) {
+            flush()
+        }
+    }
+    flush()
+    return names
+}
+
+// nameConnectors are the lowercase words found inside names.
+var nameConnectors = wordSet("of", "the", "for", "and", "di", "del", "della", "dei", "degli", "e", "von", "van", "der", "de", "du", "des", "la", "le", "y")
+
+func isQuestionWord(word string) bool {
+    switch word {
+    case "what", "who", "when", "where", "why", "how", "which", "is", "are", "do", "does", "did", "can", "could",
+        "cosa", "cos'è", "cos’è", "chi", "quando", "dove", "perché", "come", "quale", "quali", "quanto", "quanti",
+        "was", "wer", "wann", "wo", "warum", "wie", "welche",
+        "que", "qui", "quand", "où", "pourquoi", "comment", "quel", "quelle",
+        "qué", "quién", "cuándo", "dónde", "por", "cómo", "cuál":
+        return true
+    }
+    return false
+}
+
+// dateRange reads the time span a message refers to: relative expressions
+// ("yesterday", "questa settimana"), a month with or without a year, or a
+// year alone.
+func dateRange(lower string, now time.Time) (time.Time, time.Time) {
+    padded := " " + strings.Join(strings.Fields(lower), " ") + " "
+    for _, relative := range relativeDates {
+        for _, words := range relative.words {
+            if strings.Contains(padded, " "+words+" ") || strings.Contains(padded, " "+words+"?") || strings.Contains(padded, " "+words+",") || strings.Contains(padded, " "+words+".") {
+                return now.AddDate(0, 0, -relative.days), now
+            }
+        }
+    }
+    year := 0
+    if match := yearPattern.FindString(lower); match != "" {
+        year, _ = strconv.Atoi(match)
+        if year > now.Year() {
+            year = 0
+        }
+    }
+    for _, word := range splitWords(lower) {
+        month := monthNames[word]
+        if month == 0 {
+            continue
+        }
+        y := year
+        if y == 0 {
+            // Un mese senza anno è l'ultimo trascorso con quel nome
+            y = now.Year()
+            if month > now.Month() {
+                y--
+            }
+        }
+        from := time.Date(y, month, 1, 0, 0, 0, 0, time.UTC)
+        return from, minTime(from.AddDate(0, 1, 0), now)
+    }
+    if year != 0 {
+        from := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+        return from, minTime(from.AddDate(1, 0, 0), now)
+    }
+    return time.Time{}, time.Time{}
+}
+
+func minTime(a, b time.Time) time.Time {
+    if a.Before(b) {
+        return a
+    }
+    return b
+}
+
+// words returns the phrases and terms together, lowercased, for ranking.
+func (q NewsQuery) words() []string {
+    var words []string
+    seen := make(map[string]bool)
+    for _, phrase := range q.Phrases {
+        for _, word := range queryTerms(phrase) {
+            if !seen[word] {
+                seen[word] = true
+                words = append(words, word)
+            }
+        }
+    }
+    for _, term := range q.Terms {
+        if !seen[term] {
+            seen[term] = true
+            words = append(words, term)
+        }
+    }
+    return words
+}
+
+// boolean writes the query in the syntax shared by NewsAPI and GDELT:
+// phrases in quotes are all required, terms are alternatives.
+func (q NewsQuery) boolean(and string) string {
+    var parts []string
+    for _, phrase := range q.Phrases {
+        if strings.Contains(phrase, " ") {
+            parts = append(parts, `"`+strings.ReplaceAll(phrase, `"`, "")+`"`)
+        } else {
+            parts = append(parts, phrase)
+        }
+    }
+    switch len(q.Terms) {
+    case 0:
+    case 1:
+        parts = append(parts, q.Terms[0])
+    default:
+        // Con un nome, le parole chiave restringono; senza, basta che ne compaia una
+        parts = append(parts, "("+strings.Join(q.Terms, " OR ")+")")
+    }
+    return strings.Join(parts, and)
+}
+
+// within reports whether a publication date falls in the query's range.
+// Undated articles always do.
+func (q NewsQuery) within(published time.Time) bool {
+    if published.IsZero() || q.From.IsZero() {
+        return true
+    }
+    // Un giorno di margine per fusi orari e articoli pubblicati dopo i fatti
+    return !published.Before(q.From.AddDate(0, 0, -1)) && !published.After(q.To.AddDate(0, 0, 2))
+}
+
+func (q NewsQuery) String() string {
+    if q.Skip {
+        return "(no lookup)"
+    }
+    out := q.boolean(" AND ")
+    if !q.From.IsZero() {
+        out += fmt.Sprintf(" [%s..%s]", q.From.Format("2006-01-02"), q.To.Format("2006-01-02"))
+    }
+    if !q.TimeSensitive {
+        out += " (reference only)"
+    }
+    return out
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+var queryNow = time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC)
+
+func TestExtractNewsQuery(t *testing.T) {
+    tests := []struct {
+        message   string
+        phrases   []string
+        terms     []string
+        sensitive bool
+        skip      bool
+    }{
+        {"What did Giorgia Meloni say yesterday about inflation?", []string{"Giorgia Meloni"}, []string{"say", "inflation"}, true, false},
+        {"Latest NATO summit in Vilnius", []string{"NATO", "Vilnius"}, []string{"summit"}, true, false},
+        {"“Mario Draghi” speech", []string{"Mario Draghi"}, []string{"speech"}, true, false},
+        {"What is a black hole?", nil, []string{"black", "hole"}, false, false},
+        {"Cos'è la democrazia?", nil, []string{"democrazia"}, false, false},
+        {"Che cos’è la fotosintesi", nil, []string{"fotosintesi"}, false, false},
+        {"Tell me about the fall of the Berlin Wall in 1989", []string{"Berlin Wall"}, []string{"fall"}, false, false},
+        {"Translate this to French", nil, nil, true, true},
+        {"```go\nfmt.Println(1)\n```", nil, nil, true, true},
+        {"12 * (3 + 4) =", nil, nil, true, true},
+        {"Hi, what's new?", nil, nil, true, true},
+    }
+    for _, tt := range tests {
+        q := extractNewsQuery(tt.message, queryNow)
+        if q.Skip != tt.skip || q.TimeSensitive != tt.sensitive {
+            t.Errorf("%q: skip %v, time sensitive %v; want %v, %v", tt.message, q.Skip, q.TimeSensitive, tt.skip, tt.sensitive)
+        }
+        if tt.skip {
+            continue
+        }
+        if !reflect.DeepEqual(q.Phrases, tt.phrases) || !reflect.DeepEqual(q.Terms, tt.terms) {
+            t.Errorf("%q: phrases %q, terms %q; want %q, %q", tt.message, q.Phrases, q.Terms, tt.phrases, tt.terms)
+        }
+    }
+}
+
+func TestDateRange(t *testing.T) {
+    day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+    tests := []struct {
+        text     string
+        from, to time.Time
+    }{
+        {"what happened yesterday?", queryNow.AddDate(0, 0, -2), queryNow},
+        {"cosa è successo questa settimana", queryNow.AddDate(0, 0, -7), queryNow},
+        {"news from last week.", queryNow.AddDate(0, 0, -14), queryNow},
+        {"elections in march 2024", day(2024, 3, 1), day(2024, 4, 1)},
+        // Ottobre non è ancora arrivato: è quello dell'anno scorso
+        {"what happened in october", day(2024, 10, 1), day(2024, 11, 1)},
+        {"le notizie di marzo", day(2025, 3, 1), day(2025, 4, 1)},
+        {"the 2019 budget", day(2019, 1, 1), day(2020, 1, 1)},
+        {"results of 2025", day(2025, 1, 1), queryNow},
+        {"plans for 2030", time.Time{}, time.Time{}},
+        {"how do magnets work", time.Time{}, time.Time{}},
+    }
+    for _, tt := range tests {
+        from, to := dateRange(tt.text, queryNow)
+        if !from.Equal(tt.from) || !to.Equal(tt.to) {
+            t.Errorf("dateRange(%q) = %v..%v; want %v..%v", tt.text, from, to, tt.from, tt.to)
+        }
+    }
+}
+
+func TestProperNames(t *testing.T) {
+    tests := []struct {
+        text string
+        want []string
+    }{
+        {"What did the Bank of Italy say to Giorgia Meloni?", []string{"Bank of Italy", "Giorgia Meloni"}},
+        {"Sono a Roma. Cosa pensa Draghi?", []string{"Roma", "Draghi"}},
+        {"Cos'è la NATO?", []string{"NATO"}},
+        {"Yesterday Biden met Macron in March", []string{"Biden", "Macron"}},
+        // Le virgolette tipografiche chiudono il nome come quelle ASCII
+        {"secondo «Lagarde» Draghi ha torto", []string{"Lagarde", "Draghi"}},
+        {"secondo “Lagarde” Draghi ha torto", []string{"Lagarde", "Draghi"}},
+        {"the University of", []string{"University"}},
+        {"nothing here", nil},
+    }
+    for _, tt := range tests {
+        if got := properNames(tt.text); !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("properNames(%q) = %q; want %q", tt.text, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+    "bytes"
+    "embed"
+    "fmt"
+    "html/template"
+    "net/http"
+    "strings"
+)
+
+// The server-rendered pages live in templates/ and are compiled into the
+// binary. html/template escapes every value by context, so stored text can
+// never close a tag or start a script.
+//
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+var pageTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+    "markdown": renderMarkdown,
+    "join":     strings.Join,
+    // sourceList lists every retrieved source of a turn with a fact check,
+    // so that the claim table's [n] can be looked up, and only the cited
+    // ones otherwise.
+    "sourceList": func(turn ConversationTurn) []SourceEntry {
+        return sourceEntries(turn, len(turn.Claims) > 0)
+    },
+    "lines": func(text string) template.HTML {
+        return template.HTML(strings.ReplaceAll(template.HTMLEscapeString(text), "\n", "<br>"))
+    },
+}).ParseFS(templateFiles, "templates/*.html"))
+
+// renderPage executes the named template into a buffer first, so that a
+// failing template produces a clean 500 instead of half a page.
+func renderPage(w http.ResponseWriter, name string, data interface{}) {
+    var page bytes.Buffer
+    if err := pageTemplates.ExecuteTemplate(&page, name, data); err != nil {
+        fmt.Printf("Error rendering %s: %v\n", name, err)
+        http.Error(w, "Error rendering page", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    page.WriteTo(w)
+}
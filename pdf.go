@@ -0,0 +1,195 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// pdfWriter lays out plain text on A4 pages using the standard Helvetica
+// fonts, which every PDF reader ships, so no font has to be embedded.
+// Text is encoded as WinAnsi; characters outside it print as '?'.
+type pdfWriter struct {
+    title   string
+    pages   []*bytes.Buffer
+    current *bytes.Buffer
+    y       float64
+}
+
+const (
+    pdfPageWidth  = 595.0
+    pdfPageHeight = 842.0
+    pdfMargin     = 56.0
+)
+
+func newPDFWriter(title string) *pdfWriter {
+    pdf := &pdfWriter{title: title}
+    pdf.newPage()
+    return pdf
+}
+
+func (p *pdfWriter) newPage() {
+    p.current = &bytes.Buffer{}
+    p.pages = append(p.pages, p.current)
+    p.y = pdfPageHeight - pdfMargin
+}
+
+// Heading writes a bold line, moving to a new page if fewer than two lines
+// would fit below it.
+func (p *pdfWriter) Heading(text string, size float64) {
+    if p.y-3*size < pdfMargin {
+        p.newPage()
+    }
+    p.y -= size * 0.5
+    p.Text(text, "F2", size)
+    p.y -= size * 0.3
+}
+
+// Text writes a wrapped paragraph in the given font ("F1" regular or "F2"
+// bold). Line breaks in text are kept.
+func (p *pdfWriter) Text(text, font string, size float64) {
+    leading := size * 1.35
+    for _, paragraph := range strings.Split(text, "\n") {
+        for _, line := range wrapPDFLine(paragraph, font, size, pdfPageWidth-2*pdfMargin) {
+            if p.y-leading < pdfMargin {
+                p.newPage()
+            }
+            p.y -= leading
+            fmt.Fprintf(p.current, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, pdfMargin, p.y, pdfEscape(line))
+        }
+    }
+}
+
+func (p *pdfWriter) Space(points float64) {
+    p.y -= points
+}
+
+// Bytes assembles the document: catalog, page tree, the two fonts, then a
+// page and a content stream per page, followed by the cross-reference table.
+func (p *pdfWriter) Bytes() []byte {
+    var out bytes.Buffer
+    var offsets []int
+    object := func(body string) {
+        offsets = append(offsets, out.Len())
+        fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+    }
+
+    out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+    kids := make([]string, len(p.pages))
+    for i := range p.pages {
+        kids[i] = fmt.Sprintf("%d 0 R", 6+2*i)
+    }
+    object("<< /Type /Catalog /Pages 2 0 R >>")
+    object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(p.pages)))
+    object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+    object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+    object(fmt.Sprintf("<< /Title (%s) /Producer (ARCA-b Chat AI) /CreationDate (D:%s) >>",
+        pdfEscape(p.title), time.Now().UTC().Format("20060102150405Z")))
+    for i, page := range p.pages {
+        object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+            pdfPageWidth, pdfPageHeight, 7+2*i))
+        object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+    }
+
+    xref := out.Len()
+    fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+    for _, offset := range offsets {
+        fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+    }
+    fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+    return out.Bytes()
+}
+
+// wrapPDFLine breaks text into lines no wider than width points.
+func wrapPDFLine(text, font string, size, width float64) []string {
+    words := strings.Fields(text)
+    if len(words) == 0 {
+        return []string{""}
+    }
+    var lines []string
+    line := ""
+    for _, word := range words {
+        // Le parole più lunghe di una riga vengono spezzate
+        for pdfTextWidth(word, font, size) > width {
+            cut := len([]rune(word))
+            for cut > 1 && pdfTextWidth(string([]rune(word)[:cut]), font, size) > width {
+                cut--
+            }
+            if line != "" {
+                lines = append(lines, line)
+                line = ""
+            }
+            lines = append(lines, string([]rune(word)[:cut]))
+            word = string([]rune(word)[cut:])
+        }
+        candidate := word
+        if line != "" {
+            candidate = line + " " + word
+        }
+        if pdfTextWidth(candidate, font, size) > width && line != "" {
+            lines = append(lines, line)
+            candidate = word
+        }
+        line = candidate
+    }
+    return append(lines, line)
+}
+
+// helveticaWidths are the advance widths of ASCII 32-126 in Helvetica, in
+// thousandths of the font size, from the standard AFM metrics.
+var helveticaWidths = [95]int{
+    278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+    556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+    1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+    667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+    333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+    556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+func pdfTextWidth(text, font string, size float64) float64 {
+    total := 0
+    for _, r := range text {
+        if r >= 32 && r <= 126 {
+            total += helveticaWidths[r-32]
+        } else {
+            total += 556
+        }
+    }
+    width := float64(total) * size / 1000
+    if font == "F2" {
+        // Il grassetto è circa il 6% più largo
+        width *= 1.06
+    }
+    return width
+}
+
+// winAnsiExtras maps the characters that WinAnsi places in 0x80-0x9F.
+var winAnsiExtras = map[rune]byte{
+    '€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+    'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A, '‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E, '‘': 0x91,
+    '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98,
+    '™': 0x99, 'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+func pdfEscape(text string) string {
+    var out strings.Builder
+    for _, r := range text {
+        switch {
+        case r == '(' || r == ')' || r == '\\':
+            out.WriteByte('\\')
+            out.WriteRune(r)
+        case r == '\t':
+            out.WriteString("    ")
+        case r >= 32 && r <= 126:
+            out.WriteRune(r)
+        case r >= 0xA0 && r <= 0xFF:
+            fmt.Fprintf(&out, "\\%03o", r)
+        case winAnsiExtras[r] != 0:
+            fmt.Fprintf(&out, "\\%03o", winAnsiExtras[r])
+        default:
+            out.WriteByte('?')
+        }
+    }
+    return out.String()
+}
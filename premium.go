@@ -0,0 +1,496 @@
+package main
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// PremiumGrant is stored under premiumPrefix+owner, where owner is either an
+// account ("user:<id>") or an anonymous session ("anon:<id>").
+type PremiumGrant struct {
+    Owner     string    `json:"owner"`
+    Source    string    `json:"source"`
+    GrantedBy string    `json:"grantedBy"`
+    GrantedAt time.Time `json:"grantedAt"`
+    ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (g *PremiumGrant) Active(now time.Time) bool {
+    return g != nil && now.Before(g.ExpiresAt)
+}
+
+type Voucher struct {
+    Code           string    `json:"code"`
+    Days           int       `json:"days"`
+    MaxRedemptions int       `json:"maxRedemptions"`
+    CreatedBy      string    `json:"createdBy"`
+    CreatedAt      time.Time `json:"createdAt"`
+    ExpiresAt      time.Time `json:"expiresAt,omitempty"`
+}
+
+type AuditEntry struct {
+    Time    time.Time `json:"time"`
+    Actor   string    `json:"actor"`
+    Action  string    `json:"action"`
+    Target  string    `json:"target"`
+    Details string    `json:"details,omitempty"`
+}
+
+const (
+    voucherPrefix           = "voucher:"
+    voucherRedemptionPrefix = "voucher-redemptions:"
+    voucherRedeemedPrefix   = "voucher-redeemed:"
+    auditPrefix             = "audit:"
+)
+
+func loadPremium(owner string) (*PremiumGrant, error) {
+    grant := &PremiumGrant{}
+    found, err := store.Get(premiumPrefix+owner, grant)
+    if err != nil || !found {
+        return nil, err
+    }
+    return grant, nil
+}
+
+// grantPremium extends the owner's premium period by the given number of
+// days, starting from the current expiry when it is still in the future.
+// The store lock keeps a voucher and a donation granted at the same time,
+// on any instance, from losing each other's days.
+func grantPremium(owner string, days int, source, actor string) (*PremiumGrant, error) {
+    if days <= 0 {
+        return nil, fmt.Errorf("days must be positive")
+    }
+    unlock, err := sessionLocks.Lock(premiumPrefix + owner)
+    if err != nil {
+        return nil, err
+    }
+    defer unlock()
+    now := time.Now()
+    grant, err := loadPremium(owner)
+    if err != nil {
+        return nil, err
+    }
+    start := now
+    if grant.Active(now) {
+        start = grant.ExpiresAt
+    }
+    grant = &PremiumGrant{
+        Owner:     owner,
+        Source:    source,
+        GrantedBy: actor,
+        GrantedAt: now,
+        ExpiresAt: start.Add(time.Duration(days) * 24 * time.Hour),
+    }
+    if err := store.Set(premiumPrefix+owner, grant, 0); err != nil {
+        return nil, err
+    }
+    audit(actor, "premium.grant", owner, fmt.Sprintf("%d days via %s, expires %s", days, source, grant.ExpiresAt.Format(time.RFC3339)))
+    return grant, nil
+}
+
+func revokePremium(owner, actor string) error {
+    if err := store.Delete(premiumPrefix + owner); err != nil {
+        return err
+    }
+    audit(actor, "premium.revoke", owner, "")
+    return nil
+}
+
+func createVoucher(days, maxRedemptions int, validFor time.Duration, actor string) (*Voucher, error) {
+    if days <= 0 || maxRedemptions <= 0 {
+        return nil, fmt.Errorf("days and maxRedemptions must be positive")
+    }
+    token, err := randomToken()
+    if err != nil {
+        return nil, err
+    }
+    v := &Voucher{
+        Code:           "ARCA-" + strings.ToUpper(token[:12]),
+        Days:           days,
+        MaxRedemptions: maxRedemptions,
+        CreatedBy:      actor,
+        CreatedAt:      time.Now(),
+    }
+    if validFor > 0 {
+        v.ExpiresAt = v.CreatedAt.Add(validFor)
+    }
+    if err := store.Set(voucherPrefix+v.Code, v, 0); err != nil {
+        return nil, err
+    }
+    audit(actor, "voucher.create", v.Code, fmt.Sprintf("%d days, %d redemptions", days, maxRedemptions))
+    return v, nil
+}
+
+// redeemVoucher grants the voucher's premium days to owner. The redemption
+// counter is incremented atomically in the store, so a single-use code
+// cannot be redeemed twice even when two instances race, and each owner
+// claims its own redemption with SetNX, so nobody can use up a multi-use
+// code alone.
+func redeemVoucher(code, owner string) (*PremiumGrant, error) {
+    code = strings.ToUpper(strings.TrimSpace(code))
+    var v Voucher
+    found, err := store.Get(voucherPrefix+code, &v)
+    if err != nil {
+        return nil, err
+    }
+    if !found {
+        return nil, fmt.Errorf("unknown voucher code")
+    }
+    if !v.ExpiresAt.IsZero() && time.Now().After(v.ExpiresAt) {
+        return nil, fmt.Errorf("voucher has expired")
+    }
+    redeemedKey := voucherRedeemedPrefix + code + ":" + owner
+    first, err := store.SetNX(redeemedKey, time.Now().UTC(), 0)
+    if err != nil {
+        return nil, err
+    }
+    if !first {
+        return nil, fmt.Errorf("you have already redeemed this voucher")
+    }
+    count, err := store.Incr(voucherRedemptionPrefix+code, 0)
+    if err != nil {
+        store.Delete(redeemedKey)
+        return nil, err
+    }
+    if int(count) > v.MaxRedemptions {
+        store.Delete(redeemedKey)
+        return nil, fmt.Errorf("voucher has already been redeemed")
+    }
+    grant, err := grantPremium(owner, v.Days, "voucher:"+code, owner)
+    if err != nil {
+        // Restituisce il posto, così il voucher resta utilizzabile
+        store.IncrBy(voucherRedemptionPrefix+code, -1, 0)
+        store.Delete(redeemedKey)
+        return nil, err
+    }
+    return grant, nil
+}
+
+func audit(actor, action, target, details string) {
+    entry := AuditEntry{Time: time.Now().UTC(), Actor: actor, Action: action, Target: target, Details: details}
+    key := fmt.Sprintf("%s%020d:%s", auditPrefix, entry.Time.UnixNano(), uuid.New().String())
+    if err := store.Set(key, entry, 0); err != nil {
+        fmt.Printf("Error writing audit entry %s %s: %v\n", action, target, err)
+    }
+}
+
+func listAudit(limit int) ([]AuditEntry, error) {
+    keys, err := store.Keys(auditPrefix)
+    if err != nil {
+        return nil, err
+    }
+    if limit > 0 && len(keys) > limit {
+        keys = keys[len(keys)-limit:]
+    }
+    entries := make([]AuditEntry, 0, len(keys))
+    for i := len(keys) - 1; i >= 0; i-- {
+        var entry AuditEntry
+        if found, err := store.Get(keys[i], &entry); err == nil && found {
+            entries = append(entries, entry)
+        }
+    }
+    return entries, nil
+}
+
+// resolveOwner maps an admin-supplied target to an owner key: an email
+// address selects the account, anything else is taken as a session ID.
+func resolveOwner(email, sessionID string) (string, error) {
+    if email != "" {
+        normalized, err := normalizeEmail(email)
+        if err != nil {
+            return "", err
+        }
+        user, err := findUserByEmail(normalized)
+        if err != nil {
+            return "", err
+        }
+        if user == nil {
+            return "", fmt.Errorf("no account for %s", normalized)
+        }
+        return userPrefix + user.ID, nil
+    }
+    if sessionID != "" {
+        if !validSessionID(sessionID) {
+            return "", fmt.Errorf("invalid session id: %s", sessionID)
+        }
+        return anonymousPrefix + sessionID, nil
+    }
+    return "", fmt.Errorf("email or sessionId is required")
+}
+
+// adminAuthorized checks the bearer token against ADMIN_TOKEN. The admin API
+// is disabled entirely when no token is configured.
+func adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+    adminToken := os.Getenv("ADMIN_TOKEN")
+    token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return false
+    }
+    return true
+}
+
+// Admin Premium Handler: POST grants, DELETE revokes.
+func handleAdminPremium(w http.ResponseWriter, r *http.Request) {
+    if !adminAuthorized(w, r) {
+        return
+    }
+    var req struct {
+        Email     string `json:"email"`
+        SessionID string `json:"sessionId"`
+        Days      int    `json:"days"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    owner, err := resolveOwner(req.Email, req.SessionID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    switch r.Method {
+    case http.MethodPost:
+        grant, err := grantPremium(owner, req.Days, "admin", "admin-api")
+        if err != nil {
+            http.Error(w, "Error granting premium: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        writeJSON(w, grant)
+    case http.MethodDelete:
+        if err := revokePremium(owner, "admin-api"); err != nil {
+            http.Error(w, "Error revoking premium: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.WriteHeader(http.StatusOK)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// Admin Voucher Handler
+func handleAdminVouchers(w http.ResponseWriter, r *http.Request) {
+    if !adminAuthorized(w, r) {
+        return
+    }
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var req struct {
+        Days           int `json:"days"`
+        MaxRedemptions int `json:"maxRedemptions"`
+        ValidDays      int `json:"validDays"`
+        Count          int `json:"count"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if req.MaxRedemptions == 0 {
+        req.MaxRedemptions = 1
+    }
+    if req.Count == 0 {
+        req.Count = 1
+    }
+    vouchers := make([]*Voucher, 0, req.Count)
+    for i := 0; i < req.Count; i++ {
+        v, err := createVoucher(req.Days, req.MaxRedemptions, time.Duration(req.ValidDays)*24*time.Hour, "admin-api")
+        if err != nil {
+            http.Error(w, "Error creating voucher: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        vouchers = append(vouchers, v)
+    }
+    writeJSON(w, vouchers)
+}
+
+// Admin Audit Handler
+func handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+    if !adminAuthorized(w, r) {
+        return
+    }
+    limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+    if limit <= 0 {
+        limit = 100
+    }
+    entries, err := listAudit(limit)
+    if err != nil {
+        http.Error(w, "Error loading audit log: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    writeJSON(w, entries)
+}
+
+// Premium Status Handler
+func handlePremiumStatus(w http.ResponseWriter, r *http.Request) {
+    owner, err := requestOwner(r)
+    if err != nil {
+        http.Error(w, "Error: Session not found", http.StatusBadRequest)
+        return
+    }
+    grant, err := loadPremium(owner)
+    if err != nil {
+        http.Error(w, "Error loading premium status: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    status := map[string]interface{}{"isPremium": grant.Active(time.Now())}
+    if grant != nil {
+        status["expiresAt"] = grant.ExpiresAt
+    }
+    writeJSON(w, status)
+}
+
+// Voucher Redemption Handler
+func handleRedeemVoucher(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    owner, err := requestOwner(r)
+    if err != nil {
+        http.Error(w, "Error: Session not found", http.StatusBadRequest)
+        return
+    }
+    var req struct {
+        Code string `json:"code"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    grant, err := redeemVoucher(req.Code, owner)
+    if err != nil {
+        http.Error(w, "Error redeeming voucher: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    writeJSON(w, map[string]interface{}{"isPremium": true, "expiresAt": grant.ExpiresAt})
+}
+
+// runCLI handles the administrative subcommands, which operate directly on
+// the store configured by STORE_URL. All but the index commands need a
+// persistent store, since an in-memory one is lost when the command exits:
+//
+//    ARCA-b premium grant <email|session-id> <days>
+//    ARCA-b premium revoke <email|session-id>
+//    ARCA-b voucher create <days> [max-redemptions]
+//    ARCA-b audit [limit]
+func runCLI(args []string) error {
+    actor := "cli"
+    if u := os.Getenv("USER"); u != "" {
+        actor = "cli:" + u
+    }
+    if len(args) > 0 && args[0] != "index" && !persistentStoreURL(os.Getenv("STORE_URL")) {
+        return fmt.Errorf("STORE_URL must name a persistent store (redis:// or rediss://) for %s commands", args[0])
+    }
+    target := func(arg string) (string, error) {
+        if strings.Contains(arg, "@") {
+            return resolveOwner(arg, "")
+        }
+        return resolveOwner("", arg)
+    }
+    switch {
+    case len(args) == 4 && args[0] == "premium" && args[1] == "grant":
+        owner, err := target(args[2])
+        if err != nil {
+            return err
+        }
+        days, err := strconv.Atoi(args[3])
+        if err != nil {
+            return fmt.Errorf("invalid number of days: %s", args[3])
+        }
+        grant, err := grantPremium(owner, days, "admin", actor)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("Premium granted to %s until %s\n", owner, grant.ExpiresAt.Format(time.RFC3339))
+    case len(args) == 3 && args[0] == "premium" && args[1] == "revoke":
+        owner, err := target(args[2])
+        if err != nil {
+            return err
+        }
+        if err := revokePremium(owner, actor); err != nil {
+            return err
+        }
+        fmt.Printf("Premium revoked for %s\n", owner)
+    case len(args) >= 3 && args[0] == "voucher" && args[1] == "create":
+        days, err := strconv.Atoi(args[2])
+        if err != nil {
+            return fmt.Errorf("invalid number of days: %s", args[2])
+        }
+        maxRedemptions := 1
+        if len(args) > 3 {
+            if maxRedemptions, err = strconv.Atoi(args[3]); err != nil {
+                return fmt.Errorf("invalid max redemptions: %s", args[3])
+            }
+        }
+        v, err := createVoucher(days, maxRedemptions, 0, actor)
+        if err != nil {
+            return err
+        }
+        fmt.Println(v.Code)
+    case len(args) >= 1 && args[0] == "audit":
+        limit := 50
+        if len(args) > 1 {
+            limit, _ = strconv.Atoi(args[1])
+        }
+        entries, err := listAudit(limit)
+        if err != nil {
+            return err
+        }
+        for _, e := range entries {
+            fmt.Printf("%s %-16s %-15s %s %s\n", e.Time.Format(time.RFC3339), e.Actor, e.Action, e.Target, e.Details)
+        }
+    case len(args) == 2 && args[0] == "prompts" && args[1] == "show":
+        loadPromptConfig()
+        config, err := currentPromptConfig()
+        if err != nil {
+            return err
+        }
+        out, _ := json.MarshalIndent(config, "", "  ")
+        fmt.Println(string(out))
+    case len(args) == 3 && args[0] == "prompts" && args[1] == "load":
+        config, err := readPromptFile(args[2])
+        if err != nil {
+            return err
+        }
+        if err := savePromptConfig(config, actor); err != nil {
+            return err
+        }
+        fmt.Printf("System prompts updated from %s\n", args[2])
+    case len(args) == 2 && args[0] == "prompts" && args[1] == "reset":
+        if err := resetPromptConfig(actor); err != nil {
+            return err
+        }
+        fmt.Println("System prompts reset to the defaults")
+    case len(args) == 3 && args[0] == "index" && args[1] == "scan":
+        if err := loadDocumentIndex(); err != nil {
+            return err
+        }
+        embed, finish := meteredEmbedder("system", "", os.Getenv("COHERE_API_KEY"), &http.Client{Timeout: 30 * time.Second})
+        added, err := documents.Scan(args[2], embed)
+        finish()
+        if err != nil {
+            return err
+        }
+        fmt.Printf("Indexed %d new documents from %s\n", added, args[2])
+    case len(args) == 2 && args[0] == "index" && args[1] == "list":
+        if err := loadDocumentIndex(); err != nil {
+            return err
+        }
+        for _, doc := range documents.List("") {
+            fmt.Printf("%s %-40s %6d %s\n", doc.ID, doc.Name, doc.Chunks, doc.AddedAt.Format(time.RFC3339))
+        }
+    default:
+        return fmt.Errorf("usage: ARCA-b premium grant <email|session-id> <days> | premium revoke <email|session-id> | voucher create <days> [max-redemptions] | audit [limit] | prompts show|reset | prompts load <file> | index scan <dir> | index list")
+    }
+    return nil
+}
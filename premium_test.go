@@ -0,0 +1,67 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestRedeemVoucherOncePerOwner(t *testing.T) {
+    store = newMemoryStore()
+    v, err := createVoucher(30, 3, 0, "test")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := redeemVoucher(v.Code, "anon:a"); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := redeemVoucher(v.Code, "anon:a"); err == nil {
+        t.Fatal("the same owner redeemed the voucher twice")
+    }
+    for i := 0; i < 2; i++ {
+        if _, err := redeemVoucher(v.Code, fmt.Sprintf("anon:other%d", i)); err != nil {
+            t.Fatalf("redemption %d: %v", i+2, err)
+        }
+    }
+    if _, err := redeemVoucher(v.Code, "anon:late"); err == nil {
+        t.Fatal("voucher redeemed more than its maximum")
+    }
+}
+
+func TestCLIRequiresPersistentStore(t *testing.T) {
+    store = newMemoryStore()
+    for _, storeURL := range []string{"", "memory://", "fake://"} {
+        t.Setenv("STORE_URL", storeURL)
+        if err := runCLI([]string{"voucher", "create", "30"}); err == nil {
+            t.Errorf("voucher create succeeded with STORE_URL=%q", storeURL)
+        }
+    }
+}
+
+func TestGrantPremiumConcurrent(t *testing.T) {
+    for name, s := range storeBackends(t) {
+        t.Run(name, func(t *testing.T) {
+            store = s
+            var wg sync.WaitGroup
+            for i := 0; i < 10; i++ {
+                wg.Add(1)
+                go func() {
+                    defer wg.Done()
+                    if _, err := grantPremium("user:racer", 3, "test", "test"); err != nil {
+                        t.Error(err)
+                    }
+                }()
+            }
+            wg.Wait()
+            grant, err := loadPremium("user:racer")
+            if err != nil {
+                t.Fatal(err)
+            }
+            // Dieci concessioni da 3 giorni: nessuna deve andare persa
+            if days := time.Until(grant.ExpiresAt).Hours() / 24; days < 29.9 || days > 30 {
+                t.Fatalf("premium lasts %.2f days; want 30", days)
+            }
+        })
+    }
+}
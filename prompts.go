@@ -0,0 +1,364 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "sort"
+    "strings"
+    "time"
+)
+
+// PromptConfig is the system-prompt layer sent to every provider. It lives
+// in the store so operators can change it at runtime, through the admin API
+// or the CLI, on every instance at once. Prompts may use the placeholders
+// {language} and {date}.
+type PromptConfig struct {
+    Global    string                    `json:"global"`
+    Providers map[string]ProviderPrompt `json:"providers,omitempty"`
+    Personas  map[string]*Persona       `json:"personas,omitempty"`
+    UpdatedAt time.Time                 `json:"updatedAt"`
+    UpdatedBy string                    `json:"updatedBy,omitempty"`
+}
+
+// ProviderPrompt is added after the global prompt, or replaces it when
+// ReplaceGlobal is set, for models that need to be told differently.
+type ProviderPrompt struct {
+    Prompt        string `json:"prompt"`
+    ReplaceGlobal bool   `json:"replaceGlobal,omitempty"`
+}
+
+// Persona is a role the models are asked to play. The operator defines the
+// shared ones in PromptConfig; accounts can add their own.
+type Persona struct {
+    Name   string `json:"name"`
+    Label  string `json:"label"`
+    Prompt string `json:"prompt"`
+    Custom bool   `json:"custom,omitempty"`
+}
+
+const (
+    promptConfigKey   = "config:prompts"
+    maxCustomPersonas = 20
+    maxPromptLength   = 4000
+)
+
+var defaultPromptConfig = PromptConfig{
+    Global: "You are one of several AI models consulted by ARCA-b Chat AI, which compares and blends their answers into one. " +
+        "Be accurate and objective, present the main points of view on contested topics, and say clearly when you are not sure. " +
+        "Today is {date}.",
+    Personas: map[string]*Persona{
+        "teacher": {
+            Name:   "teacher",
+            Label:  "Teacher",
+            Prompt: "Act as a patient teacher: explain step by step, check the key ideas with a short example and point out common mistakes.",
+        },
+        "journalist": {
+            Name:   "journalist",
+            Label:  "Fact-checking journalist",
+            Prompt: "Act as a fact-checking journalist: separate facts from opinions, name your sources when you can and flag claims that are disputed.",
+        },
+        "developer": {
+            Name:   "developer",
+            Label:  "Senior developer",
+            Prompt: "Act as a senior software developer: prefer working code, mention trade-offs and security issues, and keep explanations short.",
+        },
+    },
+}
+
+// promptDefaults is what the configuration falls back to when nothing is
+// stored: the PROMPTS_FILE given at startup, or the built-in defaults.
+var promptDefaults = defaultPromptConfig
+
+// loadPromptConfig reads PROMPTS_FILE, if set, as the default configuration.
+func loadPromptConfig() {
+    path := os.Getenv("PROMPTS_FILE")
+    if path == "" {
+        return
+    }
+    config, err := readPromptFile(path)
+    if err != nil {
+        fmt.Printf("Error: invalid PROMPTS_FILE, using the built-in prompts: %v\n", err)
+        return
+    }
+    promptDefaults = *config
+    fmt.Printf("System prompts loaded from %s\n", path)
+}
+
+func readPromptFile(path string) (*PromptConfig, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var config PromptConfig
+    if err := json.Unmarshal(data, &config); err != nil {
+        return nil, fmt.Errorf("error parsing %s: %v", path, err)
+    }
+    if err := validatePromptConfig(&config); err != nil {
+        return nil, err
+    }
+    return &config, nil
+}
+
+// currentPromptConfig returns the stored configuration, or the defaults.
+func currentPromptConfig() (*PromptConfig, error) {
+    var config PromptConfig
+    found, err := store.Get(promptConfigKey, &config)
+    if err != nil {
+        return nil, err
+    }
+    if !found {
+        config = promptDefaults
+    }
+    return &config, nil
+}
+
+func savePromptConfig(config *PromptConfig, actor string) error {
+    config.UpdatedAt = time.Now().UTC()
+    config.UpdatedBy = actor
+    if err := store.Set(promptConfigKey, config, 0); err != nil {
+        return err
+    }
+    audit(actor, "prompts.update", promptConfigKey, fmt.Sprintf("%d provider overrides, %d personas", len(config.Providers), len(config.Personas)))
+    return nil
+}
+
+func resetPromptConfig(actor string) error {
+    if err := store.Delete(promptConfigKey); err != nil {
+        return err
+    }
+    audit(actor, "prompts.reset", promptConfigKey, "")
+    return nil
+}
+
+func validatePromptConfig(config *PromptConfig) error {
+    if len(config.Global) > maxPromptLength {
+        return fmt.Errorf("global prompt must be at most %d characters", maxPromptLength)
+    }
+    for provider, prompt := range config.Providers {
+        if !isChatProvider(provider) {
+            return fmt.Errorf("unknown provider %q", provider)
+        }
+        if len(prompt.Prompt) > maxPromptLength {
+            return fmt.Errorf("prompt for %s must be at most %d characters", provider, maxPromptLength)
+        }
+    }
+    personas := make(map[string]*Persona, len(config.Personas))
+    for name, persona := range config.Personas {
+        if persona == nil {
+            return fmt.Errorf("persona %q is empty", name)
+        }
+        persona.Name = name
+        if err := validatePersona(persona); err != nil {
+            return err
+        }
+        persona.Custom = false
+        personas[persona.Name] = persona
+    }
+    config.Personas = personas
+    return nil
+}
+
+func validatePersona(persona *Persona) error {
+    persona.Name = strings.ToLower(strings.TrimSpace(persona.Name))
+    if !styleNamePattern.MatchString(persona.Name) {
+        return fmt.Errorf("persona name must be 1-32 lowercase letters, digits or dashes")
+    }
+    if strings.TrimSpace(persona.Label) == "" {
+        persona.Label = persona.Name
+    }
+    if strings.TrimSpace(persona.Prompt) == "" || len(persona.Prompt) > maxPromptLength {
+        return fmt.Errorf("persona prompt must be 1-%d characters", maxPromptLength)
+    }
+    return nil
+}
+
+// resolvePersona finds a persona among the shared ones and the owner's own.
+// An empty name means no persona.
+func resolvePersona(config *PromptConfig, owner, name string) (*Persona, error) {
+    name = strings.ToLower(strings.TrimSpace(name))
+    if name == "" {
+        return nil, nil
+    }
+    if persona, ok := config.Personas[name]; ok {
+        return persona, nil
+    }
+    if strings.HasPrefix(owner, userPrefix) {
+        profile, err := loadProfile(owner)
+        if err != nil {
+            return nil, err
+        }
+        if persona, ok := profile.Personas[name]; ok {
+            return persona, nil
+        }
+    }
+    return nil, fmt.Errorf("unknown persona %q", name)
+}
+
+// systemPrompt composes what a provider receives as its system message:
+// global prompt, provider prompt, persona, style and answer language, in
+// this order, with the placeholders filled in.
+func (c *PromptConfig) systemPrompt(provider string, persona *Persona, style *StylePreset, lang Language) promptOptions {
+    options := style.forProvider(provider)
+    var parts []string
+    override, hasOverride := c.Providers[provider]
+    if !hasOverride || !override.ReplaceGlobal {
+        parts = append(parts, c.Global)
+    }
+    if hasOverride {
+        parts = append(parts, override.Prompt)
+    }
+    if persona != nil {
+        parts = append(parts, persona.Prompt)
+    }
+    parts = append(parts, options.System, lang.instruction())
+    replacer := strings.NewReplacer("{language}", lang.Name, "{date}", time.Now().UTC().Format("2006-01-02"))
+    var prompt []string
+    for _, part := range parts {
+        if part = strings.TrimSpace(part); part != "" {
+            prompt = append(prompt, replacer.Replace(part))
+        }
+    }
+    options.System = strings.Join(prompt, "\n\n")
+    return options
+}
+
+// Admin Prompts Handler:
+//   GET    /admin/prompts  current configuration
+//   PUT    /admin/prompts  replace it
+//   DELETE /admin/prompts  go back to PROMPTS_FILE or the built-in defaults
+func handleAdminPrompts(w http.ResponseWriter, r *http.Request) {
+    if !adminAuthorized(w, r) {
+        return
+    }
+    switch r.Method {
+    case http.MethodGet:
+        config, err := currentPromptConfig()
+        if err != nil {
+            http.Error(w, "Error loading prompts: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        writeJSON(w, config)
+    case http.MethodPut:
+        var config PromptConfig
+        if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+            http.Error(w, "Invalid request", http.StatusBadRequest)
+            return
+        }
+        if err := validatePromptConfig(&config); err != nil {
+            http.Error(w, "Invalid prompts: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        if err := savePromptConfig(&config, "admin-api"); err != nil {
+            http.Error(w, "Error saving prompts: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        writeJSON(w, config)
+    case http.MethodDelete:
+        if err := resetPromptConfig("admin-api"); err != nil {
+            http.Error(w, "Error resetting prompts: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        writeJSON(w, promptDefaults)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// Personas Handler:
+//   GET    /personas         shared personas and the caller's own
+//   POST   /personas         create or replace a persona (accounts only)
+//   DELETE /personas/{name}  delete one of the caller's personas
+func handlePersonas(w http.ResponseWriter, r *http.Request) {
+    owner, err := requestOwner(r)
+    if err != nil {
+        http.Error(w, "Error: Session not found", http.StatusBadRequest)
+        return
+    }
+    config, err := currentPromptConfig()
+    if err != nil {
+        http.Error(w, "Error loading personas: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/personas"), "/")
+    if r.Method == http.MethodGet && name == "" {
+        personas := make([]*Persona, 0, len(config.Personas))
+        for _, persona := range config.Personas {
+            personas = append(personas, persona)
+        }
+        if strings.HasPrefix(owner, userPrefix) {
+            profile, err := loadProfile(owner)
+            if err != nil {
+                http.Error(w, "Error loading personas: "+err.Error(), http.StatusInternalServerError)
+                return
+            }
+            for _, persona := range profile.Personas {
+                personas = append(personas, persona)
+            }
+        }
+        sort.Slice(personas, func(i, j int) bool {
+            if personas[i].Custom != personas[j].Custom {
+                return !personas[i].Custom
+            }
+            return personas[i].Name < personas[j].Name
+        })
+        writeJSON(w, map[string]interface{}{"personas": personas})
+        return
+    }
+    if !strings.HasPrefix(owner, userPrefix) {
+        http.Error(w, "Log in to save personas", http.StatusUnauthorized)
+        return
+    }
+    unlock, err := sessionLocks.Lock(profilePrefix + owner)
+    if err != nil {
+        http.Error(w, "Error loading personas: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    defer unlock()
+    profile, err := loadProfile(owner)
+    if err != nil {
+        http.Error(w, "Error loading personas: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    switch {
+    case r.Method == http.MethodPost && name == "":
+        var persona Persona
+        if err := json.NewDecoder(r.Body).Decode(&persona); err != nil {
+            http.Error(w, "Invalid request", http.StatusBadRequest)
+            return
+        }
+        if err := validatePersona(&persona); err != nil {
+            http.Error(w, "Invalid persona: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        if _, shared := config.Personas[persona.Name]; shared {
+            http.Error(w, fmt.Sprintf("Invalid persona: %q is a shared persona", persona.Name), http.StatusBadRequest)
+            return
+        }
+        if _, exists := profile.Personas[persona.Name]; !exists && len(profile.Personas) >= maxCustomPersonas {
+            http.Error(w, fmt.Sprintf("At most %d personas", maxCustomPersonas), http.StatusBadRequest)
+            return
+        }
+        persona.Custom = true
+        profile.Personas[persona.Name] = &persona
+        if err := saveProfile(owner, profile); err != nil {
+            http.Error(w, "Error saving persona: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        writeJSON(w, persona)
+    case r.Method == http.MethodDelete && name != "":
+        if _, exists := profile.Personas[name]; !exists {
+            http.Error(w, "Persona not found", http.StatusNotFound)
+            return
+        }
+        delete(profile.Personas, name)
+        if err := saveProfile(owner, profile); err != nil {
+            http.Error(w, "Error deleting persona: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        writeJSON(w, map[string]interface{}{"deleted": true})
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
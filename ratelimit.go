@@ -0,0 +1,199 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// rateLimitTier is a token bucket holding Capacity requests that refills
+// completely over Period. Tiers are configured with RATE_LIMIT_<NAME>, for
+// example RATE_LIMIT_PREMIUM=300/1h.
+type rateLimitTier struct {
+    Name     string
+    Capacity int64
+    Period   time.Duration
+}
+
+var rateLimitTiers = map[string]*rateLimitTier{
+    "anonymous": {Name: "anonymous", Capacity: 15, Period: time.Hour},
+    "account":   {Name: "account", Capacity: 30, Period: time.Hour},
+    "premium":   {Name: "premium", Capacity: 300, Period: time.Hour},
+    // ip caps every client address regardless of cookies, so clearing them
+    // does not reset the limit.
+    "ip": {Name: "ip", Capacity: 60, Period: time.Hour},
+    // auth slows down password guessing and magic-link spam.
+    "auth": {Name: "auth", Capacity: 10, Period: 15 * time.Minute},
+}
+
+const rateLimitPrefix = "ratelimit:"
+
+// trustedProxies are the networks whose X-Forwarded-For header is believed.
+// The default covers load balancers on loopback and private networks.
+var trustedProxies = parseCIDRs("127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7")
+
+func parseCIDRs(list string) []*net.IPNet {
+    var nets []*net.IPNet
+    for _, cidr := range strings.Split(list, ",") {
+        cidr = strings.TrimSpace(cidr)
+        if cidr == "" {
+            continue
+        }
+        if _, n, err := net.ParseCIDR(cidr); err == nil {
+            nets = append(nets, n)
+        } else {
+            fmt.Printf("Error: invalid trusted proxy %q: %v\n", cidr, err)
+        }
+    }
+    return nets
+}
+
+func loadRateLimitConfig() {
+    for name, tier := range rateLimitTiers {
+        value := os.Getenv("RATE_LIMIT_" + strings.ToUpper(name))
+        if value == "" {
+            continue
+        }
+        parts := strings.SplitN(value, "/", 2)
+        capacity, err := strconv.ParseInt(parts[0], 10, 64)
+        if err != nil || capacity <= 0 || len(parts) != 2 {
+            fmt.Printf("Error: invalid RATE_LIMIT_%s %q, expected e.g. 15/1h\n", strings.ToUpper(name), value)
+            continue
+        }
+        period, err := time.ParseDuration(parts[1])
+        if err != nil || period <= 0 {
+            fmt.Printf("Error: invalid RATE_LIMIT_%s period %q\n", strings.ToUpper(name), parts[1])
+            continue
+        }
+        tier.Capacity = capacity
+        tier.Period = period
+    }
+    if value, ok := os.LookupEnv("TRUSTED_PROXIES"); ok {
+        trustedProxies = parseCIDRs(value)
+    }
+}
+
+func isTrustedProxy(ip net.IP) bool {
+    for _, n := range trustedProxies {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// followed through trusted proxies, starting from the nearest hop, so a
+// client cannot pick its own address by sending the header.
+func clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    ip := net.ParseIP(host)
+    if ip == nil || !isTrustedProxy(ip) {
+        return host
+    }
+    hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+    for i := len(hops) - 1; i >= 0; i-- {
+        hop := net.ParseIP(strings.TrimSpace(hops[i]))
+        if hop == nil {
+            break
+        }
+        ip = hop
+        if !isTrustedProxy(hop) {
+            break
+        }
+    }
+    return ip.String()
+}
+
+func takeFromTier(tierName, id string) (TokenBucket, *rateLimitTier, error) {
+    tier := rateLimitTiers[tierName]
+    bucket, err := store.Take(rateLimitPrefix+tierName+":"+id, tier.Capacity, tier.Period)
+    return bucket, tier, err
+}
+
+func ceilSeconds(d time.Duration) int {
+    return int(math.Ceil(d.Seconds()))
+}
+
+// setRateLimitHeaders writes the RateLimit-* fields of the IETF httpapi
+// draft for the most restrictive bucket of the request.
+func setRateLimitHeaders(w http.ResponseWriter, bucket TokenBucket, tier *rateLimitTier) {
+    w.Header().Set("RateLimit-Limit", strconv.FormatInt(bucket.Capacity, 10))
+    w.Header().Set("RateLimit-Remaining", strconv.FormatInt(bucket.Remaining, 10))
+    w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(bucket.ResetAfter)))
+    w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;name=%q", tier.Capacity, int(tier.Period.Seconds()), tier.Name))
+}
+
+func writeRateLimited(w http.ResponseWriter, bucket TokenBucket, tier *rateLimitTier) {
+    setRateLimitHeaders(w, bucket, tier)
+    w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(bucket.RetryAfter)))
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusTooManyRequests)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "error":      "rate_limited",
+        "tier":       tier.Name,
+        "limit":      tier.Capacity,
+        "window":     int(tier.Period.Seconds()),
+        "retryAfter": ceilSeconds(bucket.RetryAfter),
+    })
+}
+
+// enforceRateLimit charges one request to the owner's tier and to the
+// client IP. It writes the RateLimit headers, and a 429 reply when either
+// bucket is empty, in which case it returns false.
+func enforceRateLimit(w http.ResponseWriter, r *http.Request, owner string) (*UserRequestTracker, bool) {
+    tracker, err := loadRequestTracker(owner)
+    if err != nil {
+        http.Error(w, "Error checking rate limit: "+err.Error(), http.StatusInternalServerError)
+        return nil, false
+    }
+    ownerBucket, ownerTier, err := takeFromTier(tracker.Tier, owner)
+    if err != nil {
+        http.Error(w, "Error checking rate limit: "+err.Error(), http.StatusInternalServerError)
+        return nil, false
+    }
+    if !ownerBucket.Allowed {
+        writeRateLimited(w, ownerBucket, ownerTier)
+        return nil, false
+    }
+    if !tracker.IsPremium {
+        ipBucket, ipTier, err := takeFromTier("ip", clientIP(r))
+        if err != nil {
+            http.Error(w, "Error checking rate limit: "+err.Error(), http.StatusInternalServerError)
+            return nil, false
+        }
+        if !ipBucket.Allowed {
+            writeRateLimited(w, ipBucket, ipTier)
+            return nil, false
+        }
+        if ipBucket.Remaining < ownerBucket.Remaining {
+            ownerBucket, ownerTier = ipBucket, ipTier
+        }
+    }
+    setRateLimitHeaders(w, ownerBucket, ownerTier)
+    return tracker, true
+}
+
+// enforceIPRateLimit charges one request to the client IP in the given tier.
+func enforceIPRateLimit(w http.ResponseWriter, r *http.Request, tierName string) bool {
+    bucket, tier, err := takeFromTier(tierName, clientIP(r))
+    if err != nil {
+        http.Error(w, "Error checking rate limit: "+err.Error(), http.StatusInternalServerError)
+        return false
+    }
+    if !bucket.Allowed {
+        writeRateLimited(w, bucket, tier)
+        return false
+    }
+    setRateLimitHeaders(w, bucket, tier)
+    return true
+}
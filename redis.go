@@ -0,0 +1,559 @@
+package main
+
+import (
+    "bufio"
+    "crypto/tls"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// redisStore talks the Redis protocol (RESP2) directly, so it works with
+// Redis, Valkey, KeyDB, Dragonfly and the in-process fake below.
+type redisStore struct {
+    addr     string
+    useTLS   bool
+    username string
+    password string
+    db       int
+    pool     chan *redisConn
+}
+
+type redisConn struct {
+    conn net.Conn
+    r    *bufio.Reader
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+const redisIncrScript = `local ttl = redis.call('PTTL', KEYS[1])
+local n = redis.call('INCRBY', KEYS[1], ARGV[2])
+if ttl == -2 and tonumber(ARGV[1]) > 0 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+return n`
+
+// GETDEL needs Redis 6.2; the script works with older servers too.
+const redisGetDeleteScript = `local value = redis.call('GET', KEYS[1])
+if value then redis.call('DEL', KEYS[1]) end
+return value`
+
+const redisCompareDeleteScript = `if redis.call('GET', KEYS[1]) == ARGV[1] then return redis.call('DEL', KEYS[1]) end
+return 0`
+
+// redisTakeScript is the Lua version of takeToken. The caller's clock is
+// passed in so that the fake server can run the same logic in Go.
+const redisTakeScript = `local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1]) or capacity
+local updated = tonumber(state[2]) or now
+tokens = math.min(capacity, tokens + (now - updated) * capacity / period)
+local allowed = 0
+if tokens >= 1 then
+    tokens = tokens - 1
+    allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], period)
+return {allowed, tostring(tokens)}`
+
+func newRedisStore(u *url.URL) (*redisStore, error) {
+    s := &redisStore{
+        addr:   u.Host,
+        useTLS: u.Scheme == "rediss",
+        pool:   make(chan *redisConn, 16),
+    }
+    if !strings.Contains(s.addr, ":") {
+        s.addr += ":6379"
+    }
+    if u.User != nil {
+        s.username = u.User.Username()
+        s.password, _ = u.User.Password()
+    }
+    if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+        n, err := strconv.Atoi(db)
+        if err != nil {
+            return nil, fmt.Errorf("invalid Redis database %q", db)
+        }
+        s.db = n
+    }
+    if _, err := s.do("PING"); err != nil {
+        return nil, fmt.Errorf("error connecting to Redis at %s: %v", s.addr, err)
+    }
+    return s, nil
+}
+
+func (s *redisStore) dial() (*redisConn, error) {
+    var conn net.Conn
+    var err error
+    dialer := &net.Dialer{Timeout: 5 * time.Second}
+    if s.useTLS {
+        conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, &tls.Config{ServerName: strings.Split(s.addr, ":")[0]})
+    } else {
+        conn, err = dialer.Dial("tcp", s.addr)
+    }
+    if err != nil {
+        return nil, err
+    }
+    c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+    if s.password != "" {
+        args := []string{"AUTH", s.password}
+        if s.username != "" {
+            args = []string{"AUTH", s.username, s.password}
+        }
+        if _, err := c.do(args...); err != nil {
+            conn.Close()
+            return nil, err
+        }
+    }
+    if s.db != 0 {
+        if _, err := c.do("SELECT", strconv.Itoa(s.db)); err != nil {
+            conn.Close()
+            return nil, err
+        }
+    }
+    return c, nil
+}
+
+func (s *redisStore) do(args ...string) (interface{}, error) {
+    var c *redisConn
+    select {
+    case c = <-s.pool:
+    default:
+        var err error
+        c, err = s.dial()
+        if err != nil {
+            return nil, err
+        }
+    }
+    reply, err := c.do(args...)
+    var replyErr redisError
+    if err != nil && !errors.As(err, &replyErr) {
+        c.conn.Close()
+        return nil, err
+    }
+    select {
+    case s.pool <- c:
+    default:
+        c.conn.Close()
+    }
+    return reply, err
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+    c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+    if _, err := c.conn.Write(encodeRedisCommand(args)); err != nil {
+        return nil, err
+    }
+    return readRedisReply(c.r)
+}
+
+func encodeRedisCommand(args []string) []byte {
+    var b strings.Builder
+    b.WriteString(fmt.Sprintf("*%d\r\n", len(args)))
+    for _, arg := range args {
+        b.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg))
+    }
+    return []byte(b.String())
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+    line, err := r.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    line = strings.TrimSuffix(line, "\r\n")
+    if line == "" {
+        return nil, fmt.Errorf("empty Redis reply")
+    }
+    switch line[0] {
+    case '+':
+        return line[1:], nil
+    case '-':
+        return nil, redisError(line[1:])
+    case ':':
+        return strconv.ParseInt(line[1:], 10, 64)
+    case '$':
+        n, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+        if n < 0 {
+            return nil, nil
+        }
+        buf := make([]byte, n+2)
+        if _, err := io.ReadFull(r, buf); err != nil {
+            return nil, err
+        }
+        return buf[:n], nil
+    case '*':
+        n, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+        if n < 0 {
+            return nil, nil
+        }
+        items := make([]interface{}, n)
+        for i := range items {
+            if items[i], err = readRedisReply(r); err != nil {
+                return nil, err
+            }
+        }
+        return items, nil
+    }
+    return nil, fmt.Errorf("unexpected Redis reply: %q", line)
+}
+
+func (s *redisStore) Get(key string, value interface{}) (bool, error) {
+    reply, err := s.do("GET", key)
+    if err != nil {
+        return false, err
+    }
+    if reply == nil {
+        return false, nil
+    }
+    data, ok := reply.([]byte)
+    if !ok {
+        return false, fmt.Errorf("unexpected Redis reply for GET %s", key)
+    }
+    if err := json.Unmarshal(data, value); err != nil {
+        return false, fmt.Errorf("error decoding %s: %v", key, err)
+    }
+    return true, nil
+}
+
+func (s *redisStore) Set(key string, value interface{}, ttl time.Duration) error {
+    data, err := json.Marshal(value)
+    if err != nil {
+        return fmt.Errorf("error encoding %s: %v", key, err)
+    }
+    args := []string{"SET", key, string(data)}
+    if ttl > 0 {
+        args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+    }
+    _, err = s.do(args...)
+    return err
+}
+
+func (s *redisStore) Delete(key string) error {
+    _, err := s.do("DEL", key)
+    return err
+}
+
+func (s *redisStore) SetNX(key string, value interface{}, ttl time.Duration) (bool, error) {
+    data, err := json.Marshal(value)
+    if err != nil {
+        return false, fmt.Errorf("error encoding %s: %v", key, err)
+    }
+    args := []string{"SET", key, string(data), "NX"}
+    if ttl > 0 {
+        args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+    }
+    reply, err := s.do(args...)
+    if err != nil {
+        return false, err
+    }
+    return reply != nil, nil
+}
+
+func (s *redisStore) GetDelete(key string, value interface{}) (bool, error) {
+    reply, err := s.do("EVAL", redisGetDeleteScript, "1", key)
+    if err != nil {
+        return false, err
+    }
+    if reply == nil {
+        return false, nil
+    }
+    data, ok := reply.([]byte)
+    if !ok {
+        return false, fmt.Errorf("unexpected Redis reply for GETDEL %s", key)
+    }
+    if err := json.Unmarshal(data, value); err != nil {
+        return false, fmt.Errorf("error decoding %s: %v", key, err)
+    }
+    return true, nil
+}
+
+func (s *redisStore) CompareAndDelete(key string, value interface{}) (bool, error) {
+    data, err := json.Marshal(value)
+    if err != nil {
+        return false, fmt.Errorf("error encoding %s: %v", key, err)
+    }
+    reply, err := s.do("EVAL", redisCompareDeleteScript, "1", key, string(data))
+    if err != nil {
+        return false, err
+    }
+    n, _ := reply.(int64)
+    return n == 1, nil
+}
+
+func (s *redisStore) Incr(key string, ttl time.Duration) (int64, error) {
+    return s.IncrBy(key, 1, ttl)
+}
+
+func (s *redisStore) IncrBy(key string, delta int64, ttl time.Duration) (int64, error) {
+    reply, err := s.do("EVAL", redisIncrScript, "1", key, strconv.FormatInt(ttl.Milliseconds(), 10), strconv.FormatInt(delta, 10))
+    if err != nil {
+        return 0, err
+    }
+    count, ok := reply.(int64)
+    if !ok {
+        return 0, fmt.Errorf("unexpected Redis reply for INCR %s", key)
+    }
+    return count, nil
+}
+
+func (s *redisStore) Take(key string, capacity int64, period time.Duration) (TokenBucket, error) {
+    reply, err := s.do("EVAL", redisTakeScript, "1", key,
+        strconv.FormatInt(capacity, 10), strconv.FormatInt(period.Milliseconds(), 10), strconv.FormatInt(time.Now().UnixMilli(), 10))
+    if err != nil {
+        return TokenBucket{}, err
+    }
+    items, ok := reply.([]interface{})
+    if !ok || len(items) != 2 {
+        return TokenBucket{}, fmt.Errorf("unexpected Redis reply for token bucket %s", key)
+    }
+    allowed, _ := items[0].(int64)
+    tokensText, _ := items[1].([]byte)
+    tokens, err := strconv.ParseFloat(string(tokensText), 64)
+    if err != nil {
+        return TokenBucket{}, fmt.Errorf("unexpected Redis reply for token bucket %s", key)
+    }
+    return bucketResult(TokenBucket{Allowed: allowed == 1, Capacity: capacity}, tokens, capacity, period), nil
+}
+
+func (s *redisStore) Keys(prefix string) ([]string, error) {
+    var keys []string
+    seen := make(map[string]bool)
+    cursor := "0"
+    pattern := redisGlobEscaper.Replace(prefix) + "*"
+    for {
+        reply, err := s.do("SCAN", cursor, "MATCH", pattern, "COUNT", "200")
+        if err != nil {
+            return nil, err
+        }
+        items, ok := reply.([]interface{})
+        if !ok || len(items) != 2 {
+            return nil, fmt.Errorf("unexpected Redis reply for SCAN")
+        }
+        next, _ := items[0].([]byte)
+        batch, _ := items[1].([]interface{})
+        for _, item := range batch {
+            if key, ok := item.([]byte); ok && !seen[string(key)] {
+                seen[string(key)] = true
+                keys = append(keys, string(key))
+            }
+        }
+        cursor = string(next)
+        if cursor == "0" || cursor == "" {
+            break
+        }
+    }
+    sort.Strings(keys)
+    return keys, nil
+}
+
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// fakeRedis is a minimal in-process server for the subset of the Redis
+// protocol used by redisStore. Scripts are not interpreted: each script the
+// store sends is mapped to an equivalent Go function.
+type fakeRedis struct {
+    mu      sync.Mutex
+    entries map[string]memoryEntry
+}
+
+var fakeRedisScripts = map[string]func(f *fakeRedis, keys, args []string) (interface{}, error){
+    redisIncrScript: func(f *fakeRedis, keys, args []string) (interface{}, error) {
+        ms, _ := strconv.ParseInt(args[0], 10, 64)
+        delta, _ := strconv.ParseInt(args[1], 10, 64)
+        return incrEntry(f.entries, keys[0], delta, time.Duration(ms)*time.Millisecond)
+    },
+    redisGetDeleteScript: func(f *fakeRedis, keys, args []string) (interface{}, error) {
+        entry, ok := f.entries[keys[0]]
+        delete(f.entries, keys[0])
+        if !ok || entry.expired(time.Now()) {
+            return nil, nil
+        }
+        return entry.data, nil
+    },
+    redisCompareDeleteScript: func(f *fakeRedis, keys, args []string) (interface{}, error) {
+        if deleteEntryIf(f.entries, keys[0], []byte(args[0])) {
+            return int64(1), nil
+        }
+        return int64(0), nil
+    },
+    redisTakeScript: func(f *fakeRedis, keys, args []string) (interface{}, error) {
+        capacity, _ := strconv.ParseInt(args[0], 10, 64)
+        periodMs, _ := strconv.ParseInt(args[1], 10, 64)
+        now, _ := strconv.ParseInt(args[2], 10, 64)
+        var state bucketState
+        if entry, ok := f.entries[keys[0]]; ok && !entry.expired(time.Now()) {
+            json.Unmarshal(entry.data, &state)
+        }
+        result := takeToken(&state, capacity, time.Duration(periodMs)*time.Millisecond, now)
+        data, _ := json.Marshal(state)
+        f.entries[keys[0]] = memoryEntry{data: data, expiresAt: time.Now().Add(time.Duration(periodMs) * time.Millisecond)}
+        var allowed int64
+        if result.Allowed {
+            allowed = 1
+        }
+        return []interface{}{allowed, []byte(strconv.FormatFloat(state.Tokens, 'f', -1, 64))}, nil
+    },
+}
+
+func startFakeRedis(addr string) (string, error) {
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return "", err
+    }
+    f := &fakeRedis{entries: make(map[string]memoryEntry)}
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            go f.serve(conn)
+        }
+    }()
+    return listener.Addr().String(), nil
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+    defer conn.Close()
+    r := bufio.NewReader(conn)
+    for {
+        request, err := readRedisReply(r)
+        if err != nil {
+            return
+        }
+        items, _ := request.([]interface{})
+        args := make([]string, len(items))
+        for i, item := range items {
+            b, _ := item.([]byte)
+            args[i] = string(b)
+        }
+        reply, err := f.exec(args)
+        if err != nil {
+            reply = redisError("ERR " + err.Error())
+        }
+        if _, err := conn.Write(encodeRedisReply(reply)); err != nil {
+            return
+        }
+    }
+}
+
+func (f *fakeRedis) exec(args []string) (interface{}, error) {
+    if len(args) == 0 {
+        return nil, fmt.Errorf("empty command")
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    now := time.Now()
+    switch strings.ToUpper(args[0]) {
+    case "PING":
+        return "PONG", nil
+    case "AUTH", "SELECT":
+        return "OK", nil
+    case "GET":
+        entry, ok := f.entries[args[1]]
+        if !ok || entry.expired(now) {
+            return nil, nil
+        }
+        return entry.data, nil
+    case "SET":
+        var ttl time.Duration
+        nx := false
+        for i := 3; i < len(args); i++ {
+            switch strings.ToUpper(args[i]) {
+            case "NX":
+                nx = true
+            case "PX":
+                if i+1 < len(args) {
+                    ms, _ := strconv.ParseInt(args[i+1], 10, 64)
+                    ttl = time.Duration(ms) * time.Millisecond
+                    i++
+                }
+            }
+        }
+        if nx {
+            if !setEntryNX(f.entries, args[1], []byte(args[2]), ttl) {
+                return nil, nil
+            }
+            return "OK", nil
+        }
+        entry := memoryEntry{data: []byte(args[2])}
+        if ttl > 0 {
+            entry.expiresAt = now.Add(ttl)
+        }
+        f.entries[args[1]] = entry
+        return "OK", nil
+    case "DEL":
+        var n int64
+        for _, key := range args[1:] {
+            if _, ok := f.entries[key]; ok {
+                delete(f.entries, key)
+                n++
+            }
+        }
+        return n, nil
+    case "SCAN":
+        prefix := ""
+        for i := 2; i+1 < len(args); i += 2 {
+            if strings.ToUpper(args[i]) == "MATCH" {
+                prefix = redisGlobUnescaper.Replace(strings.TrimSuffix(args[i+1], "*"))
+            }
+        }
+        var keys []interface{}
+        for key, entry := range f.entries {
+            if strings.HasPrefix(key, prefix) && !entry.expired(now) {
+                keys = append(keys, []byte(key))
+            }
+        }
+        return []interface{}{[]byte("0"), keys}, nil
+    case "EVAL":
+        script, ok := fakeRedisScripts[args[1]]
+        if !ok {
+            return nil, fmt.Errorf("unknown script")
+        }
+        numKeys, _ := strconv.Atoi(args[2])
+        return script(f, args[3:3+numKeys], args[3+numKeys:])
+    }
+    return nil, fmt.Errorf("unknown command '%s'", args[0])
+}
+
+var redisGlobUnescaper = strings.NewReplacer(`\\`, `\`, `\*`, `*`, `\?`, `?`, `\[`, `[`, `\]`, `]`)
+
+func encodeRedisReply(reply interface{}) []byte {
+    switch v := reply.(type) {
+    case nil:
+        return []byte("$-1\r\n")
+    case string:
+        return []byte("+" + v + "\r\n")
+    case redisError:
+        return []byte("-" + string(v) + "\r\n")
+    case int64:
+        return []byte(":" + strconv.FormatInt(v, 10) + "\r\n")
+    case []byte:
+        return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(v), v))
+    case []interface{}:
+        out := []byte(fmt.Sprintf("*%d\r\n", len(v)))
+        for _, item := range v {
+            out = append(out, encodeRedisReply(item)...)
+        }
+        return out
+    }
+    return []byte("-ERR unsupported reply\r\n")
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "unicode"
+)
+
+// AnswerFlag marks an answer that avoids the question, with the words that
+// gave it away.
+type AnswerFlag struct {
+    Kind     string `json:"kind"`
+    Evidence string `json:"evidence"`
+}
+
+// Kinds of AnswerFlag. A refusal declines to answer; hedging piles up
+// caveats instead of taking a position; an evasive answer redirects the
+// user elsewhere or talks about something else.
+const (
+    flagRefusal = "refusal"
+    flagHedging = "hedging"
+    flagEvasive = "evasive"
+)
+
+var flagKinds = []string{flagRefusal, flagHedging, flagEvasive}
+
+// Weights applied to an answer's similarity score in the synthesis.
+// Refusals are not scored at all unless every provider refused.
+var flagWeights = map[string]float64{
+    flagHedging: 0.75,
+    flagEvasive: 0.5,
+}
+
+const (
+    // Un rifiuto in una risposta lunga è un avvertimento seguito da una risposta vera
+    maxRefusalLength = 400
+    maxEvasiveLength = 600
+    shortHedgeLength = 500
+)
+
+var (
+    refusalPattern = regexp.MustCompile(`(?i)\bI(?:'m| am)? (?:can(?:no|')t|cannot|unable to|not able to|won't|will not|must decline to) (?:help|assist|provide|discuss|answer|comment|engage|share|talk|give|offer|fulfil|fulfill|comply)` +
+        `|\b(?:I'm|I am) (?:sorry|afraid),? but I (?:can(?:no|')t|cannot|won't)` +
+        `|\bas an AI(?: language model)?,? I (?:can(?:no|')t|cannot|don't|do not|am not able)` +
+        `|\bI (?:don't|do not) (?:feel comfortable|think it(?:'s| is) appropriate)` +
+        `|\blet's (?:talk|chat) about something else` +
+        `|\bnon posso (?:aiutarti|rispondere|fornire|discutere|parlare|commentare|esprimere)` +
+        `|\bmi dispiace,? ma non (?:posso|sono in grado)` +
+        `|\bnon sono in grado di (?:rispondere|fornire|aiutarti|discutere)` +
+        `|\bich kann (?:dir |ihnen )?(?:dabei |hierbei )?(?:nicht|keine) (?:helfen|antworten|beantworten|auskunft)` +
+        `|\bje ne peux pas (?:vous |t')?(?:aider|répondre|fournir|discuter)` +
+        `|\bno puedo (?:ayudar|responder|proporcionar|discutir|hablar)` +
+        `|\blo siento,? pero no puedo` +
+        `|我无法|我不能(?:回答|提供|讨论)`)
+    hedgingPattern = regexp.MustCompile(`(?i)\bit(?:'s| is) (?:difficult|hard|impossible) to (?:say|determine|know|predict)` +
+        `|\bthere(?: is|'s) no (?:clear|simple|single|definitive|easy) answer` +
+        `|\b(?:opinions|views) (?:vary|differ)` +
+        `|\bit (?:really )?depends\b` +
+        `|\b(?:complex|nuanced|sensitive|controversial|multifaceted) (?:issue|topic|question|subject)` +
+        `|\bsome (?:people )?(?:argue|believe|say)[^.]*(?:while|whereas) others` +
+        `|\bit(?:'s| is) (?:important|worth) (?:to note|noting|to remember)` +
+        `|\bè difficile (?:dire|stabilire|prevedere)` +
+        `|\bnon c'è una risposta (?:semplice|univoca|definitiva)` +
+        `|\ble opinioni (?:variano|divergono|sono divise)` +
+        `|\bdipende da` +
+        `|\b(?:questione|tema|argomento) (?:complesso|complessa|delicato|delicata|controverso|controversa)` +
+        `|\bè importante (?:notare|ricordare|sottolineare)` +
+        `|\bes ist schwer zu sagen|\bdie meinungen (?:gehen auseinander|sind geteilt)|\bes kommt darauf an` +
+        `|\bil est difficile de dire|\bles avis (?:divergent|sont partagés)|\bcela dépend` +
+        `|\bes difícil (?:decir|saber)|\blas opiniones (?:varían|difieren|están divididas)|\bdepende de`)
+    redirectPattern = regexp.MustCompile(`(?i)\b(?:I (?:recommend|suggest|encourage)(?: that)?(?: you)?(?: to)?|you (?:should|may want to|might want to)) (?:consult|check|refer to|look (?:at|up)|seek)[^.]*\b(?:official|reliable|reputable|trusted|professional|expert|authorit)` +
+        `|\bplease (?:consult|refer to|check) ` +
+        `|\bti (?:consiglio|suggerisco) di (?:consultare|verificare|rivolgerti)|\bti invito a consultare|\bconsulta(?:re)? fonti (?:ufficiali|affidabili)` +
+        `|\bich empfehle (?:ihnen|dir),? (?:offizielle|zuverlässige)` +
+        `|\bje vous (?:recommande|conseille) de consulter` +
+        `|\b(?:te|le) recomiendo consultar`)
+)
+
+// flagAnswer looks for refusals, hedging and evasion in a provider's
+// answer to question.
+func flagAnswer(question, answer string) []AnswerFlag {
+    var flags []AnswerFlag
+    length := len([]rune(strings.TrimSpace(answer)))
+    refusal := refusalPattern.FindString(answer)
+    if refusal != "" && length <= maxRefusalLength {
+        return []AnswerFlag{{Kind: flagRefusal, Evidence: refusal}}
+    }
+    hedges := hedgingPattern.FindAllString(answer, -1)
+    if refusal != "" {
+        // Un rifiuto parziale ("non posso dare consigli medici, ma...") conta come cautela
+        hedges = append(hedges, refusal)
+    }
+    if len(hedges) >= 2 || len(hedges) == 1 && length <= shortHedgeLength {
+        flags = append(flags, AnswerFlag{Kind: flagHedging, Evidence: strings.Join(hedges, "; ")})
+    }
+    if redirect := redirectPattern.FindString(answer); redirect != "" && length <= maxEvasiveLength {
+        flags = append(flags, AnswerFlag{Kind: flagEvasive, Evidence: redirect})
+    } else if missing := missingNames(question, answer); missing != "" {
+        flags = append(flags, AnswerFlag{Kind: flagEvasive, Evidence: "does not mention " + missing})
+    }
+    return flags
+}
+
+// missingNames returns the names in the question that the answer never
+// mentions, when it mentions none of them: an answer about something else.
+func missingNames(question, answer string) string {
+    names := properNames(question)
+    if len(names) == 0 {
+        return ""
+    }
+    lower := strings.ToLower(answer)
+    for _, name := range names {
+        for _, word := range strings.Fields(name) {
+            if len([]rune(word)) > 2 && strings.Contains(lower, strings.ToLower(word)) {
+                return ""
+            }
+        }
+    }
+    return strings.Join(names, ", ")
+}
+
+// hasFlag reports whether flags include kind.
+func hasFlag(flags []AnswerFlag, kind string) bool {
+    for _, flag := range flags {
+        if flag.Kind == kind {
+            return true
+        }
+    }
+    return false
+}
+
+// flagWeight is the factor applied to the score of a flagged answer.
+func flagWeight(flags []AnswerFlag) float64 {
+    weight := 1.0
+    for _, flag := range flags {
+        if w, ok := flagWeights[flag.Kind]; ok && w < weight {
+            weight = w
+        }
+    }
+    return weight
+}
+
+// questionTopics are checked in order; a question belongs to the topic
+// with most matching words. Stems of up to three letters must match a
+// whole word, longer ones a word prefix; stems that are also common words
+// in another language, such as "ai" or "salut", are left out.
+var questionTopics = []struct {
+    name  string
+    stems []string
+}{
+    {"politics", []string{"politic", "govern", "president", "minister", "parliament", "parlament", "election", "elezion", "wahl", "élection", "eleccion", "party", "partito", "partei", "democra", "dictat", "dittat", "sanction", "protest", "censor", "censur", "propagand", "tiananmen", "taiwan", "tibet", "xinjiang", "uyghur", "uigur", "putin", "trump", "biden", "meloni"}},
+    {"conflict", []string{"war", "wars", "guerra", "krieg", "guerre", "militar", "army", "esercit", "armee", "bomb", "invasion", "invasi", "terror", "genocid", "ukrain", "gaza", "israel", "palestin", "missil", "weapon", "waffe"}},
+    {"religion", []string{"religi", "god", "dio", "gott", "dieu", "dios", "islam", "muslim", "musulm", "christ", "crist", "church", "chiesa", "kirche", "églis", "iglesi", "jew", "jews", "ebre", "jüd", "bible", "bibbia", "quran", "corano", "koran", "pope", "buddh", "hindu"}},
+    {"sexuality", []string{"sex", "sexual", "sessual", "gender", "lgbt", "gay", "lesbi", "transgender", "queer", "omosess", "homosex", "porn"}},
+    {"health", []string{"health", "sanit", "gesundheit", "santé", "medic", "vaccin", "impf", "disease", "malatt", "krankheit", "covid", "cancer", "cancro", "krebs", "symptom", "therap", "abort", "pain", "headache"}},
+    {"drugs", []string{"drug", "drugs", "drog", "cocain", "heroin", "eroin", "cannabis", "marijuana", "fentanyl", "lsd"}},
+    {"crime", []string{"crime", "crimin", "reato", "verbrechen", "murder", "omicid", "mord", "hack", "steal", "rubar", "fraud", "frode", "betrug"}},
+    {"history", []string{"history", "storia", "geschicht", "histoire", "histori", "ancient", "antic", "medieval", "medioeval", "century", "secolo", "jahrhundert", "siècle", "siglo", "holocaust", "olocaust", "fascis", "nazi", "colonial"}},
+    {"finance", []string{"stock", "azion", "aktie", "crypto", "bitcoin", "invest", "econom", "inflat", "tax", "taxes", "tasse", "steuer", "bank", "market", "mercat", "markt", "price", "prezz", "preis"}},
+    {"science", []string{"scien", "physic", "fisic", "chemi", "biolog", "climat", "clima", "klima", "evolu", "space", "spazio", "planet"}},
+    {"technology", []string{"software", "program", "code", "codice", "computer", "internet", "artificial", "chatbot", "app", "smartphone", "tech"}},
+}
+
+const generalTopic = "general"
+
+// questionTopic files a question under a broad topic, so refusal rates can
+// be compared on sensitive subjects.
+func questionTopic(question string) string {
+    words := strings.FieldsFunc(strings.ToLower(question), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+    })
+    best, bestCount := generalTopic, 0
+    for _, topic := range questionTopics {
+        count := 0
+        for _, word := range words {
+            for _, stem := range topic.stems {
+                if word == stem || len([]rune(stem)) > 3 && strings.HasPrefix(word, stem) {
+                    count++
+                    break
+                }
+            }
+        }
+        if count > bestCount {
+            best, bestCount = topic.name, count
+        }
+    }
+    return best
+}
+
+// Flag counters are kept per month, provider and topic under
+// transparencyPrefix+"2006-01:provider:topic:kind", with kind "answers"
+// for the number of answers given.
+const (
+    transparencyPrefix    = "transparency:"
+    transparencyTTL       = 400 * 24 * time.Hour
+    maxTransparencyMonths = 12
+)
+
+func recordAnswerFlags(provider, topic string, flags []AnswerFlag, now time.Time) {
+    prefix := fmt.Sprintf("%s%s:%s:%s:", transparencyPrefix, now.UTC().Format("2006-01"), provider, topic)
+    counters := []string{"answers"}
+    for _, flag := range flags {
+        counters = append(counters, flag.Kind)
+    }
+    for _, counter := range counters {
+        if _, err := store.Incr(prefix+counter, transparencyTTL); err != nil {
+            fmt.Printf("Error recording answer flags for %s: %v\n", provider, err)
+        }
+    }
+}
+
+// FlagStats counts the answers of a provider and how many were flagged.
+type FlagStats struct {
+    Answers int64              `json:"answers"`
+    Flags   map[string]int64   `json:"flags"`
+    Rates   map[string]float64 `json:"rates"`
+}
+
+type ProviderFlagStats struct {
+    FlagStats
+    Topics map[string]*FlagStats `json:"topics"`
+}
+
+func newFlagStats() FlagStats {
+    return FlagStats{Flags: make(map[string]int64), Rates: make(map[string]float64)}
+}
+
+func (s *FlagStats) add(counter string, n int64) {
+    if counter == "answers" {
+        s.Answers += n
+    } else {
+        s.Flags[counter] += n
+    }
+}
+
+func (s *FlagStats) computeRates() {
+    for _, kind := range flagKinds {
+        s.Rates[kind] = 0
+        if s.Answers > 0 {
+            s.Rates[kind] = float64(s.Flags[kind]) / float64(s.Answers)
+        }
+    }
+}
+
+// transparencyStats adds up the flag counters of the given months.
+func transparencyStats(months []string) (map[string]*ProviderFlagStats, error) {
+    providers := make(map[string]*ProviderFlagStats)
+    for _, month := range months {
+        keys, err := store.Keys(transparencyPrefix + month + ":")
+        if err != nil {
+            return nil, err
+        }
+        for _, key := range keys {
+            parts := strings.Split(strings.TrimPrefix(key, transparencyPrefix+month+":"), ":")
+            if len(parts) != 3 {
+                continue
+            }
+            n, err := store.IncrBy(key, 0, transparencyTTL)
+            if err != nil {
+                return nil, err
+            }
+            provider, topic, counter := parts[0], parts[1], parts[2]
+            stats := providers[provider]
+            if stats == nil {
+                stats = &ProviderFlagStats{FlagStats: newFlagStats(), Topics: make(map[string]*FlagStats)}
+                providers[provider] = stats
+            }
+            if stats.Topics[topic] == nil {
+                topicStats := newFlagStats()
+                stats.Topics[topic] = &topicStats
+            }
+            stats.add(counter, n)
+            stats.Topics[topic].add(counter, n)
+        }
+    }
+    for _, stats := range providers {
+        stats.computeRates()
+        for _, topic := range stats.Topics {
+            topic.computeRates()
+        }
+    }
+    return providers, nil
+}
+
+// Transparency Handler: GET /transparency?months=3 publishes how often each
+// provider refused, hedged or evaded, overall and by topic, over the last
+// months (the current one included).
+func handleTransparency(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    count := 3
+    if value := r.URL.Query().Get("months"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 1 || n > maxTransparencyMonths {
+            http.Error(w, fmt.Sprintf("Invalid months: expected 1 to %d", maxTransparencyMonths), http.StatusBadRequest)
+            return
+        }
+        count = n
+    }
+    now := time.Now().UTC()
+    var months []string
+    for i := 0; i < count; i++ {
+        months = append(months, time.Date(now.Year(), now.Month()-time.Month(i), 1, 0, 0, 0, 0, time.UTC).Format("2006-01"))
+    }
+    providers, err := transparencyStats(months)
+    if err != nil {
+        http.Error(w, "Error loading statistics: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    topics := make([]string, 0, len(questionTopics)+1)
+    for _, topic := range questionTopics {
+        topics = append(topics, topic.name)
+    }
+    topics = append(topics, generalTopic)
+    sort.Strings(months)
+    writeJSON(w, map[string]interface{}{
+        "from":      months[0],
+        "to":        months[len(months)-1],
+        "kinds":     flagKinds,
+        "topics":    topics,
+        "providers": providers,
+    })
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestFlagAnswer(t *testing.T) {
+    filler := strings.Repeat("The city has a long history of trade and industry. ", 8)
+    tests := []struct {
+        name     string
+        question string
+        answer   string
+        want     []string
+    }{
+        {"refusal", "How do I pick a lock?", "I'm sorry, but I can't help with that request.", []string{flagRefusal}},
+        {"italian refusal", "Come si fa?", "Mi dispiace, ma non posso aiutarti con questa richiesta.", []string{flagRefusal}},
+        // In una risposta lunga il rifiuto parziale è solo una cautela
+        {"partial refusal", "Is Turin a good place to live?", "I can't give personal advice about Turin, but here is what I know. " + filler[:len(filler)-30], []string{flagHedging}},
+        {"short hedge", "Is coffee healthy?", "It's difficult to say, it depends on the person.", []string{flagHedging}},
+        {"long answer with one hedge", "Is coffee healthy?", "It depends on the dose. " + filler + filler, nil},
+        {"redirect", "Should I take aspirin?", "I recommend that you consult a professional doctor about this.", []string{flagEvasive}},
+        {"talks about something else", "What did Giorgia Meloni say yesterday?", "The weather in the north is sunny and the roads are clear.", []string{flagEvasive}},
+        {"direct answer", "What did Giorgia Meloni say yesterday?", "Meloni announced a new budget plan for next year.", nil},
+    }
+    for _, tt := range tests {
+        var kinds []string
+        for _, flag := range flagAnswer(tt.question, tt.answer) {
+            if flag.Evidence == "" {
+                t.Errorf("%s: %s flag without evidence", tt.name, flag.Kind)
+            }
+            kinds = append(kinds, flag.Kind)
+        }
+        if !reflect.DeepEqual(kinds, tt.want) {
+            t.Errorf("%s: flags %v; want %v", tt.name, kinds, tt.want)
+        }
+    }
+}
+
+func TestQuestionTopic(t *testing.T) {
+    tests := []struct {
+        question string
+        want     string
+    }{
+        {"Who won the last election in Taiwan?", "politics"},
+        {"Is the covid vaccine safe?", "health"},
+        {"Quali sono i rischi per la sanità pubblica?", "health"},
+        {"Will artificial intelligence replace programmers?", "technology"},
+        {"What happened in the war in Ukraine?", "conflict"},
+        {"Cosa è successo ai lavoratori della fabbrica?", generalTopic},
+        {"Salut, tu vas bien ?", generalTopic},
+        {"Tanti saluti da Roma", generalTopic},
+        {"What time is it?", generalTopic},
+    }
+    for _, tt := range tests {
+        if got := questionTopic(tt.question); got != tt.want {
+            t.Errorf("questionTopic(%q) = %s; want %s", tt.question, got, tt.want)
+        }
+    }
+}
+
+func TestTransparencyStats(t *testing.T) {
+    store = newMemoryStore()
+    june := time.Date(2025, 6, 10, 0, 0, 0, 0, time.UTC)
+    may := time.Date(2025, 5, 10, 0, 0, 0, 0, time.UTC)
+    refusal := []AnswerFlag{{Kind: flagRefusal, Evidence: "I can't help"}}
+    hedging := []AnswerFlag{{Kind: flagHedging, Evidence: "it depends"}}
+    recordAnswerFlags("A", "politics", refusal, june)
+    recordAnswerFlags("A", "politics", nil, june)
+    recordAnswerFlags("A", "health", hedging, may)
+    recordAnswerFlags("A", "health", nil, may)
+    recordAnswerFlags("B", "politics", nil, june)
+    // Un mese non richiesto non entra nelle statistiche
+    recordAnswerFlags("B", "politics", refusal, time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC))
+
+    providers, err := transparencyStats([]string{"2025-06", "2025-05"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    a := providers["A"]
+    if a == nil || a.Answers != 4 || a.Flags[flagRefusal] != 1 || a.Flags[flagHedging] != 1 {
+        t.Fatalf("provider A = %+v", a)
+    }
+    if a.Rates[flagRefusal] != 0.25 || a.Rates[flagHedging] != 0.25 || a.Rates[flagEvasive] != 0 {
+        t.Fatalf("provider A rates = %v", a.Rates)
+    }
+    if politics := a.Topics["politics"]; politics == nil || politics.Answers != 2 || politics.Rates[flagRefusal] != 0.5 {
+        t.Fatalf("provider A politics = %+v", politics)
+    }
+    if health := a.Topics["health"]; health == nil || health.Answers != 2 || health.Rates[flagHedging] != 0.5 || health.Rates[flagRefusal] != 0 {
+        t.Fatalf("provider A health = %+v", health)
+    }
+    if b := providers["B"]; b == nil || b.Answers != 1 || b.Rates[flagRefusal] != 0 {
+        t.Fatalf("provider B = %+v", b)
+    }
+    if len(providers) != 2 {
+        t.Fatalf("%d providers; want 2", len(providers))
+    }
+}
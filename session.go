@@ -0,0 +1,131 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/sashabaranov/go-openai"
+)
+
+// keyedMutex hands out one mutex per key, so that requests on the same
+// session are serialized while different sessions proceed in parallel.
+// Entries are dropped as soon as nobody holds or waits for them.
+type keyedMutex struct {
+    mu    sync.Mutex
+    locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+    mu   sync.Mutex
+    refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+    return &keyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+// Lock blocks until key is free and returns the matching unlock function.
+func (k *keyedMutex) Lock(key string) func() {
+    k.mu.Lock()
+    lock, ok := k.locks[key]
+    if !ok {
+        lock = &keyedLock{}
+        k.locks[key] = lock
+    }
+    lock.refs++
+    k.mu.Unlock()
+
+    lock.mu.Lock()
+    return func() {
+        lock.mu.Unlock()
+        k.mu.Lock()
+        lock.refs--
+        if lock.refs == 0 {
+            delete(k.locks, key)
+        }
+        k.mu.Unlock()
+    }
+}
+
+const (
+    lockPrefix = "lock:"
+    // lockTTL frees the lock of an instance that died while holding it.
+    lockTTL     = 30 * time.Second
+    lockTimeout = 10 * time.Second
+)
+
+// storeLocker serializes the updates of a key across every ARCA-b
+// instance. The keyedMutex queues the requests of this process, so that
+// only one of them at a time polls the lock key that the store holds for
+// all instances.
+type storeLocker struct {
+    local *keyedMutex
+}
+
+func newStoreLocker() *storeLocker {
+    return &storeLocker{local: newKeyedMutex()}
+}
+
+// Lock blocks until key is free, or lockTimeout has passed, and returns the
+// matching unlock function.
+func (l *storeLocker) Lock(key string) (func(), error) {
+    unlockLocal := l.local.Lock(key)
+    token := uuid.New().String()
+    deadline := time.Now().Add(lockTimeout)
+    wait := 5 * time.Millisecond
+    for {
+        acquired, err := store.SetNX(lockPrefix+key, token, lockTTL)
+        if err != nil {
+            unlockLocal()
+            return nil, fmt.Errorf("error locking %s: %v", key, err)
+        }
+        if acquired {
+            break
+        }
+        if time.Now().After(deadline) {
+            unlockLocal()
+            return nil, fmt.Errorf("timed out waiting for the lock on %s", key)
+        }
+        time.Sleep(wait)
+        if wait < 100*time.Millisecond {
+            wait *= 2
+        }
+    }
+    return func() {
+        // Se il lock è scaduto e un'altra istanza l'ha preso, non va rilasciato
+        if _, err := store.CompareAndDelete(lockPrefix+key, token); err != nil {
+            fmt.Printf("Error releasing the lock on %s: %v\n", key, err)
+        }
+        unlockLocal()
+    }, nil
+}
+
+var sessionLocks = newStoreLocker()
+
+// updateSession loads the session, applies fn and saves the result while
+// holding the per-session lock, so overlapping requests on the same session,
+// on this instance or any other, cannot lose each other's messages. It
+// returns a snapshot of the history that the caller may hand to provider
+// goroutines without further locking.
+// sessionID is chatSessionID(owner, chat), so chatTTL sees the owner.
+func updateSession(sessionID string, fn func(session *Session) error) ([]openai.ChatCompletionMessage, error) {
+    unlock, err := sessionLocks.Lock(sessionID)
+    if err != nil {
+        return nil, err
+    }
+    defer unlock()
+
+    session := &Session{History: []openai.ChatCompletionMessage{}}
+    if _, err := store.Get(sessionPrefix+sessionID, session); err != nil {
+        return nil, err
+    }
+    if err := fn(session); err != nil {
+        return nil, err
+    }
+    if err := store.Set(sessionPrefix+sessionID, session, chatTTL(sessionID)); err != nil {
+        return nil, err
+    }
+    return append([]openai.ChatCompletionMessage(nil), session.History...), nil
+}
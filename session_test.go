@@ -0,0 +1,73 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+
+    "github.com/sashabaranov/go-openai"
+)
+
+func TestUpdateSessionConcurrent(t *testing.T) {
+    const workers = 20
+    for name, s := range storeBackends(t) {
+        t.Run(name, func(t *testing.T) {
+            store = s
+            var wg sync.WaitGroup
+            for i := 0; i < workers; i++ {
+                wg.Add(1)
+                go func(i int) {
+                    defer wg.Done()
+                    _, err := updateSession("owner:chat", func(session *Session) error {
+                        session.History = append(session.History, openai.ChatCompletionMessage{Role: "user", Content: fmt.Sprint(i)})
+                        return nil
+                    })
+                    if err != nil {
+                        t.Error(err)
+                    }
+                }(i)
+            }
+            wg.Wait()
+            var session Session
+            store.Get(sessionPrefix+"owner:chat", &session)
+            if len(session.History) != workers {
+                t.Fatalf("history has %d messages; want %d", len(session.History), workers)
+            }
+        })
+    }
+}
+
+// Two instances sharing a networked store have separate process locks:
+// only the lock key in the store keeps their updates from overlapping.
+func TestStoreLockerAcrossInstances(t *testing.T) {
+    backends := storeBackends(t)
+    store = backends["fake://"]
+    instances := []*storeLocker{newStoreLocker(), newStoreLocker()}
+    const rounds = 25
+    var wg sync.WaitGroup
+    for _, locker := range instances {
+        for i := 0; i < 4; i++ {
+            wg.Add(1)
+            go func(locker *storeLocker) {
+                defer wg.Done()
+                for j := 0; j < rounds; j++ {
+                    unlock, err := locker.Lock("shared")
+                    if err != nil {
+                        t.Error(err)
+                        return
+                    }
+                    var n int
+                    store.Get("value", &n)
+                    store.Set("value", n+1, 0)
+                    unlock()
+                }
+            }(locker)
+        }
+    }
+    wg.Wait()
+    var n int
+    store.Get("value", &n)
+    if want := len(instances) * 4 * rounds; n != want {
+        t.Fatalf("value = %d; want %d, updates were lost", n, want)
+    }
+}
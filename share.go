@@ -0,0 +1,299 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// ProviderAnswer is one provider's raw answer within a turn.
+type ProviderAnswer struct {
+    Name          string     `json:"name"`
+    Content       string     `json:"content"`
+    Failed        bool       `json:"failed,omitempty"`
+    Contribution  float64    `json:"contribution"`
+    Usage         TokenUsage `json:"usage"`
+    // Language is the detected language of Content; WrongLanguage is set
+    // when it is not the one the user asked for.
+    Language      string `json:"language,omitempty"`
+    WrongLanguage bool   `json:"wrongLanguage,omitempty"`
+    // Original is the answer as the provider wrote it, when Content is a
+    // translation made by TranslatedBy.
+    Original     string `json:"original,omitempty"`
+    TranslatedBy string `json:"translatedBy,omitempty"`
+    // Flags mark a refusal, hedging or evasion found in Content.
+    Flags []AnswerFlag `json:"flags,omitempty"`
+}
+
+// ConversationTurn is a question with the synthesized answer and the
+// answers it was built from. Index counts the turns of the chat; /chat
+// returns it as turnIndex and the page sends it back as conversationIndex
+// when sharing.
+type ConversationTurn struct {
+    Index         int              `json:"index"`
+    Time          time.Time        `json:"time"`
+    Question      string           `json:"question"`
+    Language      string           `json:"language"`
+    Response      string           `json:"response"`
+    RawResponses  string           `json:"rawResponses"`
+    Contributions string           `json:"contributions"`
+    ServiceLevel  string           `json:"serviceLevel,omitempty"`
+    Style         string           `json:"style,omitempty"`
+    Persona       string           `json:"persona,omitempty"`
+    Providers     []ProviderAnswer `json:"providers"`
+    Sources       []Article        `json:"sources,omitempty"`
+    Citations     []Citation       `json:"citations,omitempty"`
+    Claims        []Claim          `json:"claims,omitempty"`
+    Disagreements []Disagreement   `json:"disagreements,omitempty"`
+    // Source is "imported" for turns brought in from another assistant.
+    Source string `json:"source,omitempty"`
+}
+
+// SharedConversation is the snapshot published at /conversation/{id}.
+type SharedConversation struct {
+    ID        string             `json:"id"`
+    Owner     string             `json:"owner"`
+    CreatedAt time.Time          `json:"createdAt"`
+    ExpiresAt *time.Time         `json:"expiresAt,omitempty"`
+    RevokedAt *time.Time         `json:"revokedAt,omitempty"`
+    Turns     []ConversationTurn `json:"turns"`
+}
+
+const (
+    // maxSessionTurns bounds the transcript kept in a session.
+    maxSessionTurns = 50
+    // sharedConversationOwnerPrefix indexes shares by owner for listing.
+    sharedConversationOwnerPrefix = "conversation-owner:"
+)
+
+func (c *SharedConversation) Available(now time.Time) bool {
+    return c.RevokedAt == nil && (c.ExpiresAt == nil || now.Before(*c.ExpiresAt))
+}
+
+// publicView is what other people see: the owner is left out.
+func (c *SharedConversation) publicView() map[string]interface{} {
+    return map[string]interface{}{
+        "id":        c.ID,
+        "createdAt": c.CreatedAt,
+        "expiresAt": c.ExpiresAt,
+        "turns":     c.Turns,
+    }
+}
+
+// recordTurn appends a finished turn to the chat transcript, updates the
+// chat's summary and returns the turn's index.
+func recordTurn(owner, chatID string, turn ConversationTurn) (int, error) {
+    _, err := updateSession(chatSessionID(owner, chatID), func(session *Session) error {
+        turn.Index = 0
+        if n := len(session.Turns); n > 0 {
+            turn.Index = session.Turns[n-1].Index + 1
+        }
+        session.Turns = append(session.Turns, turn)
+        if len(session.Turns) > maxSessionTurns {
+            session.Turns = session.Turns[len(session.Turns)-maxSessionTurns:]
+        }
+        chat, found, err := loadChat(owner, chatID)
+        if err != nil || !found {
+            return err
+        }
+        if chat.Turns == 0 && chat.Title == defaultChatTitle {
+            chat.Title = chatTitle(turn.Question)
+        }
+        chat.Turns = turn.Index + 1
+        chat.UpdatedAt = time.Now().UTC()
+        chat.Preview = chatTitle(turn.Response)
+        return saveChat(owner, chat)
+    })
+    return turn.Index, err
+}
+
+// sessionTranscript returns the turns of the chat up to and including the
+// one with the given index.
+func sessionTranscript(owner, chatID string, index int) ([]ConversationTurn, error) {
+    session, err := loadChatSession(owner, chatID)
+    if err != nil {
+        return nil, err
+    }
+    var turns []ConversationTurn
+    for _, turn := range session.Turns {
+        if turn.Index > index {
+            break
+        }
+        turns = append(turns, turn)
+    }
+    if len(turns) == 0 || turns[len(turns)-1].Index != index {
+        return nil, fmt.Errorf("turn %d not found in chat", index)
+    }
+    return turns, nil
+}
+
+func shareConversation(owner string, turns []ConversationTurn, expiresInDays int) (*SharedConversation, error) {
+    now := time.Now().UTC()
+    conversation := &SharedConversation{
+        ID:        uuid.New().String(),
+        Owner:     owner,
+        CreatedAt: now,
+        Turns:     turns,
+    }
+    var ttl time.Duration
+    if expiresInDays > 0 {
+        expires := now.AddDate(0, 0, expiresInDays)
+        conversation.ExpiresAt = &expires
+        ttl = expires.Sub(now)
+    }
+    if err := store.Set(conversationPrefix+conversation.ID, conversation, ttl); err != nil {
+        return nil, err
+    }
+    if err := store.Set(sharedConversationOwnerPrefix+owner+":"+conversation.ID, conversation.ID, ttl); err != nil {
+        return nil, err
+    }
+    return conversation, nil
+}
+
+// loadSharedConversation also reads links saved before transcripts were
+// stored, which held a single ChatResponse.
+func loadSharedConversation(id string) (*SharedConversation, bool, error) {
+    var raw json.RawMessage
+    found, err := store.Get(conversationPrefix+id, &raw)
+    if err != nil || !found {
+        return nil, found, err
+    }
+    var conversation SharedConversation
+    if err := json.Unmarshal(raw, &conversation); err != nil {
+        return nil, false, fmt.Errorf("error decoding conversation: %v", err)
+    }
+    if conversation.Turns == nil {
+        var legacy ChatResponse
+        if err := json.Unmarshal(raw, &legacy); err != nil {
+            return nil, false, fmt.Errorf("error decoding conversation: %v", err)
+        }
+        conversation.ID = id
+        conversation.Turns = []ConversationTurn{{
+            Response:      legacy.Response,
+            RawResponses:  legacy.RawResponses,
+            Contributions: legacy.Contributions,
+        }}
+    }
+    return &conversation, true, nil
+}
+
+func revokeSharedConversation(owner, id string) (bool, error) {
+    conversation, found, err := loadSharedConversation(id)
+    if err != nil || !found || conversation.Owner != owner {
+        return false, err
+    }
+    if conversation.RevokedAt == nil {
+        now := time.Now().UTC()
+        conversation.RevokedAt = &now
+    }
+    var ttl time.Duration
+    if conversation.ExpiresAt != nil {
+        ttl = time.Until(*conversation.ExpiresAt)
+        if ttl <= 0 {
+            ttl = time.Second
+        }
+    }
+    return true, store.Set(conversationPrefix+id, conversation, ttl)
+}
+
+// Conversation Handler: GET shows a shared conversation, as JSON with
+// ?format=json, GET .../export downloads it and DELETE lets its owner
+// revoke it.
+func handleConversation(w http.ResponseWriter, r *http.Request) {
+    id := strings.TrimPrefix(r.URL.Path, "/conversation/")
+    id, export := strings.CutSuffix(id, "/export")
+    if id == "" || strings.Contains(id, "/") {
+        http.Error(w, "Conversation ID not provided", http.StatusBadRequest)
+        return
+    }
+    if export && r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if r.Method == http.MethodDelete {
+        owner, err := requestOwner(r)
+        if err != nil {
+            http.Error(w, "Error: Session not found", http.StatusBadRequest)
+            return
+        }
+        revoked, err := revokeSharedConversation(owner, id)
+        if err != nil {
+            http.Error(w, "Error revoking conversation: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        if !revoked {
+            http.Error(w, "Conversation not found", http.StatusNotFound)
+            return
+        }
+        writeJSON(w, map[string]interface{}{"revoked": true})
+        return
+    }
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    conversation, exists, err := loadSharedConversation(id)
+    if err != nil {
+        http.Error(w, "Error loading conversation: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if !exists {
+        http.Error(w, "Conversation not found", http.StatusNotFound)
+        return
+    }
+    if !conversation.Available(time.Now()) {
+        http.Error(w, "This conversation is no longer shared", http.StatusGone)
+        return
+    }
+    if export {
+        handleConversationExport(w, r, conversation)
+        return
+    }
+    if r.URL.Query().Get("format") == "json" {
+        writeJSON(w, conversation.publicView())
+        return
+    }
+    renderPage(w, "conversation.html", conversation)
+}
+
+// Shared Conversations Handler: the caller's own shared links.
+func handleSharedConversations(w http.ResponseWriter, r *http.Request) {
+    owner, err := requestOwner(r)
+    if err != nil {
+        http.Error(w, "Error: Session not found", http.StatusBadRequest)
+        return
+    }
+    keys, err := store.Keys(sharedConversationOwnerPrefix + owner + ":")
+    if err != nil {
+        http.Error(w, "Error listing conversations: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    shared := make([]map[string]interface{}, 0, len(keys))
+    now := time.Now()
+    for _, key := range keys {
+        id := strings.TrimPrefix(key, sharedConversationOwnerPrefix+owner+":")
+        conversation, found, err := loadSharedConversation(id)
+        if err != nil || !found {
+            continue
+        }
+        question := ""
+        if len(conversation.Turns) > 0 {
+            question = conversation.Turns[0].Question
+        }
+        shared = append(shared, map[string]interface{}{
+            "id":        conversation.ID,
+            "url":       publicURL + "/conversation/" + conversation.ID,
+            "question":  question,
+            "turns":     len(conversation.Turns),
+            "createdAt": conversation.CreatedAt,
+            "expiresAt": conversation.ExpiresAt,
+            "revokedAt": conversation.RevokedAt,
+            "available": conversation.Available(now),
+        })
+    }
+    writeJSON(w, shared)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestSharedPageResolvesClaimSources(t *testing.T) {
+    conversation := &SharedConversation{ID: "c", Turns: []ConversationTurn{{
+        Index:     3,
+        Question:  "What did the ECB decide?",
+        Response:  "Rates were kept steady [1].",
+        Providers: []ProviderAnswer{{Name: "OpenAI", Content: "Rates were kept steady."}},
+        Sources: []Article{
+            {Title: "ECB holds rates", URL: "https://example.org/ecb"},
+            {Title: "Inflation slows", URL: "https://example.org/inflation"},
+        },
+        Citations: []Citation{{Number: 1, Article: Article{Title: "ECB holds rates", URL: "https://example.org/ecb"}}},
+        Claims:    []Claim{{Text: "Inflation slowed.", StatedBy: []string{"OpenAI"}, Sources: []int{2}, Status: "supported"}},
+    }}}
+    w := httptest.NewRecorder()
+    renderPage(w, "conversation.html", conversation)
+    page := w.Body.String()
+    for _, want := range []string{`id="source-3-2"`, `href="#source-3-2"`, "Inflation slows"} {
+        if !strings.Contains(page, want) {
+            t.Errorf("shared page lacks %q", want)
+        }
+    }
+
+    // Senza fact-check restano solo le fonti citate
+    conversation.Turns[0].Claims = nil
+    w = httptest.NewRecorder()
+    renderPage(w, "conversation.html", conversation)
+    if page := w.Body.String(); strings.Contains(page, "Inflation slows") || !strings.Contains(page, "ECB holds rates") {
+        t.Error("shared page without claims should list only the cited sources")
+    }
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "hash/fnv"
+    "math"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Store holds the state that must be shared by every ARCA-b instance:
+// sessions, request counters, premium flags and shared conversations.
+// Values are stored as JSON so that any backend can hold them.
+type Store interface {
+    Get(key string, value interface{}) (bool, error)
+    Set(key string, value interface{}, ttl time.Duration) error
+    Delete(key string) error
+    // SetNX stores value only if key does not exist yet and reports
+    // whether it did.
+    SetNX(key string, value interface{}, ttl time.Duration) (bool, error)
+    // GetDelete atomically reads and removes the value at key, so that only
+    // one caller can consume it.
+    GetDelete(key string, value interface{}) (bool, error)
+    // CompareAndDelete removes key only if it still holds value.
+    CompareAndDelete(key string, value interface{}) (bool, error)
+    // Incr atomically increments the counter at key and returns the new
+    // value. The ttl is applied only when the counter is created.
+    Incr(key string, ttl time.Duration) (int64, error)
+    // IncrBy is Incr with an arbitrary delta; a zero delta reads the counter.
+    IncrBy(key string, delta int64, ttl time.Duration) (int64, error)
+    // Take atomically removes one token from the bucket at key, which holds
+    // up to capacity tokens and refills completely over period.
+    Take(key string, capacity int64, period time.Duration) (TokenBucket, error)
+    Keys(prefix string) ([]string, error)
+}
+
+// TokenBucket is the outcome of a Take call.
+type TokenBucket struct {
+    Allowed    bool
+    Capacity   int64
+    Remaining  int64
+    RetryAfter time.Duration
+    ResetAfter time.Duration
+}
+
+type bucketState struct {
+    Tokens  float64 `json:"tokens"`
+    Updated int64   `json:"updated"`
+}
+
+// takeToken refills the bucket for the time elapsed since its last update
+// and then tries to remove one token. now is in milliseconds.
+func takeToken(state *bucketState, capacity int64, period time.Duration, now int64) TokenBucket {
+    periodMs := float64(period.Milliseconds())
+    if state.Updated == 0 {
+        state.Tokens = float64(capacity)
+        state.Updated = now
+    }
+    state.Tokens = math.Min(float64(capacity), state.Tokens+float64(now-state.Updated)*float64(capacity)/periodMs)
+    state.Updated = now
+    result := TokenBucket{Capacity: capacity}
+    if state.Tokens >= 1 {
+        state.Tokens--
+        result.Allowed = true
+    }
+    return bucketResult(result, state.Tokens, capacity, period)
+}
+
+func bucketResult(result TokenBucket, tokens float64, capacity int64, period time.Duration) TokenBucket {
+    msPerToken := float64(period.Milliseconds()) / float64(capacity)
+    result.Remaining = int64(math.Floor(tokens))
+    result.ResetAfter = time.Duration((float64(capacity)-tokens)*msPerToken) * time.Millisecond
+    if !result.Allowed {
+        result.RetryAfter = time.Duration((1-tokens)*msPerToken) * time.Millisecond
+    }
+    return result
+}
+
+const (
+    sessionPrefix      = "session:"
+    requestsPrefix     = "requests:"
+    premiumPrefix      = "premium:"
+    conversationPrefix = "conversation:"
+
+    sessionTTL = 7 * 24 * time.Hour
+)
+
+// newStore picks the backend from STORE_URL. An empty value keeps everything
+// in process memory, "redis://" or "rediss://" connects to any server that
+// speaks the Redis protocol and "fake://" starts an in-process fake server,
+// which exercises the networked code path without an external dependency.
+func newStore(storeURL string) (Store, error) {
+    if storeURL == "" || storeURL == "memory://" {
+        return newMemoryStore(), nil
+    }
+    u, err := url.Parse(storeURL)
+    if err != nil {
+        return nil, fmt.Errorf("error parsing STORE_URL: %v", err)
+    }
+    switch u.Scheme {
+    case "redis", "rediss":
+        return newRedisStore(u)
+    case "fake":
+        addr, err := startFakeRedis("127.0.0.1:0")
+        if err != nil {
+            return nil, fmt.Errorf("error starting fake Redis server: %v", err)
+        }
+        return newRedisStore(&url.URL{Scheme: "redis", Host: addr})
+    }
+    return nil, fmt.Errorf("unsupported STORE_URL scheme: %s", u.Scheme)
+}
+
+// persistentStoreURL reports whether storeURL names a store that outlives
+// the process, so that CLI changes reach the running server.
+func persistentStoreURL(storeURL string) bool {
+    return strings.HasPrefix(storeURL, "redis://") || strings.HasPrefix(storeURL, "rediss://")
+}
+
+type memoryEntry struct {
+    data      []byte
+    expiresAt time.Time
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+    return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+// memoryShards is the number of independently locked partitions of the
+// in-memory store, so that unrelated sessions never wait on each other.
+const memoryShards = 32
+
+type memoryShard struct {
+    mu      sync.Mutex
+    entries map[string]memoryEntry
+}
+
+type memoryStore struct {
+    shards [memoryShards]*memoryShard
+}
+
+func newMemoryStore() *memoryStore {
+    s := &memoryStore{}
+    for i := range s.shards {
+        s.shards[i] = &memoryShard{entries: make(map[string]memoryEntry)}
+    }
+    return s
+}
+
+func (s *memoryStore) shard(key string) *memoryShard {
+    h := fnv.New32a()
+    h.Write([]byte(key))
+    return s.shards[h.Sum32()%memoryShards]
+}
+
+func (s *memoryStore) Get(key string, value interface{}) (bool, error) {
+    shard := s.shard(key)
+    shard.mu.Lock()
+    entry, ok := shard.entries[key]
+    if ok && entry.expired(time.Now()) {
+        delete(shard.entries, key)
+        ok = false
+    }
+    shard.mu.Unlock()
+    if !ok {
+        return false, nil
+    }
+    if err := json.Unmarshal(entry.data, value); err != nil {
+        return false, fmt.Errorf("error decoding %s: %v", key, err)
+    }
+    return true, nil
+}
+
+func (s *memoryStore) Set(key string, value interface{}, ttl time.Duration) error {
+    data, err := json.Marshal(value)
+    if err != nil {
+        return fmt.Errorf("error encoding %s: %v", key, err)
+    }
+    entry := memoryEntry{data: data}
+    if ttl > 0 {
+        entry.expiresAt = time.Now().Add(ttl)
+    }
+    shard := s.shard(key)
+    shard.mu.Lock()
+    shard.entries[key] = entry
+    shard.mu.Unlock()
+    return nil
+}
+
+func (s *memoryStore) Delete(key string) error {
+    shard := s.shard(key)
+    shard.mu.Lock()
+    delete(shard.entries, key)
+    shard.mu.Unlock()
+    return nil
+}
+
+func (s *memoryStore) SetNX(key string, value interface{}, ttl time.Duration) (bool, error) {
+    data, err := json.Marshal(value)
+    if err != nil {
+        return false, fmt.Errorf("error encoding %s: %v", key, err)
+    }
+    shard := s.shard(key)
+    shard.mu.Lock()
+    defer shard.mu.Unlock()
+    return setEntryNX(shard.entries, key, data, ttl), nil
+}
+
+func (s *memoryStore) GetDelete(key string, value interface{}) (bool, error) {
+    shard := s.shard(key)
+    shard.mu.Lock()
+    entry, ok := shard.entries[key]
+    delete(shard.entries, key)
+    shard.mu.Unlock()
+    if !ok || entry.expired(time.Now()) {
+        return false, nil
+    }
+    if err := json.Unmarshal(entry.data, value); err != nil {
+        return false, fmt.Errorf("error decoding %s: %v", key, err)
+    }
+    return true, nil
+}
+
+func (s *memoryStore) CompareAndDelete(key string, value interface{}) (bool, error) {
+    data, err := json.Marshal(value)
+    if err != nil {
+        return false, fmt.Errorf("error encoding %s: %v", key, err)
+    }
+    shard := s.shard(key)
+    shard.mu.Lock()
+    defer shard.mu.Unlock()
+    return deleteEntryIf(shard.entries, key, data), nil
+}
+
+func (s *memoryStore) Incr(key string, ttl time.Duration) (int64, error) {
+    return s.IncrBy(key, 1, ttl)
+}
+
+func (s *memoryStore) IncrBy(key string, delta int64, ttl time.Duration) (int64, error) {
+    shard := s.shard(key)
+    shard.mu.Lock()
+    defer shard.mu.Unlock()
+    return incrEntry(shard.entries, key, delta, ttl)
+}
+
+func (s *memoryStore) Take(key string, capacity int64, period time.Duration) (TokenBucket, error) {
+    shard := s.shard(key)
+    shard.mu.Lock()
+    defer shard.mu.Unlock()
+    return takeEntry(shard.entries, key, capacity, period)
+}
+
+func (s *memoryStore) Keys(prefix string) ([]string, error) {
+    now := time.Now()
+    var keys []string
+    for _, shard := range s.shards {
+        shard.mu.Lock()
+        for key, entry := range shard.entries {
+            if strings.HasPrefix(key, prefix) && !entry.expired(now) {
+                keys = append(keys, key)
+            }
+        }
+        shard.mu.Unlock()
+    }
+    sort.Strings(keys)
+    return keys, nil
+}
+
+// setEntryNX implements SetNX for the in-memory maps; the caller holds the lock.
+func setEntryNX(entries map[string]memoryEntry, key string, data []byte, ttl time.Duration) bool {
+    now := time.Now()
+    if entry, ok := entries[key]; ok && !entry.expired(now) {
+        return false
+    }
+    entry := memoryEntry{data: data}
+    if ttl > 0 {
+        entry.expiresAt = now.Add(ttl)
+    }
+    entries[key] = entry
+    return true
+}
+
+// deleteEntryIf implements CompareAndDelete for the in-memory maps; the
+// caller holds the lock.
+func deleteEntryIf(entries map[string]memoryEntry, key string, data []byte) bool {
+    entry, ok := entries[key]
+    if !ok || entry.expired(time.Now()) || string(entry.data) != string(data) {
+        return false
+    }
+    delete(entries, key)
+    return true
+}
+
+// incrEntry implements IncrBy for the in-memory maps; the caller holds the lock.
+func incrEntry(entries map[string]memoryEntry, key string, delta int64, ttl time.Duration) (int64, error) {
+    now := time.Now()
+    entry, ok := entries[key]
+    if !ok || entry.expired(now) {
+        entry = memoryEntry{data: []byte("0")}
+        if ttl > 0 {
+            entry.expiresAt = now.Add(ttl)
+        }
+    }
+    count, err := strconv.ParseInt(string(entry.data), 10, 64)
+    if err != nil {
+        return 0, fmt.Errorf("value at %s is not a counter", key)
+    }
+    count += delta
+    entry.data = []byte(strconv.FormatInt(count, 10))
+    entries[key] = entry
+    return count, nil
+}
+
+// takeEntry implements Take for the in-memory maps; the caller holds the lock.
+func takeEntry(entries map[string]memoryEntry, key string, capacity int64, period time.Duration) (TokenBucket, error) {
+    now := time.Now()
+    var state bucketState
+    if entry, ok := entries[key]; ok && !entry.expired(now) {
+        if err := json.Unmarshal(entry.data, &state); err != nil {
+            return TokenBucket{}, fmt.Errorf("value at %s is not a token bucket", key)
+        }
+    }
+    result := takeToken(&state, capacity, period, now.UnixMilli())
+    data, _ := json.Marshal(state)
+    entries[key] = memoryEntry{data: data, expiresAt: now.Add(period)}
+    return result, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+    "reflect"
+    "sync"
+    "testing"
+    "time"
+)
+
+// storeBackends returns a fresh store for every backend that must honour
+// the Store contract.
+func storeBackends(t *testing.T) map[string]Store {
+    backends := make(map[string]Store)
+    for _, storeURL := range []string{"memory://", "fake://"} {
+        s, err := newStore(storeURL)
+        if err != nil {
+            t.Fatalf("newStore(%s): %v", storeURL, err)
+        }
+        backends[storeURL] = s
+    }
+    return backends
+}
+
+func TestStoreContract(t *testing.T) {
+    tests := []struct {
+        name string
+        run  func(t *testing.T, s Store)
+    }{
+        {"get missing", func(t *testing.T, s Store) {
+            var v string
+            found, err := s.Get("missing", &v)
+            if err != nil || found {
+                t.Fatalf("Get(missing) = %v, %v; want false, nil", found, err)
+            }
+        }},
+        {"set and get", func(t *testing.T, s Store) {
+            type value struct{ Name string }
+            if err := s.Set("k", value{"arca"}, 0); err != nil {
+                t.Fatal(err)
+            }
+            var got value
+            if found, err := s.Get("k", &got); err != nil || !found || got.Name != "arca" {
+                t.Fatalf("Get(k) = %v, %v, %+v", found, err, got)
+            }
+        }},
+        {"set ttl expires", func(t *testing.T, s Store) {
+            if err := s.Set("k", 1, 50*time.Millisecond); err != nil {
+                t.Fatal(err)
+            }
+            time.Sleep(80 * time.Millisecond)
+            var v int
+            if found, _ := s.Get("k", &v); found {
+                t.Fatal("value still there after its ttl")
+            }
+            if keys, _ := s.Keys("k"); len(keys) != 0 {
+                t.Fatalf("Keys lists expired key: %v", keys)
+            }
+        }},
+        {"delete", func(t *testing.T, s Store) {
+            s.Set("k", 1, 0)
+            if err := s.Delete("k"); err != nil {
+                t.Fatal(err)
+            }
+            var v int
+            if found, _ := s.Get("k", &v); found {
+                t.Fatal("value still there after Delete")
+            }
+        }},
+        {"incr and incrby", func(t *testing.T, s Store) {
+            for want := int64(1); want <= 3; want++ {
+                if n, err := s.Incr("c", 0); err != nil || n != want {
+                    t.Fatalf("Incr = %d, %v; want %d", n, err, want)
+                }
+            }
+            if n, _ := s.IncrBy("c", 10, 0); n != 13 {
+                t.Fatalf("IncrBy(10) = %d; want 13", n)
+            }
+            if n, _ := s.IncrBy("c", -5, 0); n != 8 {
+                t.Fatalf("IncrBy(-5) = %d; want 8", n)
+            }
+            if n, _ := s.IncrBy("c", 0, 0); n != 8 {
+                t.Fatalf("IncrBy(0) = %d; want 8", n)
+            }
+        }},
+        {"incr ttl set on create only", func(t *testing.T, s Store) {
+            s.Incr("c", 60*time.Millisecond)
+            time.Sleep(40 * time.Millisecond)
+            // Un secondo Incr non deve prolungare la scadenza
+            s.Incr("c", time.Hour)
+            time.Sleep(40 * time.Millisecond)
+            if n, _ := s.IncrBy("c", 0, 0); n != 0 {
+                t.Fatalf("counter = %d after its ttl; want 0", n)
+            }
+        }},
+        {"incr on non-counter", func(t *testing.T, s Store) {
+            s.Set("k", map[string]int{"a": 1}, 0)
+            if _, err := s.Incr("k", 0); err == nil {
+                t.Fatal("Incr on a JSON object succeeded")
+            }
+        }},
+        {"take and refill", func(t *testing.T, s Store) {
+            for i := 0; i < 2; i++ {
+                if b, err := s.Take("bucket", 2, 200*time.Millisecond); err != nil || !b.Allowed {
+                    t.Fatalf("Take %d = %+v, %v; want allowed", i, b, err)
+                }
+            }
+            b, err := s.Take("bucket", 2, 200*time.Millisecond)
+            if err != nil || b.Allowed || b.RetryAfter <= 0 || b.Remaining != 0 {
+                t.Fatalf("Take on empty bucket = %+v, %v", b, err)
+            }
+            time.Sleep(b.RetryAfter + 20*time.Millisecond)
+            if b, _ := s.Take("bucket", 2, 200*time.Millisecond); !b.Allowed {
+                t.Fatalf("Take after refill = %+v; want allowed", b)
+            }
+        }},
+        {"setnx", func(t *testing.T, s Store) {
+            if ok, err := s.SetNX("k", "first", 0); err != nil || !ok {
+                t.Fatalf("SetNX on a new key = %v, %v; want true", ok, err)
+            }
+            if ok, _ := s.SetNX("k", "second", 0); ok {
+                t.Fatal("SetNX overwrote an existing key")
+            }
+            var v string
+            if s.Get("k", &v); v != "first" {
+                t.Fatalf("Get(k) = %q; want first", v)
+            }
+            s.SetNX("short", 1, 50*time.Millisecond)
+            time.Sleep(80 * time.Millisecond)
+            if ok, _ := s.SetNX("short", 2, 0); !ok {
+                t.Fatal("SetNX failed on an expired key")
+            }
+        }},
+        {"getdelete", func(t *testing.T, s Store) {
+            s.Set("k", "once", 0)
+            var v string
+            if found, err := s.GetDelete("k", &v); err != nil || !found || v != "once" {
+                t.Fatalf("GetDelete = %v, %v, %q", found, err, v)
+            }
+            if found, _ := s.GetDelete("k", &v); found {
+                t.Fatal("second GetDelete found the value")
+            }
+        }},
+        {"compareanddelete", func(t *testing.T, s Store) {
+            s.Set("k", "mine", 0)
+            if ok, _ := s.CompareAndDelete("k", "theirs"); ok {
+                t.Fatal("CompareAndDelete removed a different value")
+            }
+            if ok, err := s.CompareAndDelete("k", "mine"); err != nil || !ok {
+                t.Fatalf("CompareAndDelete = %v, %v; want true", ok, err)
+            }
+            var v string
+            if found, _ := s.Get("k", &v); found {
+                t.Fatal("value still there after CompareAndDelete")
+            }
+        }},
+        {"keys prefix", func(t *testing.T, s Store) {
+            for _, key := range []string{"a:1", "a:2", "ab:3", "b:1", "x*[1]:1", "x*[1]:2", "xy:1"} {
+                s.Set(key, 1, 0)
+            }
+            cases := map[string][]string{
+                "a:":     {"a:1", "a:2"},
+                "a":      {"a:1", "a:2", "ab:3"},
+                "x*[1]:": {"x*[1]:1", "x*[1]:2"},
+                "none":   nil,
+            }
+            for prefix, want := range cases {
+                got, err := s.Keys(prefix)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if len(got) == 0 && len(want) == 0 {
+                    continue
+                }
+                if !reflect.DeepEqual(got, want) {
+                    t.Errorf("Keys(%q) = %v; want %v", prefix, got, want)
+                }
+            }
+        }},
+    }
+    for _, tt := range tests {
+        for name, s := range storeBackends(t) {
+            t.Run(name+"/"+tt.name, func(t *testing.T) {
+                tt.run(t, s)
+            })
+        }
+    }
+}
+
+func TestStoreConcurrentCounters(t *testing.T) {
+    const workers, rounds = 16, 50
+    for name, s := range storeBackends(t) {
+        t.Run(name, func(t *testing.T) {
+            var wg sync.WaitGroup
+            var mu sync.Mutex
+            allowed := 0
+            for i := 0; i < workers; i++ {
+                wg.Add(1)
+                go func() {
+                    defer wg.Done()
+                    for j := 0; j < rounds; j++ {
+                        if _, err := s.Incr("counter", time.Minute); err != nil {
+                            t.Error(err)
+                        }
+                        b, err := s.Take("bucket", 100, time.Hour)
+                        if err != nil {
+                            t.Error(err)
+                        }
+                        if b.Allowed {
+                            mu.Lock()
+                            allowed++
+                            mu.Unlock()
+                        }
+                    }
+                }()
+            }
+            wg.Wait()
+            if n, _ := s.IncrBy("counter", 0, 0); n != workers*rounds {
+                t.Errorf("counter = %d; want %d", n, workers*rounds)
+            }
+            if allowed != 100 {
+                t.Errorf("bucket allowed %d takes; want its capacity, 100", allowed)
+            }
+        })
+    }
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+// promptOptions is what a provider call needs from the request beyond the
+// conversation: extra system instructions and an output token limit.
+// A zero MaxTokens leaves the provider's default.
+type promptOptions struct {
+    System    string
+    MaxTokens int
+}
+
+// StylePreset shapes the answers: Instructions become part of every
+// provider's system prompt and MaxTokens caps the output. Providers can
+// override either, for models that need to be told differently.
+type StylePreset struct {
+    Name         string                   `json:"name"`
+    Label        string                   `json:"label"`
+    Instructions string                   `json:"instructions"`
+    MaxTokens    int                      `json:"maxTokens"`
+    Providers    map[string]StyleOverride `json:"providers,omitempty"`
+    Custom       bool                     `json:"custom,omitempty"`
+}
+
+func maxTokensOr(maxTokens, fallback int) int {
+    if maxTokens > 0 {
+        return maxTokens
+    }
+    return fallback
+}
+
+type StyleOverride struct {
+    Instructions string `json:"instructions,omitempty"`
+    MaxTokens    int    `json:"maxTokens,omitempty"`
+}
+
+// UserProfile holds the preferences of an account.
+type UserProfile struct {
+    Styles   map[string]*StylePreset `json:"styles,omitempty"`
+    Personas map[string]*Persona     `json:"personas,omitempty"`
+}
+
+const (
+    profilePrefix   = "profile:"
+    maxCustomStyles = 20
+)
+
+var styleNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+var stylePresets = map[string]*StylePreset{
+    "balanced": {
+        Name:      "balanced",
+        Label:     "Balanced",
+        MaxTokens: 1000,
+    },
+    "concise": {
+        Name:         "concise",
+        Label:        "Concise",
+        Instructions: "Answer in at most three short sentences. Skip introductions, caveats and repetition of the question.",
+        MaxTokens:    300,
+    },
+    "detailed": {
+        Name:         "detailed",
+        Label:        "Detailed",
+        Instructions: "Give a thorough answer. Explain the reasoning, cover the relevant aspects and exceptions, and use headings when the answer has several parts.",
+        MaxTokens:    1800,
+    },
+    "eli5": {
+        Name:         "eli5",
+        Label:        "Explain like I'm five",
+        Instructions: "Explain the answer as you would to a curious ten-year-old: short sentences, everyday words, one concrete analogy, no jargon.",
+        MaxTokens:    600,
+    },
+    "academic": {
+        Name:         "academic",
+        Label:        "Academic with citations",
+        Instructions: "Answer in a formal academic register. Support each factual claim with a citation in brackets, e.g. [Author, Year] or a URL, and end with a References list. Say explicitly when no reliable source is known.",
+        MaxTokens:    1800,
+        Providers: map[string]StyleOverride{
+            // Il modello generate di Cohere tende a inventare i riferimenti
+            "Cohere": {Instructions: "Answer in a formal academic register. Cite only sources you are certain exist, in brackets, and end with a References list. If unsure, write \"no reliable source known\" instead of a citation."},
+        },
+    },
+    "bullets": {
+        Name:         "bullets",
+        Label:        "Bullet summary",
+        Instructions: "Answer only with a bulleted list of at most seven points, one line each, most important first. No introduction or conclusion.",
+        MaxTokens:    500,
+    },
+}
+
+const defaultStyle = "balanced"
+
+func isChatProvider(name string) bool {
+    for _, provider := range chatProviders {
+        if provider == name {
+            return true
+        }
+    }
+    return false
+}
+
+func loadProfile(owner string) (*UserProfile, error) {
+    profile := &UserProfile{}
+    if _, err := store.Get(profilePrefix+owner, profile); err != nil {
+        return nil, err
+    }
+    if profile.Styles == nil {
+        profile.Styles = make(map[string]*StylePreset)
+    }
+    if profile.Personas == nil {
+        profile.Personas = make(map[string]*Persona)
+    }
+    return profile, nil
+}
+
+func saveProfile(owner string, profile *UserProfile) error {
+    return store.Set(profilePrefix+owner, profile, 0)
+}
+
+// resolveStyle finds a preset by name among the built-in ones and the
+// owner's custom ones. An empty name is the default style.
+func resolveStyle(owner, name string) (*StylePreset, error) {
+    name = strings.ToLower(strings.TrimSpace(name))
+    if name == "" {
+        name = defaultStyle
+    }
+    if preset, ok := stylePresets[name]; ok {
+        return preset, nil
+    }
+    if strings.HasPrefix(owner, userPrefix) {
+        profile, err := loadProfile(owner)
+        if err != nil {
+            return nil, err
+        }
+        if preset, ok := profile.Styles[name]; ok {
+            return preset, nil
+        }
+    }
+    return nil, fmt.Errorf("unknown style %q", name)
+}
+
+// forProvider applies the provider's override, if any.
+func (s *StylePreset) forProvider(provider string) promptOptions {
+    options := promptOptions{System: s.Instructions, MaxTokens: s.MaxTokens}
+    if override, ok := s.Providers[provider]; ok {
+        if override.Instructions != "" {
+            options.System = override.Instructions
+        }
+        if override.MaxTokens > 0 {
+            options.MaxTokens = override.MaxTokens
+        }
+    }
+    return options
+}
+
+func validateStyle(preset *StylePreset) error {
+    preset.Name = strings.ToLower(strings.TrimSpace(preset.Name))
+    if !styleNamePattern.MatchString(preset.Name) {
+        return fmt.Errorf("name must be 1-32 lowercase letters, digits or dashes")
+    }
+    if _, builtIn := stylePresets[preset.Name]; builtIn {
+        return fmt.Errorf("%q is a built-in style", preset.Name)
+    }
+    if strings.TrimSpace(preset.Label) == "" {
+        preset.Label = preset.Name
+    }
+    if len(preset.Instructions) > 2000 {
+        return fmt.Errorf("instructions must be at most 2000 characters")
+    }
+    if preset.MaxTokens == 0 {
+        preset.MaxTokens = stylePresets[defaultStyle].MaxTokens
+    }
+    if preset.MaxTokens < 50 || preset.MaxTokens > 4000 {
+        return fmt.Errorf("maxTokens must be between 50 and 4000")
+    }
+    for provider, override := range preset.Providers {
+        if !isChatProvider(provider) {
+            return fmt.Errorf("unknown provider %q", provider)
+        }
+        if len(override.Instructions) > 2000 || override.MaxTokens < 0 || override.MaxTokens > 4000 {
+            return fmt.Errorf("invalid override for %s", provider)
+        }
+    }
+    preset.Custom = true
+    return nil
+}
+
+// Styles Handler:
+//   GET    /styles         built-in presets and the caller's custom ones
+//   POST   /styles         create or replace a custom preset (accounts only)
+//   DELETE /styles/{name}  delete a custom preset
+func handleStyles(w http.ResponseWriter, r *http.Request) {
+    owner, err := requestOwner(r)
+    if err != nil {
+        http.Error(w, "Error: Session not found", http.StatusBadRequest)
+        return
+    }
+    name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/styles"), "/")
+    if r.Method == http.MethodGet && name == "" {
+        styles := make([]*StylePreset, 0, len(stylePresets))
+        for _, preset := range stylePresets {
+            styles = append(styles, preset)
+        }
+        if strings.HasPrefix(owner, userPrefix) {
+            profile, err := loadProfile(owner)
+            if err != nil {
+                http.Error(w, "Error loading styles: "+err.Error(), http.StatusInternalServerError)
+                return
+            }
+            for _, preset := range profile.Styles {
+                styles = append(styles, preset)
+            }
+        }
+        sort.Slice(styles, func(i, j int) bool {
+            if styles[i].Custom != styles[j].Custom {
+                return !styles[i].Custom
+            }
+            return styles[i].Name < styles[j].Name
+        })
+        writeJSON(w, map[string]interface{}{"default": defaultStyle, "styles": styles})
+        return
+    }
+    if !strings.HasPrefix(owner, userPrefix) {
+        http.Error(w, "Log in to save custom styles", http.StatusUnauthorized)
+        return
+    }
+    unlock, err := sessionLocks.Lock(profilePrefix + owner)
+    if err != nil {
+        http.Error(w, "Error loading styles: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    defer unlock()
+    profile, err := loadProfile(owner)
+    if err != nil {
+        http.Error(w, "Error loading styles: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    switch {
+    case r.Method == http.MethodPost && name == "":
+        var preset StylePreset
+        if err := json.NewDecoder(r.Body).Decode(&preset); err != nil {
+            http.Error(w, "Invalid request", http.StatusBadRequest)
+            return
+        }
+        if err := validateStyle(&preset); err != nil {
+            http.Error(w, "Invalid style: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        if _, exists := profile.Styles[preset.Name]; !exists && len(profile.Styles) >= maxCustomStyles {
+            http.Error(w, fmt.Sprintf("At most %d custom styles", maxCustomStyles), http.StatusBadRequest)
+            return
+        }
+        profile.Styles[preset.Name] = &preset
+        if err := saveProfile(owner, profile); err != nil {
+            http.Error(w, "Error saving style: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        writeJSON(w, preset)
+    case r.Method == http.MethodDelete && name != "":
+        if _, exists := profile.Styles[name]; !exists {
+            http.Error(w, "Style not found", http.StatusNotFound)
+            return
+        }
+        delete(profile.Styles, name)
+        if err := saveProfile(owner, profile); err != nil {
+            http.Error(w, "Error deleting style: "+err.Error(), http.StatusInternalServerError)
+            return
+        }
+        writeJSON(w, map[string]interface{}{"deleted": true})
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
@@ -0,0 +1 @@
+{"batchcomplete":"","continue":{"sroffset":2,"continue":"-||"},"query":{"searchinfo":{"totalhits":1523},"search":[{"ns":0,"title":"European Central Bank","pageid":9472,"size":98213,"wordcount":9120,"snippet":"The <span class=\"searchmatch\">European</span> <span class=\"searchmatch\">Central</span> <span class=\"searchmatch\">Bank</span> (ECB) is the prime component of the Eurosystem","timestamp":"2026-10-10T08:12:44Z"},{"ns":0,"title":"Monetary policy","pageid":19903,"size":54011,"wordcount":5400,"snippet":"Monetary policy is the policy adopted by the monetary authority","timestamp":"2026-09-28T17:01:02Z"}]}}
@@ -0,0 +1,101 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "os"
+    "time"
+
+    "github.com/sashabaranov/go-openai"
+)
+
+// translator rewrites answers that came back in the wrong language, so they
+// can be scored and blended with the others. The provider is chosen with
+// TRANSLATION_PROVIDER; without it wrong-language answers are only flagged
+// and left out of the synthesis.
+type translator struct {
+    provider string
+    key      string
+    client   *http.Client
+    openAI   *openai.Client
+}
+
+var translationProviders = []string{"OpenAI", "DeepSeek", "Mistral", "Cohere"}
+
+func newTranslator(client *http.Client, openAIClient *openai.Client, keys map[string]string) *translator {
+    provider := os.Getenv("TRANSLATION_PROVIDER")
+    if provider == "" {
+        return nil
+    }
+    for _, name := range translationProviders {
+        if name == provider {
+            if keys[name] == "" {
+                fmt.Printf("Error: TRANSLATION_PROVIDER is %s but its API key is not set\n", name)
+                return nil
+            }
+            fmt.Printf("Wrong-language answers will be translated by %s\n", name)
+            return &translator{provider: name, key: keys[name], client: client, openAI: openAIClient}
+        }
+    }
+    fmt.Printf("Error: unsupported TRANSLATION_PROVIDER %q, expected one of %v\n", provider, translationProviders)
+    return nil
+}
+
+func translationOptions(lang Language) promptOptions {
+    return promptOptions{
+        System: fmt.Sprintf("Translate the user's text into %s. Keep the meaning, the Markdown formatting, code, names and numbers unchanged. "+
+            "Output only the translation, without comments.", lang.Name),
+        MaxTokens: 2000,
+    }
+}
+
+func (t *translator) translate(text string, lang Language) (string, TokenUsage, error) {
+    options := translationOptions(lang)
+    switch t.provider {
+    case "OpenAI":
+        ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+        defer cancel()
+        resp, err := t.openAI.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+            Model: openai.GPT3Dot5Turbo,
+            Messages: []openai.ChatCompletionMessage{
+                {Role: openai.ChatMessageRoleSystem, Content: options.System},
+                {Role: openai.ChatMessageRoleUser, Content: text},
+            },
+            MaxTokens: options.MaxTokens,
+        })
+        if err != nil {
+            return "", TokenUsage{}, err
+        }
+        if len(resp.Choices) == 0 {
+            return "", TokenUsage{}, fmt.Errorf("no translation from OpenAI")
+        }
+        return resp.Choices[0].Message.Content, TokenUsage{InputTokens: resp.Usage.PromptTokens, OutputTokens: resp.Usage.CompletionTokens}, nil
+    case "DeepSeek":
+        return getDeepSeekResponse(t.client, t.key, []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: text}}, options)
+    case "Mistral":
+        return getMistralResponse(t.key, t.client, text, options)
+    case "Cohere":
+        return getCohereResponse(t.key, t.client, text, options)
+    }
+    return "", TokenUsage{}, fmt.Errorf("unsupported translation provider %s", t.provider)
+}
+
+// fixLanguage translates answer in place when it is in the wrong language.
+// It returns the usage of the translation, if one was made.
+func (t *translator) fixLanguage(answer *ProviderAnswer, lang Language) (TokenUsage, error) {
+    if t == nil || !answer.WrongLanguage {
+        return TokenUsage{}, nil
+    }
+    translated, usage, err := t.translate(answer.Content, lang)
+    if err != nil {
+        return usage, err
+    }
+    if code, wrong := checkAnswerLanguage(translated, lang); wrong {
+        return usage, fmt.Errorf("translation is still in %s", code)
+    }
+    answer.Original = answer.Content
+    answer.Content = translated
+    answer.TranslatedBy = t.provider
+    return usage, nil
+}